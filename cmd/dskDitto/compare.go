@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
+	"github.com/jdefrancesco/dskDitto/internal/dwalk"
+)
+
+// compareMatch is a source file with a copy of its content under the
+// reference roots.
+type compareMatch struct {
+	source string
+	copies []string
+}
+
+// compareReport answers whether every source file has a copy under the
+// reference roots.
+type compareReport struct {
+	missing []string
+	matched []compareMatch
+}
+
+// pathWithin reports whether path is root or lies below it.
+func pathWithin(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// referenceMatcher returns a func reporting whether a scanned path lies under
+// one of the reference roots.
+func referenceMatcher(refRoots []string) func(string) bool {
+	roots := absRoots(refRoots)
+	return func(path string) bool {
+		for _, root := range roots {
+			if pathWithin(path, root) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// validateCompareMode returns an error if --reference is combined with
+// incompatible flags or overlaps the source roots.
+func validateCompareMode(refRoots, sourceRoots []string, otherMatchMode bool, singleFile, backupFile, saveResults, loadResults string, keep uint, dirTrees bool) error {
+	if len(refRoots) == 0 {
+		return nil
+	}
+	if len(sourceRoots) == 0 {
+		sourceRoots = []string{"."}
+	}
+	if otherMatchMode || singleFile != "" || dirTrees {
+		return fmt.Errorf("--reference cannot be combined with --name-only, --file-shallow, --fuzzy, --file or --dir-trees")
+	}
+	if keep > 0 || backupFile != "" || saveResults != "" || loadResults != "" {
+		return fmt.Errorf("--reference only reports; it cannot be combined with --remove, --backup, --save-results or --load-results")
+	}
+	sources, refs := absRoots(sourceRoots), absRoots(refRoots)
+	for _, src := range sources {
+		for _, ref := range refs {
+			if pathWithin(src, ref) || pathWithin(ref, src) {
+				return fmt.Errorf("source root %s and reference root %s overlap", src, ref)
+			}
+		}
+	}
+	return nil
+}
+
+// compareCandidates splits the walk into source files and the candidates worth
+// hashing. Only size groups holding both a source and a reference file are
+// kept, so reference files are hashed only when a source file shares their
+// size, and sources without such a file are already known to be missing.
+func compareCandidates(sizeGroups map[int64][]dwalk.FileCandidate, paths *dpath.Store, isReference func(string) bool) (candidates []dwalk.FileCandidate, sources []dpath.ID, skipped uint) {
+	for _, files := range sizeGroups {
+		var haveSource, haveReference bool
+		for _, file := range files {
+			if isReference(paths.Path(file.ID)) {
+				haveReference = true
+				continue
+			}
+			haveSource = true
+			sources = append(sources, file.ID)
+		}
+		if haveSource && haveReference {
+			candidates = append(candidates, files...)
+			continue
+		}
+		skipped += uint(len(files))
+	}
+	return candidates, sources, skipped
+}
+
+// buildCompareReport matches every source file against the reference files in
+// its content group. Sources outside any group with a reference member are
+// missing.
+func buildCompareReport(dMap *dmap.Dmap, sources []dpath.ID, isReference func(string) bool) compareReport {
+	copies := make(map[dpath.ID][]string)
+	for _, ids := range dMap.GroupIDs() {
+		var refs []string
+		var srcs []dpath.ID
+		for _, id := range ids {
+			if path := dMap.Path(id); isReference(path) {
+				refs = append(refs, path)
+			} else {
+				srcs = append(srcs, id)
+			}
+		}
+		if len(refs) == 0 {
+			continue
+		}
+		sort.Strings(refs)
+		for _, id := range srcs {
+			copies[id] = refs
+		}
+	}
+
+	var report compareReport
+	for _, id := range sources {
+		path := dMap.Path(id)
+		if refs, ok := copies[id]; ok {
+			report.matched = append(report.matched, compareMatch{source: path, copies: refs})
+			continue
+		}
+		report.missing = append(report.missing, path)
+	}
+	sort.Strings(report.missing)
+	sort.Slice(report.matched, func(i, j int) bool {
+		return report.matched[i].source < report.matched[j].source
+	})
+	return report
+}
+
+// write prints the report as plain text. With summary set, it closes with the
+// number of files and missing files in each source directory.
+func (r compareReport) write(w io.Writer, summary bool) {
+	fmt.Fprintf(w, "Missing from reference (%d):\n", len(r.missing))
+	for _, path := range r.missing {
+		fmt.Fprintf(w, "  %s\n", path)
+	}
+	fmt.Fprintf(w, "\nPresent in reference (%d):\n", len(r.matched))
+	for _, match := range r.matched {
+		fmt.Fprintf(w, "  %s\n", match.source)
+		for _, dup := range match.copies {
+			fmt.Fprintf(w, "    -> %s\n", dup)
+		}
+	}
+	if !summary {
+		return
+	}
+
+	type dirCount struct{ files, missing int }
+	counts := make(map[string]*dirCount)
+	count := func(path string, missing bool) {
+		dir := filepath.Dir(path)
+		c, ok := counts[dir]
+		if !ok {
+			c = &dirCount{}
+			counts[dir] = c
+		}
+		c.files++
+		if missing {
+			c.missing++
+		}
+	}
+	for _, path := range r.missing {
+		count(path, true)
+	}
+	for _, match := range r.matched {
+		count(match.source, false)
+	}
+	dirs := make([]string, 0, len(counts))
+	for dir := range counts {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	fmt.Fprintf(w, "\nSummary by directory:\n")
+	for _, dir := range dirs {
+		c := counts[dir]
+		fmt.Fprintf(w, "  %s: %d file(s), %d missing\n", dir, c.files, c.missing)
+	}
+}
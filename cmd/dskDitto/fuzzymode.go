@@ -30,9 +30,10 @@ func addFuzzyContentGroups(
 		minDups = 2
 	}
 
+	paths := dMap.Paths()
 	fuzzyCandidates := make([]fuzzy.Candidate, 0, len(candidates))
 	for _, c := range candidates {
-		fuzzyCandidates = append(fuzzyCandidates, fuzzy.Candidate{Path: c.Path, Size: c.Size})
+		fuzzyCandidates = append(fuzzyCandidates, fuzzy.Candidate{Path: paths.Path(c.ID), Size: c.Size})
 	}
 
 	res, err := fuzzy.FindSimilarGroups(fuzzyCandidates, fuzzy.Options{
@@ -90,7 +91,7 @@ func validateFuzzyMode(fuzzyMode, shallowMode bool, singleFile, backupFile, rest
 		return fmt.Errorf("--fuzzy cannot be combined with --restore")
 	}
 	if keep > 0 || linkMode {
-		return fmt.Errorf("--remove/--link/--reflink are disabled in --fuzzy mode; near matches are review-only")
+		return fmt.Errorf("--remove/--link/--reflink/--hardlink/--dedupe are disabled in --fuzzy mode; near matches are review-only")
 	}
 	if threshold < 0 || threshold > 100 {
 		return fmt.Errorf("--fuzzy-threshold must be between 0 and 100")
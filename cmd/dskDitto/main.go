@@ -14,6 +14,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,11 +22,13 @@ import (
 	"github.com/jdefrancesco/dskDitto/internal/config"
 	"github.com/jdefrancesco/dskDitto/internal/dfs"
 	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
 	"github.com/jdefrancesco/dskDitto/internal/dsklog"
 	"github.com/jdefrancesco/dskDitto/internal/dupview"
 	"github.com/jdefrancesco/dskDitto/internal/dwalk"
 	"github.com/jdefrancesco/dskDitto/internal/fuzzy"
 	"github.com/jdefrancesco/dskDitto/internal/manifest"
+	"github.com/jdefrancesco/dskDitto/internal/plan"
 	"github.com/jdefrancesco/dskDitto/internal/ui"
 	"github.com/jdefrancesco/dskDitto/pkg/utils"
 
@@ -313,6 +316,7 @@ func main() {
 		flXdev           = boolFlag("xdev", "", false, "Alias for --one-file-system.", catFilter)
 		flDirConcurrency = intFlag("dir-concurrency", "", 0, "Limit concurrent directory reads; <= 0 uses automatic tuning.", catFilter)
 		flNoCache        = boolFlag("no-cache", "", false, "Ask supported platforms not to populate filesystem cache while hashing.", catFilter)
+		flProgressive    = boolFlag("progressive", "", false, "Hash candidates of the same size in lockstep, growing windows and stop reading them as soon as they differ.", catFilter)
 		flMinDups        = uintFlag("dups", "", 2, "Minimum duplicate file `count` required to display a group.", catFilter)
 		flHashAlgo       = stringFlag("hash", "H", "sha256", "Hash algorithm `algo`: sha256 (default) or blake3.", catFilter)
 
@@ -320,6 +324,12 @@ func main() {
 		flSingleFile  = stringFlag("file", "f", "", "Only search for duplicates of the specified `path` file.", catScope)
 		flNameOnly    = boolFlag("name-only", "", false, "Only compare exact file names, ignoring content and size.", catScope)
 		flFileShallow = stringFlag("file-shallow", "", "", "Only search for files with the same exact name as the specified `path` file.", catScope)
+		flDirTrees    = boolFlag("dir-trees", "", false, "Also report whole directory trees that are identical, as directory-level groups.", catScope)
+		flDirSuperset = boolFlag("dir-supersets", "", false, "With --dir-trees, also report directories that hold a copy of everything in another directory.", catScope)
+		flReferences  stringListFlag
+		flCompareSum  = boolFlag("compare-summary", "", false, "With --reference, end the report with a per-directory count of missing files.", catScope)
+		flCrossRoot   = boolFlag("cross-root-only", "", false, "Only report groups whose files come from more than one of the given paths.", catScope)
+		flUnique      = boolFlag("unique", "", false, "List files whose content has no other copy instead of duplicates (with --reference, no copy under the reference roots).", catScope)
 
 		// Fuzzy Matching
 		flFuzzy              = boolFlag("fuzzy", "F", false, "Enable fuzzy content matching to find near-duplicate files.", catFuzzy)
@@ -331,7 +341,23 @@ func main() {
 		// Duplicate Actions
 		flKeep        = uintFlag("remove", "r", 0, "Operate on duplicates, keeping only this many `keep` files per group.", catActions)
 		flLinkMode    = boolFlag("link", "l", false, "Convert extra duplicates into symlinks instead of deleting them (use with --remove).", catActions)
+		flLinkStyle   = stringFlag("link-style", "", "absolute", "Write symlinks created by --link and TUI/GUI linking as `absolute` or relative paths.", catActions)
+		flKeepRules   = stringFlag("keep", "", "", "Choose the copies to keep by `rules`: newest, oldest, shortest-path, longest-path, most-hardlinks (comma-separated; later rules break ties).", catActions)
+		flKeepIn      stringListFlag
+		flPrefer      stringListFlag
 		flReflinkMode = boolFlag("reflink", "R", false, "Convert extra duplicates into reflinks (copy-on-write clones) instead of deleting them (use with --remove; requires a reflink-capable filesystem such as APFS, Btrfs, or XFS with reflink=1).", catActions)
+		flHardlink    = boolFlag("hardlink", "L", false, "Convert extra duplicates into hard links to a kept copy instead of deleting them (use with --remove; files must share a device).", catActions)
+		flDedupe      = boolFlag("dedupe", "D", false, "Share extra duplicates' data with a kept copy in place via the kernel's verified FIDEDUPERANGE (use with --remove; Linux on Btrfs or XFS with reflink=1).", catActions)
+		flTrash       = boolFlag("trash", "", false, "Move removed duplicates to the freedesktop Trash instead of deleting them (applies to --remove and TUI/GUI deletes).", catActions)
+		flPlanOut     = stringFlag("plan-out", "", "", "With --remove, write the intended deletes/links to a reviewable JSON plan `file` instead of acting.", catActions)
+		flApplyPlan   = stringFlag("apply-plan", "", "", "Re-verify and apply a plan `file` written by --plan-out, skipping files that changed since.", catActions)
+		flScriptOut   = stringFlag("script-out", "", "", "With --remove, write a POSIX shell `file` that makes the deletes/links with rm and ln instead of acting.", catActions)
+		flRehash      = boolFlag("rehash", "", false, "Re-hash each duplicate and its kept copy right before removing or replacing it, not just compare size and mtime.", catActions)
+		flQuarantine  = stringFlag("quarantine", "", "", "Move removed duplicates below a dated directory inside `dir`, keeping their paths, instead of deleting them (applies to --remove and TUI/GUI deletes).", catActions)
+		flProtect     stringListFlag
+		flMaxDelete   = uintFlag("max-delete", "", 0, "Abort any batch that would delete or convert more than `N` files (0 disables).", catActions)
+		flMaxReclaim  = stringFlag("max-reclaim", "", "", "Abort any batch that would reclaim more than this `size` (e.g. 10GiB).", catActions)
+		flMinAge      = uintFlag("min-age", "", 0, "Refuse to delete or convert files modified within the last `minutes`.", catActions)
 
 		// Output & Export
 		flTextOutput  = boolFlag("text", "t", false, "Dump results in grep/text friendly format. Useful for scripting.", catOutput)
@@ -339,17 +365,33 @@ func main() {
 		flCSVOut      = stringFlag("csv-out", "", "", "Write duplicate groups to the specified CSV `file`.", catOutput)
 		flJSONOut     = stringFlag("json-out", "", "", "Write duplicate groups to the specified JSON `file`.", catOutput)
 		flDetectFS    = stringFlag("fs-detect", "", "", "Detect filesystem in use by specified `path`.", catOutput)
+		flSaveResults = stringFlag("save-results", "", "", "Save the full scan results to `file` for review later with --load-results.", catOutput)
+		flLoadResults = stringFlag("load-results", "", "", "Review results saved with --save-results from `file` instead of scanning.", catOutput)
 
 		// Backup & Restore
 		flBackupFile  = stringFlag("backup", "", "", "Write duplicate restore backup JSONL to the specified `file`.", catRestore)
 		flRestoreFile = stringFlag("restore", "", "", "Restore duplicate files from the specified JSONL `file`.", catRestore)
-		flDryRun      = boolFlag("dry-run", "n", false, "With --restore, print actions without writing files.", catRestore)
+		flUndoFile    = stringFlag("undo", "", "", "Reverse the actions recorded in the backup journal `file`, newest first, verifying each entry.", catRestore)
+		flCompactFile = stringFlag("manifest-compact", "", "", "Rewrite the backup journal `file` without superseded entries or entries for files already restored.", catRestore)
+		flDryRun      = boolFlag("dry-run", "n", false, "Print what --restore, --undo, --manifest-compact, --remove or --apply-plan would do, or what TUI/GUI actions would do, without changing files.", catRestore)
 		flVerifyHash  = boolFlag("verify-hash", "", true, "With --restore, verify canonical file hashes before replay.", catRestore)
 	)
 	// The exclude flag can take multiple path targets; -x is its shorthand.
 	flag.Var(&flExcludePaths, "exclude", "Exclude a `path` from scanning (repeatable).")
 	flag.Var(&flExcludePaths, "x", "Exclude a `path` from scanning (repeatable).")
 	registerFlag("x", "exclude", catFilter)
+	// --reference switches to compare mode: the path arguments are the sources
+	// checked for copies under the reference roots.
+	flag.Var(&flReferences, "reference", "Report which files have a copy of their content under this reference `path` (repeatable).")
+	registerFlag("", "reference", catScope)
+	// --keep-in and --prefer rank directories for the keep policy.
+	flag.Var(&flKeepIn, "keep-in", "Never remove or replace files under this `dir` (repeatable).")
+	registerFlag("", "keep-in", catActions)
+	flag.Var(&flPrefer, "prefer", "Keep copies under this `dir` ahead of others; earlier directories win (repeatable).")
+	registerFlag("", "prefer", catActions)
+	// --protect adds to the system directories that are always protected.
+	flag.Var(&flProtect, "protect", "Never delete or convert files under this `dir`, on top of /etc, /usr, /boot and other system directories (repeatable).")
+	registerFlag("", "protect", catActions)
 	flag.Parse()
 
 	if *flGui {
@@ -366,17 +408,58 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *flLinkMode && *flReflinkMode {
-		fmt.Fprintf(os.Stderr, "invalid invocation: --link and --reflink cannot be combined\n")
+	convertModes := 0
+	for _, set := range []bool{*flLinkMode, *flReflinkMode, *flHardlink, *flDedupe} {
+		if set {
+			convertModes++
+		}
+	}
+	if convertModes > 1 {
+		fmt.Fprintf(os.Stderr, "invalid invocation: --link, --reflink, --hardlink and --dedupe cannot be combined\n")
 		os.Exit(1)
 	}
+	convertMode := convertModes > 0
 
 	fuzzyMode := *flFuzzy
-	if fuzzyErr := validateFuzzyMode(fuzzyMode, shallowMode, *flSingleFile, *flBackupFile, *flRestoreFile, *flKeep, *flLinkMode || *flReflinkMode, *flFuzzyThreshold); fuzzyErr != nil {
+	if fuzzyErr := validateFuzzyMode(fuzzyMode, shallowMode, *flSingleFile, *flBackupFile, *flRestoreFile, *flKeep, convertMode, *flFuzzyThreshold); fuzzyErr != nil {
 		fmt.Fprintf(os.Stderr, "invalid fuzzy invocation: %v\n", fuzzyErr)
 		os.Exit(1)
 	}
 
+	if err := validateDirTreeMode(*flDirTrees, *flDirSuperset, shallowMode || fuzzyMode, *flSingleFile, *flBackupFile); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid directory tree invocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	compareMode := len(flReferences) > 0
+	if err := validateCompareMode(flReferences, flag.Args(), shallowMode || fuzzyMode, *flSingleFile, *flBackupFile, *flSaveResults, *flLoadResults, *flKeep, *flDirTrees); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid compare invocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := validateCrossRootMode(*flCrossRoot, flag.Args(), shallowMode || fuzzyMode, *flSingleFile, *flLoadResults, *flDirTrees, compareMode); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid cross-root invocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := validatePlanMode(*flPlanOut, *flApplyPlan, flag.Args(), *flKeep, convertMode, *flBackupFile,
+		*flRestoreFile, *flLoadResults, *flSaveResults, *flTrash || *flQuarantine != "", *flDirTrees); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid plan invocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := validateScriptMode(*flScriptOut, *flPlanOut, *flApplyPlan, *flKeep, *flReflinkMode || *flDedupe, *flBackupFile,
+		*flTrash || *flQuarantine != "", *flDirTrees); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid script invocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	uniqueMode := *flUnique
+	if err := validateUniqueMode(uniqueMode, shallowMode || fuzzyMode, *flSingleFile, *flBackupFile, *flSaveResults, *flLoadResults, *flKeep, *flDirTrees, *flCrossRoot, *flCompareSum); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid unique invocation: %v\n", err)
+		os.Exit(1)
+	}
+
 	var fuzzyMinFileSize int64
 	if fuzzyMode {
 		if *flFuzzyMinSize != "" && *flFuzzyMinSize != "0" {
@@ -429,9 +512,55 @@ func main() {
 		fmt.Printf("Filesystem: %s\n\n", fs)
 	}
 
+	if *flCompactFile != "" {
+		if *flLoadResults != "" || *flSaveResults != "" {
+			fmt.Fprintf(os.Stderr, "invalid compact invocation: --manifest-compact cannot be combined with --load-results or --save-results\n")
+			os.Exit(1)
+		}
+		if err := validateCompactMode(*flCompactFile, *flUndoFile, *flRestoreFile, *flBackupFile, flag.Args(), *flGui, *flTextOutput, *flShowBullets, *flCSVOut,
+			*flJSONOut, *flSingleFile, *flFileShallow, *flNameOnly, *flKeep, convertMode); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid compact invocation: %v\n", err)
+			os.Exit(1)
+		}
+		result, err := manifest.Compact(*flCompactFile, *flDryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "compact failed: %v\n", err)
+			os.Exit(1)
+		}
+		verb := "Compacted"
+		if *flDryRun {
+			verb = "Dry run: would compact"
+		}
+		pterm.Success.Printf("%s manifest %s: kept %d entries, dropped %d superseded and %d already restored.\n",
+			verb, *flCompactFile, result.Kept, result.Superseded, result.Restored)
+		os.Exit(0)
+	}
+
+	if *flUndoFile != "" {
+		if *flLoadResults != "" || *flSaveResults != "" {
+			fmt.Fprintf(os.Stderr, "invalid undo invocation: --undo cannot be combined with --load-results or --save-results\n")
+			os.Exit(1)
+		}
+		if err := validateUndoMode(*flUndoFile, *flRestoreFile, *flBackupFile, flag.Args(), *flGui, *flTextOutput, *flShowBullets, *flCSVOut,
+			*flJSONOut, *flSingleFile, *flFileShallow, *flNameOnly, *flKeep, convertMode); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid undo invocation: %v\n", err)
+			os.Exit(1)
+		}
+		if err := manifest.Undo(*flUndoFile, manifest.RestoreOptions{DryRun: *flDryRun}, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "undo failed: %v\n", err)
+			os.Exit(1)
+		}
+		pterm.Success.Printf("Undo completed from journal %s.\n", *flUndoFile)
+		os.Exit(0)
+	}
+
 	if *flRestoreFile != "" {
+		if *flLoadResults != "" || *flSaveResults != "" {
+			fmt.Fprintf(os.Stderr, "invalid restore invocation: --restore cannot be combined with --load-results or --save-results\n")
+			os.Exit(1)
+		}
 		if err := validateRestoreMode(*flRestoreFile, *flBackupFile, flag.Args(), *flGui, *flTextOutput, *flShowBullets, *flCSVOut,
-			*flJSONOut, *flSingleFile, *flFileShallow, *flNameOnly, *flKeep, *flLinkMode || *flReflinkMode); err != nil {
+			*flJSONOut, *flSingleFile, *flFileShallow, *flNameOnly, *flKeep, convertMode); err != nil {
 			fmt.Fprintf(os.Stderr, "invalid restore invocation: %v\n", err)
 			os.Exit(1)
 		}
@@ -450,6 +579,105 @@ func main() {
 		os.Exit(0)
 	}
 
+	keepPolicy, err := buildKeepPolicy(*flKeepRules, flKeepIn, flPrefer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid keep policy: %v\n", err)
+		os.Exit(1)
+	}
+
+	guard, err := buildGuard(flProtect, *flMaxDelete, *flMaxReclaim, *flMinAge)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid invocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	linkStyle, err := dfs.ParseLinkStyle(*flLinkStyle)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid invocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	disposal, err := buildDisposal(*flTrash, *flQuarantine, convertMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid invocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *flApplyPlan != "" {
+		p, err := plan.Read(*flApplyPlan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "apply plan failed: %v\n", err)
+			os.Exit(1)
+		}
+		manifestPath := planManifestPath(*flApplyPlan, *flBackupFile)
+		result, err := dupview.ApplyPlan(p, dupview.ApplyOptions{
+			BackupPath: manifestPath,
+			Disposal:   disposal,
+			LinkStyle:  linkStyle,
+			DryRun:     *flDryRun,
+			Guard:      guard,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "apply plan failed: %v\n", err)
+			os.Exit(1)
+		}
+		ok := reportPlanResult(os.Stdout, os.Stderr, result)
+		if !*flDryRun {
+			fmt.Printf("Restore manifest written to %s.\n", manifestPath)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	outputs := resultOutputs{
+		keep:         *flKeep,
+		keepPolicy:   keepPolicy,
+		linkMode:     *flLinkMode,
+		reflinkMode:  *flReflinkMode,
+		hardlinkMode: *flHardlink,
+		dedupeMode:   *flDedupe,
+		csvOut:       *flCSVOut,
+		jsonOut:      *flJSONOut,
+		backupFile:   *flBackupFile,
+		timeOnly:     *flTimeOnly,
+		textOutput:   *flTextOutput,
+		bullets:      *flShowBullets,
+		gui:          *flGui,
+		skipConfirm:  *flNoConfirm,
+		disposal:     disposal,
+		linkStyle:    linkStyle,
+		planOut:      *flPlanOut,
+		scriptOut:    *flScriptOut,
+		rehash:       *flRehash,
+		dryRun:       *flDryRun,
+		guard:        guard,
+	}
+
+	if *flLoadResults != "" {
+		if err := validateLoadResultsMode(*flLoadResults, *flSaveResults, flag.Args(), *flSingleFile, *flFileShallow, *flNameOnly, fuzzyMode); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid load invocation: %v\n", err)
+			os.Exit(1)
+		}
+		dMap, scan, err := dmap.LoadResults(*flLoadResults)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load results: %v\n", err)
+			os.Exit(1)
+		}
+		pterm.Success.Printf("Loaded %d files in %d groups from %s (scanned %s).\n", dMap.FileCount(), dMap.MapSize(),
+			*flLoadResults, scan.ScannedAt.Local().Format(time.DateTime))
+		if stale := dMap.StaleCount(); stale > 0 {
+			pterm.Warning.Printf("%d file(s) changed since the scan; they are marked stale and will not be modified.\n", stale)
+		}
+		if outputs.keep != 0 {
+			pterm.Info.Printf("Keep count set; will leave %d files at least\n", outputs.keep)
+		}
+		outputs.scan = scan
+		handleResults(dMap, scan.HashAlgorithm, outputs)
+		return
+	}
+
 	MinFileSize := int64(0)
 
 	// XXX: NOTE: This logic started to get a little messy. I need to refactor several blocks. If anyone cares to refactor
@@ -551,6 +779,12 @@ func main() {
 	if len(rootDirs) == 0 {
 		rootDirs = []string{"."}
 	}
+	walkRoots := rootDirs
+	isReference := referenceMatcher(flReferences)
+	if compareMode {
+		walkRoots = append(append([]string(nil), rootDirs...), flReferences...)
+		pterm.Info.Printf("Checking %s for copies under %s\n", strings.Join(rootDirs, ", "), strings.Join(flReferences, ", "))
+	}
 
 	// Dmap stores duplicate file information. Failure is fatal.
 	minDups := *flMinDups
@@ -611,7 +845,9 @@ func main() {
 	// First collect cheap file metadata. Hashing waits until after this pass so
 	// unique file sizes never touch the expensive content path.
 	candidateFiles := make(chan dwalk.FileCandidate, 4096)
-	walker := dwalk.NewCandidateWalker(rootDirs, candidateFiles, appCfg)
+	paths := dMap.Paths()
+	walker := dwalk.NewCandidateWalker(walkRoots, candidateFiles, paths, appCfg)
+	dMap.SetRoots(walker.Roots())
 	walker.Run(ctx)
 
 	sizeGroups := make(map[int64][]dwalk.FileCandidate, 4096)
@@ -640,7 +876,7 @@ CollectLoop:
 				continue
 			}
 			if shallowMode {
-				name := filepath.Base(candidate.Path)
+				name := paths.Base(candidate.ID)
 				if shallowTargetName != "" && name != shallowTargetName {
 					continue
 				}
@@ -659,6 +895,11 @@ CollectLoop:
 	}
 
 	var sampledFiles uint
+	var sharedFiles int
+	var dirTrees, dirSupersets int
+	var compareSources []dpath.ID
+	var uniqueScanned []dpath.ID
+	var uniqueFailures hashFailures
 	var fullHashedFiles uint
 	var fuzzyProcessed uint
 	var fuzzySkipped uint
@@ -685,11 +926,30 @@ CollectLoop:
 		addedGroups, skippedByName := addNameOnlyGroups(dMap, nameGroups, minDups)
 		nameGroups = nil
 		dsklog.Dlogger.Debugf("Added %d shallow filename groups; skipped %d files with unique names", addedGroups, skippedByName)
+	} else if compareMode {
+		sampleList, sources, skippedBySize := compareCandidates(sizeGroups, paths, isReference)
+		compareSources = sources
+		sizeGroups = nil
+		dsklog.Dlogger.Debugf("Skipped %d files without a same-sized counterpart before sample hashing", skippedBySize)
+		sampledFiles, fullHashedFiles = runContentPipeline(ctx, dMap, sampleList, 2, nil, hashAlgo, hashOptions, *flProgressive, false, nil, tickC, updateProgress)
+	} else if uniqueMode {
+		sampleList, scanned := uniqueCandidates(sizeGroups)
+		uniqueScanned = scanned
+		sizeGroups = nil
+		dsklog.Dlogger.Debugf("%d of %d files are unique by size", len(scanned)-len(sampleList), len(scanned))
+		sampledFiles, fullHashedFiles = runContentPipeline(ctx, dMap, sampleList, 2, nil, hashAlgo, hashOptions, *flProgressive, false, &uniqueFailures, tickC, updateProgress)
 	} else {
-		sampleList, skippedBySize := eligibleHashCandidates(sizeGroups, minDups, singleFileMode)
+		sampleList, skippedBySize := eligibleHashCandidates(sizeGroups, minDups, singleFileMode, *flCrossRoot)
 		sizeGroups = nil
 		dsklog.Dlogger.Debugf("Skipped %d files with unique sizes before sample hashing", skippedBySize)
-		sampledFiles, fullHashedFiles = runContentPipeline(ctx, dMap, sampleList, minDups, singleTarget, hashAlgo, hashOptions, tickC, updateProgress)
+		sampledFiles, fullHashedFiles = runContentPipeline(ctx, dMap, sampleList, minDups, singleTarget, hashAlgo, hashOptions, *flProgressive, *flCrossRoot, nil, tickC, updateProgress)
+		sharedFiles = dMap.MarkSharedExtents()
+		dsklog.Dlogger.Debugf("Flagged %d files whose extents are already shared", sharedFiles)
+		if *flDirTrees {
+			updateProgress("Comparing directory trees...")
+			dirTrees, dirSupersets = dMap.FindDirectoryTrees(dmap.DirTreeOptions{Roots: rootDirs, Supersets: *flDirSuperset})
+			dsklog.Dlogger.Debugf("Added %d directory tree groups and %d superset groups", dirTrees, dirSupersets)
+		}
 	}
 
 	stopProgress()
@@ -710,6 +970,33 @@ CollectLoop:
 		finalInfo = "Scanned " + pterm.LightWhite(scannedFiles) + " files by name in " + pterm.LightWhite(duration)
 	}
 	pterm.Success.Println(finalInfo)
+	if sharedFiles > 0 {
+		pterm.Info.Printf("%d duplicate file(s) already share disk blocks with a copy and are not counted as wasted space.\n", sharedFiles)
+	}
+	if *flDirTrees {
+		pterm.Info.Printf("Found %d identical directory tree group(s) and %d superset pair(s).\n", dirTrees, dirSupersets)
+	}
+
+	if compareMode {
+		report := buildCompareReport(dMap, compareSources, isReference)
+		pterm.Info.Printf("%d of %d source file(s) have no copy under the reference roots.\n", len(report.missing), len(compareSources))
+		if uniqueMode {
+			writeUniqueFiles(os.Stdout, report.missing)
+			os.Exit(0)
+		}
+		report.write(os.Stdout, *flCompareSum)
+		os.Exit(0)
+	}
+	if uniqueMode {
+		unique, unreadable := findUniqueFiles(dMap, uniqueScanned, uniqueFailures.IDs())
+		pterm.Info.Printf("%d of %d file(s) have no other copy in the provided paths.\n", len(unique), len(uniqueScanned))
+		if len(unreadable) > 0 {
+			pterm.Warning.Printf("%d file(s) could not be read and are not listed as unique:\n", len(unreadable))
+			writeUniqueFiles(os.Stderr, unreadable)
+		}
+		writeUniqueFiles(os.Stdout, unique)
+		os.Exit(0)
+	}
 
 	if fuzzyMode {
 		if dMap.IsEmpty() {
@@ -737,61 +1024,186 @@ CollectLoop:
 		pterm.Info.Printf("Found %d file(s) named %s.\n", len(files), shallowTargetName)
 	}
 
-	// Write backup manifest before any batch-mode action. In interactive mode
-	// the manifest is written lazily by the TUI/GUI via applyOptions.BackupPath.
-	if *flBackupFile != "" && (keepCount > 0 || *flTimeOnly || *flTextOutput || *flShowBullets || *flCSVOut != "" || *flJSONOut != "") {
-		writeBackupManifest(dMap, hashAlgo, *flBackupFile)
+	outputs.scan = dmap.ScanInfo{
+		Roots:         absRoots(rootDirs),
+		HashAlgorithm: hashAlgo,
+		MinFileSize:   MinFileSize,
+		MaxFileSize:   MaxFileSize,
+		MinDuplicates: minDups,
+		ScannedAt:     start,
+	}
+	if *flSaveResults != "" {
+		if err := dMap.SaveResults(*flSaveResults, outputs.scan); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to save results: %v\n", err)
+			os.Exit(1)
+		}
+		pterm.Success.Printf("Scan results saved to %s.\n", *flSaveResults)
+	}
+
+	handleResults(dMap, hashAlgo, outputs)
+}
+
+// resultOutputs holds the flags deciding what happens to results once a scan
+// finishes or saved results are loaded.
+type resultOutputs struct {
+	keep         uint
+	keepPolicy   dmap.KeepPolicy
+	linkMode     bool
+	reflinkMode  bool
+	hardlinkMode bool
+	dedupeMode   bool
+	csvOut       string
+	jsonOut      string
+	backupFile   string
+	timeOnly     bool
+	textOutput   bool
+	bullets      bool
+	gui          bool
+	skipConfirm  bool
+	disposal     *dfs.Disposal
+	linkStyle    dfs.LinkStyle
+	planOut      string
+	scriptOut    string
+	rehash       bool
+	dryRun       bool
+	guard        dmap.Guard
+	// scan describes the scan behind the results, for manifest headers.
+	scan dmap.ScanInfo
+}
+
+// action returns the duplicate action selected by the conversion flags.
+func (out resultOutputs) action() dupview.Action {
+	switch {
+	case out.linkMode:
+		return dupview.ActionLink
+	case out.reflinkMode:
+		return dupview.ActionReflink
+	case out.hardlinkMode:
+		return dupview.ActionHardlink
+	case out.dedupeMode:
+		return dupview.ActionDedupe
+	}
+	return dupview.ActionDelete
+}
+
+// handleResults acts on dMap: it runs the requested batch action or export,
+// or opens the results for interactive review.
+func handleResults(dMap *dmap.Dmap, hashAlgo dfs.HashAlgorithm, out resultOutputs) {
+	keepCount := out.keep
+	dMap.SetKeepPolicy(out.keepPolicy)
+	dMap.SetDisposal(out.disposal)
+	dMap.SetLinkStyle(out.linkStyle)
+	dMap.SetGuard(out.guard)
+	if out.rehash {
+		dMap.SetVerifyHash(hashAlgo)
+	}
+
+	// A batch action journals each file once it acted on it. Without one the
+	// backup manifest lists every group up front. In interactive mode the
+	// TUI/GUI journals its actions via applyOptions.BackupPath. A dry run
+	// changes nothing, so it needs none.
+	if out.backupFile != "" && !out.dryRun {
+		switch {
+		case keepCount > 0:
+			journalBatch(dMap, hashAlgo, out.backupFile, out.action(), out.scan)
+		case out.timeOnly || out.textOutput || out.bullets || out.csvOut != "" || out.jsonOut != "":
+			writeBackupManifest(dMap, hashAlgo, out.backupFile, out.scan)
+		}
 	}
 
 	applyOptions := dupview.ApplyOptions{
-		BackupPath:    *flBackupFile,
+		BackupPath:    out.backupFile,
 		HashAlgorithm: hashAlgo,
-		SkipConfirm:   *flNoConfirm,
+		SkipConfirm:   out.skipConfirm,
+		Disposal:      out.disposal,
+		LinkStyle:     out.linkStyle,
+		VerifyHash:    out.rehash,
+		DryRun:        out.dryRun,
+		Guard:         out.guard,
+		Scan:          out.scan,
 	}
 
 	switch {
-	case keepCount > 0 && *flLinkMode:
+	case keepCount > 0 && out.planOut != "":
+		steps, planErr := writePlan(dMap, out.planOut, keepCount, out.action(), hashAlgo, out.linkStyle)
+		if planErr != nil {
+			fmt.Fprintf(os.Stderr, "write plan failed: %v\n", planErr)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote a plan with %d step(s) to %s. Review it, then run --apply-plan %s.\n", steps, out.planOut, out.planOut)
+	case keepCount > 0 && out.scriptOut != "":
+		steps, scriptErr := writeScript(dMap, out.scriptOut, keepCount, out.action(), hashAlgo, out.linkStyle)
+		if scriptErr != nil {
+			fmt.Fprintf(os.Stderr, "write script failed: %v\n", scriptErr)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote a script with %d step(s) to %s. Review it, then run it with sh %s.\n", steps, out.scriptOut, out.scriptOut)
+	case keepCount > 0 && out.dryRun:
+		if err := printPreview(os.Stdout, dMap, keepCount, out.action(), applyOptions); err != nil {
+			fmt.Fprintf(os.Stderr, "Dry run: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Dry run: nothing was changed.")
+	case keepCount > 0 && out.linkMode:
 		linkedPaths, linkErr := dMap.LinkDuplicates(keepCount)
 		fmt.Printf("Converted %d duplicate files to symlinks, kept %d real file(s) per group.\n", len(linkedPaths), keepCount)
 		if linkErr != nil {
 			fmt.Fprintf(os.Stderr, "Linking completed with errors: %v\n", linkErr)
 			os.Exit(1)
 		}
-	case keepCount > 0 && *flReflinkMode:
+	case keepCount > 0 && out.reflinkMode:
 		reflinkedPaths, reflinkErr := dMap.ReflinkDuplicates(keepCount)
 		fmt.Printf("Converted %d duplicate files to reflinks, kept %d real file(s) per group.\n", len(reflinkedPaths), keepCount)
 		if reflinkErr != nil {
 			fmt.Fprintf(os.Stderr, "Reflinking completed with errors: %v\n", reflinkErr)
 			os.Exit(1)
 		}
+	case keepCount > 0 && out.hardlinkMode:
+		hardlinkedPaths, hardlinkErr := dMap.HardlinkDuplicates(keepCount)
+		fmt.Printf("Converted %d duplicate files to hard links, kept %d distinct file(s) per group.\n", len(hardlinkedPaths), keepCount)
+		if hardlinkErr != nil {
+			fmt.Fprintf(os.Stderr, "Hard linking completed with errors: %v\n", hardlinkErr)
+			os.Exit(1)
+		}
+	case keepCount > 0 && out.dedupeMode:
+		dedupedPaths, dedupeErr := dMap.DedupeDuplicates(keepCount)
+		fmt.Printf("Deduplicated %d duplicate files in place, kept %d unshared file(s) per group.\n", len(dedupedPaths), keepCount)
+		if dedupeErr != nil {
+			fmt.Fprintf(os.Stderr, "Dedupe completed with errors: %v\n", dedupeErr)
+			os.Exit(1)
+		}
 	case keepCount > 0:
 		removedPaths, removeErr := dMap.RemoveDuplicates(keepCount)
-		fmt.Printf("Removed %d duplicate files, kept %d per group.\n", len(removedPaths), keepCount)
+		if out.disposal != nil {
+			fmt.Printf("Moved %d duplicate files to %s, kept %d per group.\n", len(removedPaths), out.disposal.Destination(), keepCount)
+		} else {
+			fmt.Printf("Removed %d duplicate files, kept %d per group.\n", len(removedPaths), keepCount)
+		}
 		if removeErr != nil {
 			fmt.Fprintf(os.Stderr, "Removal completed with errors: %v\n", removeErr)
 			os.Exit(1)
 		}
-	case *flCSVOut != "":
-		pterm.Info.Printf("Writing CSV to %s...\n", *flCSVOut)
-		if err := dMap.WriteCSV(*flCSVOut); err != nil {
+	case out.csvOut != "":
+		pterm.Info.Printf("Writing CSV to %s...\n", out.csvOut)
+		if err := dMap.WriteCSV(out.csvOut); err != nil {
 			fmt.Fprintf(os.Stderr, "failed to write CSV output: %v\n", err)
 			os.Exit(1)
 		}
-		pterm.Success.Printf("CSV file %s written to disk.\n", *flCSVOut)
-	case *flJSONOut != "":
-		pterm.Info.Printf("Writing JSON to %s...\n", *flJSONOut)
-		if err := dMap.WriteJSON(*flJSONOut); err != nil {
+		pterm.Success.Printf("CSV file %s written to disk.\n", out.csvOut)
+	case out.jsonOut != "":
+		pterm.Info.Printf("Writing JSON to %s...\n", out.jsonOut)
+		if err := dMap.WriteJSON(out.jsonOut); err != nil {
 			fmt.Fprintf(os.Stderr, "failed to write JSON output: %v\n", err)
 			os.Exit(1)
 		}
-		pterm.Success.Printf("JSON file %s written to disk.\n", *flJSONOut)
-	case *flTimeOnly:
+		pterm.Success.Printf("JSON file %s written to disk.\n", out.jsonOut)
+	case out.timeOnly:
 		// scan-only benchmark mode; elapsed time already printed above
-	case *flTextOutput:
+	case out.textOutput:
 		dMap.PrintDmap()
-	case *flShowBullets:
+	case out.bullets:
 		dMap.ShowResultsBullet()
-	case *flGui:
+	case out.gui:
 		if err := launchGUI(dMap, applyOptions); err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			os.Exit(1)
@@ -801,14 +1213,100 @@ CollectLoop:
 	}
 }
 
-func eligibleHashCandidates(sizeGroups map[int64][]dwalk.FileCandidate, minDups uint, singleFileMode bool) ([]dwalk.FileCandidate, uint) {
+// buildGuard assembles the safety limits from --protect, --max-delete,
+// --max-reclaim and --min-age. Directories are made absolute to match scanned
+// paths.
+func buildGuard(protect []string, maxDelete uint, maxReclaim string, minAge uint) (dmap.Guard, error) {
+	if maxDelete > uint(math.MaxInt) {
+		return dmap.Guard{}, fmt.Errorf("--max-delete of %d exceeds maximum %d", maxDelete, math.MaxInt)
+	}
+	if minAge > uint(math.MaxInt64/int64(time.Minute)) {
+		return dmap.Guard{}, fmt.Errorf("--min-age of %d minutes is too large", minAge)
+	}
+	guard := dmap.Guard{
+		MaxFiles: int(maxDelete),
+		MinAge:   time.Duration(minAge) * time.Minute,
+	}
+	if len(protect) > 0 {
+		guard.Protect = absRoots(protect)
+	}
+	if maxReclaim != "" {
+		size, err := utils.ParseSize(maxReclaim)
+		if err != nil {
+			return dmap.Guard{}, fmt.Errorf("invalid --max-reclaim: %w", err)
+		}
+		if size == 0 {
+			return dmap.Guard{}, fmt.Errorf("--max-reclaim must be greater than zero")
+		}
+		guard.MaxReclaim = size
+	}
+	return guard, nil
+}
+
+// buildKeepPolicy assembles the keep policy from --keep, --keep-in and
+// --prefer. Directories are made absolute to match scanned paths.
+func buildKeepPolicy(rules string, keepIn, prefer []string) (dmap.KeepPolicy, error) {
+	parsed, err := dmap.ParseKeepRules(rules)
+	if err != nil {
+		return dmap.KeepPolicy{}, err
+	}
+	policy := dmap.KeepPolicy{Rules: parsed}
+	if len(keepIn) > 0 {
+		policy.KeepIn = absRoots(keepIn)
+	}
+	if len(prefer) > 0 {
+		policy.Prefer = absRoots(prefer)
+	}
+	return policy, nil
+}
+
+// buildDisposal returns where --trash or --quarantine send removed
+// duplicates, or nil to delete them. Neither applies to the link actions,
+// which replace duplicates rather than remove them.
+func buildDisposal(trash bool, quarantine string, convert bool) (*dfs.Disposal, error) {
+	switch {
+	case trash && quarantine != "":
+		return nil, fmt.Errorf("--trash and --quarantine cannot be combined")
+	case (trash || quarantine != "") && convert:
+		return nil, fmt.Errorf("--trash and --quarantine only apply to removal, not --link, --reflink, --hardlink or --dedupe")
+	case trash:
+		return dfs.TrashDisposal(), nil
+	case quarantine != "":
+		return dfs.QuarantineDisposal(quarantine, time.Now())
+	}
+	return nil, nil
+}
+
+// absRoots returns roots as absolute paths so saved results stay meaningful
+// when loaded from another directory.
+func absRoots(roots []string) []string {
+	out := make([]string, 0, len(roots))
+	for _, root := range roots {
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		out = append(out, root)
+	}
+	return out
+}
+
+// eligibleHashCandidates returns the files worth sample hashing: those sharing
+// their size with enough others. With crossRootOnly set, a size group must
+// also span more than one root.
+func eligibleHashCandidates(sizeGroups map[int64][]dwalk.FileCandidate, minDups uint, singleFileMode, crossRootOnly bool) ([]dwalk.FileCandidate, uint) {
 	if minDups < 2 {
 		minDups = 2
 	}
+	eligible := func(files []dwalk.FileCandidate) bool {
+		if crossRootOnly && !spansRoots(files) {
+			return false
+		}
+		return singleFileMode || uint(len(files)) >= minDups
+	}
 
 	total := 0
 	for _, files := range sizeGroups {
-		if singleFileMode || uint(len(files)) >= minDups {
+		if eligible(files) {
 			total += len(files)
 		}
 	}
@@ -816,7 +1314,7 @@ func eligibleHashCandidates(sizeGroups map[int64][]dwalk.FileCandidate, minDups
 	candidates := make([]dwalk.FileCandidate, 0, total)
 	var skipped uint
 	for _, files := range sizeGroups {
-		if singleFileMode || uint(len(files)) >= minDups {
+		if eligible(files) {
 			candidates = append(candidates, files...)
 			continue
 		}
@@ -826,6 +1324,16 @@ func eligibleHashCandidates(sizeGroups map[int64][]dwalk.FileCandidate, minDups
 	return candidates, skipped
 }
 
+// spansRoots reports whether files were found under more than one scan root.
+func spansRoots(files []dwalk.FileCandidate) bool {
+	for _, file := range files[min(1, len(files)):] {
+		if file.Root != files[0].Root {
+			return true
+		}
+	}
+	return false
+}
+
 func addNameOnlyGroups(dMap *dmap.Dmap, nameGroups map[string][]dwalk.FileCandidate, minDups uint) (uint, uint) {
 	if dMap == nil {
 		return 0, 0
@@ -848,11 +1356,12 @@ func addNameOnlyGroups(dMap *dmap.Dmap, nameGroups map[string][]dwalk.FileCandid
 			skipped += uint(len(files))
 			continue
 		}
+		paths := dMap.Paths()
 		sort.Slice(files, func(i, j int) bool {
-			return files[i].Path < files[j].Path
+			return paths.Path(files[i].ID) < paths.Path(files[j].ID)
 		})
 		for _, file := range files {
-			dMap.AddNamePath(name, file.Path)
+			dMap.AddNameID(name, file.ID, file.FileMeta)
 		}
 		addedGroups++
 	}
@@ -919,15 +1428,16 @@ type sampledFile struct {
 	candidate       dwalk.FileCandidate
 	digest          dmap.Digest
 	coversWholeFile bool
+	zeroFilled      bool
 }
 
-func eligibleSampleCandidates(sampleGroups map[sampleKey][]sampledFile, minDups uint, singleFileMode bool) ([]sampledFile, []dwalk.FileCandidate, uint) {
+func eligibleSampleCandidates(sampleGroups map[sampleKey][]sampledFile, minDups uint, singleFileMode, crossRootOnly bool) ([]sampledFile, [][]dwalk.FileCandidate, uint) {
 	if minDups < 2 {
 		minDups = 2
 	}
 
 	var directFiles []sampledFile
-	var fullHashList []dwalk.FileCandidate
+	var fullHashGroups [][]dwalk.FileCandidate
 	var skipped uint
 
 	for _, files := range sampleGroups {
@@ -938,19 +1448,29 @@ func eligibleSampleCandidates(sampleGroups map[sampleKey][]sampledFile, minDups
 			skipped += uint(len(files))
 			continue
 		}
+		group := make([]dwalk.FileCandidate, 0, len(files))
+		for _, file := range files {
+			group = append(group, file.candidate)
+		}
+		if crossRootOnly && !spansRoots(group) {
+			skipped += uint(len(files))
+			continue
+		}
 		if files[0].coversWholeFile {
 			directFiles = append(directFiles, files...)
 			continue
 		}
-		for _, file := range files {
-			fullHashList = append(fullHashList, file.candidate)
-		}
+		fullHashGroups = append(fullHashGroups, group)
 	}
 
-	return directFiles, fullHashList, skipped
+	return directFiles, fullHashGroups, skipped
 }
 
 // runContentPipeline runs the two-phase sample-then-full-hash pipeline and populates dMap.
+// With progressive set, sample groups are hashed in lockstep windows instead of
+// each file being hashed independently. With crossRootOnly set, groups whose
+// files all come from one root are dropped at every stage and never reach dMap.
+// Files that can't be read at either stage are recorded in failures.
 // It returns the count of files sampled and the count fully hashed.
 func runContentPipeline(
 	ctx context.Context,
@@ -960,37 +1480,50 @@ func runContentPipeline(
 	singleTarget *singleFileTarget,
 	hashAlgo dfs.HashAlgorithm,
 	hashOptions dfs.HashOptions,
+	progressive bool,
+	crossRootOnly bool,
+	failures *hashFailures,
 	tickC <-chan time.Time,
 	updateProgress func(string),
 ) (sampledFiles, fullHashedFiles uint) {
 	singleFileMode := singleTarget != nil
+	paths := dMap.Paths()
 	sampleGroups := make(map[sampleKey][]sampledFile, 4096)
 
 	if len(sampleList) > 0 {
 		sampleJobs := make(chan dwalk.FileCandidate, min(len(sampleList), 4096))
-		sampledFileCh := make(chan sampledFile, min(len(sampleList), 4096))
 		workerCount := sampleWorkerCount(len(sampleList))
+		// Each worker groups its own samples; they are merged once all finish.
+		workerGroups := make([]map[sampleKey][]sampledFile, workerCount)
+		var sampled atomic.Uint64
 
 		var sampleWG sync.WaitGroup
 		sampleWG.Add(workerCount)
 		for i := 0; i < workerCount; i++ {
+			groups := make(map[sampleKey][]sampledFile)
+			workerGroups[i] = groups
 			go func() {
 				defer sampleWG.Done()
 				for candidate := range sampleJobs {
-					sample, err := dfs.HashFileSampleWithOptions(candidate.Path, candidate.Size, hashAlgo, hashOptions)
+					path := paths.Path(candidate.ID)
+					sample, err := dfs.HashFileSampleWithOptions(path, candidate.Size, hashAlgo, hashOptions)
 					if err != nil {
-						dsklog.Dlogger.Debugf("Skipping file after sample failure %s: %v", candidate.Path, err)
+						dsklog.Dlogger.Debugf("Skipping file after sample failure %s: %v", path, err)
+						failures.add(candidate.ID)
+						continue
+					}
+					sampled.Add(1)
+					digest := dmap.Digest(sample.Digest)
+					if singleFileMode && digest != singleTarget.sampleDigest {
 						continue
 					}
-					select {
-					case <-ctx.Done():
-						return
-					case sampledFileCh <- sampledFile{
+					key := sampleKey{size: candidate.Size, digest: digest}
+					groups[key] = append(groups[key], sampledFile{
 						candidate:       candidate,
-						digest:          dmap.Digest(sample.Digest),
+						digest:          digest,
 						coversWholeFile: sample.CoversWholeFile,
-					}:
-					}
+						zeroFilled:      sample.ZeroFilled,
+					})
 				}
 			}()
 		}
@@ -1004,62 +1537,77 @@ func runContentPipeline(
 				}
 			}
 		}()
-		go func() {
-			sampleWG.Wait()
-			close(sampledFileCh)
-		}()
+		waitWithProgress(&sampleWG, tickC, func() {
+			updateProgress(fmt.Sprintf("Sampled %d/%d candidate files...", sampled.Load(), len(sampleList)))
+		})
+		sampledFiles = uint(sampled.Load())
 
-	SampleLoop:
-		for {
-			select {
-			case sample, ok := <-sampledFileCh:
-				if !ok {
-					break SampleLoop
-				}
-				sampledFiles++
-				if singleFileMode && sample.digest != singleTarget.sampleDigest {
-					continue
-				}
-				key := sampleKey{size: sample.candidate.Size, digest: sample.digest}
-				sampleGroups[key] = append(sampleGroups[key], sample)
-			case <-tickC:
-				updateProgress(fmt.Sprintf("Sampled %d/%d candidate files...", sampledFiles, len(sampleList)))
+		for _, groups := range workerGroups {
+			for key, files := range groups {
+				sampleGroups[key] = append(sampleGroups[key], files...)
 			}
 		}
 	}
 
-	directFiles, fullHashList, skippedBySample := eligibleSampleCandidates(sampleGroups, minDups, singleFileMode)
+	directFiles, fullHashGroups, skippedBySample := eligibleSampleCandidates(sampleGroups, minDups, singleFileMode, crossRootOnly)
 	sampleGroups = nil
 	dsklog.Dlogger.Debugf("Skipped %d files with unique samples before full hashing", skippedBySample)
 
 	for _, file := range directFiles {
-		dMap.AddPath(file.digest, file.candidate.Path)
+		dMap.AddFileID(file.digest, file.candidate.ID, dmap.FileInfo{
+			FileMeta:   file.candidate.FileMeta,
+			ZeroFilled: file.zeroFilled,
+		})
 	}
 
-	if len(fullHashList) == 0 {
+	if len(fullHashGroups) == 0 {
 		return
 	}
 
+	if progressive {
+		minGroup := max(int(minDups), 2)
+		if singleFileMode {
+			minGroup = 2
+		}
+		fullHashedFiles = runProgressiveHashing(ctx, dMap, fullHashGroups, minGroup, crossRootOnly, failures, hashAlgo, hashOptions, tickC, updateProgress)
+		return
+	}
+
+	var fullHashList []dwalk.FileCandidate
+	for _, group := range fullHashGroups {
+		fullHashList = append(fullHashList, group...)
+	}
+
 	hashJobs := make(chan dwalk.FileCandidate, min(len(fullHashList), 4096))
-	hashedFiles := make(chan *dfs.Dfile, min(len(fullHashList), 4096))
 	workerCount := hashWorkerCount(len(fullHashList))
+	var hashed atomic.Uint64
 
+	// Workers add straight into the Dmap, which is safe for concurrent use.
+	// In cross-root mode each worker holds its files back instead, since a
+	// group's roots are only known once all of its members are hashed.
+	held := make([][]hashedFile, workerCount)
 	var hashWG sync.WaitGroup
 	hashWG.Add(workerCount)
 	for i := 0; i < workerCount; i++ {
 		go func() {
 			defer hashWG.Done()
 			for candidate := range hashJobs {
-				dFile, err := dfs.NewDfileWithOptions(candidate.Path, candidate.Size, hashAlgo, hashOptions)
+				if ctx.Err() != nil {
+					return
+				}
+				path := paths.Path(candidate.ID)
+				dFile, err := dfs.NewDfileWithOptions(path, candidate.Size, hashAlgo, hashOptions)
 				if err != nil {
-					dsklog.Dlogger.Debugf("Skipping file after hash failure %s: %v", candidate.Path, err)
+					dsklog.Dlogger.Debugf("Skipping file after hash failure %s: %v", path, err)
+					failures.add(candidate.ID)
 					continue
 				}
-				select {
-				case <-ctx.Done():
-					return
-				case hashedFiles <- dFile:
+				if crossRootOnly {
+					held[i] = append(held[i], hashedFile{dfile: dFile, candidate: candidate})
+				} else {
+					dMap.AddID(dFile, candidate.ID, candidate.FileMeta)
 				}
+				hashed.Add(1)
 			}
 		}()
 	}
@@ -1073,37 +1621,95 @@ func runContentPipeline(
 			}
 		}
 	}()
+	waitWithProgress(&hashWG, tickC, func() {
+		updateProgress(fmt.Sprintf("Hashed %d/%d full candidate files...", hashed.Load(), len(fullHashList)))
+	})
+	fullHashedFiles = uint(hashed.Load())
+	if crossRootOnly {
+		addCrossRootGroups(dMap, held)
+	}
+	return
+}
+
+// hashedFile is a fully hashed candidate not yet added to the Dmap.
+type hashedFile struct {
+	dfile     *dfs.Dfile
+	candidate dwalk.FileCandidate
+}
+
+// addCrossRootGroups groups the files held back by the hash workers by digest
+// and adds only the groups that span more than one root.
+func addCrossRootGroups(dMap *dmap.Dmap, held [][]hashedFile) {
+	byDigest := make(map[dmap.Digest][]hashedFile)
+	for _, files := range held {
+		for _, file := range files {
+			digest := dmap.Digest(file.dfile.Hash())
+			byDigest[digest] = append(byDigest[digest], file)
+		}
+	}
+	for _, files := range byDigest {
+		group := make([]dwalk.FileCandidate, 0, len(files))
+		for _, file := range files {
+			group = append(group, file.candidate)
+		}
+		if !spansRoots(group) {
+			continue
+		}
+		for _, file := range files {
+			dMap.AddID(file.dfile, file.candidate.ID, file.candidate.FileMeta)
+		}
+	}
+}
+
+// waitWithProgress blocks until wg is done, calling onTick on every tick.
+func waitWithProgress(wg *sync.WaitGroup, tickC <-chan time.Time, onTick func()) {
+	done := make(chan struct{})
 	go func() {
-		hashWG.Wait()
-		close(hashedFiles)
+		wg.Wait()
+		close(done)
 	}()
-
-HashLoop:
 	for {
 		select {
-		case dFile, ok := <-hashedFiles:
-			if !ok {
-				break HashLoop
-			}
-			if dFile == nil {
-				dsklog.Dlogger.Warn("Received nil dFile, skipping...")
-				continue
-			}
-			dMap.Add(dFile)
-			fullHashedFiles++
+		case <-done:
+			return
 		case <-tickC:
-			updateProgress(fmt.Sprintf("Hashed %d/%d full candidate files...", fullHashedFiles, len(fullHashList)))
+			onTick()
 		}
 	}
-	return
 }
-func writeBackupManifest(dMap *dmap.Dmap, algo dfs.HashAlgorithm, path string) {
+
+// journalBatch makes the batch action on dMap append an entry for every file
+// it acts on to the journal at path, once the file was acted on. An existing
+// journal is appended to, never replaced.
+func journalBatch(dMap *dmap.Dmap, algo dfs.HashAlgorithm, path string, action dupview.Action, scan dmap.ScanInfo) {
+	header := manifest.NewHeader(scan)
+	groups := make(map[dmap.Digest]uint64)
+	dMap.SetJournal(func(hash dmap.Digest, keep, id dpath.ID) (func() error, error) {
+		groupID, ok := groups[hash]
+		if !ok {
+			groupID = uint64(len(groups) + 1)
+			groups[hash] = groupID
+		}
+		entry, err := manifest.BatchEntry(dMap, algo, groupID, hash, keep, id, dupview.JournalAction(action))
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			return manifest.AppendUnique(path, header, []manifest.Entry{entry})
+		}, nil
+	})
+	pterm.Info.Printf("Recording each change in %s.\n", path)
+}
+
+// writeBackupManifest appends a restore entry for every group in dMap to the
+// manifest at path, creating it if needed.
+func writeBackupManifest(dMap *dmap.Dmap, algo dfs.HashAlgorithm, path string, scan dmap.ScanInfo) {
 	entries, err := manifest.EntriesFromDmap(dMap, algo)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to build restore manifest: %v\n", err)
 		os.Exit(1)
 	}
-	if err := manifest.Write(path, entries); err != nil {
+	if err := manifest.AppendUnique(path, manifest.NewHeader(scan), entries); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to write restore manifest: %v\n", err)
 		os.Exit(1)
 	}
@@ -1130,6 +1736,47 @@ func validateShallowMode(nameOnly bool, fileShallow, singleFile, backupFile stri
 	return shallowFileName(fileShallow, "--file-shallow")
 }
 
+// validateDirTreeMode returns an error if --dir-trees or --dir-supersets is
+// combined with incompatible flags. Directory trees are built from content
+// digests, so other match modes can't feed them.
+func validateDirTreeMode(dirTrees, dirSupersets, otherMatchMode bool, singleFile, backupFile string) error {
+	if dirSupersets && !dirTrees {
+		return fmt.Errorf("--dir-supersets requires --dir-trees")
+	}
+	if !dirTrees {
+		return nil
+	}
+	if otherMatchMode || singleFile != "" {
+		return fmt.Errorf("--dir-trees cannot be combined with --name-only, --file-shallow, --fuzzy or --file")
+	}
+	if backupFile != "" {
+		return fmt.Errorf("restore backups cannot cover directory groups; rerun without --backup")
+	}
+	return nil
+}
+
+// validateCrossRootMode returns an error if --cross-root-only is given fewer
+// than two roots or combined with a mode that doesn't group by content digest.
+func validateCrossRootMode(crossRootOnly bool, roots []string, otherMatchMode bool, singleFile, loadResults string, dirTrees, compareMode bool) error {
+	if !crossRootOnly {
+		return nil
+	}
+	distinct := make(map[string]bool)
+	for _, root := range absRoots(roots) {
+		distinct[root] = true
+	}
+	if len(distinct) < 2 {
+		return fmt.Errorf("--cross-root-only needs at least two paths to scan")
+	}
+	if otherMatchMode || singleFile != "" || dirTrees || compareMode {
+		return fmt.Errorf("--cross-root-only cannot be combined with --name-only, --file-shallow, --fuzzy, --file, --dir-trees or --reference")
+	}
+	if loadResults != "" {
+		return fmt.Errorf("--cross-root-only applies while scanning; it cannot be combined with --load-results")
+	}
+	return nil
+}
+
 func shallowFileName(path, flagName string) (string, error) {
 	name := filepath.Base(filepath.Clean(path))
 	if name == "." || name == string(os.PathSeparator) {
@@ -1139,17 +1786,57 @@ func shallowFileName(path, flagName string) (string, error) {
 }
 
 func validateRestoreMode(restoreManifest, backupFile string, args []string, gui, textOutput, bulletOutput bool, csvOut, jsonOut, singleFile, fileShallow string, nameOnly bool, keep uint, linkMode bool) error {
-	if restoreManifest == "" {
-		return fmt.Errorf("--restore path must not be empty")
+	return validateReplayMode("--restore", restoreManifest, backupFile, args, gui, textOutput, bulletOutput, csvOut, jsonOut, singleFile, fileShallow, nameOnly, keep, linkMode)
+}
+
+// validateUndoMode is validateRestoreMode for --undo, which also can't be
+// combined with --restore.
+func validateUndoMode(journal, restoreManifest, backupFile string, args []string, gui, textOutput, bulletOutput bool, csvOut, jsonOut, singleFile, fileShallow string, nameOnly bool, keep uint, linkMode bool) error {
+	if restoreManifest != "" {
+		return fmt.Errorf("--undo cannot be combined with --restore")
+	}
+	return validateReplayMode("--undo", journal, backupFile, args, gui, textOutput, bulletOutput, csvOut, jsonOut, singleFile, fileShallow, nameOnly, keep, linkMode)
+}
+
+// validateCompactMode is validateRestoreMode for --manifest-compact, which
+// also can't be combined with --undo or --restore.
+func validateCompactMode(journal, undoJournal, restoreManifest, backupFile string, args []string, gui, textOutput, bulletOutput bool, csvOut, jsonOut, singleFile, fileShallow string, nameOnly bool, keep uint, linkMode bool) error {
+	if undoJournal != "" || restoreManifest != "" {
+		return fmt.Errorf("--manifest-compact cannot be combined with --undo or --restore")
+	}
+	return validateReplayMode("--manifest-compact", journal, backupFile, args, gui, textOutput, bulletOutput, csvOut, jsonOut, singleFile, fileShallow, nameOnly, keep, linkMode)
+}
+
+// validateReplayMode checks the flags of a command, named by flagName, that
+// replays manifest instead of scanning.
+func validateReplayMode(flagName, manifest, backupFile string, args []string, gui, textOutput, bulletOutput bool, csvOut, jsonOut, singleFile, fileShallow string, nameOnly bool, keep uint, linkMode bool) error {
+	if manifest == "" {
+		return fmt.Errorf("%s path must not be empty", flagName)
 	}
 	if backupFile != "" {
-		return fmt.Errorf("--restore cannot be combined with --backup")
+		return fmt.Errorf("%s cannot be combined with --backup", flagName)
 	}
 	if len(args) > 0 {
-		return fmt.Errorf("path arguments are not allowed with --restore")
+		return fmt.Errorf("path arguments are not allowed with %s", flagName)
 	}
 	if gui || textOutput || bulletOutput || csvOut != "" || jsonOut != "" || keep > 0 || linkMode || singleFile != "" || fileShallow != "" || nameOnly {
-		return fmt.Errorf("--restore cannot be combined with scan/output/mutation flags")
+		return fmt.Errorf("%s cannot be combined with scan/output/mutation flags", flagName)
+	}
+	return nil
+}
+
+func validateLoadResultsMode(loadResults, saveResults string, args []string, singleFile, fileShallow string, nameOnly, fuzzyMode bool) error {
+	if loadResults == "" {
+		return fmt.Errorf("--load-results path must not be empty")
+	}
+	if saveResults != "" {
+		return fmt.Errorf("--load-results cannot be combined with --save-results")
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("path arguments are not allowed with --load-results")
+	}
+	if singleFile != "" || fileShallow != "" || nameOnly || fuzzyMode {
+		return fmt.Errorf("--load-results cannot be combined with search scope or fuzzy flags")
 	}
 	return nil
 }
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
 	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
 	"github.com/jdefrancesco/dskDitto/internal/dsklog"
 	"github.com/jdefrancesco/dskDitto/internal/dwalk"
 	"github.com/jdefrancesco/dskDitto/internal/fuzzy"
@@ -64,15 +69,16 @@ func TestHelpColorEnabledRespectsColorSafeArg(t *testing.T) {
 }
 
 func TestEligibleHashCandidatesSkipsUniqueSizes(t *testing.T) {
+	paths := dpath.NewStore()
 	groups := map[int64][]dwalk.FileCandidate{
-		10: []dwalk.FileCandidate{{Path: "one", Size: 10}},
+		10: []dwalk.FileCandidate{testCandidate(paths, "one", 10)},
 		20: []dwalk.FileCandidate{
-			{Path: "two-a", Size: 20},
-			{Path: "two-b", Size: 20},
+			testCandidate(paths, "two-a", 20),
+			testCandidate(paths, "two-b", 20),
 		},
 	}
 
-	got, skipped := eligibleHashCandidates(groups, 2, false)
+	got, skipped := eligibleHashCandidates(groups, 2, false, false)
 	if skipped != 1 {
 		t.Fatalf("expected one skipped unique-size file, got %d", skipped)
 	}
@@ -82,11 +88,12 @@ func TestEligibleHashCandidatesSkipsUniqueSizes(t *testing.T) {
 }
 
 func TestEligibleHashCandidatesKeepsSingleFileCandidates(t *testing.T) {
+	paths := dpath.NewStore()
 	groups := map[int64][]dwalk.FileCandidate{
-		10: []dwalk.FileCandidate{{Path: "target-sized", Size: 10}},
+		10: []dwalk.FileCandidate{testCandidate(paths, "target-sized", 10)},
 	}
 
-	got, skipped := eligibleHashCandidates(groups, 2, true)
+	got, skipped := eligibleHashCandidates(groups, 2, true, false)
 	if skipped != 0 {
 		t.Fatalf("expected no skipped target-size candidates, got %d", skipped)
 	}
@@ -96,31 +103,32 @@ func TestEligibleHashCandidatesKeepsSingleFileCandidates(t *testing.T) {
 }
 
 func TestEligibleSampleCandidatesSplitsFullSamplesAndLargeFiles(t *testing.T) {
+	paths := dpath.NewStore()
 	var digest dmap.Digest
 	digest[0] = 1
 	groups := map[sampleKey][]sampledFile{
 		{size: 10, digest: digest}: []sampledFile{
-			{candidate: dwalk.FileCandidate{Path: "small-a", Size: 10}, digest: digest, coversWholeFile: true},
-			{candidate: dwalk.FileCandidate{Path: "small-b", Size: 10}, digest: digest, coversWholeFile: true},
+			{candidate: testCandidate(paths, "small-a", 10), digest: digest, coversWholeFile: true},
+			{candidate: testCandidate(paths, "small-b", 10), digest: digest, coversWholeFile: true},
 		},
 		{size: 100, digest: digest}: []sampledFile{
-			{candidate: dwalk.FileCandidate{Path: "large-a", Size: 100}, digest: digest},
-			{candidate: dwalk.FileCandidate{Path: "large-b", Size: 100}, digest: digest},
+			{candidate: testCandidate(paths, "large-a", 100), digest: digest},
+			{candidate: testCandidate(paths, "large-b", 100), digest: digest},
 		},
 		{size: 200, digest: digest}: []sampledFile{
-			{candidate: dwalk.FileCandidate{Path: "unique-sample", Size: 200}, digest: digest},
+			{candidate: testCandidate(paths, "unique-sample", 200), digest: digest},
 		},
 	}
 
-	direct, full, skipped := eligibleSampleCandidates(groups, 2, false)
+	direct, full, skipped := eligibleSampleCandidates(groups, 2, false, false)
 	if skipped != 1 {
 		t.Fatalf("expected one skipped unique-sample file, got %d", skipped)
 	}
 	if len(direct) != 2 {
 		t.Fatalf("expected two direct full-sample files, got %d", len(direct))
 	}
-	if len(full) != 2 {
-		t.Fatalf("expected two full hash candidates, got %d", len(full))
+	if len(full) != 1 || len(full[0]) != 2 {
+		t.Fatalf("expected one group of two full hash candidates, got %v", full)
 	}
 }
 func TestHashWorkerCount(t *testing.T) {
@@ -170,6 +178,22 @@ func TestResolveMaxFileSizeRejectsAllSizesWithMaxSize(t *testing.T) {
 	}
 }
 
+func TestBuildGuard(t *testing.T) {
+	guard, err := buildGuard([]string{"data"}, 10, "1MiB", 5)
+	if err != nil {
+		t.Fatalf("buildGuard failed: %v", err)
+	}
+	if !filepath.IsAbs(guard.Protect[0]) || guard.MaxFiles != 10 || guard.MaxReclaim != 1<<20 || guard.MinAge != 5*time.Minute {
+		t.Fatalf("unexpected guard %+v", guard)
+	}
+	if _, err := buildGuard(nil, 0, "lots", 0); err == nil {
+		t.Fatalf("expected an invalid --max-reclaim to be rejected")
+	}
+	if _, err := buildGuard(nil, 0, "0", 0); err == nil {
+		t.Fatalf("expected --max-reclaim 0 to be rejected")
+	}
+}
+
 func TestValidateRestoreModeAcceptsValidInvocation(t *testing.T) {
 	err := validateRestoreMode("restore.jsonl", "", nil, false, false, false, "", "", "", "", false, 0, false)
 	if err != nil {
@@ -197,6 +221,50 @@ func TestValidateRestoreModeRejectsScanFlags(t *testing.T) {
 	}
 }
 
+func TestValidateUndoMode(t *testing.T) {
+	if err := validateUndoMode("journal.jsonl", "", "", nil, false, false, false, "", "", "", "", false, 0, false); err != nil {
+		t.Fatalf("expected valid undo invocation, got %v", err)
+	}
+	if err := validateUndoMode("journal.jsonl", "restore.jsonl", "", nil, false, false, false, "", "", "", "", false, 0, false); err == nil {
+		t.Fatalf("expected --restore to be rejected")
+	}
+	err := validateUndoMode("journal.jsonl", "", "", nil, false, false, false, "", "", "", "", false, 1, false)
+	if err == nil || !strings.Contains(err.Error(), "--undo cannot be combined") {
+		t.Fatalf("expected mutation flags to be rejected, got %v", err)
+	}
+}
+
+func TestValidateCompactMode(t *testing.T) {
+	if err := validateCompactMode("journal.jsonl", "", "", "", nil, false, false, false, "", "", "", "", false, 0, false); err != nil {
+		t.Fatalf("expected valid compact invocation, got %v", err)
+	}
+	if err := validateCompactMode("journal.jsonl", "journal.jsonl", "", "", nil, false, false, false, "", "", "", "", false, 0, false); err == nil {
+		t.Fatalf("expected --undo to be rejected")
+	}
+	err := validateCompactMode("journal.jsonl", "", "", "", []string{"/data"}, false, false, false, "", "", "", "", false, 0, false)
+	if err == nil || !strings.Contains(err.Error(), "--manifest-compact") {
+		t.Fatalf("expected path arguments to be rejected, got %v", err)
+	}
+}
+
+func TestValidateLoadResultsModeAcceptsValidInvocation(t *testing.T) {
+	if err := validateLoadResultsMode("results.json", "", nil, "", "", false, false); err != nil {
+		t.Fatalf("expected valid load invocation, got %v", err)
+	}
+}
+
+func TestValidateLoadResultsModeRejectsScanInputs(t *testing.T) {
+	if err := validateLoadResultsMode("results.json", "", []string{"."}, "", "", false, false); err == nil {
+		t.Fatalf("expected path arguments to be rejected")
+	}
+	if err := validateLoadResultsMode("results.json", "again.json", nil, "", "", false, false); err == nil {
+		t.Fatalf("expected --save-results to be rejected")
+	}
+	if err := validateLoadResultsMode("results.json", "", nil, "", "", false, true); err == nil {
+		t.Fatalf("expected fuzzy mode to be rejected")
+	}
+}
+
 func TestAddNameOnlyGroups(t *testing.T) {
 	dsklog.InitializeDlogger(filepath.Join(t.TempDir(), "test.log"))
 
@@ -205,13 +273,14 @@ func TestAddNameOnlyGroups(t *testing.T) {
 		t.Fatalf("NewDmap failed: %v", err)
 	}
 
+	paths := dm.Paths()
 	groups := map[string][]dwalk.FileCandidate{
 		"same.txt": {
-			{Path: "/tmp/b/same.txt"},
-			{Path: "/tmp/a/same.txt"},
+			testCandidate(paths, "/tmp/b/same.txt", 0),
+			testCandidate(paths, "/tmp/a/same.txt", 0),
 		},
 		"unique.txt": {
-			{Path: "/tmp/a/unique.txt"},
+			testCandidate(paths, "/tmp/a/unique.txt", 0),
 		},
 	}
 
@@ -349,10 +418,11 @@ func TestAddFuzzyContentGroups(t *testing.T) {
 		t.Fatalf("write c: %v", err)
 	}
 
+	paths := dm.Paths()
 	added, processed, skipped, err := addFuzzyContentGroups(dm, []dwalk.FileCandidate{
-		{Path: a, Size: int64(len(aData))},
-		{Path: b, Size: int64(len(bData))},
-		{Path: c, Size: int64(len(cData))},
+		testCandidate(paths, a, int64(len(aData))),
+		testCandidate(paths, b, int64(len(bData))),
+		testCandidate(paths, c, int64(len(cData))),
 	}, 2, 70, false, fuzzy.DefaultMaxFuzzyCandidates, nil, nil)
 	if err != nil {
 		t.Fatalf("addFuzzyContentGroups failed: %v", err)
@@ -378,3 +448,447 @@ func TestAddFuzzyContentGroups(t *testing.T) {
 		t.Fatalf("expected fuzzy match type in dmap")
 	}
 }
+
+func TestRunProgressiveHashingDropsDivergentFiles(t *testing.T) {
+	dsklog.InitializeDlogger(filepath.Join(t.TempDir(), "test.log"))
+	dir := t.TempDir()
+
+	const size = 200 << 10
+	data := []byte(strings.Repeat("lockstep", size/8))
+	diverged := append([]byte(nil), data...)
+	diverged[150<<10] ^= 0xff
+
+	dm, err := dmap.NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	paths := dm.Paths()
+
+	files := map[string][]byte{"a.bin": data, "b.bin": data, "c.bin": diverged}
+	var group []dwalk.FileCandidate
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, files[name], 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		group = append(group, testCandidate(paths, path, size))
+	}
+	lonePath := filepath.Join(dir, "lone.bin")
+	if err := os.WriteFile(lonePath, diverged, 0o644); err != nil {
+		t.Fatalf("write %s: %v", lonePath, err)
+	}
+	otherPath := filepath.Join(dir, "other.bin")
+	if err := os.WriteFile(otherPath, data, 0o644); err != nil {
+		t.Fatalf("write %s: %v", otherPath, err)
+	}
+	split := []dwalk.FileCandidate{testCandidate(paths, lonePath, size), testCandidate(paths, otherPath, size)}
+
+	hashed := runProgressiveHashing(context.Background(), dm, [][]dwalk.FileCandidate{group, split}, 2, false, nil, dfs.HashSHA256, dfs.HashOptions{}, nil, func(string) {})
+	if hashed != 2 {
+		t.Fatalf("expected 2 fully hashed files, got %d", hashed)
+	}
+	if dm.MapSize() != 1 {
+		t.Fatalf("expected one duplicate group, got %d", dm.MapSize())
+	}
+	for _, group := range dm.GetMap() {
+		if len(group) != 2 || filepath.Base(group[0]) != "a.bin" || filepath.Base(group[1]) != "b.bin" {
+			t.Fatalf("unexpected duplicate group: %v", group)
+		}
+	}
+}
+
+// TestRunContentPipelineHashesConcurrently runs the sample and full-hash
+// stages, whose workers write into shared state directly; run with -race.
+func TestRunContentPipelineHashesConcurrently(t *testing.T) {
+	dsklog.InitializeDlogger(filepath.Join(t.TempDir(), "test.log"))
+	dir := t.TempDir()
+
+	const size = 200 << 10
+	dm, err := dmap.NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	paths := dm.Paths()
+
+	var candidates []dwalk.FileCandidate
+	for group := 0; group < 4; group++ {
+		data := []byte(strings.Repeat(fmt.Sprintf("group-%d;", group), size/8))[:size]
+		for copyIdx := 0; copyIdx < 3; copyIdx++ {
+			path := filepath.Join(dir, fmt.Sprintf("g%d_%d.bin", group, copyIdx))
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatalf("write %s: %v", path, err)
+			}
+			candidates = append(candidates, testCandidate(paths, path, size))
+		}
+	}
+
+	sampled, hashed := runContentPipeline(context.Background(), dm, candidates, 2, nil, dfs.HashSHA256, dfs.HashOptions{}, false, false, nil, nil, func(string) {})
+	if sampled != uint(len(candidates)) || hashed != uint(len(candidates)) {
+		t.Fatalf("sampled %d, hashed %d; want %d each", sampled, hashed, len(candidates))
+	}
+	if dm.MapSize() != 4 {
+		t.Fatalf("expected 4 duplicate groups, got %d", dm.MapSize())
+	}
+	for _, group := range dm.GetMap() {
+		if len(group) != 3 {
+			t.Fatalf("unexpected duplicate group: %v", group)
+		}
+	}
+}
+
+func TestRunContentPipelineCrossRootOnlyDropsSingleRootGroups(t *testing.T) {
+	dsklog.InitializeDlogger(filepath.Join(t.TempDir(), "test.log"))
+	dir := t.TempDir()
+
+	// Large enough that the sample doesn't cover the whole file, so both the
+	// size/sample stages and the full-hash stage see every group.
+	const size = 200 << 10
+	for _, progressive := range []bool{false, true} {
+		dm, err := dmap.NewDmap(2)
+		if err != nil {
+			t.Fatalf("NewDmap failed: %v", err)
+		}
+		paths := dm.Paths()
+
+		var candidates []dwalk.FileCandidate
+		for group, roots := range [][]int{{0, 1}, {0, 0}, {1, 1, 1}} {
+			data := []byte(strings.Repeat(fmt.Sprintf("group-%d;", group), size/8))[:size]
+			for copyIdx, root := range roots {
+				path := filepath.Join(dir, fmt.Sprintf("g%d_%d.bin", group, copyIdx))
+				if err := os.WriteFile(path, data, 0o644); err != nil {
+					t.Fatalf("write %s: %v", path, err)
+				}
+				candidate := testCandidate(paths, path, size)
+				candidate.Root = root
+				candidates = append(candidates, candidate)
+			}
+		}
+
+		runContentPipeline(context.Background(), dm, candidates, 2, nil, dfs.HashSHA256, dfs.HashOptions{}, progressive, true, nil, nil, func(string) {})
+		groups := dm.GetMap()
+		if len(groups) != 1 {
+			t.Fatalf("progressive=%v: expected only the cross-root group, got %v", progressive, groups)
+		}
+		for _, group := range groups {
+			if len(group) != 2 || !strings.Contains(group[0], "g0_") {
+				t.Fatalf("progressive=%v: unexpected group %v", progressive, group)
+			}
+		}
+	}
+}
+
+func TestEligibleHashCandidatesCrossRootOnly(t *testing.T) {
+	paths := dpath.NewStore()
+	sameRoot := []dwalk.FileCandidate{testCandidate(paths, "a", 10), testCandidate(paths, "b", 10)}
+	crossRoot := []dwalk.FileCandidate{testCandidate(paths, "c", 20), testCandidate(paths, "d", 20)}
+	crossRoot[1].Root = 1
+
+	got, skipped := eligibleHashCandidates(map[int64][]dwalk.FileCandidate{10: sameRoot, 20: crossRoot}, 2, false, true)
+	if skipped != 2 || len(got) != 2 || got[0].Size != 20 {
+		t.Fatalf("expected only the cross-root size group, got %v (skipped %d)", got, skipped)
+	}
+}
+
+func TestValidateCrossRootMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		roots      []string
+		otherMatch bool
+		singleFile string
+		load       string
+		dirTrees   bool
+		compare    bool
+		wantErr    bool
+	}{
+		{name: "two roots", roots: []string{"a", "b"}},
+		{name: "single root", roots: []string{"a"}, wantErr: true},
+		{name: "no roots", wantErr: true},
+		{name: "same root twice", roots: []string{"a", "./a/"}, wantErr: true},
+		{name: "name only", roots: []string{"a", "b"}, otherMatch: true, wantErr: true},
+		{name: "single file", roots: []string{"a", "b"}, singleFile: "x", wantErr: true},
+		{name: "dir trees", roots: []string{"a", "b"}, dirTrees: true, wantErr: true},
+		{name: "compare", roots: []string{"a", "b"}, compare: true, wantErr: true},
+		{name: "load results", roots: []string{"a", "b"}, load: "r.json", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := validateCrossRootMode(true, tt.roots, tt.otherMatch, tt.singleFile, tt.load, tt.dirTrees, tt.compare)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: validateCrossRootMode err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if err := validateCrossRootMode(false, nil, true, "x", "r.json", true, true); err != nil {
+		t.Fatalf("disabled mode should not validate: %v", err)
+	}
+}
+
+func TestFindUniqueFilesAcrossEliminationStages(t *testing.T) {
+	dsklog.InitializeDlogger(filepath.Join(t.TempDir(), "test.log"))
+	dir := t.TempDir()
+
+	large := strings.Repeat("x", 200<<10)
+	files := map[string]string{
+		"dup-a":       "same content",
+		"dup-b":       "same content",
+		"by-size":     "a length nothing else has",
+		"by-sample-a": "sample one!!",
+		"by-sample-b": "sample two!!",
+		"by-hash-a":   large + "a",
+		"by-hash-b":   large + "b",
+	}
+	dm, err := dmap.NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	sizeGroups := make(map[int64][]dwalk.FileCandidate)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		size := int64(len(content))
+		sizeGroups[size] = append(sizeGroups[size], testCandidate(dm.Paths(), path, size))
+	}
+
+	candidates, scanned := uniqueCandidates(sizeGroups)
+	if len(scanned) != len(files) || len(candidates) != len(files)-1 {
+		t.Fatalf("uniqueCandidates returned %d candidates of %d scanned", len(candidates), len(scanned))
+	}
+	_, hashed := runContentPipeline(context.Background(), dm, candidates, 2, nil, dfs.HashSHA256, dfs.HashOptions{}, false, false, nil, nil, func(string) {})
+	if hashed != 2 {
+		t.Fatalf("only the large files should be fully hashed, got %d", hashed)
+	}
+
+	got, unreadable := findUniqueFiles(dm, scanned, nil)
+	if len(unreadable) != 0 {
+		t.Fatalf("no file should be unreadable, got %v", unreadable)
+	}
+	want := []string{"by-hash-a", "by-hash-b", "by-sample-a", "by-sample-b", "by-size"}
+	if len(got) != len(want) {
+		t.Fatalf("findUniqueFiles = %v, want %v", got, want)
+	}
+	for i, name := range want {
+		if got[i] != filepath.Join(dir, name) {
+			t.Fatalf("findUniqueFiles[%d] = %s, want %s", i, got[i], name)
+		}
+	}
+}
+
+func TestFindUniqueFilesReportsUnreadableSeparately(t *testing.T) {
+	dsklog.InitializeDlogger(filepath.Join(t.TempDir(), "test.log"))
+	dir := t.TempDir()
+
+	dm, err := dmap.NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	sizeGroups := make(map[int64][]dwalk.FileCandidate)
+	for _, name := range []string{"kept", "gone"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("twelve bytes"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		sizeGroups[12] = append(sizeGroups[12], testCandidate(dm.Paths(), path, 12))
+	}
+	// A file removed after the walk fails its sample read.
+	if err := os.Remove(filepath.Join(dir, "gone")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	candidates, scanned := uniqueCandidates(sizeGroups)
+	var failures hashFailures
+	runContentPipeline(context.Background(), dm, candidates, 2, nil, dfs.HashSHA256, dfs.HashOptions{}, false, false, &failures, nil, func(string) {})
+
+	unique, unreadable := findUniqueFiles(dm, scanned, failures.IDs())
+	if len(unique) != 1 || unique[0] != filepath.Join(dir, "kept") {
+		t.Fatalf("unique = %v, want only kept", unique)
+	}
+	if len(unreadable) != 1 || unreadable[0] != filepath.Join(dir, "gone") {
+		t.Fatalf("unreadable = %v, want only gone", unreadable)
+	}
+}
+
+func TestValidateUniqueMode(t *testing.T) {
+	if err := validateUniqueMode(true, false, "", "", "", "", 0, false, false, false); err != nil {
+		t.Fatalf("plain --unique rejected: %v", err)
+	}
+	if err := validateUniqueMode(false, true, "x", "b", "s", "l", 1, true, true, true); err != nil {
+		t.Fatalf("disabled mode should not validate: %v", err)
+	}
+	invalid := map[string]error{
+		"fuzzy":           validateUniqueMode(true, true, "", "", "", "", 0, false, false, false),
+		"single file":     validateUniqueMode(true, false, "x", "", "", "", 0, false, false, false),
+		"remove":          validateUniqueMode(true, false, "", "", "", "", 1, false, false, false),
+		"save results":    validateUniqueMode(true, false, "", "", "r.json", "", 0, false, false, false),
+		"cross root":      validateUniqueMode(true, false, "", "", "", "", 0, false, true, false),
+		"compare summary": validateUniqueMode(true, false, "", "", "", "", 0, false, false, true),
+	}
+	for name, err := range invalid {
+		if err == nil {
+			t.Fatalf("%s: expected --unique to be rejected", name)
+		}
+	}
+}
+
+func TestBuildKeepPolicy(t *testing.T) {
+	policy, err := buildKeepPolicy("oldest,most-hardlinks", []string{"keep"}, []string{"/data/a", "/data/b"})
+	if err != nil {
+		t.Fatalf("buildKeepPolicy: %v", err)
+	}
+	if len(policy.Rules) != 2 || policy.Rules[0] != dmap.KeepOldest || policy.Rules[1] != dmap.KeepMostHardlinks {
+		t.Fatalf("unexpected rules %v", policy.Rules)
+	}
+	if len(policy.KeepIn) != 1 || !filepath.IsAbs(policy.KeepIn[0]) {
+		t.Fatalf("--keep-in should be made absolute, got %v", policy.KeepIn)
+	}
+	if len(policy.Prefer) != 2 || policy.Prefer[0] != "/data/a" {
+		t.Fatalf("--prefer order must be kept, got %v", policy.Prefer)
+	}
+	if policy, err := buildKeepPolicy("", nil, nil); err != nil || len(policy.Rules)+len(policy.KeepIn)+len(policy.Prefer) != 0 {
+		t.Fatalf("no flags should give the zero policy, got %+v (%v)", policy, err)
+	}
+	if _, err := buildKeepPolicy("largest", nil, nil); err == nil {
+		t.Fatal("expected an unknown rule to be rejected")
+	}
+}
+
+// testCandidate interns path in paths and returns a walker candidate for it.
+func testCandidate(paths *dpath.Store, path string, size int64) dwalk.FileCandidate {
+	return dwalk.FileCandidate{FileMeta: dfs.FileMeta{Size: size}, ID: paths.Add(path)}
+}
+
+func TestValidateDirTreeMode(t *testing.T) {
+	if err := validateDirTreeMode(true, true, false, "", ""); err != nil {
+		t.Fatalf("expected valid invocation, got %v", err)
+	}
+	if err := validateDirTreeMode(false, true, false, "", ""); err == nil {
+		t.Fatalf("expected --dir-supersets without --dir-trees to be rejected")
+	}
+	if err := validateDirTreeMode(true, false, true, "", ""); err == nil {
+		t.Fatalf("expected other match modes to be rejected")
+	}
+	if err := validateDirTreeMode(true, false, false, "target.bin", ""); err == nil {
+		t.Fatalf("expected --file to be rejected")
+	}
+	if err := validateDirTreeMode(true, false, false, "", "backup.jsonl"); err == nil {
+		t.Fatalf("expected --backup to be rejected")
+	}
+}
+
+func TestCompareReportsMissingAndMatchedSources(t *testing.T) {
+	dsklog.InitializeDlogger(filepath.Join(t.TempDir(), "test.log"))
+	root := t.TempDir()
+	src, ref := filepath.Join(root, "src"), filepath.Join(root, "ref")
+
+	dm, err := dmap.NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	paths := dm.Paths()
+	write := func(path, content string) dwalk.FileCandidate {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		return testCandidate(paths, path, int64(len(content)))
+	}
+	sizeGroups := make(map[int64][]dwalk.FileCandidate)
+	for _, c := range []dwalk.FileCandidate{
+		write(filepath.Join(src, "photo.jpg"), "same"),
+		write(filepath.Join(src, "edited.jpg"), "diff"),
+		write(filepath.Join(src, "large.raw"), "no reference this size"),
+		write(filepath.Join(ref, "2024", "photo.jpg"), "same"),
+		write(filepath.Join(ref, "other.jpg"), "more"),
+		write(filepath.Join(ref, "unrelated.bin"), "never hashed"),
+	} {
+		sizeGroups[c.Size] = append(sizeGroups[c.Size], c)
+	}
+
+	isReference := referenceMatcher([]string{ref})
+	candidates, sources, skipped := compareCandidates(sizeGroups, paths, isReference)
+	if len(sources) != 3 || len(candidates) != 4 || skipped != 2 {
+		t.Fatalf("compareCandidates = %d candidates, %d sources, %d skipped", len(candidates), len(sources), skipped)
+	}
+	runContentPipeline(context.Background(), dm, candidates, 2, nil, dfs.HashSHA256, dfs.HashOptions{}, false, false, nil, nil, func(string) {})
+
+	report := buildCompareReport(dm, sources, isReference)
+	wantMissing := []string{filepath.Join(src, "edited.jpg"), filepath.Join(src, "large.raw")}
+	if fmt.Sprint(report.missing) != fmt.Sprint(wantMissing) {
+		t.Fatalf("missing = %v, want %v", report.missing, wantMissing)
+	}
+	if len(report.matched) != 1 || report.matched[0].source != filepath.Join(src, "photo.jpg") ||
+		fmt.Sprint(report.matched[0].copies) != fmt.Sprint([]string{filepath.Join(ref, "2024", "photo.jpg")}) {
+		t.Fatalf("unexpected matches %+v", report.matched)
+	}
+
+	var out strings.Builder
+	report.write(&out, true)
+	if !strings.Contains(out.String(), src+": 3 file(s), 2 missing") {
+		t.Fatalf("summary missing from report:\n%s", out.String())
+	}
+}
+
+func TestValidateCompareMode(t *testing.T) {
+	root := t.TempDir()
+	src, ref := filepath.Join(root, "src"), filepath.Join(root, "ref")
+	if err := validateCompareMode([]string{ref}, []string{src}, false, "", "", "", "", 0, false); err != nil {
+		t.Fatalf("expected valid invocation, got %v", err)
+	}
+	if err := validateCompareMode([]string{filepath.Join(src, "sub")}, []string{src}, false, "", "", "", "", 0, false); err == nil {
+		t.Fatalf("expected overlapping roots to be rejected")
+	}
+	if err := validateCompareMode([]string{ref}, []string{src}, false, "", "", "", "", 1, false); err == nil {
+		t.Fatalf("expected --remove to be rejected")
+	}
+	if err := validateCompareMode([]string{ref}, []string{src}, true, "", "", "", "", 0, false); err == nil {
+		t.Fatalf("expected other match modes to be rejected")
+	}
+}
+
+func TestValidatePlanMode(t *testing.T) {
+	if err := validatePlanMode("plan.json", "", []string{"."}, 1, true, "", "", "", "", false, false); err != nil {
+		t.Fatalf("expected valid --plan-out, got %v", err)
+	}
+	if err := validatePlanMode("", "plan.json", nil, 0, false, "restore.jsonl", "", "", "", true, false); err != nil {
+		t.Fatalf("expected valid --apply-plan, got %v", err)
+	}
+	invalid := map[string]error{
+		"both":             validatePlanMode("a.json", "b.json", nil, 1, false, "", "", "", "", false, false),
+		"no remove":        validatePlanMode("plan.json", "", nil, 0, false, "", "", "", "", false, false),
+		"backup at plan":   validatePlanMode("plan.json", "", nil, 1, false, "b.jsonl", "", "", "", false, false),
+		"trash at plan":    validatePlanMode("plan.json", "", nil, 1, false, "", "", "", "", true, false),
+		"dir trees":        validatePlanMode("plan.json", "", nil, 1, false, "", "", "", "", false, true),
+		"apply with paths": validatePlanMode("", "plan.json", []string{"."}, 0, false, "", "", "", "", false, false),
+		"apply with link":  validatePlanMode("", "plan.json", nil, 0, true, "", "", "", "", false, false),
+		"apply with load":  validatePlanMode("", "plan.json", nil, 0, false, "", "", "r.json", "", false, false),
+	}
+	for name, err := range invalid {
+		if err == nil {
+			t.Fatalf("%s: expected plan invocation to be rejected", name)
+		}
+	}
+}
+
+func TestValidateScriptMode(t *testing.T) {
+	if err := validateScriptMode("", "", "", 0, true, "b.jsonl", true, true); err != nil {
+		t.Fatalf("disabled mode should not validate: %v", err)
+	}
+	if err := validateScriptMode("s.sh", "", "", 1, false, "", false, false); err != nil {
+		t.Fatalf("expected valid --script-out, got %v", err)
+	}
+	invalid := map[string]error{
+		"no remove": validateScriptMode("s.sh", "", "", 0, false, "", false, false),
+		"plan out":  validateScriptMode("s.sh", "p.json", "", 1, false, "", false, false),
+		"reflink":   validateScriptMode("s.sh", "", "", 1, true, "", false, false),
+		"backup":    validateScriptMode("s.sh", "", "", 1, false, "b.jsonl", false, false),
+		"trash":     validateScriptMode("s.sh", "", "", 1, false, "", true, false),
+		"dir trees": validateScriptMode("s.sh", "", "", 1, false, "", false, true),
+	}
+	for name, err := range invalid {
+		if err == nil {
+			t.Fatalf("%s: expected --script-out to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/dupview"
+	"github.com/jdefrancesco/dskDitto/internal/plan"
+)
+
+// validatePlanMode returns an error if --plan-out or --apply-plan is combined
+// with flags that don't fit the two-phase workflow. Writing a plan changes
+// nothing, so flags that only matter when acting belong to --apply-plan.
+func validatePlanMode(planOut, applyPlan string, args []string, keep uint, convert bool, backupFile, restoreFile, loadResults, saveResults string, disposal bool, dirTrees bool) error {
+	if planOut != "" {
+		if applyPlan != "" {
+			return fmt.Errorf("--plan-out and --apply-plan cannot be combined")
+		}
+		if keep == 0 {
+			return fmt.Errorf("--plan-out needs --remove to say how many copies to keep")
+		}
+		if backupFile != "" || disposal {
+			return fmt.Errorf("--backup, --trash and --quarantine take effect with --apply-plan, not --plan-out")
+		}
+		if dirTrees {
+			return fmt.Errorf("--plan-out cannot describe directory groups from --dir-trees")
+		}
+	}
+	if applyPlan != "" {
+		if len(args) > 0 {
+			return fmt.Errorf("path arguments are not allowed with --apply-plan")
+		}
+		if keep > 0 || convert || restoreFile != "" || loadResults != "" || saveResults != "" {
+			return fmt.Errorf("--apply-plan cannot be combined with --remove, --link, --reflink, --hardlink, --dedupe, --restore, --load-results or --save-results")
+		}
+	}
+	return nil
+}
+
+// markedGroups returns the groups of dMap with all but keep copies of each
+// marked, by the map's keep policy. Files the map's guard protects are left
+// unmarked, as the batch actions would leave them.
+func markedGroups(dMap *dmap.Dmap, keep uint) []*dupview.Group {
+	model := dupview.New(dMap)
+	for _, group := range model.Groups {
+		dupview.MarkExtras(group, dMap.KeepPolicy(), keep)
+		dupview.UnmarkProtected(group, dMap.Guard())
+	}
+	return model.Groups
+}
+
+// buildPlan marks all but keep copies of every group in dMap, by the map's
+// keep policy, and describes the changes action would make. It fails if they
+// exceed the limits of the map's guard.
+func buildPlan(dMap *dmap.Dmap, keep uint, action dupview.Action, algo dfs.HashAlgorithm, style dfs.LinkStyle) (plan.Plan, error) {
+	groups := markedGroups(dMap, keep)
+	preview := dupview.BuildPreview(groups, action, dupview.ApplyOptions{Guard: dMap.Guard()})
+	if err := dMap.Guard().CheckBatch(preview.Files, preview.Reclaim); err != nil {
+		return plan.Plan{}, err
+	}
+	return dupview.BuildPlan(groups, action, algo, style)
+}
+
+// printPreview marks dMap as --remove would and prints what action would do
+// to each group with opts, without changing anything. It returns an error if
+// the batch would exceed the limits of opts.Guard.
+func printPreview(out io.Writer, dMap *dmap.Dmap, keep uint, action dupview.Action, opts dupview.ApplyOptions) error {
+	preview := dupview.BuildPreview(markedGroups(dMap, keep), action, opts)
+	for _, line := range preview.Lines() {
+		fmt.Fprintln(out, line)
+	}
+	return opts.Guard.CheckBatch(preview.Files, preview.Reclaim)
+}
+
+// writePlan writes the plan for dMap to path and returns its step count.
+func writePlan(dMap *dmap.Dmap, path string, keep uint, action dupview.Action, algo dfs.HashAlgorithm, style dfs.LinkStyle) (int, error) {
+	p, err := buildPlan(dMap, keep, action, algo, style)
+	if err != nil {
+		return 0, err
+	}
+	if err := plan.Write(path, p); err != nil {
+		return 0, err
+	}
+	return len(p.Steps), nil
+}
+
+// writeScript writes the plan for dMap to path as a shell script and returns
+// its step count.
+func writeScript(dMap *dmap.Dmap, path string, keep uint, action dupview.Action, algo dfs.HashAlgorithm, style dfs.LinkStyle) (int, error) {
+	p, err := buildPlan(dMap, keep, action, algo, style)
+	if err != nil {
+		return 0, err
+	}
+	if err := plan.WriteScript(path, p, dMap.Roots()); err != nil {
+		return 0, err
+	}
+	return len(p.Steps), nil
+}
+
+// validateScriptMode returns an error if --script-out is combined with flags
+// the generated script can't honor.
+func validateScriptMode(scriptOut, planOut, applyPlan string, keep uint, noShellCommand bool, backupFile string, disposal bool, dirTrees bool) error {
+	if scriptOut == "" {
+		return nil
+	}
+	if keep == 0 {
+		return fmt.Errorf("--script-out needs --remove to say how many copies to keep")
+	}
+	if planOut != "" || applyPlan != "" {
+		return fmt.Errorf("--script-out cannot be combined with --plan-out or --apply-plan")
+	}
+	if noShellCommand {
+		return fmt.Errorf("--script-out cannot express --reflink or --dedupe; use --plan-out instead")
+	}
+	if backupFile != "" || disposal {
+		return fmt.Errorf("--script-out cannot be combined with --backup, --trash or --quarantine")
+	}
+	if dirTrees {
+		return fmt.Errorf("--script-out cannot describe directory groups from --dir-trees")
+	}
+	return nil
+}
+
+// planManifestPath returns where --apply-plan writes its restore manifest:
+// the --backup path if given, otherwise beside the plan.
+func planManifestPath(planPath, backupFile string) string {
+	if backupFile != "" {
+		return backupFile
+	}
+	return planPath + ".restore.jsonl"
+}
+
+// reportPlanResult prints the outcome of --apply-plan and reports whether
+// every step it attempted succeeded. Skipped steps are reported but aren't
+// failures.
+func reportPlanResult(out, errOut io.Writer, result dupview.PlanResult) bool {
+	for _, skipped := range result.Skipped {
+		fmt.Fprintf(errOut, "skipped %s %s: %v\n", skipped.Step.Action, skipped.Step.Path, skipped.Err)
+	}
+	for _, entry := range result.Failed {
+		fmt.Fprintf(errOut, "failed %s: %s\n", entry.Path, entry.Message)
+	}
+	for _, preview := range result.Previews {
+		for _, line := range preview.Lines() {
+			fmt.Fprintln(out, line)
+		}
+	}
+	for _, summary := range result.Summaries {
+		fmt.Fprintln(out, summary)
+	}
+	if len(result.Skipped) > 0 {
+		fmt.Fprintf(out, "Skipped %d step(s) that no longer match the plan.\n", len(result.Skipped))
+	}
+	return len(result.Failed) == 0
+}
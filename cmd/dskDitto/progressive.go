@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/dsklog"
+	"github.com/jdefrancesco/dskDitto/internal/dwalk"
+	"github.com/jdefrancesco/dskDitto/pkg/utils"
+)
+
+// Progressive hashing window schedule: 64 KiB, 1 MiB, 16 MiB, 256 MiB, then
+// 1 GiB per round until the group finishes.
+const (
+	progressiveFirstWindow = 64 * utils.KiB
+	progressiveGrowth      = 16
+	progressiveMaxWindow   = utils.GiB
+)
+
+// nextProgressiveWindow returns the window to use after window.
+func nextProgressiveWindow(window int64) int64 {
+	return min(window*progressiveGrowth, progressiveMaxWindow)
+}
+
+// progressiveResult carries one file's outcome for a hashing round.
+type progressiveResult struct {
+	hasher *dfs.ProgressiveHash
+	err    error
+}
+
+// runProgressiveHashing hashes each sample group in lockstep. Every member is
+// advanced by the same window, running digests are compared, and sub-groups
+// that fall below minGroup are dropped without reading the rest of their
+// files. With crossRootOnly set, sub-groups whose files all come from one root
+// are dropped the same way. Groups that reach the end of their files are added
+// to dMap, and files that fail to read are recorded in failures.
+// It returns the number of files fully hashed.
+func runProgressiveHashing(
+	ctx context.Context,
+	dMap *dmap.Dmap,
+	groups [][]dwalk.FileCandidate,
+	minGroup int,
+	crossRootOnly bool,
+	failures *hashFailures,
+	hashAlgo dfs.HashAlgorithm,
+	hashOptions dfs.HashOptions,
+	tickC <-chan time.Time,
+	updateProgress func(string),
+) (fullHashedFiles uint) {
+	paths := dMap.Paths()
+	candidates := make(map[*dfs.ProgressiveHash]dwalk.FileCandidate)
+	dropGroup := func(hashers []*dfs.ProgressiveHash) bool {
+		if len(hashers) < minGroup {
+			return true
+		}
+		if !crossRootOnly {
+			return false
+		}
+		group := make([]dwalk.FileCandidate, 0, len(hashers))
+		for _, hasher := range hashers {
+			group = append(group, candidates[hasher])
+		}
+		return !spansRoots(group)
+	}
+	active := make([][]*dfs.ProgressiveHash, 0, len(groups))
+	for _, group := range groups {
+		hashers := make([]*dfs.ProgressiveHash, 0, len(group))
+		for _, candidate := range group {
+			path := paths.Path(candidate.ID)
+			hasher, err := dfs.NewProgressiveHash(path, candidate.Size, hashAlgo, hashOptions)
+			if err != nil {
+				dsklog.Dlogger.Debugf("Skipping file after hash failure %s: %v", path, err)
+				failures.add(candidate.ID)
+				continue
+			}
+			candidates[hasher] = candidate
+			hashers = append(hashers, hasher)
+		}
+		if !dropGroup(hashers) {
+			active = append(active, hashers)
+		}
+	}
+
+	var dropped uint
+	window := int64(progressiveFirstWindow)
+	for len(active) > 0 {
+		var pending []*dfs.ProgressiveHash
+		for _, group := range active {
+			pending = append(pending, group...)
+		}
+		failed := advanceProgressive(ctx, pending, window, tickC, func(done int) {
+			updateProgress(fmt.Sprintf("Progressively hashing %d groups (%d/%d files, %s window)...",
+				len(active), done, len(pending), utils.DisplaySize(uint64(window))))
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		for hasher := range failed {
+			failures.add(candidates[hasher].ID)
+		}
+		next := active[:0]
+		for _, group := range active {
+			for _, sub := range splitByRunningDigest(group, failed) {
+				if dropGroup(sub) {
+					dropped += uint(len(sub))
+					continue
+				}
+				// Members share a size, so they finish in the same round.
+				if sub[0].Done() {
+					for _, hasher := range sub {
+						candidate := candidates[hasher]
+						dMap.AddID(hasher.Dfile(), candidate.ID, candidate.FileMeta)
+						fullHashedFiles++
+					}
+					continue
+				}
+				next = append(next, sub)
+			}
+		}
+		active = next
+		window = nextProgressiveWindow(window)
+	}
+
+	dsklog.Dlogger.Debugf("Progressive hashing dropped %d files before reading them in full", dropped)
+	return
+}
+
+// advanceProgressive advances every hasher by window using the full-hash
+// worker pool. It returns the set of hashers that failed and must be dropped.
+func advanceProgressive(
+	ctx context.Context,
+	pending []*dfs.ProgressiveHash,
+	window int64,
+	tickC <-chan time.Time,
+	onTick func(done int),
+) map[*dfs.ProgressiveHash]bool {
+	failed := make(map[*dfs.ProgressiveHash]bool)
+	if len(pending) == 0 {
+		return failed
+	}
+
+	jobs := make(chan *dfs.ProgressiveHash, min(len(pending), 4096))
+	results := make(chan progressiveResult, min(len(pending), 4096))
+	workerCount := hashWorkerCount(len(pending))
+
+	var wg sync.WaitGroup
+	wg.Add(workerCount)
+	for i := 0; i < workerCount; i++ {
+		go func() {
+			defer wg.Done()
+			for hasher := range jobs {
+				err := hasher.Advance(window)
+				select {
+				case <-ctx.Done():
+					return
+				case results <- progressiveResult{hasher: hasher, err: err}:
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, hasher := range pending {
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- hasher:
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	done := 0
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				return failed
+			}
+			done++
+			if res.err != nil {
+				dsklog.Dlogger.Debugf("Skipping file after hash failure %s: %v", res.hasher.FileName(), res.err)
+				failed[res.hasher] = true
+			}
+		case <-tickC:
+			onTick(done)
+		}
+	}
+}
+
+// splitByRunningDigest partitions group by running digest, omitting failed
+// hashers. Sub-groups keep the order in which their first member appeared.
+func splitByRunningDigest(group []*dfs.ProgressiveHash, failed map[*dfs.ProgressiveHash]bool) [][]*dfs.ProgressiveHash {
+	index := make(map[[32]byte]int, len(group))
+	var subs [][]*dfs.ProgressiveHash
+	for _, hasher := range group {
+		if failed[hasher] {
+			continue
+		}
+		sum := hasher.Running()
+		i, ok := index[sum]
+		if !ok {
+			i = len(subs)
+			index[sum] = i
+			subs = append(subs, nil)
+		}
+		subs[i] = append(subs[i], hasher)
+	}
+	return subs
+}
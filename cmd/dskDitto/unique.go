@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
+	"github.com/jdefrancesco/dskDitto/internal/dwalk"
+)
+
+// validateUniqueMode returns an error if --unique is combined with flags that
+// act on or reshape duplicate groups.
+func validateUniqueMode(unique, otherMatchMode bool, singleFile, backupFile, saveResults, loadResults string, keep uint, dirTrees, crossRootOnly, compareSummary bool) error {
+	if !unique {
+		return nil
+	}
+	if otherMatchMode || singleFile != "" || dirTrees || crossRootOnly {
+		return fmt.Errorf("--unique cannot be combined with --name-only, --file-shallow, --fuzzy, --file, --dir-trees or --cross-root-only")
+	}
+	if keep > 0 || backupFile != "" || saveResults != "" || loadResults != "" {
+		return fmt.Errorf("--unique only reports; it cannot be combined with --remove, --backup, --save-results or --load-results")
+	}
+	if compareSummary {
+		return fmt.Errorf("--compare-summary cannot be combined with --unique")
+	}
+	return nil
+}
+
+// uniqueCandidates returns every scanned file and the files worth hashing.
+// Files alone in their size group are unique without being read.
+func uniqueCandidates(sizeGroups map[int64][]dwalk.FileCandidate) (candidates []dwalk.FileCandidate, scanned []dpath.ID) {
+	for _, files := range sizeGroups {
+		for _, file := range files {
+			scanned = append(scanned, file.ID)
+		}
+	}
+	candidates, _ = eligibleHashCandidates(sizeGroups, 2, false, false)
+	return candidates, scanned
+}
+
+// hashFailures collects the files that could not be read while sampling or
+// hashing. It is safe for concurrent use, and a nil *hashFailures records
+// nothing.
+type hashFailures struct {
+	mu  sync.Mutex
+	ids []dpath.ID
+}
+
+func (f *hashFailures) add(id dpath.ID) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.ids = append(f.ids, id)
+	f.mu.Unlock()
+}
+
+// IDs returns the files recorded so far.
+func (f *hashFailures) IDs() []dpath.ID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]dpath.ID(nil), f.ids...)
+}
+
+// findUniqueFiles returns the sorted paths of the scanned files that share no
+// content group with another file, and separately those in failed, which
+// could not be read and so can't be called unique. Files dropped by the size
+// or sample stages never reach dMap, so they count as unique along with
+// singleton full hashes.
+func findUniqueFiles(dMap *dmap.Dmap, scanned, failed []dpath.ID) (unique, unreadable []string) {
+	copied := make(map[dpath.ID]bool)
+	for _, ids := range dMap.GroupIDs() {
+		if len(ids) < 2 {
+			continue
+		}
+		for _, id := range ids {
+			copied[id] = true
+		}
+	}
+	unread := make(map[dpath.ID]bool, len(failed))
+	for _, id := range failed {
+		unread[id] = true
+	}
+	for _, id := range scanned {
+		switch {
+		case unread[id]:
+			unreadable = append(unreadable, dMap.Path(id))
+		case !copied[id]:
+			unique = append(unique, dMap.Path(id))
+		}
+	}
+	sort.Strings(unique)
+	sort.Strings(unreadable)
+	return unique, unreadable
+}
+
+// writeUniqueFiles prints one path per line so the list can be piped into
+// other tools.
+func writeUniqueFiles(w io.Writer, paths []string) {
+	for _, path := range paths {
+		fmt.Fprintln(w, path)
+	}
+}
@@ -4,16 +4,19 @@ package bench
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"sync"
 	"testing"
 
 	"github.com/jdefrancesco/dskDitto/internal/config"
 	"github.com/jdefrancesco/dskDitto/internal/dfs"
 	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
 	"github.com/jdefrancesco/dskDitto/internal/dsklog"
 	"github.com/jdefrancesco/dskDitto/internal/dwalk"
 )
@@ -278,6 +281,120 @@ func BenchmarkDmapOperations(b *testing.B) {
 	}
 }
 
+// BenchmarkDmapContention compares hash workers funnelling results through a
+// single consumer goroutine against workers adding to the sharded Dmap
+// directly. Digests are synthetic so only the insert path is measured.
+func BenchmarkDmapContention(b *testing.B) {
+	setupBenchmark(b)
+
+	const files, groups = 1 << 16, 1 << 12
+	digests := make([]dmap.Digest, files)
+	for i := range digests {
+		digests[i] = dmap.Digest(sha256.Sum256([]byte(strconv.Itoa(i % groups))))
+	}
+
+	for _, workers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("SingleConsumer/workers=%d", workers), func(b *testing.B) {
+			for b.Loop() {
+				dMap, err := dmap.NewDmap(2)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ids := make(chan int, 4096)
+				var consumer sync.WaitGroup
+				consumer.Add(1)
+				go func() {
+					defer consumer.Done()
+					for i := range ids {
+						dMap.AddFileID(digests[i], dpath.ID(i), dmap.FileInfo{FileMeta: dfs.FileMeta{Size: 1}}) // #nosec G115 -- bounded by files
+					}
+				}()
+				feedWorkers(workers, files, func(i int) { ids <- i })
+				close(ids)
+				consumer.Wait()
+			}
+		})
+		b.Run(fmt.Sprintf("Direct/workers=%d", workers), func(b *testing.B) {
+			for b.Loop() {
+				dMap, err := dmap.NewDmap(2)
+				if err != nil {
+					b.Fatal(err)
+				}
+				feedWorkers(workers, files, func(i int) {
+					dMap.AddFileID(digests[i], dpath.ID(i), dmap.FileInfo{FileMeta: dfs.FileMeta{Size: 1}}) // #nosec G115 -- bounded by files
+				})
+			}
+		})
+	}
+}
+
+// feedWorkers splits [0, total) across workers goroutines, calling fn for
+// each index, and waits for them to finish.
+func feedWorkers(workers, total int, fn func(i int)) {
+	chunk := chunkSize(total, workers)
+	var wg sync.WaitGroup
+	for start := 0; start < total; start += chunk {
+		end := min(start+chunk, total)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkPathStoreMemory compares the heap retained by plain path strings
+// against the interned dpath.Store for a synthetic tree of 200k files spread
+// over 10k directories. The heap-bytes/path metric shows the reduction.
+func BenchmarkPathStoreMemory(b *testing.B) {
+	const dirs, filesPerDir = 10_000, 20
+
+	pathFor := func(dir, file int) string {
+		return fmt.Sprintf("/home/user/src/project_%03d/internal/package_%02d/testdata/file_%04d.dat", dir/100, dir%100, file)
+	}
+
+	b.Run("Strings", func(b *testing.B) {
+		for b.Loop() {
+			before := heapInUse()
+			paths := make([]string, 0, dirs*filesPerDir)
+			for d := range dirs {
+				for f := range filesPerDir {
+					paths = append(paths, pathFor(d, f))
+				}
+			}
+			b.ReportMetric(float64(heapInUse()-before)/float64(len(paths)), "heap-bytes/path")
+			runtime.KeepAlive(paths)
+		}
+	})
+
+	b.Run("Store", func(b *testing.B) {
+		for b.Loop() {
+			before := heapInUse()
+			store := dpath.NewStore()
+			ids := make([]dpath.ID, 0, dirs*filesPerDir)
+			for d := range dirs {
+				for f := range filesPerDir {
+					ids = append(ids, store.Add(pathFor(d, f)))
+				}
+			}
+			b.ReportMetric(float64(heapInUse()-before)/float64(len(ids)), "heap-bytes/path")
+			runtime.KeepAlive(store)
+			runtime.KeepAlive(ids)
+		}
+	})
+}
+
+// heapInUse returns live heap bytes after a full collection.
+func heapInUse() int64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc) // #nosec G115 -- heap size fits in int64
+}
+
 // runMonitorLoop is a helper that runs the monitor loop using either a fixed slice
 // of dfiles or a factory function that returns a fresh slice.
 func runMonitorLoop(b *testing.B, cached []*dfs.Dfile, factory func() []*dfs.Dfile) uint {
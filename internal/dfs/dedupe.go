@@ -0,0 +1,36 @@
+package dfs
+
+import (
+	"errors"
+)
+
+// ErrDedupeUnsupported indicates the current platform, or the filesystem
+// backing the paths, can't share extents between existing files with
+// FIDEDUPERANGE (e.g. Btrfs and XFS with reflink=1 can).
+var ErrDedupeUnsupported = errors.New("dedupe not supported on this filesystem/platform")
+
+// ErrDedupeDiffers indicates the kernel compared a range of the two files and
+// found it not byte-identical, so it refused to share it.
+var ErrDedupeDiffers = errors.New("file contents differ")
+
+// DedupeSupported reports whether this platform has the FIDEDUPERANGE ioctl
+// at all. Callers should still handle ErrDedupeUnsupported from Dedupe.
+func DedupeSupported() bool {
+	return dedupeSupported
+}
+
+// Dedupe asks the kernel to make path share target's extents. Unlike
+// ReflinkReplace nothing is replaced: the kernel locks both files, checks
+// that each range is byte-identical and only then shares it, so path keeps
+// its inode, owner, mode, timestamps and attributes, and a file that changed
+// since it was hashed is refused with ErrDedupeDiffers (wrapped). Both files
+// must have the same size. The work is split into ranges the kernel accepts
+// in one call; if a later range fails, earlier ones stay shared, which is
+// harmless because they were verified identical.
+// Returns ErrDedupeUnsupported (wrapped) if deduplication isn't possible here.
+func Dedupe(path, target string) error {
+	if path == "" || target == "" {
+		return errors.New("dedupe paths must not be empty")
+	}
+	return dedupe(path, target)
+}
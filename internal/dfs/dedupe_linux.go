@@ -0,0 +1,92 @@
+//go:build linux
+
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const dedupeSupported = true
+
+// dedupeChunk is the most dedupe asks for in a single FIDEDUPERANGE call.
+// Btrfs refuses to go past 16 MiB per call; filesystems may also dedupe less
+// than asked, which the loop in dedupe picks up.
+const dedupeChunk = 16 << 20
+
+// dedupe shares target's extents with path, one range at a time.
+func dedupe(path, target string) error {
+	src, err := os.Open(target) // #nosec G304 -- caller-controlled duplicate-group path
+	if err != nil {
+		return fmt.Errorf("open %s: %w", target, err)
+	}
+	defer func() { _ = src.Close() }()
+
+	// The kernel accepts a read-only destination from its owner or anyone
+	// allowed to write it, and leaves its mtime alone either way.
+	dst, err := os.Open(path) // #nosec G304 -- caller-controlled duplicate-group path
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer func() { _ = dst.Close() }()
+
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", target, err)
+	}
+	dstInfo, err := dst.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	if !srcInfo.Mode().IsRegular() || !dstInfo.Mode().IsRegular() {
+		return fmt.Errorf("dedupe %s -> %s: both must be regular files", path, target)
+	}
+	if srcInfo.Size() != dstInfo.Size() {
+		return fmt.Errorf("%w: %s is %d bytes, %s is %d", ErrDedupeDiffers, path, dstInfo.Size(), target, srcInfo.Size())
+	}
+	if os.SameFile(srcInfo, dstInfo) {
+		return nil
+	}
+
+	size := uint64(srcInfo.Size())
+	for offset := uint64(0); offset < size; {
+		arg := unix.FileDedupeRange{
+			Src_offset: offset,
+			Src_length: min(size-offset, dedupeChunk),
+			Info: []unix.FileDedupeRangeInfo{{
+				Dest_fd:     int64(dst.Fd()),
+				Dest_offset: offset,
+			}},
+		}
+		if err := unix.IoctlFileDedupeRange(int(src.Fd()), &arg); err != nil {
+			return dedupeError(path, target, offset, err)
+		}
+		info := arg.Info[0]
+		switch {
+		case info.Status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+			return fmt.Errorf("%w: %s and %s at offset %d", ErrDedupeDiffers, path, target, offset)
+		case info.Status < 0:
+			return dedupeError(path, target, offset, syscall.Errno(-info.Status))
+		case info.Bytes_deduped == 0:
+			return fmt.Errorf("FIDEDUPERANGE %s -> %s made no progress at offset %d", target, path, offset)
+		}
+		offset += info.Bytes_deduped
+	}
+	return nil
+}
+
+func dedupeError(path, target string, offset uint64, err error) error {
+	if isDedupeUnsupportedErrno(err) {
+		return fmt.Errorf("%w: FIDEDUPERANGE %s -> %s: %v", ErrDedupeUnsupported, target, path, err)
+	}
+	return fmt.Errorf("FIDEDUPERANGE %s -> %s at offset %d: %w", target, path, offset, err)
+}
+
+func isDedupeUnsupportedErrno(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.ENOTTY) ||
+		errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EINVAL)
+}
@@ -0,0 +1,75 @@
+//go:build linux
+
+package dfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedupeKeepsInodeAndMetadata(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.bin")
+	dup := filepath.Join(dir, "dup.bin")
+	// Span more than one dedupeChunk so the range loop runs more than once.
+	content := make([]byte, dedupeChunk+4096+17)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(target, content, 0o644); err != nil {
+		t.Fatalf("write target: %v", err)
+	}
+	if err := os.WriteFile(dup, content, 0o600); err != nil {
+		t.Fatalf("write dup: %v", err)
+	}
+	before, err := LstatMeta(dup)
+	if err != nil {
+		t.Fatalf("lstat dup: %v", err)
+	}
+
+	if err := Dedupe(dup, target); err != nil {
+		if errors.Is(err, ErrDedupeUnsupported) {
+			t.Skipf("filesystem does not support FIDEDUPERANGE: %v", err)
+		}
+		t.Fatalf("Dedupe: %v", err)
+	}
+	after, err := LstatMeta(dup)
+	if err != nil {
+		t.Fatalf("lstat dup: %v", err)
+	}
+	if after.Ino != before.Ino || after.Mode != before.Mode || after.ModTime != before.ModTime {
+		t.Fatalf("dedupe changed the duplicate: before %+v after %+v", before, after)
+	}
+}
+
+func TestDedupeRefusesDifferentFiles(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.bin")
+	dup := filepath.Join(dir, "dup.bin")
+	if err := os.WriteFile(target, []byte("original content"), 0o644); err != nil {
+		t.Fatalf("write target: %v", err)
+	}
+	if err := os.WriteFile(dup, []byte("changed"), 0o644); err != nil {
+		t.Fatalf("write dup: %v", err)
+	}
+
+	if err := Dedupe(dup, target); !errors.Is(err, ErrDedupeDiffers) {
+		t.Fatalf("expected ErrDedupeDiffers for files of different sizes, got %v", err)
+	}
+
+	if err := os.WriteFile(dup, []byte("original CONTENT"), 0o644); err != nil {
+		t.Fatalf("rewrite dup: %v", err)
+	}
+	err := Dedupe(dup, target)
+	if errors.Is(err, ErrDedupeUnsupported) {
+		t.Skipf("filesystem does not support FIDEDUPERANGE: %v", err)
+	}
+	if !errors.Is(err, ErrDedupeDiffers) {
+		t.Fatalf("expected the kernel to refuse differing content, got %v", err)
+	}
+	if data, _ := os.ReadFile(dup); string(data) != "original CONTENT" {
+		t.Fatalf("refused dedupe changed the duplicate: %q", data)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package dfs
+
+import "fmt"
+
+const dedupeSupported = false
+
+func dedupe(path, target string) error {
+	return fmt.Errorf("%w: %s -> %s", ErrDedupeUnsupported, target, path)
+}
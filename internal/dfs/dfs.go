@@ -41,11 +41,18 @@ type Dfile struct {
 	fileSize int64
 	algo     HashAlgorithm
 	fileHash [32]byte
+
+	// Bytes allocated on disk, as opposed to fileSize which is the apparent size.
+	diskSize   int64
+	sparse     bool
+	zeroFilled bool
 }
 
 type FileHashSample struct {
 	Digest          [32]byte
 	CoversWholeFile bool
+	// ZeroFilled is only meaningful when CoversWholeFile is set.
+	ZeroFilled bool
 }
 
 type HashOptions struct {
@@ -95,6 +102,16 @@ func (d *Dfile) FileSize() int64 { return d.fileSize }
 // Algorithm returns the hashing algorithm used to create this Dfile.
 func (d *Dfile) Algorithm() HashAlgorithm { return d.algo }
 
+// DiskSize returns the number of bytes allocated on disk for the file. This is
+// smaller than FileSize for sparse files.
+func (d *Dfile) DiskSize() int64 { return d.diskSize }
+
+// Sparse reports whether holes were skipped while hashing the file.
+func (d *Dfile) Sparse() bool { return d.sparse }
+
+// ZeroFilled reports whether the file is non-empty and consists entirely of zero bytes.
+func (d *Dfile) ZeroFilled() bool { return d.zeroFilled }
+
 // GetHash will return hash bytes as fixed-size array.
 func (d *Dfile) Hash() [32]byte { return d.fileHash }
 
@@ -149,10 +166,37 @@ func (d *Dfile) hashFile(options HashOptions) error {
 	if err != nil {
 		return err
 	}
+	tracker := &zeroTracker{w: h}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", d.fileName, err)
+	}
+	d.diskSize = AllocatedSize(info)
+
+	// Only files allocating fewer blocks than their apparent size can have
+	// holes, so everything else skips the extra seeks.
+	hashed := false
+	if d.diskSize < info.Size() {
+		holes, err := hashExtents(f, 0, info.Size(), tracker, bufPtr[:])
+		switch {
+		case err == nil:
+			d.sparse = holes
+			hashed = true
+		case errors.Is(err, errSparseUnsupported):
+			dsklog.Dlogger.Debugf("Sparse hashing unavailable for %s: %v", d.fileName, err)
+		default:
+			return fmt.Errorf("failed to hash sparse file %s: %w", d.fileName, err)
+		}
+	}
 
-	if _, err := io.CopyBuffer(h, f, bufPtr[:]); err != nil {
-		return fmt.Errorf("failed to copy file %s into hash buffer for processing: %w", d.fileName, err)
+	// Hide WriteTo so CopyBuffer actually uses our pooled buffer.
+	if !hashed {
+		if _, err := io.CopyBuffer(tracker, struct{ io.Reader }{f}, bufPtr[:]); err != nil {
+			return fmt.Errorf("failed to copy file %s into hash buffer for processing: %w", d.fileName, err)
+		}
 	}
+	d.zeroFilled = tracker.zeroFilled()
 
 	sum := h.Sum(nil)
 	copy(d.fileHash[:], sum)
@@ -209,6 +253,7 @@ func HashFileSampleWithOptions(path string, size int64, algo HashAlgorithm, opti
 		sum := h.Sum(nil)
 		copy(sample.Digest[:], sum)
 		sample.CoversWholeFile = n == want
+		sample.ZeroFilled = sample.CoversWholeFile && isZero(buf[:n])
 		return sample, nil
 	}
 
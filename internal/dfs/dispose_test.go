@@ -0,0 +1,60 @@
+package dfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuarantineKeepsPathStructure(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "scan", "sub", "dup.txt")
+	if err := os.MkdirAll(filepath.Dir(src), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(src, []byte("dup"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	now := time.Date(2026, 10, 18, 15, 4, 5, 0, time.Local)
+	disposal, err := QuarantineDisposal(filepath.Join(dir, "quarantine"), now)
+	if err != nil {
+		t.Fatalf("QuarantineDisposal: %v", err)
+	}
+	if disposal.Verb() != "quarantined" {
+		t.Fatalf("unexpected verb %q", disposal.Verb())
+	}
+
+	if err := disposal.Remove(src); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	want := filepath.Join(dir, "quarantine", "2026-10-18T150405", strings.TrimPrefix(src, string(filepath.Separator)))
+	data, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatalf("quarantined file missing: %v", err)
+	}
+	if string(data) != "dup" {
+		t.Fatalf("unexpected content %q", data)
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Fatalf("source should be gone, got %v", err)
+	}
+}
+
+func TestNilDisposalDeletes(t *testing.T) {
+	var disposal *Disposal
+	path := filepath.Join(t.TempDir(), "gone.txt")
+	if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := disposal.Remove(path); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("file should be deleted, got %v", err)
+	}
+	if disposal.Verb() != "deleted" {
+		t.Fatalf("unexpected verb %q", disposal.Verb())
+	}
+}
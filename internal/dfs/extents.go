@@ -0,0 +1,120 @@
+package dfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrExtentsUnavailable indicates the platform or filesystem can't report a
+// usable physical layout for a file (no FIEMAP, inline data, delayed
+// allocation, ...). Callers should treat sharing as unknown, not as absent.
+var ErrExtentsUnavailable = errors.New("extent layout unavailable")
+
+// ErrExtentsNotShared indicates two files were expected to reference the same
+// blocks on disk but don't.
+var ErrExtentsNotShared = errors.New("extents are not shared")
+
+// Extent is one mapped range of a file, as reported by FIEMAP.
+type Extent struct {
+	Logical  uint64
+	Physical uint64
+	Length   uint64
+	// Shared is set when the filesystem reports the blocks as referenced by
+	// more than one file (reflinks, snapshots, deduplicated extents).
+	Shared bool
+}
+
+// FileExtents returns the physical extent map of path, with physically and
+// logically contiguous extents merged.
+func FileExtents(path string) ([]Extent, error) {
+	f, err := openScopedReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	extents, err := fileExtents(f)
+	if err != nil {
+		return nil, fmt.Errorf("map extents of %s: %w", path, err)
+	}
+	return mergeExtents(extents), nil
+}
+
+// SharedExtentKey fingerprints the physical layout of path. Two files with
+// the same key reference exactly the same blocks on disk, so one of them
+// costs no extra space. ok is false when the file has no data or any of its
+// extents isn't flagged shared.
+func SharedExtentKey(path string) (key [32]byte, ok bool, err error) {
+	extents, err := FileExtents(path)
+	if err != nil {
+		return key, false, err
+	}
+	key, ok = sharedExtentKey(extents)
+	return key, ok, nil
+}
+
+func sharedExtentKey(extents []Extent) (key [32]byte, ok bool) {
+	if len(extents) == 0 {
+		return key, false
+	}
+	h := sha256.New()
+	var rec [24]byte
+	for _, e := range extents {
+		if !e.Shared {
+			return key, false
+		}
+		binary.LittleEndian.PutUint64(rec[0:], e.Logical)
+		binary.LittleEndian.PutUint64(rec[8:], e.Physical)
+		binary.LittleEndian.PutUint64(rec[16:], e.Length)
+		_, _ = h.Write(rec[:])
+	}
+	copy(key[:], h.Sum(nil))
+	return key, true
+}
+
+// VerifySharedExtents confirms that a and b reference the same blocks on disk.
+// It returns ErrExtentsNotShared (wrapped) when they don't, and
+// ErrExtentsUnavailable (wrapped) when the layout can't be determined.
+func VerifySharedExtents(a, b string) error {
+	extentsA, err := FileExtents(a)
+	if err != nil {
+		return err
+	}
+	extentsB, err := FileExtents(b)
+	if err != nil {
+		return err
+	}
+	// Empty or fully sparse files have no blocks to share.
+	if len(extentsA) == 0 && len(extentsB) == 0 {
+		return nil
+	}
+	keyA, okA := sharedExtentKey(extentsA)
+	keyB, okB := sharedExtentKey(extentsB)
+	if !okA || !okB || keyA != keyB {
+		return fmt.Errorf("%w: %s and %s", ErrExtentsNotShared, a, b)
+	}
+	return nil
+}
+
+// mergeExtents joins neighbouring extents that are contiguous both logically
+// and physically and agree on sharing, so layouts compare equal regardless of
+// how the filesystem chose to split them.
+func mergeExtents(extents []Extent) []Extent {
+	if len(extents) < 2 {
+		return extents
+	}
+	merged := extents[:1]
+	for _, e := range extents[1:] {
+		last := &merged[len(merged)-1]
+		if last.Shared == e.Shared &&
+			last.Logical+last.Length == e.Logical &&
+			last.Physical+last.Length == e.Physical {
+			last.Length += e.Length
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
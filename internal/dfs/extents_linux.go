@@ -0,0 +1,86 @@
+//go:build linux
+
+package dfs
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// FIEMAP ioctl definitions from linux/fiemap.h; x/sys/unix doesn't export them.
+const (
+	fsIocFiemap            = 0xC020660B // _IOWR('f', 11, struct fiemap)
+	fiemapFlagSync         = 0x1
+	fiemapExtentLast       = 0x1
+	fiemapExtentUnknown    = 0x2
+	fiemapExtentDelalloc   = 0x4
+	fiemapExtentDataInline = 0x200
+	fiemapExtentShared     = 0x2000
+	fiemapBatch            = 64
+)
+
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+type fiemapRequest struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+	extents       [fiemapBatch]fiemapExtent
+}
+
+// fileExtents walks the extent map of f with FS_IOC_FIEMAP, syncing first so
+// delayed allocations have real addresses.
+func fileExtents(f *os.File) ([]Extent, error) {
+	var extents []Extent
+	var req fiemapRequest
+	var next uint64
+	for {
+		req = fiemapRequest{
+			start:       next,
+			length:      ^uint64(0) - next,
+			flags:       fiemapFlagSync,
+			extentCount: fiemapBatch,
+		}
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&req)))
+		if errno != 0 {
+			if errors.Is(errno, unix.ENOTTY) || errors.Is(errno, unix.EOPNOTSUPP) {
+				return nil, ErrExtentsUnavailable
+			}
+			return nil, errno
+		}
+		if req.mappedExtents == 0 {
+			return extents, nil
+		}
+		for _, fe := range req.extents[:req.mappedExtents] {
+			// The physical address of these extents is meaningless or not
+			// yet assigned, so the layout can't be compared.
+			if fe.flags&(fiemapExtentUnknown|fiemapExtentDelalloc|fiemapExtentDataInline) != 0 {
+				return nil, ErrExtentsUnavailable
+			}
+			extents = append(extents, Extent{
+				Logical:  fe.logical,
+				Physical: fe.physical,
+				Length:   fe.length,
+				Shared:   fe.flags&fiemapExtentShared != 0,
+			})
+			if fe.flags&fiemapExtentLast != 0 {
+				return extents, nil
+			}
+		}
+		last := req.extents[req.mappedExtents-1]
+		next = last.logical + last.length
+	}
+}
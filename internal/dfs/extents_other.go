@@ -0,0 +1,10 @@
+//go:build !linux
+
+package dfs
+
+import "os"
+
+// fileExtents is only implemented on Linux, where FIEMAP is available.
+func fileExtents(_ *os.File) ([]Extent, error) {
+	return nil, ErrExtentsUnavailable
+}
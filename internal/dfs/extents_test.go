@@ -0,0 +1,79 @@
+package dfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeExtentsJoinsContiguousRanges(t *testing.T) {
+	extents := []Extent{
+		{Logical: 0, Physical: 4096, Length: 4096, Shared: true},
+		{Logical: 4096, Physical: 8192, Length: 4096, Shared: true},
+		{Logical: 8192, Physical: 65536, Length: 4096, Shared: true},
+		{Logical: 12288, Physical: 69632, Length: 4096},
+	}
+	got := mergeExtents(extents)
+	want := []Extent{
+		{Logical: 0, Physical: 4096, Length: 8192, Shared: true},
+		{Logical: 8192, Physical: 65536, Length: 4096, Shared: true},
+		{Logical: 12288, Physical: 69632, Length: 4096},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("mergeExtents returned %d extents, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("extent %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSharedExtentKey(t *testing.T) {
+	shared := []Extent{{Logical: 0, Physical: 4096, Length: 8192, Shared: true}}
+	same := []Extent{{Logical: 0, Physical: 4096, Length: 8192, Shared: true}}
+	elsewhere := []Extent{{Logical: 0, Physical: 1 << 20, Length: 8192, Shared: true}}
+	partial := []Extent{
+		{Logical: 0, Physical: 4096, Length: 4096, Shared: true},
+		{Logical: 4096, Physical: 1 << 20, Length: 4096},
+	}
+
+	keyA, ok := sharedExtentKey(shared)
+	if !ok {
+		t.Fatalf("fully shared layout should produce a key")
+	}
+	keyB, _ := sharedExtentKey(same)
+	if keyA != keyB {
+		t.Fatalf("identical layouts produced different keys")
+	}
+	keyC, _ := sharedExtentKey(elsewhere)
+	if keyA == keyC {
+		t.Fatalf("different physical layouts produced the same key")
+	}
+	if _, ok := sharedExtentKey(partial); ok {
+		t.Fatalf("partially shared layout should not produce a key")
+	}
+	if _, ok := sharedExtentKey(nil); ok {
+		t.Fatalf("empty layout should not produce a key")
+	}
+}
+
+func TestVerifySharedExtentsRejectsIndependentCopies(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.bin")
+	b := filepath.Join(dir, "b.bin")
+	for _, path := range []string{a, b} {
+		if err := os.WriteFile(path, []byte("independent copy"), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	err := VerifySharedExtents(a, b)
+	if errors.Is(err, ErrExtentsUnavailable) {
+		t.Skipf("extent mapping unavailable here: %v", err)
+	}
+	if !errors.Is(err, ErrExtentsNotShared) {
+		t.Fatalf("expected ErrExtentsNotShared for independent copies, got %v", err)
+	}
+}
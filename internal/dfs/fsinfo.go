@@ -170,3 +170,19 @@ func GetFileSize(file_name string) uint64 {
 	}
 	return uint64(size)
 }
+
+// GetFileUsage returns both the apparent size of a file and the bytes it
+// allocates on disk. Both are zero if the file can't be stat'd.
+func GetFileUsage(file_name string) (size, allocated uint64) {
+	if len(file_name) == 0 {
+		dsklog.Dlogger.Warn("Empty file name provided")
+		return 0, 0
+	}
+
+	info, err := os.Stat(file_name)
+	if err != nil {
+		dsklog.Dlogger.Warnf("Error calling os.Stat on %s: %v", file_name, err)
+		return 0, 0
+	}
+	return uint64(max(info.Size(), 0)), uint64(max(AllocatedSize(info), 0))
+}
@@ -0,0 +1,73 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrCrossDevice indicates a hard link was requested between files on
+// different devices, which no filesystem can provide.
+var ErrCrossDevice = errors.New("files are on different devices")
+
+// HardlinkReplace atomically replaces the file at path with a hard link to
+// target. It links target to a temporary name in the same directory as path,
+// then renames over path so a failed link never leaves path missing. Both
+// files must be regular files on the same device; ErrCrossDevice (wrapped) is
+// returned before anything is touched when they aren't. Paths already linked
+// to target are left alone. A hard link shares target's inode, so path takes
+// on target's owner, mode and extended attributes; where those differ the
+// link is still made and ErrMetadataNotPreserved (wrapped) lists them.
+func HardlinkReplace(path, target string) error {
+	pathInfo, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	targetInfo, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if !pathInfo.Mode().IsRegular() || !targetInfo.Mode().IsRegular() {
+		return fmt.Errorf("hard link %s -> %s: both must be regular files", path, target)
+	}
+	if os.SameFile(pathInfo, targetInfo) {
+		return nil
+	}
+	attrs, err := captureAttrs(path)
+	if err != nil {
+		return err
+	}
+	targetAttrs, err := captureAttrs(target)
+	if err != nil {
+		return err
+	}
+	if pathMeta, targetMeta := MetaFromFileInfo(pathInfo), MetaFromFileInfo(targetInfo); pathMeta.Dev != targetMeta.Dev {
+		return fmt.Errorf("%w: %s and %s", ErrCrossDevice, path, target)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, ".dskditto-hardlink-*")
+	if err != nil {
+		return fmt.Errorf("create temp file in %s: %w", dir, err)
+	}
+	tmpPath := tmp.Name()
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("close temp file %s: %w", tmpPath, err)
+	}
+	// os.Link requires the new name not to exist; the temp file only
+	// reserved a unique name for us.
+	if err := os.Remove(tmpPath); err != nil {
+		return fmt.Errorf("prepare temp file %s: %w", tmpPath, err)
+	}
+
+	if err := os.Link(target, tmpPath); err != nil {
+		return fmt.Errorf("hard link %s -> %s: %w", tmpPath, target, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("rename %s -> %s: %w", tmpPath, path, err)
+	}
+	return notPreserved(path, attrs.lostTo(targetAttrs, true))
+}
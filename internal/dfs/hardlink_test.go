@@ -0,0 +1,93 @@
+package dfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHardlinkReplaceLinksToTarget(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.bin")
+	dup := filepath.Join(dir, "dup.bin")
+	content := []byte("same-content-for-hardlink-test")
+	for _, path := range []string{target, dup} {
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	if err := HardlinkReplace(dup, target); err != nil {
+		t.Fatalf("HardlinkReplace: %v", err)
+	}
+	dupInfo, err := os.Lstat(dup)
+	if err != nil {
+		t.Fatalf("lstat dup: %v", err)
+	}
+	targetInfo, err := os.Lstat(target)
+	if err != nil {
+		t.Fatalf("lstat target: %v", err)
+	}
+	if !dupInfo.Mode().IsRegular() || !os.SameFile(dupInfo, targetInfo) {
+		t.Fatalf("dup should be a regular file sharing target's inode")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".dskditto-hardlink-*")); len(matches) != 0 {
+		t.Fatalf("temporary link left behind: %v", matches)
+	}
+
+	// Linking an already linked path is a no-op.
+	if err := HardlinkReplace(dup, target); err != nil {
+		t.Fatalf("HardlinkReplace on linked file: %v", err)
+	}
+}
+
+func TestHardlinkReplaceRejectsNonRegularFiles(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.bin")
+	if err := os.WriteFile(target, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write target: %v", err)
+	}
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	if err := HardlinkReplace(sub, target); err == nil {
+		t.Fatal("expected a directory to be rejected")
+	}
+	if err := HardlinkReplace(target, filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected a missing target to be rejected")
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Fatalf("target should be untouched: %v", err)
+	}
+}
+
+func TestHardlinkReplaceRefusesCrossDevice(t *testing.T) {
+	other, err := os.MkdirTemp("/dev/shm", "dskditto-hardlink-")
+	if err != nil {
+		t.Skipf("no second filesystem available: %v", err)
+	}
+	defer os.RemoveAll(other)
+
+	target := filepath.Join(t.TempDir(), "target.bin")
+	dup := filepath.Join(other, "dup.bin")
+	for _, path := range []string{target, dup} {
+		if err := os.WriteFile(path, []byte("same"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+	targetMeta, _ := LstatMeta(target)
+	dupMeta, _ := LstatMeta(dup)
+	if targetMeta.Dev == dupMeta.Dev {
+		t.Skip("temp dir and /dev/shm share a device")
+	}
+
+	if err := HardlinkReplace(dup, target); !errors.Is(err, ErrCrossDevice) {
+		t.Fatalf("HardlinkReplace across devices = %v, want ErrCrossDevice", err)
+	}
+	if got, err := os.ReadFile(dup); err != nil || string(got) != "same" {
+		t.Fatalf("dup should be untouched: %q, %v", got, err)
+	}
+}
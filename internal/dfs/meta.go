@@ -0,0 +1,61 @@
+package dfs
+
+import (
+	"os"
+	"time"
+)
+
+// FileMeta is the stat information captured for a file once, during the
+// walk, so later stages don't have to stat it again.
+type FileMeta struct {
+	Size int64
+	// DiskSize is the allocated size (st_blocks * 512), which differs from
+	// Size for sparse, compressed or inline files.
+	DiskSize int64
+	Mode     os.FileMode
+	Uid      uint32
+	Gid      uint32
+	// ModTime is the modification time in nanoseconds since the Unix epoch.
+	ModTime int64
+	Dev     uint64
+	Ino     uint64
+	Nlink   uint64
+}
+
+// Known reports whether m was filled in from a stat rather than left zero.
+func (m FileMeta) Known() bool {
+	return m.Nlink != 0 || m.ModTime != 0 || m.Mode != 0
+}
+
+// ModTimeValue returns ModTime as a time.Time.
+func (m FileMeta) ModTimeValue() time.Time {
+	return time.Unix(0, m.ModTime)
+}
+
+// MetaFromFileInfo builds a FileMeta from an lstat or stat result. Ownership,
+// identity and link count are left zero where the platform doesn't report them.
+func MetaFromFileInfo(info os.FileInfo) FileMeta {
+	meta := FileMeta{
+		Size:     info.Size(),
+		DiskSize: AllocatedSize(info),
+		Mode:     info.Mode(),
+		ModTime:  info.ModTime().UnixNano(),
+	}
+	if st, err := GetDFileStat(info); err == nil {
+		meta.Uid = st.Uid
+		meta.Gid = st.Gid
+		meta.Dev = st.Dev
+		meta.Ino = st.Inode
+		meta.Nlink = st.Nlink
+	}
+	return meta
+}
+
+// LstatMeta returns the FileMeta for path without following a final symlink.
+func LstatMeta(path string) (FileMeta, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return FileMeta{}, err
+	}
+	return MetaFromFileInfo(info), nil
+}
@@ -0,0 +1,159 @@
+package dfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrMetadataNotPreserved indicates a conversion replaced a file but could not
+// carry all of its attributes over to the replacement. The conversion itself
+// went ahead; the error lists what was lost.
+var ErrMetadataNotPreserved = errors.New("metadata not preserved")
+
+// fileAttrs is what a conversion tries to carry over from the file it
+// replaces.
+type fileAttrs struct {
+	meta   FileMeta
+	xattrs map[string][]byte
+}
+
+// captureAttrs records the owner, mode and mtime of path, and the extended
+// attributes preservedXattr selects, without following a final symlink.
+func captureAttrs(path string) (fileAttrs, error) {
+	meta, err := LstatMeta(path)
+	if err != nil {
+		return fileAttrs{}, err
+	}
+	xattrs, err := Xattrs(path)
+	if err != nil {
+		return fileAttrs{}, fmt.Errorf("read xattrs of %s: %w", path, err)
+	}
+	for name := range xattrs {
+		if !preservedXattr(name) {
+			delete(xattrs, name)
+		}
+	}
+	return fileAttrs{meta: meta, xattrs: xattrs}, nil
+}
+
+// preservedXattr reports whether conversions carry the attribute name over:
+// user and security attributes and POSIX ACLs. trusted.* needs CAP_SYS_ADMIN
+// and the other system.* attributes belong to the filesystem.
+func preservedXattr(name string) bool {
+	switch {
+	case strings.HasPrefix(name, "trusted."):
+		return false
+	case strings.HasPrefix(name, "system."):
+		return name == "system.posix_acl_access" || name == "system.posix_acl_default"
+	}
+	return true
+}
+
+// ownerKnown reports whether the platform reported an owner for the file.
+// MetaFromFileInfo fills the link count from the same stat fields.
+func (a fileAttrs) ownerKnown() bool {
+	return a.meta.Nlink != 0
+}
+
+// applyFile gives the regular file at path the recorded owner, mode,
+// extended attributes and mtime, in that order: chown may clear set-id bits,
+// and an ACL must be set after the mode it refines. It returns a description
+// of each attribute that could not be set.
+func (a fileAttrs) applyFile(path string) []string {
+	var lost []string
+	if problem := a.chown(path); problem != "" {
+		lost = append(lost, problem)
+	}
+	mode := a.meta.Mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(path, mode); err != nil {
+		lost = append(lost, fmt.Sprintf("mode %v: %v", mode, err))
+	}
+	lost = append(lost, a.setXattrs(path)...)
+	// A zero access time is left unchanged.
+	if err := os.Chtimes(path, time.Time{}, a.meta.ModTimeValue()); err != nil {
+		lost = append(lost, fmt.Sprintf("mtime: %v", err))
+	}
+	return lost
+}
+
+// applyLink gives the symlink at path the recorded owner and mtime. A
+// symlink has no mode of its own, and Linux refuses user attributes on one.
+func (a fileAttrs) applyLink(path string) []string {
+	var lost []string
+	if problem := a.chown(path); problem != "" {
+		lost = append(lost, problem)
+	}
+	if err := lutimes(path, a.meta.ModTimeValue()); err != nil {
+		lost = append(lost, fmt.Sprintf("mtime: %v", err))
+	}
+	return lost
+}
+
+// chown gives path the recorded owner unless it already has it, so callers
+// that can't chown only fail when ownership really differs.
+func (a fileAttrs) chown(path string) string {
+	if !a.ownerKnown() {
+		return ""
+	}
+	current, err := LstatMeta(path)
+	if err == nil && current.Uid == a.meta.Uid && current.Gid == a.meta.Gid {
+		return ""
+	}
+	if err := os.Lchown(path, int(a.meta.Uid), int(a.meta.Gid)); err != nil {
+		return fmt.Sprintf("owner %d:%d: %v", a.meta.Uid, a.meta.Gid, err)
+	}
+	return ""
+}
+
+func (a fileAttrs) setXattrs(path string) []string {
+	var lost []string
+	for _, name := range sortedNames(a.xattrs) {
+		if err := setXattr(path, name, a.xattrs[name]); err != nil {
+			lost = append(lost, fmt.Sprintf("xattr %s: %v", name, err))
+		}
+	}
+	return lost
+}
+
+// lostTo describes the attributes of a that a path gives up when it becomes a
+// link to target, whose inode then decides them: the owner when owner is set,
+// the permission bits and extended attributes, wherever they differ. The mtime
+// is not compared; the contents are the same and differing times are normal.
+func (a fileAttrs) lostTo(target fileAttrs, owner bool) []string {
+	var lost []string
+	if owner && a.ownerKnown() && target.ownerKnown() && (a.meta.Uid != target.meta.Uid || a.meta.Gid != target.meta.Gid) {
+		lost = append(lost, fmt.Sprintf("owner %d:%d is now %d:%d", a.meta.Uid, a.meta.Gid, target.meta.Uid, target.meta.Gid))
+	}
+	if mine, theirs := a.meta.Mode.Perm(), target.meta.Mode.Perm(); mine != theirs {
+		lost = append(lost, fmt.Sprintf("mode %v is now %v", mine, theirs))
+	}
+	for _, name := range sortedNames(a.xattrs) {
+		if !bytes.Equal(a.xattrs[name], target.xattrs[name]) {
+			lost = append(lost, fmt.Sprintf("xattr %s", name))
+		}
+	}
+	return lost
+}
+
+// notPreserved returns ErrMetadataNotPreserved (wrapped) describing lost, or
+// nil if nothing was.
+func notPreserved(path string, lost []string) error {
+	if len(lost) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w for %s: %s", ErrMetadataNotPreserved, path, strings.Join(lost, "; "))
+}
+
+func sortedNames(attrs map[string][]byte) []string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
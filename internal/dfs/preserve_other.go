@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package dfs
+
+import (
+	"errors"
+	"time"
+)
+
+func lutimes(string, time.Time) error {
+	return errors.New("setting symlink times is not supported on this platform")
+}
@@ -0,0 +1,109 @@
+package dfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreservedXattr(t *testing.T) {
+	for name, want := range map[string]bool{
+		"user.comment":             true,
+		"security.selinux":         true,
+		"system.posix_acl_access":  true,
+		"system.posix_acl_default": true,
+		"system.nfs4_acl":          false,
+		"trusted.overlay.opaque":   false,
+		"com.apple.quarantine":     true,
+	} {
+		if got := preservedXattr(name); got != want {
+			t.Errorf("preservedXattr(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestApplyFileRestoresModeAndMtime(t *testing.T) {
+	dir := t.TempDir()
+	orig := filepath.Join(dir, "orig.bin")
+	clone := filepath.Join(dir, "clone.bin")
+	if err := os.WriteFile(orig, []byte("data"), 0o640); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(clone, []byte("data"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	mtime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	if err := os.Chtimes(orig, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	attrs, err := captureAttrs(orig)
+	if err != nil {
+		t.Fatalf("captureAttrs: %v", err)
+	}
+	if lost := attrs.applyFile(clone); len(lost) != 0 {
+		t.Fatalf("applyFile lost %v", lost)
+	}
+	info, err := os.Lstat(clone)
+	if err != nil {
+		t.Fatalf("lstat: %v", err)
+	}
+	if info.Mode().Perm() != 0o640 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("metadata not applied: mode %v mtime %v", info.Mode().Perm(), info.ModTime())
+	}
+}
+
+func TestHardlinkReplaceReportsModeTakenFromTarget(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.bin")
+	dup := filepath.Join(dir, "dup.bin")
+	if err := os.WriteFile(target, []byte("same"), 0o644); err != nil {
+		t.Fatalf("write target: %v", err)
+	}
+	if err := os.WriteFile(dup, []byte("same"), 0o600); err != nil {
+		t.Fatalf("write dup: %v", err)
+	}
+
+	err := HardlinkReplace(dup, target)
+	if !errors.Is(err, ErrMetadataNotPreserved) || !strings.Contains(err.Error(), "mode -rw------- is now -rw-r--r--") {
+		t.Fatalf("expected the lost mode to be reported, got %v", err)
+	}
+	dupInfo, _ := os.Lstat(dup)
+	targetInfo, _ := os.Lstat(target)
+	if !os.SameFile(dupInfo, targetInfo) {
+		t.Fatalf("dup should still be linked despite the lost mode")
+	}
+}
+
+func TestSymlinkReplaceKeepsLinkMtime(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.bin")
+	dup := filepath.Join(dir, "dup.bin")
+	for _, path := range []string{target, dup} {
+		if err := os.WriteFile(path, []byte("same"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+	mtime := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(dup, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	err := SymlinkReplace(dup, target, LinkAbsolute)
+	if err != nil && strings.Contains(err.Error(), "mtime") {
+		t.Skipf("platform can't set symlink times: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("SymlinkReplace: %v", err)
+	}
+	info, err := os.Lstat(dup)
+	if err != nil {
+		t.Fatalf("lstat: %v", err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("expected a symlink with the duplicate's mtime, got mode %v mtime %v", info.Mode(), info.ModTime())
+	}
+}
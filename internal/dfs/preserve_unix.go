@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package dfs
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lutimes sets both times of path, without following a final symlink, to
+// mtime.
+func lutimes(path string, mtime time.Time) error {
+	tv := unix.NsecToTimeval(mtime.UnixNano())
+	return unix.Lutimes(path, []unix.Timeval{tv, tv})
+}
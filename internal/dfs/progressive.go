@@ -0,0 +1,115 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"path/filepath"
+
+	"github.com/jdefrancesco/dskDitto/internal/dsklog"
+)
+
+// ProgressiveHash hashes a file one window at a time so callers can compare
+// running digests across same-sized candidates and stop reading as soon as
+// they diverge. No descriptor is held between windows, so very large groups
+// don't pin open files.
+type ProgressiveHash struct {
+	dfile   *Dfile
+	h       hash.Hash
+	tracker *zeroTracker
+	offset  int64
+	options HashOptions
+}
+
+// NewProgressiveHash prepares a progressive hash of fName. Nothing is read
+// until Advance is called.
+func NewProgressiveHash(fName string, fSize int64, algo HashAlgorithm, options HashOptions) (*ProgressiveHash, error) {
+	if fName == "" {
+		return nil, errors.New("file name needs to be specified")
+	}
+	fullFileName, err := filepath.Abs(fName)
+	if err != nil {
+		return nil, err
+	}
+	h, err := newHash(algo)
+	if err != nil {
+		return nil, err
+	}
+	return &ProgressiveHash{
+		dfile: &Dfile{
+			fileName: fullFileName,
+			fileSize: fSize,
+			algo:     algo,
+		},
+		h:       h,
+		tracker: &zeroTracker{w: h},
+		options: options,
+	}, nil
+}
+
+// Advance hashes up to window more bytes, stopping at the file size recorded
+// at construction time.
+func (p *ProgressiveHash) Advance(window int64) error {
+	if p.Done() || window <= 0 {
+		return nil
+	}
+	end := min(p.offset+window, p.dfile.fileSize)
+
+	sema <- struct{}{}
+	defer func() { <-sema }()
+
+	bufPtr := bufPool.Get().(*[1 << 20]byte)
+	defer bufPool.Put(bufPtr)
+
+	f, err := openScopedReadFile(p.dfile.fileName)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", p.dfile.fileName, err)
+	}
+	defer f.Close()
+	if p.options.NoCache {
+		if err := setNoCacheFD(f.Fd()); err != nil {
+			dsklog.Dlogger.Debugf("Failed to enable no-cache for %s: %v", p.dfile.fileName, err)
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", p.dfile.fileName, err)
+	}
+	if info.Size() != p.dfile.fileSize {
+		return fmt.Errorf("file %s changed size during hashing", p.dfile.fileName)
+	}
+	p.dfile.diskSize = AllocatedSize(info)
+
+	holes, err := copyRange(f, p.offset, end, p.tracker, bufPtr[:], p.dfile.diskSize < info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to hash %s at offset %d: %w", p.dfile.fileName, p.offset, err)
+	}
+	p.dfile.sparse = p.dfile.sparse || holes
+	p.offset = end
+	return nil
+}
+
+// Offset returns how many bytes have been hashed so far.
+func (p *ProgressiveHash) Offset() int64 { return p.offset }
+
+// Done reports whether the whole file has been hashed.
+func (p *ProgressiveHash) Done() bool { return p.offset >= p.dfile.fileSize }
+
+// FileName returns the absolute path being hashed.
+func (p *ProgressiveHash) FileName() string { return p.dfile.fileName }
+
+// Running returns the digest of the bytes hashed so far. Two files of equal
+// size that have been advanced by the same windows can be compared directly.
+func (p *ProgressiveHash) Running() [32]byte {
+	var sum [32]byte
+	copy(sum[:], p.h.Sum(nil))
+	return sum
+}
+
+// Dfile returns the finished Dfile. It is only valid once Done reports true.
+func (p *ProgressiveHash) Dfile() *Dfile {
+	p.dfile.fileHash = p.Running()
+	p.dfile.zeroFilled = p.tracker.zeroFilled()
+	return p.dfile
+}
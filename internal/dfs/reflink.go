@@ -33,8 +33,20 @@ func Reflink(dst, src string) error {
 // ReflinkReplace atomically replaces the file at path with a copy-on-write
 // clone of target. It clones into a temporary file in the same directory as
 // path, then renames over path so a failed clone never leaves path missing.
+// Before the rename the clone is checked with VerifySharedExtents; if the
+// filesystem reports that no blocks are actually shared the clone is discarded
+// and ErrExtentsNotShared (wrapped) is returned. Platforms that can't report
+// extents skip the check.
+// The clone is given path's owner, mode, mtime, and user and security
+// extended attributes and POSIX ACLs before the rename; if any of them can't
+// be set the clone still replaces path and ErrMetadataNotPreserved (wrapped)
+// lists what was lost.
 // Returns ErrReflinkUnsupported (wrapped) if cloning isn't possible here.
 func ReflinkReplace(path, target string) error {
+	attrs, err := captureAttrs(path)
+	if err != nil {
+		return err
+	}
 	dir := filepath.Dir(path)
 	tmp, err := os.CreateTemp(dir, ".dskditto-reflink-*")
 	if err != nil {
@@ -54,9 +66,14 @@ func ReflinkReplace(path, target string) error {
 	if err := Reflink(tmpPath, target); err != nil {
 		return err
 	}
+	if err := VerifySharedExtents(tmpPath, target); err != nil && !errors.Is(err, ErrExtentsUnavailable) {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("verify reflink %s -> %s: %w", path, target, err)
+	}
+	lost := attrs.applyFile(tmpPath)
 	if err := os.Rename(tmpPath, path); err != nil {
 		_ = os.Remove(tmpPath)
 		return fmt.Errorf("rename %s -> %s: %w", tmpPath, path, err)
 	}
-	return nil
+	return notPreserved(path, lost)
 }
@@ -0,0 +1,166 @@
+package dfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// statBlockSize is the unit st_blocks is reported in on every platform we
+// support, regardless of the filesystem's preferred I/O block size.
+const statBlockSize = 512
+
+// errSparseUnsupported is returned by seekData when the platform or
+// filesystem cannot report data/hole boundaries.
+var errSparseUnsupported = errors.New("sparse file seeking not supported")
+
+// errNoMoreData signals that no data exists at or after the requested offset,
+// i.e. the remainder of the file is a trailing hole.
+var errNoMoreData = errors.New("no data after offset")
+
+// zeroBlock is a shared all-zero buffer. It is fed into the hash in place of
+// holes and used to test whether data read from disk is entirely zero.
+var zeroBlock [64 * 1024]byte
+
+// AllocatedSize returns the number of bytes actually allocated on disk for
+// info. Sparse and compressed files can allocate far less than their apparent
+// size. Falls back to the apparent size when the platform doesn't report
+// block counts.
+func AllocatedSize(info os.FileInfo) int64 {
+	stat, err := GetDFileStat(info)
+	if err != nil {
+		return info.Size()
+	}
+	return stat.Blocks * statBlockSize
+}
+
+// zeroTracker forwards writes to a hash while remembering whether any
+// non-zero byte has gone past, so a single read pass both hashes a file and
+// tells us if it was all zeros.
+type zeroTracker struct {
+	w       io.Writer
+	written int64
+	nonZero bool
+}
+
+func (z *zeroTracker) Write(p []byte) (int, error) {
+	if !z.nonZero && !isZero(p) {
+		z.nonZero = true
+	}
+	n, err := z.w.Write(p)
+	z.written += int64(n)
+	return n, err
+}
+
+// zeroFilled reports whether at least one byte was written and all of them
+// were zero.
+func (z *zeroTracker) zeroFilled() bool {
+	return z.written > 0 && !z.nonZero
+}
+
+// isZero reports whether every byte in p is zero.
+func isZero(p []byte) bool {
+	for len(p) > 0 {
+		n := min(len(p), len(zeroBlock))
+		if !bytes.Equal(p[:n], zeroBlock[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
+
+// writeZeros feeds n zero bytes into w. Used to stand in for holes so sparse
+// and fully allocated copies of the same content hash identically.
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		chunk := min(n, int64(len(zeroBlock)))
+		if _, err := w.Write(zeroBlock[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// hashExtents streams bytes [start, end) of f into w, reading only the data
+// extents reported by SEEK_DATA/SEEK_HOLE and synthesising zeros for holes
+// rather than asking the filesystem to materialise them. It reports whether
+// any hole was skipped. If the first seek fails because the platform or
+// filesystem can't report extents, errSparseUnsupported is returned before
+// anything has been written so the caller can fall back to a plain read.
+func hashExtents(f *os.File, start, end int64, w io.Writer, buf []byte) (bool, error) {
+	var holes bool
+	off := start
+	for off < end {
+		data, err := seekData(f, off)
+		switch {
+		case errors.Is(err, errNoMoreData):
+			data = end
+		case err != nil && off == start:
+			return false, fmt.Errorf("%w: %v", errSparseUnsupported, err)
+		case err != nil:
+			return holes, err
+		}
+		data = min(data, end)
+
+		if data > off {
+			holes = true
+			if err := writeZeros(w, data-off); err != nil {
+				return holes, err
+			}
+		}
+		if data >= end {
+			break
+		}
+
+		hole, err := seekHole(f, data)
+		if err != nil {
+			return holes, err
+		}
+		hole = min(hole, end)
+
+		if err := readRange(f, data, hole, w, buf); err != nil {
+			return holes, err
+		}
+		off = hole
+	}
+	return holes, nil
+}
+
+// readRange streams bytes [start, end) of f into w using positional reads.
+func readRange(f *os.File, start, end int64, w io.Writer, buf []byte) error {
+	for pos := start; pos < end; {
+		want := min(int64(len(buf)), end-pos)
+		n, err := f.ReadAt(buf[:want], pos)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			pos += int64(n)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// File shrank underneath us.
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRange streams bytes [start, end) of f into w. When sparse is set it
+// first tries to skip holes with hashExtents and falls back to a plain read
+// if extents can't be queried. It reports whether any hole was skipped.
+func copyRange(f *os.File, start, end int64, w io.Writer, buf []byte, sparse bool) (bool, error) {
+	if sparse {
+		holes, err := hashExtents(f, start, end, w, buf)
+		if !errors.Is(err, errSparseUnsupported) {
+			return holes, err
+		}
+	}
+	return false, readRange(f, start, end, w, buf)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package dfs
+
+import "os"
+
+func seekData(_ *os.File, _ int64) (int64, error) {
+	return 0, errSparseUnsupported
+}
+
+func seekHole(_ *os.File, _ int64) (int64, error) {
+	return 0, errSparseUnsupported
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd
+
+package dfs
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// seekData returns the offset of the first data byte at or after off.
+func seekData(f *os.File, off int64) (int64, error) {
+	pos, err := f.Seek(off, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		return 0, errNoMoreData
+	}
+	return pos, err
+}
+
+// seekHole returns the offset of the first hole at or after off. The end of
+// the file always counts as a hole.
+func seekHole(f *os.File, off int64) (int64, error) {
+	return f.Seek(off, unix.SEEK_HOLE)
+}
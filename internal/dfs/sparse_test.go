@@ -0,0 +1,216 @@
+package dfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSparseFileHashesLikeDenseCopy(t *testing.T) {
+	dir := t.TempDir()
+	const size = 8 << 20
+	payload := bytes.Repeat([]byte("ditto"), 1024)
+
+	sparsePath := filepath.Join(dir, "sparse.bin")
+	f, err := os.Create(sparsePath)
+	if err != nil {
+		t.Fatalf("failed to create sparse file: %v", err)
+	}
+	if _, err := f.WriteAt(payload, 4<<20); err != nil {
+		t.Fatalf("failed to write sparse payload: %v", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("failed to extend sparse file: %v", err)
+	}
+	_ = f.Close()
+
+	dense := make([]byte, size)
+	copy(dense[4<<20:], payload)
+	densePath := filepath.Join(dir, "dense.bin")
+	if err := os.WriteFile(densePath, dense, 0o644); err != nil {
+		t.Fatalf("failed to write dense file: %v", err)
+	}
+
+	sparseDfile, err := NewDfile(sparsePath, size, HashSHA256)
+	if err != nil {
+		t.Fatalf("NewDfile(sparse) failed: %v", err)
+	}
+	denseDfile, err := NewDfile(densePath, size, HashSHA256)
+	if err != nil {
+		t.Fatalf("NewDfile(dense) failed: %v", err)
+	}
+
+	if want := sha256.Sum256(dense); sparseDfile.Hash() != want {
+		t.Fatalf("sparse file hash doesn't match its logical content")
+	}
+	if sparseDfile.Hash() != denseDfile.Hash() {
+		t.Fatalf("sparse and dense copies hashed differently")
+	}
+	if sparseDfile.ZeroFilled() || denseDfile.ZeroFilled() {
+		t.Fatalf("files with a payload reported as zero-filled")
+	}
+	if denseDfile.Sparse() {
+		t.Fatalf("dense file reported as sparse")
+	}
+	if sparseDfile.DiskSize() >= size {
+		t.Skipf("filesystem allocated %d bytes for sparse file; holes unsupported", sparseDfile.DiskSize())
+	}
+	if !sparseDfile.Sparse() {
+		t.Fatalf("sparse file not flagged as sparse")
+	}
+}
+
+func TestZeroFilledDetection(t *testing.T) {
+	dir := t.TempDir()
+
+	holePath := filepath.Join(dir, "hole.bin")
+	if err := os.WriteFile(holePath, nil, 0o644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if err := os.Truncate(holePath, 1<<20); err != nil {
+		t.Fatalf("failed to extend file: %v", err)
+	}
+
+	zeroPath := filepath.Join(dir, "zeros.bin")
+	if err := os.WriteFile(zeroPath, make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatalf("failed to write zero file: %v", err)
+	}
+
+	dataPath := filepath.Join(dir, "data.bin")
+	data := make([]byte, 1<<20)
+	data[len(data)-1] = 1
+	if err := os.WriteFile(dataPath, data, 0o644); err != nil {
+		t.Fatalf("failed to write data file: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{holePath, true},
+		{zeroPath, true},
+		{dataPath, false},
+	}
+	for _, test := range tests {
+		df, err := NewDfile(test.path, 1<<20, HashSHA256)
+		if err != nil {
+			t.Fatalf("NewDfile(%s) failed: %v", test.path, err)
+		}
+		if df.ZeroFilled() != test.want {
+			t.Errorf("ZeroFilled(%s) = %v, want %v", filepath.Base(test.path), df.ZeroFilled(), test.want)
+		}
+	}
+
+	hole, err := NewDfile(holePath, 1<<20, HashSHA256)
+	if err != nil {
+		t.Fatalf("NewDfile(hole) failed: %v", err)
+	}
+	zeros, err := NewDfile(zeroPath, 1<<20, HashSHA256)
+	if err != nil {
+		t.Fatalf("NewDfile(zeros) failed: %v", err)
+	}
+	if hole.Hash() != zeros.Hash() {
+		t.Fatalf("all-hole file and written zeros hashed differently")
+	}
+}
+
+func TestHashFileSampleZeroFilled(t *testing.T) {
+	dir := t.TempDir()
+	zeroPath := filepath.Join(dir, "zeros.bin")
+	if err := os.WriteFile(zeroPath, make([]byte, 128), 0o644); err != nil {
+		t.Fatalf("failed to write zero file: %v", err)
+	}
+	textPath := filepath.Join(dir, "text.bin")
+	if err := os.WriteFile(textPath, []byte("ditto"), 0o644); err != nil {
+		t.Fatalf("failed to write text file: %v", err)
+	}
+
+	sample, err := HashFileSample(zeroPath, 128, HashSHA256)
+	if err != nil {
+		t.Fatalf("HashFileSample failed: %v", err)
+	}
+	if !sample.CoversWholeFile || !sample.ZeroFilled {
+		t.Fatalf("small zero file sample = %+v, want whole-file zero-filled", sample)
+	}
+
+	sample, err = HashFileSample(textPath, 5, HashSHA256)
+	if err != nil {
+		t.Fatalf("HashFileSample failed: %v", err)
+	}
+	if sample.ZeroFilled {
+		t.Fatalf("text file sample reported as zero-filled")
+	}
+}
+
+func TestProgressiveHashMatchesFullHash(t *testing.T) {
+	dir := t.TempDir()
+	const size = 3<<20 + 123
+	data := bytes.Repeat([]byte("progressive"), size/len("progressive")+1)[:size]
+	pathA := filepath.Join(dir, "a.bin")
+	if err := os.WriteFile(pathA, data, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	diverged := append([]byte(nil), data...)
+	diverged[2<<20] ^= 0xff
+	pathB := filepath.Join(dir, "b.bin")
+	if err := os.WriteFile(pathB, diverged, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	a, err := NewProgressiveHash(pathA, size, HashSHA256, HashOptions{})
+	if err != nil {
+		t.Fatalf("NewProgressiveHash failed: %v", err)
+	}
+	b, err := NewProgressiveHash(pathB, size, HashSHA256, HashOptions{})
+	if err != nil {
+		t.Fatalf("NewProgressiveHash failed: %v", err)
+	}
+
+	for _, window := range []int64{64 << 10, 1 << 20} {
+		if err := a.Advance(window); err != nil {
+			t.Fatalf("Advance(a) failed: %v", err)
+		}
+		if err := b.Advance(window); err != nil {
+			t.Fatalf("Advance(b) failed: %v", err)
+		}
+		if a.Running() != b.Running() {
+			t.Fatalf("running digests differ before the divergence point at offset %d", a.Offset())
+		}
+	}
+	if err := a.Advance(16 << 20); err != nil {
+		t.Fatalf("Advance(a) failed: %v", err)
+	}
+	if err := b.Advance(16 << 20); err != nil {
+		t.Fatalf("Advance(b) failed: %v", err)
+	}
+	if !a.Done() || a.Offset() != size {
+		t.Fatalf("expected a to be fully hashed, offset %d", a.Offset())
+	}
+	if a.Running() == b.Running() {
+		t.Fatalf("running digests should differ after the divergence point")
+	}
+
+	full, err := NewDfile(pathA, size, HashSHA256)
+	if err != nil {
+		t.Fatalf("NewDfile failed: %v", err)
+	}
+	if a.Dfile().Hash() != full.Hash() {
+		t.Fatalf("progressive digest differs from full-file digest")
+	}
+}
+
+func TestProgressiveHashRejectsChangedSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grow.bin")
+	if err := os.WriteFile(path, []byte("short"), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	p, err := NewProgressiveHash(path, 100, HashSHA256, HashOptions{})
+	if err != nil {
+		t.Fatalf("NewProgressiveHash failed: %v", err)
+	}
+	if err := p.Advance(64 << 10); err == nil {
+		t.Fatalf("expected size change to be reported")
+	}
+}
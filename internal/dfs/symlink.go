@@ -0,0 +1,173 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LinkStyle chooses how symlinks created by the link actions name their
+// target.
+type LinkStyle string
+
+const (
+	// LinkAbsolute points links at the target's absolute path.
+	LinkAbsolute LinkStyle = "absolute"
+	// LinkRelative points links at the shortest relative path from the
+	// link's directory to the target, so trees survive being moved,
+	// remounted or synced as a whole.
+	LinkRelative LinkStyle = "relative"
+)
+
+// ErrLinkMismatch indicates a newly created symlink did not resolve to its
+// intended target.
+var ErrLinkMismatch = errors.New("symlink does not resolve to its target")
+
+// ParseLinkStyle parses "absolute" or "relative". The empty string means
+// LinkAbsolute.
+func ParseLinkStyle(s string) (LinkStyle, error) {
+	switch style := LinkStyle(s); style {
+	case "", LinkAbsolute:
+		return LinkAbsolute, nil
+	case LinkRelative:
+		return style, nil
+	}
+	return "", fmt.Errorf("unknown link style %q (want absolute or relative)", s)
+}
+
+// SymlinkText returns what a symlink at path pointing at target should
+// contain in the given style. Relative links are computed between the real
+// locations of path's directory and target, so symlinked parents don't throw
+// them off.
+func SymlinkText(path, target string, style LinkStyle) (string, error) {
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	if style != LinkRelative {
+		return absTarget, nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	realTarget, err := filepath.EvalSymlinks(absTarget)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(dir, realTarget)
+}
+
+// SymlinkReplace replaces path, a file or directory, with a symlink to
+// target written in the given style. The link is created under a temporary
+// name beside path and checked to resolve to target before anything is
+// removed; a link that doesn't is discarded with ErrLinkMismatch (wrapped)
+// and path is left untouched. Files are then swapped in with a single
+// rename; directories are renamed aside first and removed only once the link
+// is in place (see swapDirForLink). The link gets path's owner and
+// mtime. Access through it is decided by target, so where path's mode or
+// extended attributes differ from target's the link is still made and
+// ErrMetadataNotPreserved (wrapped) lists them.
+func SymlinkReplace(path, target string, style LinkStyle) error {
+	attrs, err := captureAttrs(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	targetAttrs, err := captureAttrs(target)
+	if err != nil {
+		return err
+	}
+	text, err := SymlinkText(path, target, style)
+	if err != nil {
+		return fmt.Errorf("symlink %s -> %s: %w", path, target, err)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, ".dskditto-symlink-*")
+	if err != nil {
+		return fmt.Errorf("create temp file in %s: %w", dir, err)
+	}
+	tmpPath := tmp.Name()
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("close temp file %s: %w", tmpPath, err)
+	}
+	// os.Symlink requires the new name not to exist; the temp file only
+	// reserved a unique name for us.
+	if err := os.Remove(tmpPath); err != nil {
+		return fmt.Errorf("prepare temp file %s: %w", tmpPath, err)
+	}
+	if err := os.Symlink(text, tmpPath); err != nil {
+		return fmt.Errorf("symlink %s -> %s: %w", tmpPath, text, err)
+	}
+	if err := checkResolves(tmpPath, target); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	lost := attrs.applyLink(tmpPath)
+
+	if info.IsDir() {
+		if err := swapDirForLink(path, tmpPath); err != nil {
+			return err
+		}
+	} else if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("rename %s -> %s: %w", tmpPath, path, err)
+	}
+	return notPreserved(path, append(lost, attrs.lostTo(targetAttrs, false)...))
+}
+
+// swapDirForLink puts the symlink at link in place of the directory path.
+// The directory is first renamed aside within its parent and only removed
+// once the link is in place; if the link can't be renamed in, the directory
+// is renamed back and the link discarded.
+func swapDirForLink(path, link string) error {
+	parent := filepath.Dir(path)
+	aside, err := os.MkdirTemp(parent, ".dskditto-aside-*")
+	if err != nil {
+		_ = os.Remove(link)
+		return fmt.Errorf("create temp dir in %s: %w", parent, err)
+	}
+	// MkdirTemp only reserved a unique name for us.
+	if err := os.Remove(aside); err != nil {
+		_ = os.Remove(link)
+		return fmt.Errorf("prepare temp dir %s: %w", aside, err)
+	}
+	if err := os.Rename(path, aside); err != nil {
+		_ = os.Remove(link)
+		return fmt.Errorf("rename %s -> %s: %w", path, aside, err)
+	}
+	if err := os.Rename(link, path); err != nil {
+		_ = os.Remove(link)
+		if restoreErr := os.Rename(aside, path); restoreErr != nil {
+			return fmt.Errorf("rename %s -> %s: %w (directory left at %s: %v)", link, path, err, aside, restoreErr)
+		}
+		return fmt.Errorf("rename %s -> %s: %w", link, path, err)
+	}
+	if err := os.RemoveAll(aside); err != nil {
+		return fmt.Errorf("remove replaced directory %s: %w", aside, err)
+	}
+	return nil
+}
+
+// checkResolves returns ErrLinkMismatch (wrapped) unless the symlink link
+// leads to the same file as target.
+func checkResolves(link, target string) error {
+	linkInfo, err := os.Stat(link)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrLinkMismatch, link, err)
+	}
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(linkInfo, targetInfo) {
+		return fmt.Errorf("%w: %s does not lead to %s", ErrLinkMismatch, link, target)
+	}
+	return nil
+}
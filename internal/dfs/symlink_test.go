@@ -0,0 +1,126 @@
+package dfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSymlinkReplaceRelative(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "keep", "file.txt")
+	dup := filepath.Join(dir, "dups", "nested", "file.txt")
+	for _, path := range []string{target, dup} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("same"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	if err := SymlinkReplace(dup, target, LinkRelative); err != nil {
+		t.Fatalf("SymlinkReplace: %v", err)
+	}
+	text, err := os.Readlink(dup)
+	if err != nil {
+		t.Fatalf("readlink: %v", err)
+	}
+	if want := filepath.Join("..", "..", "keep", "file.txt"); text != want {
+		t.Fatalf("link text %q, want %q", text, want)
+	}
+
+	// The link keeps working after the whole tree moves.
+	moved := filepath.Join(t.TempDir(), "moved")
+	if err := os.Rename(dir, moved); err != nil {
+		t.Fatalf("rename tree: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(moved, "dups", "nested", "file.txt"))
+	if err != nil || string(data) != "same" {
+		t.Fatalf("moved link should still resolve: %q, %v", data, err)
+	}
+}
+
+func TestSymlinkReplaceAbsoluteDirectory(t *testing.T) {
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "keep")
+	dup := filepath.Join(dir, "dup")
+	for _, d := range []string{keep, dup} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(d, "a.txt"), []byte("a"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	if err := SymlinkReplace(dup, keep, LinkAbsolute); err != nil {
+		t.Fatalf("SymlinkReplace: %v", err)
+	}
+	text, err := os.Readlink(dup)
+	if err != nil {
+		t.Fatalf("readlink: %v", err)
+	}
+	if text != keep {
+		t.Fatalf("link text %q, want %q", text, keep)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".dskditto-*")); len(matches) != 0 {
+		t.Fatalf("temporary link or directory left behind: %v", matches)
+	}
+}
+
+func TestSwapDirForLinkRestoresDirectoryOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	dup := filepath.Join(dir, "dup")
+	if err := os.MkdirAll(dup, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dup, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// A link that doesn't exist can't be renamed into place.
+	if err := swapDirForLink(dup, filepath.Join(dir, "missing-link")); err == nil {
+		t.Fatal("expected the swap to fail")
+	}
+	if data, err := os.ReadFile(filepath.Join(dup, "a.txt")); err != nil || string(data) != "a" {
+		t.Fatalf("directory not restored: %q, %v", data, err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".dskditto-*")); len(matches) != 0 {
+		t.Fatalf("temporary directory left behind: %v", matches)
+	}
+}
+
+func TestCheckResolvesRejectsWrongTarget(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	other := filepath.Join(dir, "other")
+	for _, path := range []string{target, other} {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(other, link); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := checkResolves(link, target); !errors.Is(err, ErrLinkMismatch) {
+		t.Fatalf("expected ErrLinkMismatch, got %v", err)
+	}
+	if err := checkResolves(link, other); err != nil {
+		t.Fatalf("link to other should resolve: %v", err)
+	}
+}
+
+func TestParseLinkStyle(t *testing.T) {
+	for in, want := range map[string]LinkStyle{"": LinkAbsolute, "absolute": LinkAbsolute, "relative": LinkRelative} {
+		got, err := ParseLinkStyle(in)
+		if err != nil || got != want {
+			t.Fatalf("ParseLinkStyle(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseLinkStyle("sideways"); err == nil {
+		t.Fatal("expected error for unknown style")
+	}
+}
@@ -0,0 +1,175 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTrashUnsupported is returned by MoveToTrash on platforms without user
+// IDs, where the freedesktop Trash layout can't be followed.
+var ErrTrashUnsupported = errors.New("trash is not supported on this platform")
+
+// trashInfoTime is the DeletionDate layout required by the freedesktop Trash
+// specification.
+const trashInfoTime = "2006-01-02T15:04:05"
+
+// MoveToTrash moves path, a file or directory, into the freedesktop.org
+// Trash and returns its new location. Paths on the same device as the home
+// trash ($XDG_DATA_HOME/Trash) go there; others go to the trash at the top of
+// their mount, $topdir/.Trash/$uid when an administrator created a sticky
+// $topdir/.Trash, or $topdir/.Trash-$uid otherwise. A .trashinfo file
+// recording the original path and deletion date is written first so file
+// managers can restore the entry.
+func MoveToTrash(path string) (string, error) {
+	uid := os.Getuid()
+	if uid < 0 {
+		return "", ErrTrashUnsupported
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	// Resolve the parent so the mount walk sees real directories, but
+	// trash the entry itself even if it is a symlink.
+	parent, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	abs = filepath.Join(parent, filepath.Base(abs))
+	info, err := os.Lstat(abs)
+	if err != nil {
+		return "", err
+	}
+	dev := MetaFromFileInfo(info).Dev
+
+	trashDir, infoPath, err := trashFor(abs, dev, uid)
+	if err != nil {
+		return "", err
+	}
+	return trashInto(trashDir, abs, infoPath, time.Now())
+}
+
+// trashFor returns the trash directory for abs on device dev and the path to
+// record in its .trashinfo file: absolute for the home trash, relative to the
+// mount top for the others.
+func trashFor(abs string, dev uint64, uid int) (string, string, error) {
+	home, err := homeTrash()
+	if err != nil {
+		return "", "", err
+	}
+	if homeDev, err := nearestDev(home); err == nil && homeDev == dev {
+		return home, abs, nil
+	}
+
+	top := mountTop(filepath.Dir(abs), dev)
+	rel, err := filepath.Rel(top, abs)
+	if err != nil {
+		return "", "", err
+	}
+	shared := filepath.Join(top, ".Trash")
+	if info, err := os.Lstat(shared); err == nil && info.IsDir() && info.Mode()&os.ModeSticky != 0 {
+		return filepath.Join(shared, strconv.Itoa(uid)), rel, nil
+	}
+	return filepath.Join(top, ".Trash-"+strconv.Itoa(uid)), rel, nil
+}
+
+// homeTrash returns $XDG_DATA_HOME/Trash, defaulting XDG_DATA_HOME to
+// ~/.local/share.
+func homeTrash() (string, error) {
+	if data := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(data) {
+		return filepath.Join(data, "Trash"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("locate home trash: %w", err)
+	}
+	return filepath.Join(home, ".local", "share", "Trash"), nil
+}
+
+// nearestDev returns the device of path or, when it doesn't exist yet, of
+// its nearest existing parent.
+func nearestDev(path string) (uint64, error) {
+	for {
+		info, err := os.Stat(path)
+		if err == nil {
+			return MetaFromFileInfo(info).Dev, nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, os.ErrNotExist) || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
+
+// mountTop walks up from dir, which lives on device dev, and returns the
+// topmost directory still on that device.
+func mountTop(dir string, dev uint64) string {
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		info, err := os.Stat(parent)
+		if err != nil || MetaFromFileInfo(info).Dev != dev {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// trashInto moves abs into trashDir's files directory under a free name,
+// after writing the matching info/<name>.trashinfo recording infoPath.
+func trashInto(trashDir, abs, infoPath string, now time.Time) (string, error) {
+	filesDir := filepath.Join(trashDir, "files")
+	infoDir := filepath.Join(trashDir, "info")
+	for _, dir := range []string{filesDir, infoDir} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return "", fmt.Errorf("create trash directory %s: %w", dir, err)
+		}
+	}
+
+	body := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: infoPath}).EscapedPath(), now.Format(trashInfoTime))
+	base := filepath.Base(abs)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for n := 1; ; n++ {
+		name := base
+		if n > 1 {
+			name = fmt.Sprintf("%s.%d%s", stem, n, ext)
+		}
+		dest := filepath.Join(filesDir, name)
+		if _, err := os.Lstat(dest); err == nil {
+			continue
+		}
+		// Creating the info file exclusively reserves the name, as the
+		// specification requires.
+		infoFile := filepath.Join(infoDir, name+".trashinfo")
+		f, err := os.OpenFile(infoFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600) // #nosec G304 -- name is derived from the trashed path
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("create %s: %w", infoFile, err)
+		}
+		_, err = f.WriteString(body)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(abs, dest)
+		}
+		if err != nil {
+			_ = os.Remove(infoFile)
+			return "", fmt.Errorf("move %s to trash: %w", abs, err)
+		}
+		return dest, nil
+	}
+}
@@ -0,0 +1,83 @@
+package dfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMoveToTrashUsesHomeTrash(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	src := filepath.Join(dir, "my file.txt")
+	if err := os.WriteFile(src, []byte("trash me"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	dest, err := MoveToTrash(src)
+	if err != nil {
+		t.Fatalf("MoveToTrash: %v", err)
+	}
+	trash := filepath.Join(dir, "data", "Trash")
+	if want := filepath.Join(trash, "files", "my file.txt"); dest != want {
+		t.Fatalf("trashed to %s, want %s", dest, want)
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Fatalf("source should be gone, got %v", err)
+	}
+	info, err := os.ReadFile(filepath.Join(trash, "info", "my file.txt.trashinfo"))
+	if err != nil {
+		t.Fatalf("read trashinfo: %v", err)
+	}
+	realSrc := filepath.Join(mustEvalSymlinks(t, dir), "my file.txt")
+	lines := strings.Split(string(info), "\n")
+	if lines[0] != "[Trash Info]" {
+		t.Fatalf("missing header: %q", info)
+	}
+	if want := "Path=" + strings.ReplaceAll(realSrc, " ", "%20"); lines[1] != want {
+		t.Fatalf("got %q, want %q", lines[1], want)
+	}
+	if !strings.HasPrefix(lines[2], "DeletionDate=") {
+		t.Fatalf("missing deletion date: %q", info)
+	}
+	if _, err := time.ParseInLocation(trashInfoTime, strings.TrimPrefix(lines[2], "DeletionDate="), time.Local); err != nil {
+		t.Fatalf("bad deletion date: %v", err)
+	}
+}
+
+func TestMoveToTrashAvoidsNameClashes(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	var dests []string
+	for _, sub := range []string{"a", "b"} {
+		src := filepath.Join(dir, sub, "dup.txt")
+		if err := os.MkdirAll(filepath.Dir(src), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(src, []byte(sub), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		dest, err := MoveToTrash(src)
+		if err != nil {
+			t.Fatalf("MoveToTrash(%s): %v", src, err)
+		}
+		dests = append(dests, dest)
+	}
+	if filepath.Base(dests[0]) != "dup.txt" || filepath.Base(dests[1]) != "dup.2.txt" {
+		t.Fatalf("unexpected trash names: %v", dests)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data", "Trash", "info", "dup.2.txt.trashinfo")); err != nil {
+		t.Fatalf("second trashinfo missing: %v", err)
+	}
+}
+
+func mustEvalSymlinks(t *testing.T, path string) string {
+	t.Helper()
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		t.Fatalf("EvalSymlinks(%s): %v", path, err)
+	}
+	return real
+}
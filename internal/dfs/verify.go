@@ -0,0 +1,52 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrChanged indicates a file no longer matches what was recorded when it
+// was scanned.
+var ErrChanged = errors.New("file changed since scan")
+
+// CheckUnchanged returns ErrChanged (wrapped) unless path is still a regular
+// file with the size and modification time in meta. It does not follow a
+// final symlink, so a file replaced by a link counts as changed. Metadata that
+// was never recorded can't be compared and passes.
+func CheckUnchanged(path string, meta FileMeta) error {
+	if !meta.Known() {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrChanged, path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is no longer a regular file", ErrChanged, path)
+	}
+	if info.Size() != meta.Size {
+		return fmt.Errorf("%w: %s size is %d, was %d", ErrChanged, path, info.Size(), meta.Size)
+	}
+	if info.ModTime().UnixNano() != meta.ModTime {
+		return fmt.Errorf("%w: %s was modified at %s", ErrChanged, path, info.ModTime().Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// CheckHash re-hashes path with algo and returns ErrChanged (wrapped) unless
+// it still hashes to want.
+func CheckHash(path string, want [32]byte, algo HashAlgorithm) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrChanged, path, err)
+	}
+	dfile, err := NewDfile(path, info.Size(), algo)
+	if err != nil {
+		return fmt.Errorf("hash %s: %w", path, err)
+	}
+	if dfile.Hash() != want {
+		return fmt.Errorf("%w: %s content no longer matches its group", ErrChanged, path)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package dfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte("original"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	meta, err := LstatMeta(path)
+	if err != nil {
+		t.Fatalf("LstatMeta: %v", err)
+	}
+	if err := CheckUnchanged(path, meta); err != nil {
+		t.Fatalf("unchanged file rejected: %v", err)
+	}
+	if err := CheckUnchanged(path, FileMeta{Size: 1}); err != nil {
+		t.Fatalf("unrecorded metadata should pass: %v", err)
+	}
+
+	later := time.Unix(0, meta.ModTime).Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := CheckUnchanged(path, meta); !errors.Is(err, ErrChanged) {
+		t.Fatalf("expected ErrChanged for a new mtime, got %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := os.Symlink("elsewhere", path); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := CheckUnchanged(path, meta); !errors.Is(err, ErrChanged) {
+		t.Fatalf("expected ErrChanged for a symlink, got %v", err)
+	}
+}
+
+func TestCheckHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte("original"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	dfile, err := NewDfile(path, int64(len("original")), HashSHA256)
+	if err != nil {
+		t.Fatalf("NewDfile: %v", err)
+	}
+	if err := CheckHash(path, dfile.Hash(), HashSHA256); err != nil {
+		t.Fatalf("matching hash rejected: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("modified"), 0o644); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	if err := CheckHash(path, dfile.Hash(), HashSHA256); !errors.Is(err, ErrChanged) {
+		t.Fatalf("expected ErrChanged for new content, got %v", err)
+	}
+}
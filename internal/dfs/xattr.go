@@ -0,0 +1,45 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrXattrUnsupported indicates the platform has no extended attribute
+// syscalls.
+var ErrXattrUnsupported = errors.New("extended attributes not supported on this platform")
+
+// Xattrs returns the extended attributes of path, without following a final
+// symlink, keyed by name. On Linux this includes POSIX ACLs, which are stored
+// as system.posix_acl_* attributes. Attributes the caller may not read are
+// skipped. A path with no attributes returns a nil map.
+func Xattrs(path string) (map[string][]byte, error) {
+	names, err := listXattr(path)
+	if err != nil {
+		return nil, err
+	}
+	var attrs map[string][]byte
+	for _, name := range names {
+		value, err := getXattr(path, name)
+		if err != nil {
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string][]byte, len(names))
+		}
+		attrs[name] = value
+	}
+	return attrs, nil
+}
+
+// SetXattrs sets every attribute in attrs on path, without following a final
+// symlink. It tries them all and returns the failures joined.
+func SetXattrs(path string, attrs map[string][]byte) error {
+	var errs []error
+	for name, value := range attrs {
+		if err := setXattr(path, name, value); err != nil {
+			errs = append(errs, fmt.Errorf("set xattr %s on %s: %w", name, path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
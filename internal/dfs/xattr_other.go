@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package dfs
+
+func listXattr(string) ([]string, error) { return nil, nil }
+
+func getXattr(string, string) ([]byte, error) { return nil, ErrXattrUnsupported }
+
+func setXattr(string, string, []byte) error { return ErrXattrUnsupported }
@@ -0,0 +1,73 @@
+//go:build linux || darwin
+
+package dfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, path := range []string{src, dst} {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := setXattr(src, "user.dskditto.test", []byte("value")); err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EPERM) {
+			t.Skipf("filesystem does not support user xattrs: %v", err)
+		}
+		t.Fatalf("setXattr: %v", err)
+	}
+
+	attrs, err := Xattrs(src)
+	if err != nil {
+		t.Fatalf("Xattrs: %v", err)
+	}
+	if !bytes.Equal(attrs["user.dskditto.test"], []byte("value")) {
+		t.Fatalf("unexpected attributes %q", attrs)
+	}
+	if err := SetXattrs(dst, attrs); err != nil {
+		t.Fatalf("SetXattrs: %v", err)
+	}
+	copied, err := getXattr(dst, "user.dskditto.test")
+	if err != nil || string(copied) != "value" {
+		t.Fatalf("attribute not copied: %q, %v", copied, err)
+	}
+}
+
+func TestCaptureAttrsAppliesUserXattrs(t *testing.T) {
+	dir := t.TempDir()
+	orig := filepath.Join(dir, "orig")
+	clone := filepath.Join(dir, "clone")
+	for _, path := range []string{orig, clone} {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := setXattr(orig, "user.dskditto.tag", []byte("keep")); err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EPERM) {
+			t.Skipf("filesystem does not support user xattrs: %v", err)
+		}
+		t.Fatalf("setXattr: %v", err)
+	}
+
+	attrs, err := captureAttrs(orig)
+	if err != nil {
+		t.Fatalf("captureAttrs: %v", err)
+	}
+	if lost := attrs.applyFile(clone); len(lost) != 0 {
+		t.Fatalf("applyFile lost %v", lost)
+	}
+	if value, err := getXattr(clone, "user.dskditto.tag"); err != nil || string(value) != "keep" {
+		t.Fatalf("xattr not carried over: %q, %v", value, err)
+	}
+}
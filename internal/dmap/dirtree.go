@@ -0,0 +1,739 @@
+package dmap
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
+	"github.com/jdefrancesco/dskDitto/internal/dsklog"
+)
+
+// DirTreeOptions configures FindDirectoryTrees.
+type DirTreeOptions struct {
+	// Roots are the scanned roots; relative roots are made absolute to match
+	// the walker's paths. Directories above them were only partly walked and
+	// are never compared.
+	Roots []string
+	// Supersets also reports directories that hold a copy of everything in
+	// another directory, under the same relative paths.
+	Supersets bool
+}
+
+// dirNode is one scanned directory and the scanned entries directly in it.
+type dirNode struct {
+	files   map[string]dpath.ID
+	subdirs map[string]struct{}
+
+	visited  bool
+	complete bool
+	digest   Digest
+	size     int64
+	diskSize int64
+}
+
+// relFile is a file below a directory, keyed by its path relative to it.
+type relFile struct {
+	rel    string
+	id     dpath.ID
+	digest Digest
+}
+
+// TreeFile is a file below a member of a directory group as the scan saw
+// it. Tree actions re-check every one before touching the directory.
+type TreeFile struct {
+	// Rel is the file's path relative to the directory.
+	Rel  string
+	Meta dfs.FileMeta
+	// Digest is the file's content digest. Hashed is false for files no
+	// other copy was found of, which only the kept side of a superset holds.
+	Digest Digest
+	Hashed bool
+}
+
+// dirTrees holds the directory tree built from the scanned paths.
+type dirTrees struct {
+	d       *Dmap
+	roots   map[string]bool
+	inRoot  map[string]bool
+	nodes   map[string]*dirNode
+	digests map[dpath.ID]Digest
+}
+
+// FindDirectoryTrees groups directories whose whole trees are identical:
+// the same names holding the same content at every level. It runs after the
+// file pass and must see every scanned path in Paths(), so the map should
+// come straight from a content scan. A directory's digest hashes the names
+// and digests of its children, so a tree only matches when every file in it
+// is itself a duplicate. Directories holding entries the scan skipped
+// (hidden, empty or size-filtered files, symlinks, empty subdirectories) are
+// never reported, since the digest would not describe them.
+//
+// Only the topmost matching directories are reported, and file groups fully
+// explained by a directory group are dropped. Returns the number of
+// directory-tree and superset groups added.
+func (d *Dmap) FindDirectoryTrees(opts DirTreeOptions) (trees, supersets int) {
+	t := &dirTrees{
+		d:       d,
+		roots:   make(map[string]bool, len(opts.Roots)),
+		inRoot:  make(map[string]bool),
+		nodes:   make(map[string]*dirNode),
+		digests: make(map[dpath.ID]Digest),
+	}
+	for _, root := range opts.Roots {
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		t.roots[filepath.Clean(root)] = true
+	}
+	fileGroups := make(map[Digest][]dpath.ID)
+	d.rangeGroups(func(hash Digest, ids []dpath.ID) {
+		if mt := d.MatchInfo(hash).Type; mt != MatchContent && mt != MatchZeroFilled {
+			return
+		}
+		if len(ids) < 2 {
+			return
+		}
+		fileGroups[hash] = ids
+		for _, id := range ids {
+			t.digests[id] = hash
+		}
+	})
+	t.build(d.paths.Len())
+
+	byDigest := make(map[Digest][]string)
+	dirs := make([]string, 0, len(t.nodes))
+	for dir := range t.nodes {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if node := t.resolve(dir); node.complete {
+			byDigest[node.digest] = append(byDigest[node.digest], dir)
+		}
+	}
+
+	reported := make(map[string]Digest)
+	for digest, members := range byDigest {
+		if len(members) < 2 || t.coveredByParents(members) {
+			continue
+		}
+		for _, dir := range members {
+			t.addDir(digest, dir, t.nodes[dir], MatchInfo{Type: MatchDirTree, Key: fmt.Sprintf("%x", digest)})
+			reported[dir] = digest
+		}
+		trees++
+	}
+
+	t.dropCoveredFileGroups(fileGroups, reported)
+	if opts.Supersets {
+		supersets = t.findSupersets(dirs, reported)
+	}
+	return trees, supersets
+}
+
+// build links every scanned path below a root into the directory tree.
+func (t *dirTrees) build(count int) {
+	for i := 0; i < count; i++ {
+		id := dpath.ID(i) // #nosec G115 -- bounded by the store's ID space
+		path := t.d.paths.Path(id)
+		dir := filepath.Dir(path)
+		if !t.withinRoots(dir) {
+			continue
+		}
+		t.node(dir).files[filepath.Base(path)] = id
+		for !t.roots[dir] {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			p := t.node(parent)
+			if _, linked := p.subdirs[dir]; linked {
+				break
+			}
+			p.subdirs[dir] = struct{}{}
+			dir = parent
+		}
+	}
+}
+
+func (t *dirTrees) node(dir string) *dirNode {
+	node, ok := t.nodes[dir]
+	if !ok {
+		node = &dirNode{files: make(map[string]dpath.ID), subdirs: make(map[string]struct{})}
+		t.nodes[dir] = node
+	}
+	return node
+}
+
+// withinRoots reports whether dir is a root or lies below one.
+func (t *dirTrees) withinRoots(dir string) bool {
+	if in, ok := t.inRoot[dir]; ok {
+		return in
+	}
+	in := t.roots[dir]
+	if !in {
+		if parent := filepath.Dir(dir); parent != dir {
+			in = t.withinRoots(parent)
+		}
+	}
+	t.inRoot[dir] = in
+	return in
+}
+
+// resolve computes dir's digest and sizes from its children. The node is
+// complete only when every file below it is a duplicate and the directory
+// holds nothing the scan didn't see.
+func (t *dirTrees) resolve(dir string) *dirNode {
+	node := t.nodes[dir]
+	if node.visited {
+		return node
+	}
+	node.visited = true
+
+	complete := true
+	entries := make([]string, 0, len(node.files)+len(node.subdirs))
+	for name, id := range node.files {
+		digest, ok := t.digests[id]
+		if !ok {
+			complete = false
+			continue
+		}
+		entries = append(entries, "f"+name+"\x00"+string(digest[:]))
+		info := t.d.info(id)
+		node.size += info.Size
+		node.diskSize += info.DiskSize
+	}
+	for sub := range node.subdirs {
+		child := t.resolve(sub)
+		if !child.complete {
+			complete = false
+			continue
+		}
+		entries = append(entries, "d"+filepath.Base(sub)+"\x00"+string(child.digest[:]))
+		node.size += child.size
+		node.diskSize += child.diskSize
+	}
+	if !complete || !listedFully(dir, len(entries)) {
+		return node
+	}
+
+	sort.Strings(entries)
+	h := sha256.New()
+	h.Write([]byte("dskditto:dir:"))
+	for _, entry := range entries {
+		h.Write([]byte(entry))
+	}
+	copy(node.digest[:], h.Sum(nil))
+	node.complete = true
+	return node
+}
+
+// listedFully reports whether dir holds exactly want entries on disk.
+func listedFully(dir string, want int) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		dsklog.Dlogger.Debugf("Unable to list %s: %v", dir, err)
+		return false
+	}
+	return len(entries) == want
+}
+
+// coveredByParents reports whether members' distinct parents are themselves
+// identical trees, in which case the parents' group already covers them.
+func (t *dirTrees) coveredByParents(members []string) bool {
+	parents := make(map[string]bool, len(members))
+	var digest Digest
+	for i, dir := range members {
+		parent := filepath.Dir(dir)
+		node, ok := t.nodes[parent]
+		if parent == dir || !ok || !node.complete || parents[parent] {
+			return false
+		}
+		if i > 0 && node.digest != digest {
+			return false
+		}
+		digest = node.digest
+		parents[parent] = true
+	}
+	return true
+}
+
+// addDir records dir in the group for digest.
+func (t *dirTrees) addDir(digest Digest, dir string, node *dirNode, match MatchInfo) {
+	meta, err := dfs.LstatMeta(dir)
+	if err != nil {
+		dsklog.Dlogger.Debugf("Unable to stat directory %s: %v", dir, err)
+	}
+	meta.Size, meta.DiskSize = node.size, node.diskSize
+	id := t.d.paths.Add(dir)
+	t.d.setInfo(id, FileInfo{FileMeta: meta})
+	t.d.setTreeFiles(id, t.record(dir))
+	t.d.addKeyedID(digest, id, match)
+}
+
+// record lists the files below dir with the metadata and digests the scan
+// recorded for them, sorted by relative path.
+func (t *dirTrees) record(dir string) []TreeFile {
+	rel := t.treeFiles(dir, "")
+	files := make([]TreeFile, len(rel))
+	for i, f := range rel {
+		_, hashed := t.digests[f.id]
+		files[i] = TreeFile{Rel: f.rel, Meta: t.d.info(f.id).FileMeta, Digest: f.digest, Hashed: hashed}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Rel < files[j].Rel })
+	return files
+}
+
+// dropCoveredFileGroups removes file groups whose members each sit in a
+// different directory of the same reported tree group.
+func (t *dirTrees) dropCoveredFileGroups(fileGroups map[Digest][]dpath.ID, reported map[string]Digest) {
+	if len(reported) == 0 {
+		return
+	}
+	for hash, ids := range fileGroups {
+		var group Digest
+		seen := make(map[string]bool, len(ids))
+		covered := true
+		for i, id := range ids {
+			dir, digest, ok := t.topReported(t.d.paths.Path(id), reported)
+			if !ok || seen[dir] || (i > 0 && digest != group) {
+				covered = false
+				break
+			}
+			seen[dir] = true
+			group = digest
+		}
+		if !covered {
+			continue
+		}
+		t.d.deleteGroup(hash)
+		t.d.fileCount.Add(-uint64(len(ids)))
+		delete(fileGroups, hash)
+	}
+}
+
+// topReported returns the outermost reported directory holding path.
+func (t *dirTrees) topReported(path string, reported map[string]Digest) (string, Digest, bool) {
+	var top string
+	var digest Digest
+	found := false
+	for dir := filepath.Dir(path); t.withinRoots(dir); {
+		if g, ok := reported[dir]; ok {
+			top, digest, found = dir, g, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return top, digest, found
+}
+
+// findSupersets reports complete directories B whose every file also exists,
+// with the same content and relative path, below another directory A. Each
+// pair becomes a two-member group with A first, since A is the copy to keep.
+func (t *dirTrees) findSupersets(dirs []string, reported map[string]Digest) int {
+	// Every duplicate counts here, including those whose file groups were
+	// dropped in favour of a tree group.
+	pathDigest := make(map[string]Digest, len(t.digests))
+	groupPaths := make(map[Digest][]string)
+	for id, hash := range t.digests {
+		path := t.d.paths.Path(id)
+		pathDigest[path] = hash
+		groupPaths[hash] = append(groupPaths[hash], path)
+	}
+
+	// Shallow directories first, so a pair's parents are settled before it.
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], string(os.PathSeparator)) < strings.Count(dirs[j], string(os.PathSeparator))
+	})
+	pairs := make(map[string]bool)
+	added := 0
+	for _, b := range dirs {
+		node := t.nodes[b]
+		if !node.complete {
+			continue
+		}
+		if _, _, ok := t.topReported(filepath.Join(b, "x"), reported); ok {
+			continue
+		}
+		files := t.treeFiles(b, "")
+		if len(files) == 0 {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].rel < files[j].rel })
+		first := files[0]
+		for _, p := range groupPaths[first.digest] {
+			suffix := string(os.PathSeparator) + first.rel
+			if !strings.HasSuffix(p, suffix) {
+				continue
+			}
+			a := strings.TrimSuffix(p, suffix)
+			if a == b || isWithin(a, b) || isWithin(b, a) || t.nodes[a] == nil {
+				continue
+			}
+			if pairs[filepath.Dir(a)+"\x00"+filepath.Dir(b)] || !t.holdsAll(a, files, pathDigest) {
+				continue
+			}
+			pairs[a+"\x00"+b] = true
+			digest := sha256.Sum256([]byte("dskditto:dir-superset:" + a + "\x00" + b))
+			match := MatchInfo{Type: MatchDirSuperset, Key: a}
+			t.addDir(digest, a, t.treeSize(a), match)
+			t.addDir(digest, b, node, match)
+			added++
+			break
+		}
+	}
+	return added
+}
+
+// treeFiles lists the files below dir with paths relative to it.
+func (t *dirTrees) treeFiles(dir, prefix string) []relFile {
+	node := t.nodes[dir]
+	files := make([]relFile, 0, len(node.files))
+	for name, id := range node.files {
+		files = append(files, relFile{rel: prefix + name, id: id, digest: t.digests[id]})
+	}
+	for sub := range node.subdirs {
+		files = append(files, t.treeFiles(sub, prefix+filepath.Base(sub)+string(os.PathSeparator))...)
+	}
+	return files
+}
+
+// treeSize returns a node holding the sizes of every scanned file below dir,
+// including unique ones.
+func (t *dirTrees) treeSize(dir string) *dirNode {
+	total := &dirNode{}
+	var walk func(dir string)
+	walk = func(dir string) {
+		node := t.nodes[dir]
+		for _, id := range node.files {
+			meta, err := t.d.FileMeta(id)
+			if err != nil {
+				continue
+			}
+			total.size += meta.Size
+			total.diskSize += meta.DiskSize
+		}
+		for sub := range node.subdirs {
+			walk(sub)
+		}
+	}
+	walk(dir)
+	return total
+}
+
+// holdsAll reports whether every file in files exists below dir with the
+// same digest.
+func (t *dirTrees) holdsAll(dir string, files []relFile, pathDigest map[string]Digest) bool {
+	for _, f := range files {
+		if digest, ok := pathDigest[filepath.Join(dir, f.rel)]; !ok || digest != f.digest {
+			return false
+		}
+	}
+	return true
+}
+
+// isWithin reports whether path lies below dir.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// applyTrees runs act on the extra members of every directory group, keeping
+// the keep members ranked first by the keep policy, before any file group is
+// touched. A directory is skipped if anything in it is newer than the guard's
+// MinAge (see Guard.CheckTreeSettled) or unless CheckTrees passes for it and
+// the kept one. Members of other groups that lived below an acted-on directory are then
+// dropped so the file pass doesn't trip over them. Returns the directories
+// acted on.
+func (d *Dmap) applyTrees(keep int, verb string, act func(dir, keep string) error) ([]string, []error) {
+	var done []string
+	var errs []error
+	d.rangeGroups(func(hash Digest, dirs []dpath.ID) {
+		if len(dirs) <= keep || !d.MatchInfo(hash).Type.IsDirectory() {
+			return
+		}
+		dirs = d.keepOrder(dirs)
+		survivors := append([]dpath.ID(nil), dirs[:keep]...)
+		if err := d.checkSurvivor(survivors[0]); err != nil {
+			errs = append(errs, err)
+			return
+		}
+		target := d.paths.Path(survivors[0])
+		for _, id := range dirs[keep:] {
+			dir := d.paths.Path(id)
+			if d.skipStale(id) || d.skipProtected(id) {
+				survivors = append(survivors, id)
+				continue
+			}
+			if err := d.guard.CheckTreeSettled(dir, d.TreeFiles(id)); err != nil {
+				errs = append(errs, fmt.Errorf("skip directory %s: %w", dir, err))
+				survivors = append(survivors, id)
+				continue
+			}
+			if err := d.checkTrees(id, survivors[0]); err != nil {
+				errs = append(errs, fmt.Errorf("skip directory %s: %w", dir, err))
+				survivors = append(survivors, id)
+				continue
+			}
+			if err := act(dir, target); err != nil {
+				errs = append(errs, fmt.Errorf("%s %s: %w", verb, dir, err))
+				if !errors.Is(err, dfs.ErrMetadataNotPreserved) {
+					survivors = append(survivors, id)
+					continue
+				}
+			}
+			dsklog.Dlogger.Infof("Duplicate directory %s: %s (copy kept at %s)", verb, dir, target)
+			d.deleteInfo(id)
+			done = append(done, dir)
+			d.fileCount.Add(^uint64(0))
+		}
+		d.setGroup(hash, survivors)
+	})
+	d.forgetBelow(done)
+	return done, errs
+}
+
+// checkTrees runs CheckTrees on directory id and the kept directory keep,
+// using the files the scan recorded below each.
+func (d *Dmap) checkTrees(id, keep dpath.ID) error {
+	return CheckTrees(d.paths.Path(id), d.TreeFiles(id), d.paths.Path(keep), d.TreeFiles(keep), d.rehash)
+}
+
+// CheckTrees re-checks both sides of a tree action against the scan before it
+// runs: every file recorded below dir and below keep must still have its
+// scanned size and mtime and, with algo set, still hash to its digest, and
+// dir must hold nothing the scan didn't record. A directory without a record
+// fails, since nothing about its files could be checked.
+func CheckTrees(dir string, dirFiles []TreeFile, keep string, keepFiles []TreeFile, algo dfs.HashAlgorithm) error {
+	if len(dirFiles) == 0 || len(keepFiles) == 0 {
+		return fmt.Errorf("%w: no scan record of the files below %s and %s; rescan first", dfs.ErrChanged, dir, keep)
+	}
+	for _, side := range []struct {
+		dir   string
+		files []TreeFile
+	}{{dir, dirFiles}, {keep, keepFiles}} {
+		for _, f := range side.files {
+			path := filepath.Join(side.dir, f.Rel)
+			if err := dfs.CheckUnchanged(path, f.Meta); err != nil {
+				return err
+			}
+			if algo != "" && f.Hashed {
+				if err := dfs.CheckHash(path, f.Digest, algo); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	recorded := make(map[string]bool, len(dirFiles))
+	for _, f := range dirFiles {
+		recorded[f.Rel] = true
+	}
+	return filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if !recorded[rel] {
+			return fmt.Errorf("%w: %s was added since the scan", dfs.ErrChanged, path)
+		}
+		return nil
+	})
+}
+
+// setTreeFiles records the files below directory id.
+func (d *Dmap) setTreeFiles(id dpath.ID, files []TreeFile) {
+	d.treesMu.Lock()
+	defer d.treesMu.Unlock()
+	if d.trees == nil {
+		d.trees = make(map[dpath.ID][]TreeFile)
+	}
+	d.trees[id] = files
+}
+
+// TreeFiles returns the files the scan recorded below directory id, a member
+// of a directory group, or nil if there is no record.
+func (d *Dmap) TreeFiles(id dpath.ID) []TreeFile {
+	d.treesMu.Lock()
+	defer d.treesMu.Unlock()
+	return d.trees[id]
+}
+
+// forgetBelow drops group members that lie below any of dirs.
+func (d *Dmap) forgetBelow(dirs []string) {
+	if len(dirs) == 0 {
+		return
+	}
+	below := func(path string) bool {
+		for _, dir := range dirs {
+			if isWithin(path, dir) {
+				return true
+			}
+		}
+		return false
+	}
+	d.rangeGroups(func(hash Digest, ids []dpath.ID) {
+		kept := make([]dpath.ID, 0, len(ids))
+		for _, id := range ids {
+			if below(d.paths.Path(id)) {
+				d.deleteInfo(id)
+				d.fileCount.Add(^uint64(0))
+				continue
+			}
+			kept = append(kept, id)
+		}
+		switch {
+		case len(kept) == len(ids):
+		case len(kept) == 0:
+			d.deleteGroup(hash)
+		default:
+			d.setGroup(hash, kept)
+		}
+	})
+}
+
+// RemoveTree removes the directory dir as a unit with disposal, once keep is
+// confirmed to still hold a copy of everything in it. A nil disposal deletes
+// it.
+func RemoveTree(dir, keep string, disposal *dfs.Disposal) error {
+	if err := checkTreeCovered(dir, keep); err != nil {
+		return err
+	}
+	return disposal.RemoveAll(dir)
+}
+
+// LinkTree replaces the directory dir with a symlink to keep written in the
+// given style, once keep is confirmed to still hold a copy of everything in
+// it.
+func LinkTree(dir, keep string, style dfs.LinkStyle) error {
+	if err := checkTreeCovered(dir, keep); err != nil {
+		return err
+	}
+	return dfs.SymlinkReplace(dir, keep, style)
+}
+
+// ReflinkTree replaces every file below dir with a reflink clone of its copy
+// under keep, once keep is confirmed to still hold a copy of everything in
+// it. Unlike LinkTree the directory itself stays in place.
+func ReflinkTree(dir, keep string) error {
+	return replaceTree(dir, keep, dfs.ReflinkReplace)
+}
+
+// HardlinkTree replaces every file below dir with a hard link to its copy
+// under keep, once keep is confirmed to still hold a copy of everything in
+// it. Like ReflinkTree the directory itself stays in place.
+func HardlinkTree(dir, keep string) error {
+	return replaceTree(dir, keep, dfs.HardlinkReplace)
+}
+
+// DedupeTree shares the data of every file below dir with its copy under
+// keep through dfs.Dedupe, once keep is confirmed to still hold a copy of
+// everything in it. Every file stays in place.
+func DedupeTree(dir, keep string) error {
+	return replaceTree(dir, keep, dfs.Dedupe)
+}
+
+// replaceTree calls replace for every regular file below dir with the
+// matching path below keep. Files that only lost metadata don't stop the
+// walk; their errors are joined and returned at the end.
+func replaceTree(dir, keep string, replace func(path, target string) error) error {
+	if err := checkTreeCovered(dir, keep); err != nil {
+		return err
+	}
+	var lost []error
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		err = replace(path, filepath.Join(keep, rel))
+		if errors.Is(err, dfs.ErrMetadataNotPreserved) {
+			lost = append(lost, err)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Join(lost...)
+}
+
+// checkTreeCovered verifies that every entry below dir still exists below
+// keep with the same type and size, and that neither directory contains the
+// other. Files removed by earlier actions or added since the scan fail it.
+func checkTreeCovered(dir, keep string) error {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", dir, err)
+	}
+	realKeep, err := filepath.EvalSymlinks(keep)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", keep, err)
+	}
+	if realDir == realKeep || isWithin(realDir, realKeep) || isWithin(realKeep, realDir) {
+		return fmt.Errorf("%s and %s overlap", dir, keep)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	return filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		want, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		got, err := os.Lstat(filepath.Join(keep, rel))
+		if err != nil {
+			return fmt.Errorf("%s has no copy under %s: %w", path, keep, err)
+		}
+		switch {
+		case want.IsDir():
+			if !got.IsDir() {
+				return fmt.Errorf("%s is not a directory under %s", rel, keep)
+			}
+		case want.Mode().IsRegular():
+			if !got.Mode().IsRegular() || got.Size() != want.Size() {
+				return fmt.Errorf("%s differs under %s", rel, keep)
+			}
+		default:
+			return errors.New("unexpected non-regular file " + path)
+		}
+		return nil
+	})
+}
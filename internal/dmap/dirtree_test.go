@@ -0,0 +1,342 @@
+package dmap
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+)
+
+// writeTreeFixture creates files below root and records them in dm the way a
+// content scan would: every file is interned, and files whose content occurs
+// more than once are added under their digest.
+func writeTreeFixture(t *testing.T, root string, files map[string]string) *Dmap {
+	t.Helper()
+	setupLogging()
+
+	counts := make(map[string]int)
+	for _, content := range files {
+		counts[content]++
+	}
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	for rel, content := range files {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		if counts[content] < 2 {
+			dm.Paths().Add(path)
+			continue
+		}
+		meta, err := dfs.LstatMeta(path)
+		if err != nil {
+			t.Fatalf("lstat %s: %v", path, err)
+		}
+		dm.AddFile(Digest(sha256.Sum256([]byte(content))), path, FileInfo{FileMeta: meta})
+	}
+	return dm
+}
+
+// groupsOfType returns the resolved members of every group of type mt.
+func groupsOfType(dm *Dmap, mt MatchType) [][]string {
+	var out [][]string
+	for hash, paths := range dm.GetMap() {
+		if dm.MatchInfo(hash).Type == mt {
+			out = append(out, paths)
+		}
+	}
+	return out
+}
+
+func TestFindDirectoryTreesGroupsIdenticalTrees(t *testing.T) {
+	root := t.TempDir()
+	dm := writeTreeFixture(t, root, map[string]string{
+		"project/main.go":              "package main",
+		"project/docs/readme.md":       "readme",
+		"project copy/main.go":         "package main",
+		"project copy/docs/readme.md":  "readme",
+		"elsewhere/main.go":            "package main",
+		"elsewhere/unique.txt":         "only once",
+		"project-old/main.go":          "package main",
+		"project-old/docs/readme.md":   "readme",
+		"project-old/docs/changes.txt": "only here",
+	})
+
+	trees, supersets := dm.FindDirectoryTrees(DirTreeOptions{Roots: []string{root}})
+	if trees != 1 || supersets != 0 {
+		t.Fatalf("FindDirectoryTrees = (%d, %d), want (1, 0)", trees, supersets)
+	}
+	groups := groupsOfType(dm, MatchDirTree)
+	if len(groups) != 1 {
+		t.Fatalf("expected one directory tree group, got %v", groups)
+	}
+	want := map[string]bool{filepath.Join(root, "project"): true, filepath.Join(root, "project copy"): true}
+	if len(groups[0]) != 2 || !want[groups[0][0]] || !want[groups[0][1]] {
+		t.Fatalf("unexpected directory tree group %v", groups[0])
+	}
+
+	// main.go also lives outside the trees, so its group stays; readme.md is
+	// still in project-old, so its group stays too.
+	if got := len(groupsOfType(dm, MatchContent)); got != 2 {
+		t.Fatalf("expected 2 file groups to remain, got %d: %v", got, dm.GetMap())
+	}
+}
+
+func TestFindDirectoryTreesDropsExplainedFileGroups(t *testing.T) {
+	root := t.TempDir()
+	dm := writeTreeFixture(t, root, map[string]string{
+		"a/one.txt":     "one",
+		"a/sub/two.txt": "two",
+		"b/one.txt":     "one",
+		"b/sub/two.txt": "two",
+	})
+
+	if trees, _ := dm.FindDirectoryTrees(DirTreeOptions{Roots: []string{root}}); trees != 1 {
+		t.Fatalf("expected one tree group, got %d", trees)
+	}
+	if got := len(groupsOfType(dm, MatchContent)); got != 0 {
+		t.Fatalf("file groups inside the matched trees should be dropped, got %v", dm.GetMap())
+	}
+	if got := dm.FileCount(); got != 2 {
+		t.Fatalf("FileCount = %d, want 2 directories", got)
+	}
+}
+
+func TestFindDirectoryTreesSkipsUnscannedEntries(t *testing.T) {
+	root := t.TempDir()
+	dm := writeTreeFixture(t, root, map[string]string{
+		"a/one.txt": "one",
+		"b/one.txt": "one",
+	})
+	if err := os.WriteFile(filepath.Join(root, "b", ".hidden"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write hidden file: %v", err)
+	}
+
+	if trees, _ := dm.FindDirectoryTrees(DirTreeOptions{Roots: []string{root}}); trees != 0 {
+		t.Fatalf("directory holding an unscanned file must not match, got %d groups", trees)
+	}
+}
+
+func TestFindDirectoryTreesReportsSupersets(t *testing.T) {
+	root := t.TempDir()
+	dm := writeTreeFixture(t, root, map[string]string{
+		"full/one.txt":     "one",
+		"full/sub/two.txt": "two",
+		"full/extra.txt":   "only in full",
+		"part/one.txt":     "one",
+		"part/sub/two.txt": "two",
+	})
+
+	trees, supersets := dm.FindDirectoryTrees(DirTreeOptions{Roots: []string{root}, Supersets: true})
+	// full/sub and part/sub are identical trees in their own right.
+	if trees != 1 || supersets != 1 {
+		t.Fatalf("FindDirectoryTrees = (%d, %d), want (1, 1)", trees, supersets)
+	}
+	groups := groupsOfType(dm, MatchDirSuperset)
+	if len(groups) != 1 {
+		t.Fatalf("expected one superset group, got %v", groups)
+	}
+	full, part := filepath.Join(root, "full"), filepath.Join(root, "part")
+	if len(groups[0]) != 2 || groups[0][0] != full || groups[0][1] != part {
+		t.Fatalf("superset group = %v, want [%s %s]", groups[0], full, part)
+	}
+}
+
+func TestRemoveDuplicatesRemovesDirectoryTrees(t *testing.T) {
+	root := t.TempDir()
+	dm := writeTreeFixture(t, root, map[string]string{
+		"a/one.txt":     "one",
+		"a/sub/two.txt": "two",
+		"b/one.txt":     "one",
+		"b/sub/two.txt": "two",
+		"c/one.txt":     "one",
+		"c/other.txt":   "other",
+	})
+	if trees, _ := dm.FindDirectoryTrees(DirTreeOptions{Roots: []string{root}}); trees != 1 {
+		t.Fatalf("expected one tree group, got %d", trees)
+	}
+
+	removed, err := dm.RemoveDuplicates(1)
+	if err != nil {
+		t.Fatalf("RemoveDuplicates: %v", err)
+	}
+	// One of the trees goes as a unit; of the two one.txt copies left outside
+	// it, one is removed as an ordinary file.
+	if len(removed) != 2 {
+		t.Fatalf("expected a directory and a file removed, got %v", removed)
+	}
+	var removedDir string
+	for _, path := range removed {
+		if path == filepath.Join(root, "a") || path == filepath.Join(root, "b") {
+			removedDir = path
+		}
+	}
+	if removedDir == "" {
+		t.Fatalf("no directory among removed paths %v", removed)
+	}
+	if _, err := os.Stat(removedDir); !os.IsNotExist(err) {
+		t.Fatalf("%s should be gone, stat err = %v", removedDir, err)
+	}
+	kept := filepath.Join(root, "a")
+	if removedDir == kept {
+		kept = filepath.Join(root, "b")
+	}
+	if _, err := os.Stat(filepath.Join(kept, "sub", "two.txt")); err != nil {
+		t.Fatalf("kept tree damaged: %v", err)
+	}
+}
+
+func TestRemoveDuplicatesCountsTreeFilesOnceAgainstGuard(t *testing.T) {
+	root := t.TempDir()
+	dm := writeTreeFixture(t, root, map[string]string{
+		"a/one.txt":     "one",
+		"a/sub/two.txt": "two",
+		"b/one.txt":     "one",
+		"b/sub/two.txt": "two",
+		"c/one.txt":     "one",
+	})
+	if trees, _ := dm.FindDirectoryTrees(DirTreeOptions{Roots: []string{root}}); trees != 1 {
+		t.Fatalf("expected one tree group, got %d", trees)
+	}
+	// One directory and one file outside it go; the copy of one.txt inside
+	// the removed directory must not count a third time.
+	dm.SetGuard(Guard{MaxFiles: 2})
+
+	removed, err := dm.RemoveDuplicates(1)
+	if err != nil {
+		t.Fatalf("RemoveDuplicates: %v", err)
+	}
+	if len(removed) != 2 {
+		t.Fatalf("expected a directory and a file removed, got %v", removed)
+	}
+}
+
+func TestRemoveDuplicatesRefusesTreeEditedSinceScan(t *testing.T) {
+	root := t.TempDir()
+	dm := writeTreeFixture(t, root, map[string]string{
+		"a/one.txt":     "one",
+		"a/sub/two.txt": "two",
+		"b/one.txt":     "one",
+		"b/sub/two.txt": "two",
+	})
+	if trees, _ := dm.FindDirectoryTrees(DirTreeOptions{Roots: []string{root}}); trees != 1 {
+		t.Fatalf("expected one tree group, got %d", trees)
+	}
+	// A same-size edit passes the type and size comparison of
+	// checkTreeCovered; only the scan record catches it.
+	edited := filepath.Join(root, "b", "sub", "two.txt")
+	if err := os.WriteFile(edited, []byte("TWO"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(edited, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	removed, err := dm.RemoveDuplicates(1)
+	if !errors.Is(err, dfs.ErrChanged) {
+		t.Fatalf("expected dfs.ErrChanged, got %v", err)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("nothing should be removed, got %v", removed)
+	}
+	for _, dir := range []string{"a", "b"} {
+		if _, err := os.Stat(filepath.Join(root, dir, "sub", "two.txt")); err != nil {
+			t.Fatalf("%s should be untouched: %v", dir, err)
+		}
+	}
+}
+
+func TestRemoveDuplicatesRefusesTreeWithRecentFiles(t *testing.T) {
+	root := t.TempDir()
+	dm := writeTreeFixture(t, root, map[string]string{
+		"a/one.txt":     "one",
+		"a/sub/two.txt": "two",
+		"b/one.txt":     "one",
+		"b/sub/two.txt": "two",
+	})
+	if trees, _ := dm.FindDirectoryTrees(DirTreeOptions{Roots: []string{root}}); trees != 1 {
+		t.Fatalf("expected one tree group, got %d", trees)
+	}
+	// The directories themselves look settled; the files below them don't.
+	old := time.Now().Add(-2 * time.Hour)
+	for _, dir := range []string{"a", "b"} {
+		if err := os.Chtimes(filepath.Join(root, dir), old, old); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	dm.SetGuard(Guard{MinAge: time.Hour})
+
+	removed, err := dm.RemoveDuplicates(1)
+	if !errors.Is(err, ErrTooRecent) {
+		t.Fatalf("expected ErrTooRecent, got %v", err)
+	}
+	for _, path := range removed {
+		if path == filepath.Join(root, "a") || path == filepath.Join(root, "b") {
+			t.Fatalf("no directory should be removed, got %v", removed)
+		}
+	}
+}
+
+func TestRemoveTreeRefusesChangedCopy(t *testing.T) {
+	root := t.TempDir()
+	dir, keep := filepath.Join(root, "dup"), filepath.Join(root, "keep")
+	for _, d := range []string{dir, keep} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", d, err)
+		}
+		if err := os.WriteFile(filepath.Join(d, "f.txt"), []byte("same"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "new.txt"), []byte("added later"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := RemoveTree(dir, keep, nil); err == nil {
+		t.Fatal("RemoveTree should refuse a directory whose copy lacks new files")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.txt")); err != nil {
+		t.Fatalf("directory should be untouched: %v", err)
+	}
+	if err := RemoveTree(keep, keep, nil); err == nil {
+		t.Fatal("RemoveTree should refuse to remove a directory in favour of itself")
+	}
+}
+
+func TestSaveResultsKeepsTreeRecords(t *testing.T) {
+	root := t.TempDir()
+	dm := writeTreeFixture(t, root, map[string]string{
+		"a/one.txt": "one",
+		"b/one.txt": "one",
+	})
+	if trees, _ := dm.FindDirectoryTrees(DirTreeOptions{Roots: []string{root}}); trees != 1 {
+		t.Fatalf("expected one tree group, got %d", trees)
+	}
+	resultsPath := filepath.Join(t.TempDir(), "results.json")
+	if err := dm.SaveResults(resultsPath, ScanInfo{HashAlgorithm: dfs.HashSHA256}); err != nil {
+		t.Fatalf("SaveResults: %v", err)
+	}
+	loaded, _, err := LoadResults(resultsPath)
+	if err != nil {
+		t.Fatalf("LoadResults: %v", err)
+	}
+	for _, ids := range loaded.GroupIDs() {
+		for _, id := range ids {
+			files := loaded.TreeFiles(id)
+			if len(files) != 1 || files[0].Rel != "one.txt" || !files[0].Hashed || files[0].Meta.Size != 3 {
+				t.Fatalf("unexpected tree record for %s: %+v", loaded.Path(id), files)
+			}
+		}
+	}
+}
@@ -5,6 +5,12 @@
 // { HashDigest --> [fileClone1, fileClone2, etc...]}
 //
 // That is, SHA256 hash of file will serve as our hash map key, which maps to a simple list of file names.
+// File names are interned in a dpath.Store and held as compact IDs; accessors
+// such as Get and GetMap resolve them back to strings.
+//
+// A Dmap is safe for concurrent use. Groups are spread over shards keyed on
+// the digest, each with its own lock, so hash workers can add files directly
+// without funnelling through a single consumer.
 package dmap
 
 import (
@@ -13,10 +19,14 @@ import (
 	"errors"
 	"fmt"
 	"math"
-	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
 	"github.com/jdefrancesco/dskDitto/internal/dsklog"
+	"github.com/jdefrancesco/dskDitto/pkg/utils"
 
 	"github.com/pterm/pterm"
 )
@@ -29,13 +39,78 @@ const (
 	MatchContent MatchType = "content"
 	MatchName    MatchType = "name"
 	MatchFuzzy   MatchType = "fuzzy"
+	// MatchZeroFilled marks content groups whose files hold nothing but zero
+	// bytes. These are usually preallocated or broken downloads rather than
+	// real copies, so they are reported separately.
+	MatchZeroFilled MatchType = "zero-filled"
+	// MatchDirTree groups directories whose whole trees are identical. Its
+	// members are directories rather than files and are acted on as a unit.
+	MatchDirTree MatchType = "dir-tree"
+	// MatchDirSuperset pairs a directory with another that holds a copy of
+	// everything in it. The superset comes first and its Key names it.
+	MatchDirSuperset MatchType = "dir-superset"
 )
 
+// IsDirectory reports whether the group's members are directories.
+func (t MatchType) IsDirectory() bool {
+	return t == MatchDirTree || t == MatchDirSuperset
+}
+
 type MatchInfo struct {
 	Type MatchType
 	Key  string
 }
 
+// FileInfo records per-file details captured by the walker and learned
+// while hashing.
+type FileInfo struct {
+	// FileMeta holds the size, mode, ownership, mtime and identity from the
+	// walker's stat. Size is the apparent size and DiskSize the bytes actually
+	// allocated on disk.
+	dfs.FileMeta
+	// Sparse is set when holes were skipped while hashing.
+	Sparse bool
+	// ZeroFilled is set when the file consists entirely of zero bytes.
+	ZeroFilled bool
+	// AlreadyDeduplicated is set when the file's blocks are already shared
+	// with another member of its group, so removing it reclaims nothing.
+	AlreadyDeduplicated bool
+	// Stale is set when loaded results no longer match the file on disk.
+	// Duplicate actions skip stale files.
+	Stale bool
+}
+
+// Flagged reports whether the file is worth calling out to the user.
+func (fi FileInfo) Flagged() bool {
+	return fi.Sparse || fi.ZeroFilled || fi.AlreadyDeduplicated || fi.Stale
+}
+
+// Annotation describes a flagged file, e.g. "[sparse, 1.00 GiB apparent / 4.00 KiB allocated]"
+// or "[already deduplicated]". It returns an empty string for ordinary files.
+func (fi FileInfo) Annotation() string {
+	if !fi.Flagged() {
+		return ""
+	}
+	var kinds []string
+	if fi.Sparse {
+		kinds = append(kinds, "sparse")
+	}
+	if fi.ZeroFilled {
+		kinds = append(kinds, "zero-filled")
+	}
+	if fi.AlreadyDeduplicated {
+		kinds = append(kinds, "already deduplicated")
+	}
+	if fi.Stale {
+		kinds = append(kinds, "stale")
+	}
+	if !fi.Sparse && !fi.ZeroFilled {
+		return fmt.Sprintf("[%s]", strings.Join(kinds, ", "))
+	}
+	return fmt.Sprintf("[%s, %s apparent / %s allocated]", strings.Join(kinds, ", "),
+		utils.DisplaySize(uint64(max(fi.Size, 0))), utils.DisplaySize(uint64(max(fi.DiskSize, 0))))
+}
+
 // DigestFromHex converts a hex string to Digest
 func DigestFromHex(hexStr string) (Digest, error) {
 	var hash Digest
@@ -53,44 +128,214 @@ func DigestFromHex(hexStr string) (Digest, error) {
 // Initial size of our map. This will grow, but reasonable starting size helps performance.
 const mapInitSize = 4096
 
+// shardCount is the number of independently locked shards. Digests are
+// uniformly distributed, so their first byte spreads groups evenly.
+const shardCount = 64
+
+// groupShard holds the groups whose digests map to it.
+type groupShard struct {
+	mu      sync.RWMutex
+	files   map[Digest][]dpath.ID
+	matches map[Digest]MatchInfo
+}
+
+// infoShard holds the FileInfo of the path IDs that map to it.
+type infoShard struct {
+	mu   sync.RWMutex
+	info map[dpath.ID]FileInfo
+}
+
 // Dmap structure will hold our file duplication data.
 // It is the primary data structure that will house the results
 // that will eventually be returned to the user.
 type Dmap struct {
-	// Primary map structure.
-	filesMap map[Digest][]string
-	matches  map[Digest]MatchInfo
+	// Primary map structure, sharded by digest.
+	groups [shardCount]groupShard
+	// Details for files added with AddFile, sharded by path ID.
+	infos [shardCount]infoShard
+	// Interned file names referenced by groups.
+	paths *dpath.Store
 
 	// Files deffered for reasons such as size are stored here for later processing.
+	deferredMu    sync.Mutex
 	deferredFiles []string
 	// Number of files in our map.
-	fileCount uint
+	fileCount atomic.Uint64
 	// Batches of duplicate files.
 	// batchCount   uint
 	minDuplicates uint
+	// Scan roots groups are attributed to; see SetRoots.
+	roots []string
+	// Policy choosing the copies the duplicate actions keep.
+	keep KeepPolicy
+	// Where RemoveDuplicates sends removed files; nil deletes them.
+	dispose *dfs.Disposal
+	// How LinkDuplicates writes symlink targets.
+	linkStyle dfs.LinkStyle
+	// Algorithm the duplicate actions re-hash files with before touching
+	// them; empty skips re-hashing. See SetVerifyHash.
+	rehash dfs.HashAlgorithm
+	// Safety limits the duplicate actions honor; see SetGuard.
+	guard Guard
+	// Journals every file a batch action acts on; see SetJournal.
+	journal func(hash Digest, keep, id dpath.ID) (func() error, error)
+	// Files the scan saw below each member of a directory group, re-checked
+	// before tree actions.
+	treesMu sync.Mutex
+	trees   map[dpath.ID][]TreeFile
 }
 
 // NewDmap returns a new Dmap structure.
 func NewDmap(minDuplicates uint) (*Dmap, error) {
 
 	dmap := &Dmap{
-		fileCount:     0,
 		minDuplicates: minDuplicates,
 	}
 	if dmap.minDuplicates < 2 {
 		dmap.minDuplicates = 2
 	}
-	// Initialize our map.
-	dmap.filesMap = make(map[Digest][]string, mapInitSize)
-	dmap.matches = make(map[Digest]MatchInfo, mapInitSize)
+	// Initialize our shards.
+	for i := range dmap.groups {
+		dmap.groups[i].files = make(map[Digest][]dpath.ID, mapInitSize/shardCount)
+		dmap.groups[i].matches = make(map[Digest]MatchInfo, mapInitSize/shardCount)
+		dmap.infos[i].info = make(map[dpath.ID]FileInfo)
+	}
+	dmap.paths = dpath.NewStore()
 	dsklog.Dlogger.Debug("Dmap created with initial size: ", mapInitSize)
 
 	return dmap, nil
 }
 
+func (d *Dmap) shardFor(hash Digest) *groupShard {
+	return &d.groups[hash[0]%shardCount]
+}
+
+func (d *Dmap) infoShardFor(id dpath.ID) *infoShard {
+	return &d.infos[id%shardCount]
+}
+
+// setInfo records info for id.
+func (d *Dmap) setInfo(id dpath.ID, info FileInfo) {
+	s := d.infoShardFor(id)
+	s.mu.Lock()
+	s.info[id] = info
+	s.mu.Unlock()
+}
+
+// deleteInfo forgets the details recorded for id.
+func (d *Dmap) deleteInfo(id dpath.ID) {
+	s := d.infoShardFor(id)
+	s.mu.Lock()
+	delete(s.info, id)
+	s.mu.Unlock()
+}
+
+// groupEntry is one group copied out of its shard by rangeGroups.
+type groupEntry struct {
+	hash Digest
+	ids  []dpath.ID
+}
+
+// rangeGroups calls fn for every group. Each shard is copied under its read
+// lock and fn runs unlocked, so fn may call back into d, including to replace
+// or delete the group it was handed.
+func (d *Dmap) rangeGroups(fn func(hash Digest, ids []dpath.ID)) {
+	for i := range d.groups {
+		s := &d.groups[i]
+		s.mu.RLock()
+		entries := make([]groupEntry, 0, len(s.files))
+		for hash, ids := range s.files {
+			entries = append(entries, groupEntry{hash: hash, ids: ids[:len(ids):len(ids)]})
+		}
+		s.mu.RUnlock()
+		for _, e := range entries {
+			fn(e.hash, e.ids)
+		}
+	}
+}
+
+// setGroup replaces the files recorded under hash.
+func (d *Dmap) setGroup(hash Digest, ids []dpath.ID) {
+	s := d.shardFor(hash)
+	s.mu.Lock()
+	s.files[hash] = ids
+	s.mu.Unlock()
+}
+
+// deleteGroup removes hash and its match details.
+func (d *Dmap) deleteGroup(hash Digest) {
+	s := d.shardFor(hash)
+	s.mu.Lock()
+	delete(s.files, hash)
+	delete(s.matches, hash)
+	s.mu.Unlock()
+}
+
+// Paths returns the store path IDs in this map refer to. Walkers share it so
+// candidates can be added by ID without interning their paths twice.
+func (d *Dmap) Paths() *dpath.Store {
+	return d.paths
+}
+
+// Path resolves a path ID to its string.
+func (d *Dmap) Path(id dpath.ID) string {
+	return d.paths.Path(id)
+}
+
+// resolve returns the paths for ids.
+func (d *Dmap) resolve(ids []dpath.ID) []string {
+	paths := make([]string, len(ids))
+	for i, id := range ids {
+		paths[i] = d.paths.Path(id)
+	}
+	return paths
+}
+
 // Add will take a dfile and add it the map.
 func (d *Dmap) Add(dfile *dfs.Dfile) {
-	d.AddPath(Digest(dfile.Hash()), dfile.FileName())
+	d.AddFile(Digest(dfile.Hash()), dfile.FileName(), dfileInfo(dfile))
+}
+
+// AddID is Add for a dfile whose path is already interned in Paths() as id.
+// meta is the walker's stat of the file; sizes measured while hashing win.
+func (d *Dmap) AddID(dfile *dfs.Dfile, id dpath.ID, meta dfs.FileMeta) {
+	info := dfileInfo(dfile)
+	size, diskSize := info.Size, info.DiskSize
+	info.FileMeta = meta
+	info.Size, info.DiskSize = size, diskSize
+	d.AddFileID(Digest(dfile.Hash()), id, info)
+}
+
+func dfileInfo(dfile *dfs.Dfile) FileInfo {
+	return FileInfo{
+		FileMeta: dfs.FileMeta{
+			Size:     dfile.FileSize(),
+			DiskSize: dfile.DiskSize(),
+		},
+		Sparse:     dfile.Sparse(),
+		ZeroFilled: dfile.ZeroFilled(),
+	}
+}
+
+// AddFile records a path under an already computed digest along with the
+// details learned while hashing it. Groups of zero-filled files are tagged
+// MatchZeroFilled; since every file in a group shares a digest, the first
+// file decides.
+func (d *Dmap) AddFile(hash Digest, path string, info FileInfo) {
+	if path == "" {
+		return
+	}
+	d.AddFileID(hash, d.paths.Add(path), info)
+}
+
+// AddFileID is AddFile for a path already interned in Paths().
+func (d *Dmap) AddFileID(hash Digest, id dpath.ID, info FileInfo) {
+	d.setInfo(id, info)
+	matchType := MatchContent
+	if info.ZeroFilled {
+		matchType = MatchZeroFilled
+	}
+	d.addID(hash, id, matchType)
 }
 
 // AddPath records a path under an already computed digest.
@@ -98,11 +343,29 @@ func (d *Dmap) AddPath(hash Digest, path string) {
 	if path == "" {
 		return
 	}
-	if _, exists := d.matches[hash]; !exists {
-		d.matches[hash] = MatchInfo{Type: MatchContent, Key: fmt.Sprintf("%x", hash)}
+	d.addID(hash, d.paths.Add(path), MatchContent)
+}
+
+// addID appends id to hash's group. matchType only applies to new groups.
+func (d *Dmap) addID(hash Digest, id dpath.ID, matchType MatchType) {
+	s := d.shardFor(hash)
+	s.mu.Lock()
+	if _, exists := s.matches[hash]; !exists {
+		s.matches[hash] = MatchInfo{Type: matchType, Key: fmt.Sprintf("%x", hash)}
 	}
-	d.filesMap[hash] = append(d.filesMap[hash], path)
-	d.fileCount++
+	s.files[hash] = append(s.files[hash], id)
+	s.mu.Unlock()
+	d.fileCount.Add(1)
+}
+
+// addKeyedID appends id to hash's group and records match for it.
+func (d *Dmap) addKeyedID(hash Digest, id dpath.ID, match MatchInfo) {
+	s := d.shardFor(hash)
+	s.mu.Lock()
+	s.matches[hash] = match
+	s.files[hash] = append(s.files[hash], id)
+	s.mu.Unlock()
+	d.fileCount.Add(1)
 }
 
 // AddNamePath records a path under a shallow filename match key.
@@ -110,10 +373,19 @@ func (d *Dmap) AddNamePath(name, path string) {
 	if name == "" || path == "" {
 		return
 	}
-	hash := NameDigest(name)
-	d.matches[hash] = MatchInfo{Type: MatchName, Key: name}
-	d.filesMap[hash] = append(d.filesMap[hash], path)
-	d.fileCount++
+	d.AddNameID(name, d.paths.Add(path), dfs.FileMeta{})
+}
+
+// AddNameID is AddNamePath for a path already interned in Paths(). meta is
+// recorded for the file when the walker captured it.
+func (d *Dmap) AddNameID(name string, id dpath.ID, meta dfs.FileMeta) {
+	if name == "" {
+		return
+	}
+	if meta.Known() {
+		d.setInfo(id, FileInfo{FileMeta: meta})
+	}
+	d.addKeyedID(NameDigest(name), id, MatchInfo{Type: MatchName, Key: name})
 }
 
 // AddFuzzyPath records a path under a fuzzy content-match key.
@@ -121,10 +393,46 @@ func (d *Dmap) AddFuzzyPath(key, path string) {
 	if key == "" || path == "" {
 		return
 	}
-	hash := FuzzyDigest(key)
-	d.matches[hash] = MatchInfo{Type: MatchFuzzy, Key: key}
-	d.filesMap[hash] = append(d.filesMap[hash], path)
-	d.fileCount++
+	d.addKeyedID(FuzzyDigest(key), d.paths.Add(path), MatchInfo{Type: MatchFuzzy, Key: key})
+}
+
+// MarkSharedExtents flags content group members whose blocks are already
+// shared with an earlier member of the same group, e.g. after a previous
+// --reflink pass or on a btrfs/XFS tree that was deduplicated out of band.
+// The first file of each shared cluster stays unflagged since it owns the
+// space. Returns the number of files flagged; platforms without FIEMAP
+// flag nothing.
+func (d *Dmap) MarkSharedExtents() int {
+	flagged := 0
+	d.rangeGroups(func(hash Digest, files []dpath.ID) {
+		if uint(len(files)) < d.minDuplicates {
+			return
+		}
+		if t := d.MatchInfo(hash).Type; t != MatchContent && t != MatchZeroFilled {
+			return
+		}
+		owners := make(map[[32]byte]bool, len(files))
+		for _, id := range files {
+			path := d.paths.Path(id)
+			key, ok, err := dfs.SharedExtentKey(path)
+			if err != nil {
+				dsklog.Dlogger.Debugf("Unable to map extents of %s: %v", path, err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			if !owners[key] {
+				owners[key] = true
+				continue
+			}
+			info, _ := d.FileInfo(id)
+			info.AlreadyDeduplicated = true
+			d.setInfo(id, info)
+			flagged++
+		}
+	})
+	return flagged
 }
 
 // NameDigest returns a stable synthetic digest for a shallow filename group.
@@ -144,21 +452,28 @@ func (d *Dmap) AddDeferredFile(file string) {
 	if file == "" {
 		return
 	}
+	d.deferredMu.Lock()
 	d.deferredFiles = append(d.deferredFiles, file)
+	d.deferredMu.Unlock()
 }
 
 // PrintDmap will print entries currently stored in map in more text friendly way.
 func (d *Dmap) PrintDmap() {
-	for k, v := range d.filesMap {
+	d.rangeGroups(func(k Digest, v []dpath.ID) {
 		if uint(len(v)) < d.minDuplicates {
-			continue
+			return
 		}
 		fmt.Printf("%s  \n", d.headerFor(k))
-		for i, f := range v {
+		for i, id := range v {
+			f := d.paths.Path(id)
+			if note := d.info(id).Annotation(); note != "" {
+				fmt.Printf(" %d: %s %s \n", i+1, f, note)
+				continue
+			}
 			fmt.Printf(" %d: %s \n", i+1, f)
 		}
 		fmt.Printf("\n\n")
-	}
+	})
 }
 
 // ShowResultsBullet will display duplicates held in our Dmap as
@@ -166,10 +481,10 @@ func (d *Dmap) PrintDmap() {
 func (d *Dmap) ShowResultsBullet() {
 
 	var bl []pterm.BulletListItem
-	for hash, files := range d.filesMap {
+	d.rangeGroups(func(hash Digest, files []dpath.ID) {
 
 		if uint(len(files)) < d.minDuplicates {
-			continue
+			return
 		}
 		info := d.MatchInfo(hash)
 		label := "Hash: "
@@ -178,15 +493,26 @@ func (d *Dmap) ShowResultsBullet() {
 			label = "Name: "
 		} else if info.Type == MatchFuzzy {
 			label = "Similar: "
+		} else if info.Type == MatchZeroFilled {
+			label = "Zero-filled: "
+		} else if info.Type == MatchDirTree {
+			label = "Directory tree: "
+		} else if info.Type == MatchDirSuperset {
+			label = "Superset: "
 		}
 		pterm.Println(pterm.Green(label) + pterm.Cyan(value))
-		for _, f := range files {
-			blContent := pterm.BulletListItem{Level: 0, Text: f}
+		for _, id := range files {
+			f := d.paths.Path(id)
+			text := f
+			if note := d.info(id).Annotation(); note != "" {
+				text = f + " " + pterm.Yellow(note)
+			}
+			blContent := pterm.BulletListItem{Level: 0, Text: text}
 			bl = append(bl, blContent)
 		}
 		pterm.DefaultBulletList.WithItems(bl).Render()
 		bl = nil
-	}
+	})
 
 }
 
@@ -196,35 +522,131 @@ func (d *Dmap) IsEmpty() bool {
 
 // MapSize returns number of entries in the map.
 func (d *Dmap) MapSize() int {
-	return len(d.filesMap)
+	size := 0
+	for i := range d.groups {
+		s := &d.groups[i]
+		s.mu.RLock()
+		size += len(s.files)
+		s.mu.RUnlock()
+	}
+	return size
 }
 
 // FileCount will return the number of files our map currently
 // references.
 func (d *Dmap) FileCount() uint {
-	return d.fileCount
+	return uint(d.fileCount.Load())
+}
+
+// ids returns a copy of the IDs recorded under hash.
+func (d *Dmap) ids(hash Digest) ([]dpath.ID, bool) {
+	s := d.shardFor(hash)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids, ok := s.files[hash]
+	return append([]dpath.ID(nil), ids...), ok
 }
 
 // Get will get slice of files associated with hash.
 func (d *Dmap) Get(hash Digest) (files []string, err error) {
-	res, ok := d.filesMap[hash]
+	res, ok := d.ids(hash)
 	if !ok {
 		return []string{}, err
 	}
 
-	return res, nil
+	return d.resolve(res), nil
 }
 
-// GetMap will return the map.
+// GetMap returns a copy of the map with paths resolved to strings. Changes to
+// the copy do not affect the Dmap; use SetPaths to rewrite a group.
 func (d *Dmap) GetMap() map[Digest][]string {
-	return d.filesMap
+	out := make(map[Digest][]string, d.MapSize())
+	d.rangeGroups(func(hash Digest, ids []dpath.ID) {
+		out[hash] = d.resolve(ids)
+	})
+	return out
+}
+
+// GroupIDs returns a snapshot of digests to path IDs without resolving paths.
+// Callers must not modify the ID slices.
+func (d *Dmap) GroupIDs() map[Digest][]dpath.ID {
+	out := make(map[Digest][]dpath.ID, d.MapSize())
+	d.rangeGroups(func(hash Digest, ids []dpath.ID) {
+		out[hash] = ids
+	})
+	return out
+}
+
+// SetPaths replaces the files recorded under hash. Paths already in the group
+// keep their IDs and details; new ones are interned.
+func (d *Dmap) SetPaths(hash Digest, paths []string) {
+	s := d.shardFor(hash)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.files[hash]
+	existing := make(map[string]dpath.ID, len(old))
+	for _, id := range old {
+		existing[d.paths.Path(id)] = id
+	}
+	ids := make([]dpath.ID, 0, len(paths))
+	for _, path := range paths {
+		id, ok := existing[path]
+		if !ok {
+			id = d.paths.Add(path)
+		}
+		ids = append(ids, id)
+	}
+	d.fileCount.Add(uint64(len(ids)))
+	d.fileCount.Add(-uint64(len(old)))
+	s.files[hash] = ids
+}
+
+// FileInfo returns the details recorded for id by AddFile, if any.
+func (d *Dmap) FileInfo(id dpath.ID) (FileInfo, bool) {
+	if d == nil {
+		return FileInfo{}, false
+	}
+	s := d.infoShardFor(id)
+	s.mu.RLock()
+	info, ok := s.info[id]
+	s.mu.RUnlock()
+	return info, ok
+}
+
+// info is FileInfo without the presence flag.
+func (d *Dmap) info(id dpath.ID) FileInfo {
+	info, _ := d.FileInfo(id)
+	return info
+}
+
+// FileMeta returns the stat details of id's file recorded during the walk,
+// falling back to an lstat for files added without them.
+func (d *Dmap) FileMeta(id dpath.ID) (dfs.FileMeta, error) {
+	if info, ok := d.FileInfo(id); ok && info.Known() {
+		return info.FileMeta, nil
+	}
+	return dfs.LstatMeta(d.paths.Path(id))
+}
+
+// FileUsage returns the apparent and allocated sizes of id's file. Sizes
+// carried through the scan are used when known; otherwise the file is stat'd.
+func (d *Dmap) FileUsage(id dpath.ID) (size, allocated uint64) {
+	if info, ok := d.FileInfo(id); ok {
+		return uint64(max(info.Size, 0)), uint64(max(info.DiskSize, 0))
+	}
+	return dfs.GetFileUsage(d.paths.Path(id))
 }
 
 func (d *Dmap) MatchInfo(hash Digest) MatchInfo {
 	if d == nil {
 		return MatchInfo{Type: MatchContent, Key: ""}
 	}
-	if info, ok := d.matches[hash]; ok {
+	s := d.shardFor(hash)
+	s.mu.RLock()
+	info, ok := s.matches[hash]
+	s.mu.RUnlock()
+	if ok {
 		if info.Type == "" {
 			info.Type = MatchContent
 		}
@@ -241,6 +663,15 @@ func (d *Dmap) headerFor(hash Digest) string {
 	if info.Type == MatchFuzzy {
 		return fmt.Sprintf("Similar: %s", info.Key)
 	}
+	if info.Type == MatchZeroFilled {
+		return fmt.Sprintf("Zero-filled: %s", info.Key)
+	}
+	if info.Type == MatchDirTree {
+		return fmt.Sprintf("Directory tree: %s", info.Key)
+	}
+	if info.Type == MatchDirSuperset {
+		return fmt.Sprintf("Superset: %s", info.Key)
+	}
 	return fmt.Sprintf("Hash: %s", info.Key)
 }
 
@@ -257,18 +688,24 @@ func (d *Dmap) FilterToDigest(digest Digest, targetPath string) int {
 	if d == nil {
 		return 0
 	}
-	paths := append([]string(nil), d.filesMap[digest]...)
+	ids, _ := d.ids(digest)
+	paths := d.resolve(ids)
 	dups := countDuplicateEntries(paths, targetPath)
 	if dups == 0 {
 		return 0
 	}
-	d.filesMap[digest] = promotePathFirst(paths, targetPath)
-	for hash := range d.filesMap {
+	promoted := promotePathFirst(paths, targetPath)
+	if len(promoted) > len(ids) {
+		ids = append([]dpath.ID{d.paths.Add(targetPath)}, ids...)
+	} else {
+		ids = promoteIDFirst(ids, paths, targetPath)
+	}
+	d.setGroup(digest, ids)
+	d.rangeGroups(func(hash Digest, _ []dpath.ID) {
 		if hash != digest {
-			delete(d.filesMap, hash)
-			delete(d.matches, hash)
+			d.deleteGroup(hash)
 		}
-	}
+	})
 	return dups
 }
 
@@ -314,67 +751,118 @@ func promotePathFirst(paths []string, target string) []string {
 	}
 }
 
-// RemoveDuplicates removes duplicates, leaving at most "keep" files per group. Returns removed file paths.
-func (d *Dmap) RemoveDuplicates(keep uint) ([]string, error) {
-	if keep == 0 {
-		return nil, errors.New("keep count must be greater than zero")
-	}
-
-	// Guard against integer overflow
-	if keep > uint(math.MaxInt) {
-		dsklog.Dlogger.Debug("keep value overflow")
-		return nil, fmt.Errorf("keep count of %d exceeds maximum %d", keep, math.MaxInt)
-	}
-	keepThreshold := int(keep)
-
-	var removed []string
-	var errs []error
-
-	for hash, files := range d.filesMap {
-		if uint(len(files)) <= keep {
+// promoteIDFirst moves the ID whose path equals target to index 0, mirroring
+// promotePathFirst for a group whose paths are already known.
+func promoteIDFirst(ids []dpath.ID, paths []string, target string) []dpath.ID {
+	for i, p := range paths {
+		if p != target {
 			continue
 		}
-
-		keepCount := keepThreshold
-		if keepCount > len(files) {
-			keepCount = len(files)
+		if i == 0 {
+			return ids
 		}
+		result := make([]dpath.ID, 0, len(ids))
+		result = append(result, ids[i])
+		result = append(result, ids[:i]...)
+		result = append(result, ids[i+1:]...)
+		return result
+	}
+	return ids
+}
 
-		survivors := append([]string(nil), files[:keepCount]...)
+// checkSurvivor returns an error when id, the file a group's extra copies
+// defer to, changed since its results were saved.
+func (d *Dmap) checkSurvivor(id dpath.ID) error {
+	if !d.info(id).Stale {
+		return nil
+	}
+	return fmt.Errorf("skip group of %s: file changed since scan", d.paths.Path(id))
+}
 
-		for _, path := range files[keepCount:] {
-			if err := os.Remove(path); err != nil {
-				errs = append(errs, fmt.Errorf("remove %s: %w", path, err))
-				survivors = append(survivors, path)
-				continue
-			}
-			dsklog.Dlogger.Infof("Removed duplicate file: %s", path)
-			removed = append(removed, path)
-			if d.fileCount > 0 {
-				d.fileCount--
-			}
-		}
+// skipStale reports whether id changed since its results were saved and
+// should be left alone.
+func (d *Dmap) skipStale(id dpath.ID) bool {
+	if !d.info(id).Stale {
+		return false
+	}
+	dsklog.Dlogger.Infof("Skipping stale file: %s", d.paths.Path(id))
+	return true
+}
 
-		if len(survivors) == 0 {
-			delete(d.filesMap, hash)
-			delete(d.matches, hash)
-			continue
-		}
+// SetVerifyHash makes the duplicate actions re-hash every file they are about
+// to remove or replace, and the kept copy it defers to, with algo right before
+// acting. The empty algorithm, the default, only compares size and mtime.
+func (d *Dmap) SetVerifyHash(algo dfs.HashAlgorithm) {
+	d.rehash = algo
+}
 
-		d.filesMap[hash] = survivors
+// checkUnchanged returns an error wrapping dfs.ErrChanged if id no longer has
+// the size and mtime it was scanned with or, with SetVerifyHash, no longer
+// hashes to hash, or wrapping ErrTooRecent if the guard finds it modified too
+// recently. Only content groups are re-hashed; other digests aren't content
+// hashes.
+func (d *Dmap) checkUnchanged(hash Digest, id dpath.ID) error {
+	path := d.paths.Path(id)
+	if err := dfs.CheckUnchanged(path, d.info(id).FileMeta); err != nil {
+		return err
+	}
+	if err := d.guard.CheckSettled(path); err != nil {
+		return err
 	}
+	if d.rehash == "" {
+		return nil
+	}
+	if t := d.MatchInfo(hash).Type; t != MatchContent && t != MatchZeroFilled {
+		return nil
+	}
+	return dfs.CheckHash(path, hash, d.rehash)
+}
 
-	if len(errs) > 0 {
-		return removed, errors.Join(errs...)
+// SetJournal makes RemoveDuplicates and the conversions journal every file of
+// a file group they act on. prepare is called right before acting, with the
+// group's digest, the kept file the action defers to and the file about to be
+// acted on, and returns the func that records it, called only once the action
+// succeeded. A file prepare fails for is left alone; an error from recording
+// is reported with the action's other errors, the file staying as the action
+// left it. A nil prepare, the default, journals nothing.
+func (d *Dmap) SetJournal(prepare func(hash Digest, keep, id dpath.ID) (func() error, error)) {
+	d.journal = prepare
+}
+
+// prepareJournal returns the func recording id with the journal set with
+// SetJournal, or one doing nothing without a journal.
+func (d *Dmap) prepareJournal(hash Digest, keep, id dpath.ID) (func() error, error) {
+	if d.journal == nil {
+		return func() error { return nil }, nil
+	}
+	record, err := d.journal(hash, keep, id)
+	if err != nil {
+		return nil, fmt.Errorf("journal %s: %w", d.paths.Path(id), err)
 	}
+	return func() error {
+		if err := record(); err != nil {
+			return fmt.Errorf("journal %s: %w", d.paths.Path(id), err)
+		}
+		return nil
+	}, nil
+}
 
-	return removed, nil
+// SetDisposal makes RemoveDuplicates move removed files and directories to
+// the Trash or a quarantine directory instead of deleting them. A nil
+// disposal, the default, deletes them.
+func (d *Dmap) SetDisposal(disposal *dfs.Disposal) {
+	d.dispose = disposal
 }
 
-// LinkDuplicates converts duplicates to symbolic links, leaving at most "keep" real files per group.
-// It removes each extra duplicate and recreates it as a symlink pointing to one of the kept files.
-// It returns the paths that were successfully converted to symlinks.
-func (d *Dmap) LinkDuplicates(keep uint) ([]string, error) {
+// RemoveDuplicates removes duplicates, leaving at most "keep" files per group. Returns removed file paths.
+// The keep policy set with SetKeepPolicy picks the files kept; files flagged
+// Stale or protected by the policy or the guard, that no longer match their scanned
+// size, mtime or (with SetVerifyHash) hash, or that the guard finds too recently
+// modified, are left in place. A batch over the guard's limits fails before anything
+// is removed. Removed files go where the
+// disposal set with SetDisposal sends them. Directory groups go first, each extra
+// directory removed as a unit with RemoveTree.
+func (d *Dmap) RemoveDuplicates(keep uint) ([]string, error) {
 	if keep == 0 {
 		return nil, errors.New("keep count must be greater than zero")
 	}
@@ -385,54 +873,104 @@ func (d *Dmap) LinkDuplicates(keep uint) ([]string, error) {
 		return nil, fmt.Errorf("keep count of %d exceeds maximum %d", keep, math.MaxInt)
 	}
 	keepThreshold := int(keep)
+	if err := d.checkBatch(keepThreshold); err != nil {
+		return nil, err
+	}
 
-	var linked []string
-	var errs []error
+	verb := "removed"
+	if d.dispose != nil {
+		verb = d.dispose.Verb()
+	}
+	removed, errs := d.applyTrees(keepThreshold, verb, func(dir, keep string) error {
+		return RemoveTree(dir, keep, d.dispose)
+	})
 
-	for hash, files := range d.filesMap {
-		if uint(len(files)) <= keep {
-			continue
+	d.rangeGroups(func(hash Digest, files []dpath.ID) {
+		if uint(len(files)) <= keep || d.MatchInfo(hash).Type.IsDirectory() {
+			return
 		}
+		files = d.keepOrder(files)
 
 		keepCount := keepThreshold
 		if keepCount > len(files) {
 			keepCount = len(files)
 		}
 
-		// Survivors remain as real files. We point all converted symlinks at the first survivor.
-		survivors := append([]string(nil), files[:keepCount]...)
-		target := survivors[0]
+		survivors := append([]dpath.ID(nil), files[:keepCount]...)
+		if err := d.checkSurvivor(survivors[0]); err != nil {
+			errs = append(errs, err)
+			return
+		}
+		if err := d.checkUnchanged(hash, survivors[0]); err != nil {
+			errs = append(errs, fmt.Errorf("skip group: %w", err))
+			return
+		}
 
-		for _, path := range files[keepCount:] {
-			if err := os.Remove(path); err != nil {
-				errs = append(errs, fmt.Errorf("remove %s: %w", path, err))
-				survivors = append(survivors, path)
+		for _, id := range files[keepCount:] {
+			path := d.paths.Path(id)
+			if d.skipStale(id) || d.skipProtected(id) {
+				survivors = append(survivors, id)
 				continue
 			}
-			if err := os.Symlink(target, path); err != nil {
-				errs = append(errs, fmt.Errorf("symlink %s -> %s: %w", path, target, err))
-				// Try to preserve logical membership if the symlink creation fails.
-				survivors = append(survivors, path)
+			if err := d.checkUnchanged(hash, id); err != nil {
+				errs = append(errs, err)
+				survivors = append(survivors, id)
 				continue
 			}
-			dsklog.Dlogger.Infof("Converted duplicate to symlink: %s -> %s", path, target)
-			linked = append(linked, path)
+			record, err := d.prepareJournal(hash, survivors[0], id)
+			if err != nil {
+				errs = append(errs, err)
+				survivors = append(survivors, id)
+				continue
+			}
+			if err := d.dispose.Remove(path); err != nil {
+				errs = append(errs, fmt.Errorf("remove %s: %w", path, err))
+				survivors = append(survivors, id)
+				continue
+			}
+			dsklog.Dlogger.Infof("Removed duplicate file (%s): %s", verb, path)
+			if err := record(); err != nil {
+				errs = append(errs, err)
+			}
+			d.deleteInfo(id)
+			removed = append(removed, path)
+			d.fileCount.Add(^uint64(0))
 		}
 
 		if len(survivors) == 0 {
-			delete(d.filesMap, hash)
-			delete(d.matches, hash)
-			continue
+			d.deleteGroup(hash)
+			return
 		}
 
-		d.filesMap[hash] = survivors
-	}
+		d.setGroup(hash, survivors)
+	})
 
 	if len(errs) > 0 {
-		return linked, errors.Join(errs...)
+		return removed, errors.Join(errs...)
 	}
 
-	return linked, nil
+	return removed, nil
+}
+
+// SetLinkStyle sets how the symlinks LinkDuplicates creates name their
+// target. The zero style writes absolute links.
+func (d *Dmap) SetLinkStyle(style dfs.LinkStyle) {
+	d.linkStyle = style
+}
+
+// LinkDuplicates converts duplicates to symbolic links, leaving at most "keep" real files per group.
+// Each extra duplicate is atomically replaced by a symlink, written in the style set with
+// SetLinkStyle, pointing to one of the kept files; links that don't resolve to it are rolled back.
+// Extra directories in directory groups are replaced by a single symlink with LinkTree.
+// It returns the paths that were successfully converted to symlinks.
+func (d *Dmap) LinkDuplicates(keep uint) ([]string, error) {
+	tree := func(dir, keep string) error {
+		return LinkTree(dir, keep, d.linkStyle)
+	}
+	replace := func(path, target string) error {
+		return dfs.SymlinkReplace(path, target, d.linkStyle)
+	}
+	return d.replaceDuplicates(keep, "symlink", "linked", tree, replace)
 }
 
 // ReflinkDuplicates converts duplicates to copy-on-write reflink clones, leaving at most
@@ -441,8 +979,42 @@ func (d *Dmap) LinkDuplicates(keep uint) ([]string, error) {
 // LinkDuplicates, converted files remain independent regular files rather than symlinks.
 // Requires a reflink-capable filesystem (e.g. APFS, Btrfs, XFS with reflink=1); returns
 // dfs.ErrReflinkUnsupported per-file when the filesystem or platform can't clone.
+// Files in extra directories of directory groups are cloned from the kept tree with ReflinkTree.
 // It returns the paths that were successfully converted.
 func (d *Dmap) ReflinkDuplicates(keep uint) ([]string, error) {
+	return d.replaceDuplicates(keep, "reflink", "reflinked", ReflinkTree, dfs.ReflinkReplace)
+}
+
+// HardlinkDuplicates converts duplicates to hard links, leaving at most "keep" distinct
+// files per group. Each extra duplicate is atomically replaced by a hard link to one of
+// the kept files, so every path stays a regular file while the data is stored once.
+// Duplicates on a different device from the kept file fail with dfs.ErrCrossDevice and
+// are left untouched. Files in extra directories of directory groups are linked to their
+// copies in the kept tree with HardlinkTree.
+// It returns the paths that were successfully converted.
+func (d *Dmap) HardlinkDuplicates(keep uint) ([]string, error) {
+	return d.replaceDuplicates(keep, "hard link", "hard linked", HardlinkTree, dfs.HardlinkReplace)
+}
+
+// DedupeDuplicates shares the data of duplicates with one kept file per group, leaving at
+// most "keep" unshared files. Each extra duplicate is passed to the kernel with dfs.Dedupe,
+// which verifies it is still byte-identical to the kept file before sharing extents, so
+// duplicates keep their inode and metadata and files changed since the scan are refused.
+// Requires Linux and a filesystem with FIDEDUPERANGE (e.g. Btrfs, XFS with reflink=1);
+// returns dfs.ErrDedupeUnsupported per-file otherwise. Files in extra directories of
+// directory groups are deduplicated against the kept tree with DedupeTree.
+// It returns the paths that were deduplicated.
+func (d *Dmap) DedupeDuplicates(keep uint) ([]string, error) {
+	return d.replaceDuplicates(keep, "dedupe", "deduplicated", DedupeTree, dfs.Dedupe)
+}
+
+// replaceDuplicates replaces the extra members of every group with replace,
+// pointing them at the first kept file, and the extra members of directory
+// groups with tree. kind names the replacement in logs and errors, and verb
+// describes it when logging replaced directories. Files are checked with
+// checkUnchanged first, as in RemoveDuplicates. Replacements that lost some of
+// a file's metadata count as replaced and are reported in the error.
+func (d *Dmap) replaceDuplicates(keep uint, kind, verb string, tree func(dir, keep string) error, replace func(path, target string) error) ([]string, error) {
 	if keep == 0 {
 		return nil, errors.New("keep count must be greater than zero")
 	}
@@ -453,48 +1025,80 @@ func (d *Dmap) ReflinkDuplicates(keep uint) ([]string, error) {
 		return nil, fmt.Errorf("keep count of %d exceeds maximum %d", keep, math.MaxInt)
 	}
 	keepThreshold := int(keep)
+	if err := d.checkBatch(keepThreshold); err != nil {
+		return nil, err
+	}
 
-	var reflinked []string
-	var errs []error
+	replaced, errs := d.applyTrees(keepThreshold, verb, tree)
 
-	for hash, files := range d.filesMap {
-		if uint(len(files)) <= keep {
-			continue
+	d.rangeGroups(func(hash Digest, files []dpath.ID) {
+		if uint(len(files)) <= keep || d.MatchInfo(hash).Type.IsDirectory() {
+			return
 		}
+		files = d.keepOrder(files)
 
 		keepCount := keepThreshold
 		if keepCount > len(files) {
 			keepCount = len(files)
 		}
 
-		// Survivors remain as real files. We clone all converted duplicates from the first survivor.
-		survivors := append([]string(nil), files[:keepCount]...)
-		target := survivors[0]
+		// Survivors remain as distinct files. Every converted duplicate points at the first survivor.
+		survivors := append([]dpath.ID(nil), files[:keepCount]...)
+		if err := d.checkSurvivor(survivors[0]); err != nil {
+			errs = append(errs, err)
+			return
+		}
+		if err := d.checkUnchanged(hash, survivors[0]); err != nil {
+			errs = append(errs, fmt.Errorf("skip group: %w", err))
+			return
+		}
+		target := d.paths.Path(survivors[0])
 
-		for _, path := range files[keepCount:] {
-			if err := dfs.ReflinkReplace(path, target); err != nil {
-				errs = append(errs, fmt.Errorf("reflink %s -> %s: %w", path, target, err))
-				// Preserve logical membership if the clone attempt fails; the original
-				// duplicate file is left untouched by ReflinkReplace.
-				survivors = append(survivors, path)
+		for _, id := range files[keepCount:] {
+			path := d.paths.Path(id)
+			if d.skipStale(id) || d.skipProtected(id) {
+				survivors = append(survivors, id)
+				continue
+			}
+			if err := d.checkUnchanged(hash, id); err != nil {
+				errs = append(errs, err)
+				survivors = append(survivors, id)
 				continue
 			}
-			dsklog.Dlogger.Infof("Converted duplicate to reflink: %s -> %s", path, target)
-			reflinked = append(reflinked, path)
+			record, err := d.prepareJournal(hash, survivors[0], id)
+			if err != nil {
+				errs = append(errs, err)
+				survivors = append(survivors, id)
+				continue
+			}
+			if err := replace(path, target); err != nil {
+				errs = append(errs, fmt.Errorf("%s %s -> %s: %w", kind, path, target, err))
+				if !errors.Is(err, dfs.ErrMetadataNotPreserved) {
+					// Preserve logical membership if the replacement fails; the
+					// original duplicate is left untouched.
+					survivors = append(survivors, id)
+					continue
+				}
+			}
+			dsklog.Dlogger.Infof("Converted duplicate to %s: %s -> %s", kind, path, target)
+			if err := record(); err != nil {
+				errs = append(errs, err)
+			}
+			d.deleteInfo(id)
+			replaced = append(replaced, path)
 		}
 
 		if len(survivors) == 0 {
-			delete(d.filesMap, hash)
-			delete(d.matches, hash)
-			continue
+			d.deleteGroup(hash)
+			return
 		}
 
-		d.filesMap[hash] = survivors
-	}
+		d.setGroup(hash, survivors)
+	})
 
 	if len(errs) > 0 {
-		return reflinked, errors.Join(errs...)
+		return replaced, errors.Join(errs...)
 	}
 
-	return reflinked, nil
+	return replaced, nil
 }
@@ -9,9 +9,13 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
 	"github.com/jdefrancesco/dskDitto/internal/dsklog"
 )
 
@@ -124,7 +128,7 @@ func FuzzDmapAdd(f *testing.F) {
 			0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20}
 
 		// Test adding files to the map
-		dm.filesMap[testHash] = append(dm.filesMap[testHash], name)
+		dm.addID(testHash, dm.paths.Add(name), MatchContent)
 
 		// Test Get operation
 		files, err := dm.Get(testHash)
@@ -241,6 +245,53 @@ func TestRemoveDuplicates(t *testing.T) {
 	}
 }
 
+func TestRemoveDuplicatesQuarantine(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	tmp := t.TempDir()
+	scan := filepath.Join(tmp, "scan")
+	if err := os.Mkdir(scan, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(scan, fmt.Sprintf("dup_%d.dat", i))
+		if writeErr := os.WriteFile(path, []byte("duplicate"), 0o644); writeErr != nil {
+			t.Fatalf("write %s: %v", path, writeErr)
+		}
+		df, dfErr := dfs.NewDfile(path, int64(len("duplicate")), dfs.HashSHA256)
+		if dfErr != nil {
+			t.Fatalf("NewDfile(%s): %v", path, dfErr)
+		}
+		dm.Add(df)
+	}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local)
+	disposal, err := dfs.QuarantineDisposal(filepath.Join(tmp, "quarantine"), now)
+	if err != nil {
+		t.Fatalf("QuarantineDisposal: %v", err)
+	}
+	dm.SetDisposal(disposal)
+
+	removed, removeErr := dm.RemoveDuplicates(1)
+	if removeErr != nil {
+		t.Fatalf("RemoveDuplicates returned error: %v", removeErr)
+	}
+	if len(removed) != 1 {
+		t.Fatalf("expected 1 file removed, got %d", len(removed))
+	}
+	if _, statErr := os.Stat(removed[0]); !errors.Is(statErr, os.ErrNotExist) {
+		t.Fatalf("expected %s to be moved away, stat err: %v", removed[0], statErr)
+	}
+	moved := filepath.Join(tmp, "quarantine", "2026-01-02T030405", strings.TrimPrefix(removed[0], string(filepath.Separator)))
+	if _, statErr := os.Stat(moved); statErr != nil {
+		t.Fatalf("expected quarantined copy at %s: %v", moved, statErr)
+	}
+}
+
 func TestRemoveDuplicatesZeroKeep(t *testing.T) {
 	setupLogging()
 
@@ -254,6 +305,56 @@ func TestRemoveDuplicatesZeroKeep(t *testing.T) {
 	}
 }
 
+func TestLinkDuplicatesRelative(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	dm.SetLinkStyle(dfs.LinkRelative)
+
+	tmp := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a/dup.dat", "b/c/dup.dat"} {
+		path := filepath.Join(tmp, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if writeErr := os.WriteFile(path, []byte("duplicate"), 0o644); writeErr != nil {
+			t.Fatalf("write %s: %v", path, writeErr)
+		}
+		df, dfErr := dfs.NewDfile(path, int64(len("duplicate")), dfs.HashSHA256)
+		if dfErr != nil {
+			t.Fatalf("NewDfile(%s): %v", path, dfErr)
+		}
+		dm.Add(df)
+		paths = append(paths, path)
+	}
+
+	linked, linkErr := dm.LinkDuplicates(1)
+	if linkErr != nil {
+		t.Fatalf("LinkDuplicates returned error: %v", linkErr)
+	}
+	if len(linked) != 1 {
+		t.Fatalf("expected 1 file linked, got %d", len(linked))
+	}
+	kept := paths[0]
+	if linked[0] == paths[0] {
+		kept = paths[1]
+	}
+	text, err := os.Readlink(linked[0])
+	if err != nil {
+		t.Fatalf("readlink %s: %v", linked[0], err)
+	}
+	if filepath.IsAbs(text) {
+		t.Fatalf("expected a relative link, got %q", text)
+	}
+	if got := filepath.Join(filepath.Dir(linked[0]), text); got != kept {
+		t.Fatalf("link resolves to %s, want %s", got, kept)
+	}
+}
+
 func TestReflinkDuplicates(t *testing.T) {
 	setupLogging()
 
@@ -326,6 +427,74 @@ func TestReflinkDuplicatesZeroKeep(t *testing.T) {
 	}
 }
 
+func TestHardlinkDuplicates(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	tmp := t.TempDir()
+	const keep uint = 1
+	var dfiles []*dfs.Dfile
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(tmp, fmt.Sprintf("dup_%d.dat", i))
+		if writeErr := os.WriteFile(path, []byte("duplicate"), 0o644); writeErr != nil {
+			t.Fatalf("write %s: %v", path, writeErr)
+		}
+		df, dfErr := dfs.NewDfile(path, int64(len("duplicate")), dfs.HashSHA256)
+		if dfErr != nil {
+			t.Fatalf("NewDfile(%s): %v", path, dfErr)
+		}
+		dfiles = append(dfiles, df)
+		dm.Add(df)
+	}
+
+	linked, linkErr := dm.HardlinkDuplicates(keep)
+	if linkErr != nil {
+		t.Fatalf("HardlinkDuplicates returned error: %v", linkErr)
+	}
+	if len(linked) != 2 {
+		t.Fatalf("expected 2 files hard linked, got %d", len(linked))
+	}
+
+	hashKey := Digest(dfiles[0].Hash())
+	remaining := dm.GetMap()[hashKey]
+	if len(remaining) != int(keep) {
+		t.Fatalf("expected %d survivor, got %d", keep, len(remaining))
+	}
+	keptInfo, err := os.Stat(remaining[0])
+	if err != nil {
+		t.Fatalf("stat survivor: %v", err)
+	}
+	for _, path := range linked {
+		info, statErr := os.Lstat(path)
+		if statErr != nil {
+			t.Fatalf("expected %s to survive: %v", path, statErr)
+		}
+		if !info.Mode().IsRegular() {
+			t.Fatalf("expected %s to remain a regular file", path)
+		}
+		if !os.SameFile(info, keptInfo) {
+			t.Fatalf("expected %s to be a hard link to the survivor", path)
+		}
+	}
+}
+
+func TestHardlinkDuplicatesZeroKeep(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(0)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	if _, linkErr := dm.HardlinkDuplicates(0); linkErr == nil {
+		t.Fatalf("expected error when keep is zero")
+	}
+}
+
 func TestExportJSONAndCSV(t *testing.T) {
 	setupLogging()
 
@@ -347,7 +516,8 @@ func TestExportJSONAndCSV(t *testing.T) {
 
 	var digest Digest
 	digest[0] = 0x1
-	dm.filesMap[digest] = []string{fileA, fileB}
+	dm.AddPath(digest, fileA)
+	dm.AddPath(digest, fileB)
 
 	jsonPath := filepath.Join(tmp, "dups.json")
 	if err := dm.WriteJSON(jsonPath); err != nil {
@@ -510,3 +680,477 @@ func TestAddFuzzyPathRecordsFuzzyMatch(t *testing.T) {
 		t.Fatalf("expected fuzzy match key, got %s", info.Key)
 	}
 }
+
+func TestAddFileRecordsZeroFilledMatch(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	var zeroDigest, dataDigest Digest
+	zeroDigest[0] = 0x1
+	dataDigest[0] = 0x2
+	sparse := FileInfo{FileMeta: dfs.FileMeta{Size: 1 << 30, DiskSize: 4096}, Sparse: true, ZeroFilled: true}
+	dm.AddFile(zeroDigest, "/tmp/one/partial.iso", sparse)
+	dm.AddFile(zeroDigest, "/tmp/two/partial.iso", FileInfo{FileMeta: dfs.FileMeta{Size: 1 << 30, DiskSize: 1 << 30}, ZeroFilled: true})
+	dm.AddFile(dataDigest, "/tmp/one/data.bin", FileInfo{FileMeta: dfs.FileMeta{Size: 10, DiskSize: 4096}})
+
+	if info := dm.MatchInfo(zeroDigest); info.Type != MatchZeroFilled {
+		t.Fatalf("expected zero-filled match type, got %s", info.Type)
+	}
+	if info := dm.MatchInfo(dataDigest); info.Type != MatchContent {
+		t.Fatalf("expected content match type, got %s", info.Type)
+	}
+	if dm.FileCount() != 3 {
+		t.Fatalf("expected 3 files, got %d", dm.FileCount())
+	}
+
+	got, ok := dm.FileInfo(dm.GroupIDs()[zeroDigest][0])
+	if !ok || got != sparse {
+		t.Fatalf("FileInfo = %+v, %v; want %+v", got, ok, sparse)
+	}
+	if want := "[sparse, zero-filled, 1.00 GiB apparent / 4.00 KiB allocated]"; got.Annotation() != want {
+		t.Fatalf("Annotation = %q, want %q", got.Annotation(), want)
+	}
+	if info, _ := dm.FileInfo(dm.GroupIDs()[dataDigest][0]); info.Annotation() != "" {
+		t.Fatalf("ordinary file should not be annotated, got %q", info.Annotation())
+	}
+}
+
+func TestExportIncludesAllocationDetails(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	tmp := t.TempDir()
+	fileA := filepath.Join(tmp, "zeroA.bin")
+	fileB := filepath.Join(tmp, "zeroB.bin")
+	for _, path := range []string{fileA, fileB} {
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		if err := os.Truncate(path, 1<<20); err != nil {
+			t.Fatalf("truncate %s: %v", path, err)
+		}
+		df, err := dfs.NewDfile(path, 1<<20, dfs.HashSHA256)
+		if err != nil {
+			t.Fatalf("NewDfile(%s) failed: %v", path, err)
+		}
+		dm.Add(df)
+	}
+
+	csvPath := filepath.Join(tmp, "dups.csv")
+	if err := dm.WriteCSV(csvPath); err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+	csvFile, err := os.Open(csvPath)
+	if err != nil {
+		t.Fatalf("Open CSV: %v", err)
+	}
+	defer csvFile.Close()
+	rows, err := csv.NewReader(csvFile).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll CSV: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if got := rows[0][6:]; len(got) != 12 || got[0] != "allocated_bytes" || got[1] != "sparse" || got[2] != "zero_filled" || got[3] != "already_deduplicated" {
+		t.Fatalf("unexpected trailing header columns: %v", got)
+	}
+	for _, row := range rows[1:] {
+		if row[0] != string(MatchZeroFilled) {
+			t.Fatalf("unexpected match type in CSV row: %s", row[0])
+		}
+		if row[5] != strconv.Itoa(1<<20) {
+			t.Fatalf("unexpected apparent size: %s", row[5])
+		}
+		if row[8] != "true" {
+			t.Fatalf("expected zero_filled=true, got %s", row[8])
+		}
+	}
+
+	jsonPath := filepath.Join(tmp, "dups.json")
+	if err := dm.WriteJSON(jsonPath); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	jsonData, err := os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatalf("ReadFile JSON: %v", err)
+	}
+	var summary exportSummary
+	if err := json.Unmarshal(jsonData, &summary); err != nil {
+		t.Fatalf("Unmarshal JSON: %v", err)
+	}
+	for _, f := range summary.Groups[0].Files {
+		if !f.ZeroFilled {
+			t.Fatalf("expected %s to be zero-filled in JSON", f.Path)
+		}
+		if f.Sparse && f.AllocatedSize >= f.Size {
+			t.Fatalf("%s flagged sparse but allocates %d of %d bytes", f.Path, f.AllocatedSize, f.Size)
+		}
+	}
+}
+
+func TestExportReclaimableUsesDiskSizeAndSkipsDeduplicated(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	tmp := t.TempDir()
+	var digest Digest
+	digest[0] = 0x7
+	paths := []string{filepath.Join(tmp, "a"), filepath.Join(tmp, "b"), filepath.Join(tmp, "c")}
+	for _, path := range paths {
+		if err := os.WriteFile(path, []byte("0123456789"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		dm.AddFile(digest, path, FileInfo{FileMeta: dfs.FileMeta{Size: 10, DiskSize: 4096}})
+	}
+	if flagged := dm.MarkSharedExtents(); flagged != 0 {
+		t.Fatalf("independent copies flagged as shared: %d", flagged)
+	}
+
+	summary := dm.collectExportSummary()
+	if summary.ApparentSize != 30 || summary.DiskSize != 3*4096 {
+		t.Fatalf("unexpected totals apparent=%d disk=%d", summary.ApparentSize, summary.DiskSize)
+	}
+	if summary.ReclaimableSize != 2*4096 {
+		t.Fatalf("expected %d reclaimable bytes before dedup, got %d", 2*4096, summary.ReclaimableSize)
+	}
+
+	deduped := dm.GroupIDs()[digest][2]
+	info, _ := dm.FileInfo(deduped)
+	info.AlreadyDeduplicated = true
+	dm.setInfo(deduped, info)
+
+	summary = dm.collectExportSummary()
+	if summary.ReclaimableSize != 4096 || summary.Groups[0].ReclaimableSize != 4096 {
+		t.Fatalf("expected 4096 reclaimable bytes after dedup, got %d", summary.ReclaimableSize)
+	}
+	for _, f := range summary.Groups[0].Files {
+		if f.AlreadyDeduplicated != (f.Path == paths[2]) {
+			t.Fatalf("unexpected already_deduplicated=%v for %s", f.AlreadyDeduplicated, f.Path)
+		}
+	}
+	if got := info.Annotation(); got != "[already deduplicated]" {
+		t.Fatalf("unexpected annotation %q", got)
+	}
+}
+
+func TestGroupRootsAttributesFilesToInnermostRoot(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	dm.SetRoots([]string{"/data", "/backup", "/data/nested"})
+
+	var cross, nested Digest
+	cross[0], nested[0] = 0x1, 0x2
+	dm.AddPath(cross, "/data/a.txt")
+	dm.AddPath(cross, "/backup/a.txt")
+	dm.AddPath(nested, "/data/b.txt")
+	dm.AddPath(nested, "/data/nested/b.txt")
+
+	if got := dm.GroupRoots(cross); len(got) != 2 || got[0] != "/data" || got[1] != "/backup" {
+		t.Fatalf("GroupRoots(cross) = %v", got)
+	}
+	if got := dm.GroupRoots(nested); len(got) != 2 || got[0] != "/data" || got[1] != "/data/nested" {
+		t.Fatalf("GroupRoots(nested) = %v", got)
+	}
+
+	summary := dm.collectExportSummary()
+	for _, group := range summary.Groups {
+		if len(group.Roots) != 2 {
+			t.Fatalf("export group %s missing roots: %v", group.Hash, group.Roots)
+		}
+	}
+
+	dm.SetRoots([]string{"/data"})
+	if got := dm.GroupRoots(cross); got != nil {
+		t.Fatalf("single-root scan should not report roots, got %v", got)
+	}
+}
+
+func TestPathsAreInternedAndResolved(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	var digest Digest
+	digest[0] = 0x9
+	info := FileInfo{FileMeta: dfs.FileMeta{Size: 10, DiskSize: 4096}, Sparse: true}
+	id := dm.Paths().Add("/data/b/copy.txt")
+	dm.AddFileID(digest, id, info)
+	dm.AddPath(digest, "/data/a/copy.txt")
+
+	if got := dm.Path(id); got != "/data/b/copy.txt" {
+		t.Fatalf("Path(%d) = %q", id, got)
+	}
+	if dm.Paths().DirCount() != 2 {
+		t.Fatalf("expected two interned directories, got %d", dm.Paths().DirCount())
+	}
+
+	// GetMap hands out a copy; editing it must not change the Dmap.
+	snapshot := dm.GetMap()
+	snapshot[digest][0] = "/elsewhere"
+	if files, _ := dm.Get(digest); files[0] != "/data/b/copy.txt" {
+		t.Fatalf("GetMap copy leaked into the Dmap: %v", files)
+	}
+
+	dm.SetPaths(digest, []string{"/data/a/copy.txt", "/data/b/copy.txt", "/data/c/copy.txt"})
+	files, _ := dm.Get(digest)
+	if len(files) != 3 || files[0] != "/data/a/copy.txt" || files[2] != "/data/c/copy.txt" {
+		t.Fatalf("unexpected files after SetPaths: %v", files)
+	}
+	if dm.FileCount() != 3 {
+		t.Fatalf("expected 3 files after SetPaths, got %d", dm.FileCount())
+	}
+	if got, ok := dm.FileInfo(dm.GroupIDs()[digest][1]); !ok || got != info {
+		t.Fatalf("SetPaths dropped details for a kept path: %+v, %v", got, ok)
+	}
+
+	if dups := dm.FilterToDigest(digest, "/data/b/copy.txt"); dups != 2 {
+		t.Fatalf("expected 2 duplicates of the target, got %d", dups)
+	}
+	if files, _ := dm.Get(digest); files[0] != "/data/b/copy.txt" {
+		t.Fatalf("expected target promoted first, got %v", files)
+	}
+}
+
+// TestConcurrentAdd exercises the sharded locks; run with -race.
+func TestConcurrentAdd(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	const workers, perWorker, groups = 8, 500, 37
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				hash := Digest(sha256.Sum256([]byte(strconv.Itoa(i % groups))))
+				path := fmt.Sprintf("/w%d/file_%d", w, i)
+				switch i % 3 {
+				case 0:
+					dm.AddFile(hash, path, FileInfo{FileMeta: dfs.FileMeta{Size: int64(i)}})
+				case 1:
+					dm.AddNamePath(strconv.Itoa(i%groups), path)
+				default:
+					dm.AddPath(hash, path)
+				}
+				// Readers run alongside the writers.
+				_ = dm.MatchInfo(hash)
+				_, _ = dm.Get(hash)
+				_ = dm.MapSize()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if got := dm.FileCount(); got != workers*perWorker {
+		t.Fatalf("FileCount = %d, want %d", got, workers*perWorker)
+	}
+	total := 0
+	for _, files := range dm.GetMap() {
+		total += len(files)
+	}
+	if total != workers*perWorker {
+		t.Fatalf("groups hold %d files, want %d", total, workers*perWorker)
+	}
+	if got := dm.MapSize(); got != 2*groups {
+		t.Fatalf("MapSize = %d, want %d", got, 2*groups)
+	}
+}
+
+// TestConcurrentFileInfo checks that per-file details stay consistent when
+// written and read from many goroutines.
+func TestConcurrentFileInfo(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	const workers, perWorker = 8, 250
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				hash := Digest(sha256.Sum256([]byte(fmt.Sprintf("%d/%d", w, i))))
+				id := dm.Paths().Add(fmt.Sprintf("/w%d/file_%d", w, i))
+				dm.AddFileID(hash, id, FileInfo{FileMeta: dfs.FileMeta{Size: int64(w*perWorker + i)}})
+				if info, ok := dm.FileInfo(id); !ok || info.Size != int64(w*perWorker+i) {
+					t.Errorf("FileInfo(%d) = %+v, %v", id, info, ok)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if got := dm.MapSize(); got != workers*perWorker {
+		t.Fatalf("MapSize = %d, want %d", got, workers*perWorker)
+	}
+}
+
+func TestExportUsesRecordedFileMeta(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	var digest Digest
+	digest[0] = 0x9
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	// The paths don't exist, so anything beyond the recorded meta would be zero.
+	for i, path := range []string{"/nonexistent/a", "/nonexistent/b"} {
+		dm.AddFile(digest, path, FileInfo{FileMeta: dfs.FileMeta{
+			Size: 10, DiskSize: 4096, Mode: 0o640, Uid: 1000, Gid: 100,
+			ModTime: mtime.UnixNano(), Dev: 3, Ino: uint64(20 + i), Nlink: 2,
+		}})
+	}
+
+	files := dm.collectExportSummary().Groups[0].Files
+	for i, f := range files {
+		if f.Size != 10 || f.AllocatedSize != 4096 {
+			t.Fatalf("unexpected sizes for %s: %d/%d", f.Path, f.Size, f.AllocatedSize)
+		}
+		if f.Mode != "-rw-r-----" || f.Uid != 1000 || f.Gid != 100 || f.Nlink != 2 {
+			t.Fatalf("unexpected metadata for %s: %+v", f.Path, f)
+		}
+		if f.Dev != 3 || f.Ino != uint64(20+i) {
+			t.Fatalf("unexpected identity for %s: dev=%d ino=%d", f.Path, f.Dev, f.Ino)
+		}
+		if f.ModTime != mtime.Format(time.RFC3339Nano) {
+			t.Fatalf("unexpected mtime for %s: %s", f.Path, f.ModTime)
+		}
+	}
+}
+
+func TestRemoveDuplicatesRefusesChangedFiles(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	tmp := t.TempDir()
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(tmp, fmt.Sprintf("dup_%d.dat", i))
+		if err := os.WriteFile(path, []byte("duplicate"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		meta, err := dfs.LstatMeta(path)
+		if err != nil {
+			t.Fatalf("LstatMeta: %v", err)
+		}
+		dm.AddFile(Digest(sha256.Sum256([]byte("duplicate"))), path, FileInfo{FileMeta: meta})
+		paths = append(paths, path)
+	}
+	dm.SetVerifyHash(dfs.HashSHA256)
+
+	// dup_1 keeps its size and mtime but not its content; dup_2 is touched.
+	meta, _ := dfs.LstatMeta(paths[1])
+	if err := os.WriteFile(paths[1], []byte("DUPLICATE"), 0o644); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	mtime := time.Unix(0, meta.ModTime)
+	if err := os.Chtimes(paths[1], mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	later := mtime.Add(time.Minute)
+	if err := os.Chtimes(paths[2], later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	removed, err := dm.RemoveDuplicates(1)
+	if !errors.Is(err, dfs.ErrChanged) {
+		t.Fatalf("expected ErrChanged, got %v", err)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("changed files must not be removed, got %v", removed)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%s should remain: %v", path, err)
+		}
+	}
+}
+
+func TestRemoveDuplicatesJournalsOnlyFilesRemoved(t *testing.T) {
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	tmp := t.TempDir()
+	digest := Digest(sha256.Sum256([]byte("duplicate")))
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(tmp, fmt.Sprintf("dup_%d.dat", i))
+		if err := os.WriteFile(path, []byte("duplicate"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		meta, err := dfs.LstatMeta(path)
+		if err != nil {
+			t.Fatalf("LstatMeta: %v", err)
+		}
+		dm.AddFile(digest, path, FileInfo{FileMeta: meta})
+		paths = append(paths, path)
+	}
+
+	// dup_1 can't be journaled, so it must be left alone.
+	var recorded []string
+	dm.SetJournal(func(hash Digest, keep, id dpath.ID) (func() error, error) {
+		path := dm.Path(id)
+		if path == paths[1] {
+			return nil, errors.New("journal unavailable")
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s journaled after it was acted on", path)
+		}
+		return func() error {
+			if _, err := os.Stat(path); err == nil {
+				t.Errorf("%s recorded before it was removed", path)
+			}
+			recorded = append(recorded, path)
+			return nil
+		}, nil
+	})
+
+	removed, err := dm.RemoveDuplicates(1)
+	if err == nil || !strings.Contains(err.Error(), "journal unavailable") {
+		t.Fatalf("expected the journal error reported, got %v", err)
+	}
+	if len(removed) != 1 || len(recorded) != 1 || recorded[0] != removed[0] || removed[0] != paths[2] {
+		t.Fatalf("removed %v, recorded %v; want only %s", removed, recorded, paths[2])
+	}
+	if _, err := os.Stat(paths[1]); err != nil {
+		t.Fatalf("%s should remain: %v", paths[1], err)
+	}
+}
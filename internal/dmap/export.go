@@ -9,26 +9,46 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
 )
 
 type exportFile struct {
-	Path string `json:"path"`
-	Size uint64 `json:"size"`
+	Path                string `json:"path"`
+	Size                uint64 `json:"size"`
+	AllocatedSize       uint64 `json:"allocated_size"`
+	Sparse              bool   `json:"sparse"`
+	ZeroFilled          bool   `json:"zero_filled"`
+	AlreadyDeduplicated bool   `json:"already_deduplicated"`
+	Mode                string `json:"mode,omitempty"`
+	Uid                 uint32 `json:"uid"`
+	Gid                 uint32 `json:"gid"`
+	ModTime             string `json:"mtime,omitempty"`
+	Dev                 uint64 `json:"dev,omitempty"`
+	Ino                 uint64 `json:"ino,omitempty"`
+	Nlink               uint64 `json:"nlink,omitempty"`
 }
 
 type exportGroup struct {
-	MatchType      string       `json:"match_type"`
-	MatchKey       string       `json:"match_key"`
-	Hash           string       `json:"hash"`
-	DuplicateCount int          `json:"duplicate_count"`
-	Files          []exportFile `json:"files"`
+	MatchType       string       `json:"match_type"`
+	MatchKey        string       `json:"match_key"`
+	Hash            string       `json:"hash"`
+	DuplicateCount  int          `json:"duplicate_count"`
+	ApparentSize    uint64       `json:"apparent_size"`
+	DiskSize        uint64       `json:"disk_size"`
+	ReclaimableSize uint64       `json:"reclaimable_size"`
+	Roots           []string     `json:"roots,omitempty"`
+	Files           []exportFile `json:"files"`
 }
 
 type exportSummary struct {
-	GroupCount int           `json:"group_count"`
-	Groups     []exportGroup `json:"groups"`
+	GroupCount      int           `json:"group_count"`
+	ApparentSize    uint64        `json:"apparent_size"`
+	DiskSize        uint64        `json:"disk_size"`
+	ReclaimableSize uint64        `json:"reclaimable_size"`
+	Groups          []exportGroup `json:"groups"`
 }
 
 // WriteJSON writes duplicate groups that satisfy the minimum duplicate threshold to a JSON file.
@@ -61,14 +81,31 @@ func (d *Dmap) WriteCSV(path string) error {
 	defer file.Close()
 
 	writer := csv.NewWriter(file)
-	if err := writer.Write([]string{"match_type", "match_key", "hash", "duplicate_count", "path", "size_bytes"}); err != nil {
+	if err := writer.Write([]string{"match_type", "match_key", "hash", "duplicate_count", "path", "size_bytes", "allocated_bytes", "sparse", "zero_filled", "already_deduplicated", "mode", "uid", "gid", "mtime", "dev", "ino", "nlink", "roots"}); err != nil {
 		return fmt.Errorf("write CSV header: %w", err)
 	}
 
 	for _, group := range summary.Groups {
 		count := strconv.Itoa(group.DuplicateCount)
+		roots := strings.Join(group.Roots, ";")
 		for _, f := range group.Files {
-			if err := writer.Write([]string{group.MatchType, group.MatchKey, group.Hash, count, f.Path, strconv.FormatUint(f.Size, 10)}); err != nil {
+			row := []string{
+				group.MatchType, group.MatchKey, group.Hash, count, f.Path,
+				strconv.FormatUint(f.Size, 10),
+				strconv.FormatUint(f.AllocatedSize, 10),
+				strconv.FormatBool(f.Sparse),
+				strconv.FormatBool(f.ZeroFilled),
+				strconv.FormatBool(f.AlreadyDeduplicated),
+				f.Mode,
+				strconv.FormatUint(uint64(f.Uid), 10),
+				strconv.FormatUint(uint64(f.Gid), 10),
+				f.ModTime,
+				strconv.FormatUint(f.Dev, 10),
+				strconv.FormatUint(f.Ino, 10),
+				strconv.FormatUint(f.Nlink, 10),
+				roots,
+			}
+			if err := writer.Write(row); err != nil {
 				return fmt.Errorf("write CSV row: %w", err)
 			}
 		}
@@ -91,20 +128,22 @@ func (d *Dmap) collectExportSummary() exportSummary {
 	type groupData struct {
 		hash  string
 		info  MatchInfo
-		files []string
+		roots []string
+		files []dpath.ID
 	}
 
-	groups := make([]groupData, 0, len(d.filesMap))
-	for digest, files := range d.filesMap {
+	groups := make([]groupData, 0, d.MapSize())
+	d.rangeGroups(func(digest Digest, files []dpath.ID) {
 		if uint(len(files)) < d.minDuplicates {
-			continue
+			return
 		}
 		groups = append(groups, groupData{
 			hash:  fmt.Sprintf("%x", digest),
 			info:  d.MatchInfo(digest),
-			files: append([]string(nil), files...),
+			roots: d.GroupRoots(digest),
+			files: files,
 		})
-	}
+	})
 
 	sort.Slice(groups, func(i, j int) bool {
 		if groups[i].info.Type != groups[j].info.Type {
@@ -117,27 +156,76 @@ func (d *Dmap) collectExportSummary() exportSummary {
 	})
 
 	exportGroups := make([]exportGroup, 0, len(groups))
+	var apparent, disk, reclaimable uint64
 	for _, g := range groups {
 		item := exportGroup{
 			MatchType:      string(g.info.Type),
 			MatchKey:       g.info.Key,
 			Hash:           g.hash,
 			DuplicateCount: len(g.files),
+			Roots:          g.roots,
 			Files:          make([]exportFile, 0, len(g.files)),
 		}
-		for _, path := range g.files {
-			item.Files = append(item.Files, exportFile{
-				Path: path,
-				Size: dfs.GetFileSize(path),
-			})
+		for _, id := range g.files {
+			file := d.exportFileFor(id)
+			item.ApparentSize += file.Size
+			item.DiskSize += file.AllocatedSize
+			item.Files = append(item.Files, file)
 		}
+		item.ReclaimableSize = reclaimableSize(item.Files)
+		apparent += item.ApparentSize
+		disk += item.DiskSize
+		reclaimable += item.ReclaimableSize
 		exportGroups = append(exportGroups, item)
 	}
 
 	return exportSummary{
-		GroupCount: len(exportGroups),
-		Groups:     exportGroups,
+		GroupCount:      len(exportGroups),
+		ApparentSize:    apparent,
+		DiskSize:        disk,
+		ReclaimableSize: reclaimable,
+		Groups:          exportGroups,
+	}
+}
+
+// reclaimableSize sums the on-disk sizes of every copy after the first,
+// skipping files that already share their blocks with another member.
+func reclaimableSize(files []exportFile) uint64 {
+	var total uint64
+	kept := false
+	for _, f := range files {
+		if f.AlreadyDeduplicated {
+			continue
+		}
+		if !kept {
+			kept = true
+			continue
+		}
+		total += f.AllocatedSize
+	}
+	return total
+}
+
+// exportFileFor describes id's file for export. Sizes, metadata and flags
+// come from the scan when available, otherwise from a fresh stat.
+func (d *Dmap) exportFileFor(id dpath.ID) exportFile {
+	file := exportFile{Path: d.paths.Path(id)}
+	file.Size, file.AllocatedSize = d.FileUsage(id)
+	if info, ok := d.FileInfo(id); ok {
+		file.Sparse = info.Sparse
+		file.ZeroFilled = info.ZeroFilled
+		file.AlreadyDeduplicated = info.AlreadyDeduplicated
+	}
+	if meta, err := d.FileMeta(id); err == nil {
+		file.Mode = meta.Mode.String()
+		file.Uid = meta.Uid
+		file.Gid = meta.Gid
+		file.ModTime = meta.ModTimeValue().UTC().Format(time.RFC3339Nano)
+		file.Dev = meta.Dev
+		file.Ino = meta.Ino
+		file.Nlink = meta.Nlink
 	}
+	return file
 }
 
 func secureOutputFile(path string) (*os.File, error) {
@@ -0,0 +1,181 @@
+package dmap
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
+	"github.com/jdefrancesco/dskDitto/internal/dsklog"
+	"github.com/jdefrancesco/dskDitto/pkg/utils"
+)
+
+// DefaultProtected lists the system directories every Guard protects, on top
+// of its Protect list.
+var DefaultProtected = []string{"/bin", "/boot", "/etc", "/lib", "/lib64", "/sbin", "/usr", "/System", "/private/etc"}
+
+var (
+	// ErrProtected indicates a file lies in a protected directory.
+	ErrProtected = errors.New("protected path")
+	// ErrTooRecent indicates a file was modified within the guard's MinAge
+	// and may still be being written.
+	ErrTooRecent = errors.New("modified too recently")
+	// ErrLimitExceeded indicates a batch would change more files or reclaim
+	// more space than the guard allows. Nothing is changed.
+	ErrLimitExceeded = errors.New("safety limit exceeded")
+)
+
+// Guard holds the safety limits every duplicate action honors, whatever the
+// keep count, keep policy or marks say. The zero Guard still protects
+// DefaultProtected.
+type Guard struct {
+	// Protect lists further directories whose files may be reported but are
+	// never deleted or converted.
+	Protect []string
+	// MaxFiles caps how many files or directories one batch may delete or
+	// convert; zero means no cap.
+	MaxFiles int
+	// MaxReclaim caps the on-disk bytes one batch may reclaim; zero means no
+	// cap.
+	MaxReclaim uint64
+	// MinAge refuses files modified less than this long ago.
+	MinAge time.Duration
+}
+
+// Protected reports whether path lies in a protected directory, or is a
+// directory holding one.
+func (g Guard) Protected(path string) bool {
+	for _, list := range [][]string{DefaultProtected, g.Protect} {
+		for _, dir := range list {
+			if path == dir || isWithin(path, dir) || isWithin(dir, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckSettled returns an error wrapping ErrTooRecent if path was modified
+// less than MinAge ago, judging by its current mtime.
+func (g Guard) CheckSettled(path string) error {
+	if g.MinAge <= 0 {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if age := time.Since(info.ModTime()); age < g.MinAge {
+		return fmt.Errorf("%w: %s was modified %s ago", ErrTooRecent, path, max(age, 0).Round(time.Second))
+	}
+	return nil
+}
+
+// CheckTreeSettled runs CheckSettled on dir and on every file recorded below
+// it, so a tree is refused if anything in it may still be being written.
+func (g Guard) CheckTreeSettled(dir string, files []TreeFile) error {
+	if g.MinAge <= 0 {
+		return nil
+	}
+	if err := g.CheckSettled(dir); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := g.CheckSettled(filepath.Join(dir, f.Rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckBatch returns an error wrapping ErrLimitExceeded if a batch changing
+// files entries and reclaiming reclaim bytes goes over MaxFiles or
+// MaxReclaim.
+func (g Guard) CheckBatch(files int, reclaim uint64) error {
+	if g.MaxFiles > 0 && files > g.MaxFiles {
+		return fmt.Errorf("%w: batch would change %d file(s), more than the limit of %d", ErrLimitExceeded, files, g.MaxFiles)
+	}
+	if g.MaxReclaim > 0 && reclaim > g.MaxReclaim {
+		return fmt.Errorf("%w: batch would reclaim %s, more than the limit of %s", ErrLimitExceeded,
+			utils.DisplaySize(reclaim), utils.DisplaySize(g.MaxReclaim))
+	}
+	return nil
+}
+
+// SetGuard sets the safety limits RemoveDuplicates, LinkDuplicates,
+// ReflinkDuplicates, HardlinkDuplicates and DedupeDuplicates honor.
+func (d *Dmap) SetGuard(g Guard) {
+	d.guard = g
+}
+
+// Guard returns the limits set with SetGuard.
+func (d *Dmap) Guard() Guard {
+	if d == nil {
+		return Guard{}
+	}
+	return d.guard
+}
+
+// checkBatch totals what a batch action keeping keep members per group would
+// change, skipping the members it would skip, and checks it against the
+// guard before anything is touched. Files below a directory the batch would
+// change are counted with the directory, not again on their own. Groups whose
+// kept copy later fails its checks are still counted, so the estimate errs
+// high.
+func (d *Dmap) checkBatch(keep int) error {
+	if d.guard.MaxFiles == 0 && d.guard.MaxReclaim == 0 {
+		return nil
+	}
+	extras := func(ids []dpath.ID) []dpath.ID {
+		var out []dpath.ID
+		for _, id := range d.keepOrder(ids)[keep:] {
+			path := d.paths.Path(id)
+			if d.info(id).Stale || d.keep.Protected(path) || d.guard.Protected(path) {
+				continue
+			}
+			out = append(out, id)
+		}
+		return out
+	}
+	var dirs []string
+	d.rangeGroups(func(hash Digest, ids []dpath.ID) {
+		if len(ids) > keep && d.MatchInfo(hash).Type.IsDirectory() {
+			for _, id := range extras(ids) {
+				dirs = append(dirs, d.paths.Path(id))
+			}
+		}
+	})
+	below := func(path string) bool {
+		for _, dir := range dirs {
+			if isWithin(path, dir) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var files int
+	var reclaim uint64
+	d.rangeGroups(func(hash Digest, ids []dpath.ID) {
+		if len(ids) <= keep {
+			return
+		}
+		for _, id := range extras(ids) {
+			if below(d.paths.Path(id)) {
+				continue
+			}
+			info := d.info(id)
+			files++
+			if !info.AlreadyDeduplicated {
+				reclaim += uint64(max(info.DiskSize, 0))
+			}
+		}
+	})
+	if err := d.guard.CheckBatch(files, reclaim); err != nil {
+		dsklog.Dlogger.Errorf("Refusing batch: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package dmap
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+)
+
+func TestGuardProtected(t *testing.T) {
+	guard := Guard{Protect: []string{"/srv/keep"}}
+	for path, want := range map[string]bool{
+		"/etc/passwd":        true,
+		"/usr/bin/env":       true,
+		"/":                  true, // holds /etc
+		"/srv/keep/a.txt":    true,
+		"/srv/keeper/a.txt":  false,
+		"/home/user/etc.txt": false,
+	} {
+		if got := guard.Protected(path); got != want {
+			t.Errorf("Protected(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestGuardCheckBatch(t *testing.T) {
+	guard := Guard{MaxFiles: 2, MaxReclaim: 1024}
+	if err := guard.CheckBatch(2, 1024); err != nil {
+		t.Fatalf("batch at the limits refused: %v", err)
+	}
+	if err := guard.CheckBatch(3, 0); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded for files, got %v", err)
+	}
+	if err := guard.CheckBatch(1, 1025); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded for bytes, got %v", err)
+	}
+	if err := (Guard{}).CheckBatch(1<<20, 1<<40); err != nil {
+		t.Fatalf("zero guard must not cap batches: %v", err)
+	}
+}
+
+// addGuardFile writes content to root/name with mtime and adds it to dm.
+func addGuardFile(t *testing.T, dm *Dmap, digest Digest, root, name string, mtime time.Time) string {
+	t.Helper()
+	path := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("same"), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	meta, err := dfs.LstatMeta(path)
+	if err != nil {
+		t.Fatalf("lstat: %v", err)
+	}
+	dm.AddFile(digest, path, FileInfo{FileMeta: meta})
+	return path
+}
+
+func TestRemoveDuplicatesHonorsGuard(t *testing.T) {
+	setupLogging()
+	root := t.TempDir()
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	var digest Digest
+	digest[0] = 0x5
+	old := time.Now().Add(-2 * time.Hour)
+	// With no keep rules the lexically first path is kept.
+	keep := addGuardFile(t, dm, digest, root, "a-keep.txt", old)
+	extra := addGuardFile(t, dm, digest, root, "b-extra.txt", old)
+	recent := addGuardFile(t, dm, digest, root, "c-recent.txt", time.Now())
+	protected := addGuardFile(t, dm, digest, root, "protected/p.txt", old)
+	dm.SetGuard(Guard{Protect: []string{filepath.Join(root, "protected")}, MinAge: time.Hour})
+
+	removed, err := dm.RemoveDuplicates(1)
+	if !errors.Is(err, ErrTooRecent) {
+		t.Fatalf("expected ErrTooRecent, got %v", err)
+	}
+	if len(removed) != 1 || removed[0] != extra {
+		t.Fatalf("expected only %s removed, got %v", extra, removed)
+	}
+	for _, path := range []string{keep, recent, protected} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%s should remain: %v", path, err)
+		}
+	}
+}
+
+func TestRemoveDuplicatesAbortsOverLimit(t *testing.T) {
+	setupLogging()
+	root := t.TempDir()
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	var digest Digest
+	digest[0] = 0x6
+	old := time.Now().Add(-time.Hour)
+	var paths []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		paths = append(paths, addGuardFile(t, dm, digest, root, name, old))
+	}
+	dm.SetGuard(Guard{MaxFiles: 1})
+
+	for _, convert := range []func(uint) ([]string, error){dm.RemoveDuplicates, dm.HardlinkDuplicates} {
+		changed, err := convert(1)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("expected ErrLimitExceeded, got %v", err)
+		}
+		if len(changed) != 0 {
+			t.Fatalf("a batch over the limit must change nothing, got %v", changed)
+		}
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("%s should remain: %v", path, err)
+		}
+		if st, err := dfs.GetDFileStat(info); err == nil && st.Nlink != 1 {
+			t.Fatalf("%s was hard linked", path)
+		}
+	}
+}
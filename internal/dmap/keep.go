@@ -0,0 +1,178 @@
+package dmap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
+	"github.com/jdefrancesco/dskDitto/internal/dsklog"
+)
+
+// KeepRule ranks the members of a duplicate group by how worth keeping they
+// are.
+type KeepRule string
+
+const (
+	KeepNewest        KeepRule = "newest"
+	KeepOldest        KeepRule = "oldest"
+	KeepShortestPath  KeepRule = "shortest-path"
+	KeepLongestPath   KeepRule = "longest-path"
+	KeepMostHardlinks KeepRule = "most-hardlinks"
+)
+
+// ParseKeepRules parses a comma-separated list of rules such as
+// "newest,shortest-path". Later rules break ties left by earlier ones.
+func ParseKeepRules(s string) ([]KeepRule, error) {
+	var rules []KeepRule
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		rule := KeepRule(name)
+		switch rule {
+		case KeepNewest, KeepOldest, KeepShortestPath, KeepLongestPath, KeepMostHardlinks:
+			rules = append(rules, rule)
+		default:
+			return nil, fmt.Errorf("unknown keep rule %q (want newest, oldest, shortest-path, longest-path or most-hardlinks)", name)
+		}
+	}
+	return rules, nil
+}
+
+// compare returns a negative number when a is more worth keeping than b, a
+// positive one when b is, and zero when the rule can't tell them apart.
+func (r KeepRule) compare(a, b KeepMember) int {
+	switch r {
+	case KeepNewest:
+		return cmpInt64(b.Meta.ModTime, a.Meta.ModTime)
+	case KeepOldest:
+		return cmpInt64(a.Meta.ModTime, b.Meta.ModTime)
+	case KeepShortestPath:
+		return len(a.Path) - len(b.Path)
+	case KeepLongestPath:
+		return len(b.Path) - len(a.Path)
+	case KeepMostHardlinks:
+		return cmpInt64(int64(b.Meta.Nlink), int64(a.Meta.Nlink)) // #nosec G115 -- link counts fit easily
+	}
+	return 0
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// KeepMember is a group member as seen by a KeepPolicy.
+type KeepMember struct {
+	Path string
+	Meta dfs.FileMeta
+}
+
+// KeepPolicy decides which members of a group the duplicate actions keep and
+// the TUI leaves unmarked. Members are ranked by, in order: lying in a KeepIn
+// directory, the earliest Prefer directory holding them, each of Rules, and
+// finally their path, so the order never depends on the order members were
+// found in. The zero policy keeps the lexically first path.
+type KeepPolicy struct {
+	Rules []KeepRule
+	// KeepIn lists directories whose files are never removed, linked or
+	// reflinked, even beyond the keep count.
+	KeepIn []string
+	// Prefer lists directories whose files are kept ahead of others, most
+	// preferred first.
+	Prefer []string
+}
+
+// Protected reports whether path lies in a KeepIn directory, or is a
+// directory holding one, and so must be left in place.
+func (p KeepPolicy) Protected(path string) bool {
+	for _, dir := range p.KeepIn {
+		if path == dir || isWithin(path, dir) || isWithin(dir, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// preferRank returns the index of the first Prefer directory holding path,
+// or len(p.Prefer) when none does.
+func (p KeepPolicy) preferRank(path string) int {
+	for i, dir := range p.Prefer {
+		if path == dir || isWithin(path, dir) {
+			return i
+		}
+	}
+	return len(p.Prefer)
+}
+
+// Order returns the indices of members, most worth keeping first.
+func (p KeepPolicy) Order(members []KeepMember) []int {
+	order := make([]int, len(members))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := members[order[i]], members[order[j]]
+		if pa, pb := p.Protected(a.Path), p.Protected(b.Path); pa != pb {
+			return pa
+		}
+		if ra, rb := p.preferRank(a.Path), p.preferRank(b.Path); ra != rb {
+			return ra < rb
+		}
+		for _, rule := range p.Rules {
+			if c := rule.compare(a, b); c != 0 {
+				return c < 0
+			}
+		}
+		return a.Path < b.Path
+	})
+	return order
+}
+
+// SetKeepPolicy sets the policy RemoveDuplicates, LinkDuplicates,
+// ReflinkDuplicates, HardlinkDuplicates and DedupeDuplicates use to choose the
+// copies they keep.
+func (d *Dmap) SetKeepPolicy(p KeepPolicy) {
+	d.keep = p
+}
+
+// KeepPolicy returns the policy set with SetKeepPolicy.
+func (d *Dmap) KeepPolicy() KeepPolicy {
+	if d == nil {
+		return KeepPolicy{}
+	}
+	return d.keep
+}
+
+// keepOrder returns ids ranked by the keep policy, most worth keeping first.
+func (d *Dmap) keepOrder(ids []dpath.ID) []dpath.ID {
+	members := make([]KeepMember, len(ids))
+	for i, id := range ids {
+		meta, _ := d.FileMeta(id)
+		members[i] = KeepMember{Path: d.paths.Path(id), Meta: meta}
+	}
+	ordered := make([]dpath.ID, len(ids))
+	for i, j := range d.keep.Order(members) {
+		ordered[i] = ids[j]
+	}
+	return ordered
+}
+
+// skipProtected reports whether id lies in a --keep-in directory or one the
+// guard protects, and should be left alone.
+func (d *Dmap) skipProtected(id dpath.ID) bool {
+	path := d.paths.Path(id)
+	if !d.keep.Protected(path) && !d.guard.Protected(path) {
+		return false
+	}
+	dsklog.Dlogger.Infof("Keeping protected file: %s", path)
+	return true
+}
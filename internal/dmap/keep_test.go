@@ -0,0 +1,122 @@
+package dmap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+)
+
+func TestParseKeepRules(t *testing.T) {
+	rules, err := ParseKeepRules("newest, shortest-path")
+	if err != nil {
+		t.Fatalf("ParseKeepRules: %v", err)
+	}
+	if len(rules) != 2 || rules[0] != KeepNewest || rules[1] != KeepShortestPath {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+	if rules, err := ParseKeepRules(""); err != nil || rules != nil {
+		t.Fatalf("empty rules = %v, %v", rules, err)
+	}
+	if _, err := ParseKeepRules("newest,biggest"); err == nil {
+		t.Fatal("expected an unknown rule to be rejected")
+	}
+}
+
+func TestKeepPolicyOrder(t *testing.T) {
+	members := []KeepMember{
+		{Path: "/data/b/long-name.txt", Meta: dfs.FileMeta{ModTime: 1, Nlink: 1}},
+		{Path: "/data/a.txt", Meta: dfs.FileMeta{ModTime: 3, Nlink: 1}},
+		{Path: "/data/c.txt", Meta: dfs.FileMeta{ModTime: 3, Nlink: 2}},
+		{Path: "/archive/z.txt", Meta: dfs.FileMeta{ModTime: 2, Nlink: 1}},
+	}
+	paths := func(order []int) []string {
+		out := make([]string, len(order))
+		for i, j := range order {
+			out[i] = members[j].Path
+		}
+		return out
+	}
+	tests := []struct {
+		name   string
+		policy KeepPolicy
+		want   []string
+	}{
+		{name: "zero policy sorts by path", want: []string{"/archive/z.txt", "/data/a.txt", "/data/b/long-name.txt", "/data/c.txt"}},
+		{name: "newest breaks ties by path", policy: KeepPolicy{Rules: []KeepRule{KeepNewest}}, want: []string{"/data/a.txt", "/data/c.txt", "/archive/z.txt", "/data/b/long-name.txt"}},
+		{name: "newest then most hardlinks", policy: KeepPolicy{Rules: []KeepRule{KeepNewest, KeepMostHardlinks}}, want: []string{"/data/c.txt", "/data/a.txt", "/archive/z.txt", "/data/b/long-name.txt"}},
+		{name: "oldest", policy: KeepPolicy{Rules: []KeepRule{KeepOldest}}, want: []string{"/data/b/long-name.txt", "/archive/z.txt", "/data/a.txt", "/data/c.txt"}},
+		{name: "longest path", policy: KeepPolicy{Rules: []KeepRule{KeepLongestPath}}, want: []string{"/data/b/long-name.txt", "/archive/z.txt", "/data/a.txt", "/data/c.txt"}},
+		{name: "prefer outranks rules", policy: KeepPolicy{Rules: []KeepRule{KeepNewest}, Prefer: []string{"/archive", "/data/b"}}, want: []string{"/archive/z.txt", "/data/b/long-name.txt", "/data/a.txt", "/data/c.txt"}},
+		{name: "keep-in outranks prefer", policy: KeepPolicy{KeepIn: []string{"/data/b"}, Prefer: []string{"/archive"}}, want: []string{"/data/b/long-name.txt", "/archive/z.txt", "/data/a.txt", "/data/c.txt"}},
+	}
+	for _, tt := range tests {
+		got := paths(tt.policy.Order(members))
+		for i := range tt.want {
+			if got[i] != tt.want[i] {
+				t.Fatalf("%s: order = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestRemoveDuplicatesFollowsKeepPolicy(t *testing.T) {
+	setupLogging()
+	root := t.TempDir()
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+
+	var digest Digest
+	digest[0] = 0x3
+	names := []string{"old.txt", "newest.txt", "middle.txt", "protected/older.txt"}
+	for i, name := range names {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("same"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		mtime := time.Unix(1700000000+int64([]int{1, 3, 2, 0}[i]), 0)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+		meta, err := dfs.LstatMeta(path)
+		if err != nil {
+			t.Fatalf("lstat: %v", err)
+		}
+		dm.AddFile(digest, path, FileInfo{FileMeta: meta})
+	}
+	dm.SetKeepPolicy(KeepPolicy{Rules: []KeepRule{KeepNewest}, KeepIn: []string{filepath.Join(root, "protected")}})
+
+	removed, err := dm.RemoveDuplicates(1)
+	if err != nil {
+		t.Fatalf("RemoveDuplicates: %v", err)
+	}
+	// The protected file ranks first and counts as the kept copy, so even
+	// the newest file goes.
+	if len(removed) != 3 {
+		t.Fatalf("expected 3 files removed, got %v", removed)
+	}
+	if _, err := os.Stat(filepath.Join(root, "protected", "older.txt")); err != nil {
+		t.Fatalf("protected file removed: %v", err)
+	}
+
+	// Protected files stay even beyond the keep count.
+	var other Digest
+	other[0] = 0x4
+	for _, name := range []string{"protected/x.txt", "protected/y.txt"} {
+		path := filepath.Join(root, name)
+		if err := os.WriteFile(path, []byte("other"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		dm.AddPath(other, path)
+	}
+	if removed, err := dm.RemoveDuplicates(1); err != nil || len(removed) != 0 {
+		t.Fatalf("files under --keep-in must never be removed, removed %v (err %v)", removed, err)
+	}
+}
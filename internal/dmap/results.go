@@ -0,0 +1,289 @@
+package dmap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
+)
+
+// ResultsVersion is the format version written by SaveResults.
+const ResultsVersion = 1
+
+// ScanInfo describes the scan that produced a Dmap. It is saved with the
+// results so a later session can tell how they were gathered.
+type ScanInfo struct {
+	Roots         []string          `json:"roots"`
+	HashAlgorithm dfs.HashAlgorithm `json:"hash_algo"`
+	MinFileSize   int64             `json:"min_file_size"`
+	MaxFileSize   int64             `json:"max_file_size"`
+	MinDuplicates uint              `json:"min_duplicates"`
+	ScannedAt     time.Time         `json:"scanned_at"`
+}
+
+type savedFile struct {
+	Path                string `json:"path"`
+	Size                int64  `json:"size"`
+	AllocatedSize       int64  `json:"allocated_size"`
+	ModTimeUnix         int64  `json:"mtime_unix"`
+	ModTimeNsec         int64  `json:"mtime_nsec"`
+	Dev                 uint64 `json:"dev,omitempty"`
+	Ino                 uint64 `json:"ino,omitempty"`
+	Mode                uint32 `json:"mode,omitempty"`
+	Uid                 uint32 `json:"uid,omitempty"`
+	Gid                 uint32 `json:"gid,omitempty"`
+	Nlink               uint64 `json:"nlink,omitempty"`
+	Sparse              bool   `json:"sparse,omitempty"`
+	ZeroFilled          bool   `json:"zero_filled,omitempty"`
+	AlreadyDeduplicated bool   `json:"already_deduplicated,omitempty"`
+	// Tree lists the files below a directory group member; see TreeFile.
+	Tree []savedTreeFile `json:"tree,omitempty"`
+}
+
+// savedTreeFile is a TreeFile as saved by SaveResults.
+type savedTreeFile struct {
+	Rel         string `json:"rel"`
+	Hash        string `json:"hash,omitempty"`
+	Size        int64  `json:"size"`
+	ModTimeUnix int64  `json:"mtime_unix"`
+	ModTimeNsec int64  `json:"mtime_nsec"`
+}
+
+type savedGroup struct {
+	Hash      string      `json:"hash"`
+	MatchType string      `json:"match_type"`
+	MatchKey  string      `json:"match_key"`
+	Files     []savedFile `json:"files"`
+}
+
+type savedResults struct {
+	Version int          `json:"version"`
+	Scan    ScanInfo     `json:"scan"`
+	Groups  []savedGroup `json:"groups"`
+}
+
+// SaveResults writes every group in the map, together with scan, to path so
+// it can be reviewed later with LoadResults. Each file's mtime, inode, mode
+// and ownership are recorded alongside its size.
+func (d *Dmap) SaveResults(path string, scan ScanInfo) error {
+	if d == nil {
+		return errors.New("no results to save")
+	}
+	if scan.MinDuplicates == 0 {
+		scan.MinDuplicates = d.minDuplicates
+	}
+
+	results := savedResults{
+		Version: ResultsVersion,
+		Scan:    scan,
+		Groups:  make([]savedGroup, 0, d.MapSize()),
+	}
+	d.rangeGroups(func(hash Digest, ids []dpath.ID) {
+		info := d.MatchInfo(hash)
+		group := savedGroup{
+			Hash:      fmt.Sprintf("%x", hash),
+			MatchType: string(info.Type),
+			MatchKey:  info.Key,
+			Files:     make([]savedFile, 0, len(ids)),
+		}
+		for _, id := range ids {
+			group.Files = append(group.Files, d.savedFileFor(id))
+		}
+		results.Groups = append(results.Groups, group)
+	})
+	sort.Slice(results.Groups, func(i, j int) bool {
+		return results.Groups[i].Hash < results.Groups[j].Hash
+	})
+
+	file, err := secureOutputFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(results); err != nil {
+		return fmt.Errorf("encode results %s: %w", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write results %s: %w", path, err)
+	}
+	return nil
+}
+
+// savedFileFor describes id's file for SaveResults. Paths are made absolute so
+// the results can be loaded from any directory. Metadata and flags come from
+// the scan when known, otherwise from a fresh lstat.
+func (d *Dmap) savedFileFor(id dpath.ID) savedFile {
+	file := savedFile{Path: d.paths.Path(id)}
+	info, _ := d.FileInfo(id)
+	file.Sparse = info.Sparse
+	file.ZeroFilled = info.ZeroFilled
+	file.AlreadyDeduplicated = info.AlreadyDeduplicated
+	for _, tf := range d.TreeFiles(id) {
+		saved := savedTreeFile{
+			Rel:         tf.Rel,
+			Size:        tf.Meta.Size,
+			ModTimeUnix: tf.Meta.ModTime / int64(time.Second),
+			ModTimeNsec: tf.Meta.ModTime % int64(time.Second),
+		}
+		if tf.Hashed {
+			saved.Hash = fmt.Sprintf("%x", tf.Digest)
+		}
+		file.Tree = append(file.Tree, saved)
+	}
+	meta, err := d.FileMeta(id)
+	if abs, absErr := filepath.Abs(file.Path); absErr == nil {
+		file.Path = abs
+	}
+	if err != nil {
+		file.Size = info.Size
+		file.AllocatedSize = info.DiskSize
+		return file
+	}
+	file.Size = meta.Size
+	file.AllocatedSize = meta.DiskSize
+	file.ModTimeUnix = meta.ModTime / int64(time.Second)
+	file.ModTimeNsec = meta.ModTime % int64(time.Second)
+	file.Dev = meta.Dev
+	file.Ino = meta.Ino
+	file.Mode = uint32(meta.Mode)
+	file.Uid = meta.Uid
+	file.Gid = meta.Gid
+	file.Nlink = meta.Nlink
+	return file
+}
+
+// LoadResults reads results written by SaveResults into a new Dmap. Every file
+// is checked against the size and mtime recorded when it was saved; files that
+// changed or vanished are kept in their group but flagged Stale, and the
+// duplicate actions leave them alone. Inodes are not compared since results
+// are often reviewed on another machine mounting the same tree.
+func LoadResults(path string) (*Dmap, ScanInfo, error) {
+	file, err := os.Open(path) // #nosec G304 -- caller controls results path intentionally
+	if err != nil {
+		return nil, ScanInfo{}, fmt.Errorf("open results %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var results savedResults
+	if err := json.NewDecoder(bufio.NewReader(file)).Decode(&results); err != nil {
+		return nil, ScanInfo{}, fmt.Errorf("decode results %s: %w", path, err)
+	}
+	if results.Version != ResultsVersion {
+		return nil, ScanInfo{}, fmt.Errorf("unsupported results version %d in %s", results.Version, path)
+	}
+
+	d, err := NewDmap(results.Scan.MinDuplicates)
+	if err != nil {
+		return nil, ScanInfo{}, err
+	}
+	d.SetRoots(results.Scan.Roots)
+	for _, group := range results.Groups {
+		hash, err := DigestFromHex(group.Hash)
+		if err != nil {
+			return nil, ScanInfo{}, fmt.Errorf("decode group hash %q: %w", group.Hash, err)
+		}
+		matchType := MatchType(group.MatchType)
+		if matchType == "" {
+			matchType = MatchContent
+		}
+		match := MatchInfo{Type: matchType, Key: group.MatchKey}
+		for _, f := range group.Files {
+			if f.Path == "" {
+				continue
+			}
+			id := d.paths.Add(f.Path)
+			d.setInfo(id, FileInfo{
+				FileMeta: dfs.FileMeta{
+					Size:     f.Size,
+					DiskSize: f.AllocatedSize,
+					Mode:     os.FileMode(f.Mode),
+					Uid:      f.Uid,
+					Gid:      f.Gid,
+					ModTime:  time.Unix(f.ModTimeUnix, f.ModTimeNsec).UnixNano(),
+					Dev:      f.Dev,
+					Ino:      f.Ino,
+					Nlink:    f.Nlink,
+				},
+				Sparse:              f.Sparse,
+				ZeroFilled:          f.ZeroFilled,
+				AlreadyDeduplicated: f.AlreadyDeduplicated,
+				Stale:               changedSinceSave(f, matchType.IsDirectory()),
+			})
+			if len(f.Tree) > 0 {
+				tree, err := loadTreeFiles(f.Tree)
+				if err != nil {
+					return nil, ScanInfo{}, fmt.Errorf("decode tree of %s: %w", f.Path, err)
+				}
+				d.setTreeFiles(id, tree)
+			}
+			d.addKeyedID(hash, id, match)
+		}
+	}
+	return d, results.Scan, nil
+}
+
+// loadTreeFiles turns saved tree files back into TreeFiles. Only size and
+// mtime are restored, which is all CheckTrees compares besides the digest.
+func loadTreeFiles(saved []savedTreeFile) ([]TreeFile, error) {
+	files := make([]TreeFile, 0, len(saved))
+	for _, f := range saved {
+		tf := TreeFile{Rel: f.Rel, Meta: dfs.FileMeta{
+			Size:    f.Size,
+			ModTime: time.Unix(f.ModTimeUnix, f.ModTimeNsec).UnixNano(),
+		}}
+		if f.Hash != "" {
+			digest, err := DigestFromHex(f.Hash)
+			if err != nil {
+				return nil, err
+			}
+			tf.Digest, tf.Hashed = digest, true
+		}
+		files = append(files, tf)
+	}
+	return files, nil
+}
+
+// changedSinceSave reports whether f no longer matches the file on disk. A
+// directory's saved size is that of its tree, so only its mtime, which moves
+// whenever an entry is added or removed, is compared.
+func changedSinceSave(f savedFile, dir bool) bool {
+	st, err := os.Lstat(f.Path)
+	if err != nil {
+		return true
+	}
+	if dir != st.IsDir() || (!dir && !st.Mode().IsRegular()) {
+		return true
+	}
+	if !dir && st.Size() != f.Size {
+		return true
+	}
+	mt := st.ModTime()
+	return mt.Unix() != f.ModTimeUnix || int64(mt.Nanosecond()) != f.ModTimeNsec
+}
+
+// StaleCount returns the number of files flagged Stale by LoadResults.
+func (d *Dmap) StaleCount() int {
+	if d == nil {
+		return 0
+	}
+	count := 0
+	d.rangeGroups(func(_ Digest, ids []dpath.ID) {
+		for _, id := range ids {
+			if d.info(id).Stale {
+				count++
+			}
+		}
+	})
+	return count
+}
@@ -0,0 +1,154 @@
+package dmap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+)
+
+func writeResultsFixture(t *testing.T, dir string, names ...string) (*Dmap, Digest, []string) {
+	t.Helper()
+	setupLogging()
+
+	dm, err := NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	var digest Digest
+	var paths []string
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("duplicate"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		df, err := dfs.NewDfile(path, int64(len("duplicate")), dfs.HashSHA256)
+		if err != nil {
+			t.Fatalf("NewDfile(%s): %v", path, err)
+		}
+		digest = Digest(df.Hash())
+		dm.Add(df)
+		paths = append(paths, path)
+	}
+	return dm, digest, paths
+}
+
+func TestSaveAndLoadResultsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	dm, digest, paths := writeResultsFixture(t, dir, "a.dat", "b.dat")
+	dm.AddNamePath("notes.txt", filepath.Join(dir, "x", "notes.txt"))
+
+	scannedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	resultsPath := filepath.Join(dir, "results.json")
+	scan := ScanInfo{Roots: []string{dir}, HashAlgorithm: dfs.HashSHA256, MaxFileSize: 1 << 30, ScannedAt: scannedAt}
+	if err := dm.SaveResults(resultsPath, scan); err != nil {
+		t.Fatalf("SaveResults: %v", err)
+	}
+
+	loaded, gotScan, err := LoadResults(resultsPath)
+	if err != nil {
+		t.Fatalf("LoadResults: %v", err)
+	}
+	if gotScan.HashAlgorithm != dfs.HashSHA256 || !gotScan.ScannedAt.Equal(scannedAt) || gotScan.MinDuplicates != 2 {
+		t.Fatalf("unexpected scan info: %+v", gotScan)
+	}
+	if loaded.FileCount() != dm.FileCount() || loaded.MapSize() != dm.MapSize() {
+		t.Fatalf("loaded %d files in %d groups, want %d in %d", loaded.FileCount(), loaded.MapSize(), dm.FileCount(), dm.MapSize())
+	}
+
+	files, _ := loaded.Get(digest)
+	if len(files) != 2 || files[0] != paths[0] || files[1] != paths[1] {
+		t.Fatalf("unexpected content group: %v", files)
+	}
+	if info := loaded.MatchInfo(NameDigest("notes.txt")); info.Type != MatchName || info.Key != "notes.txt" {
+		t.Fatalf("unexpected name match info: %+v", info)
+	}
+
+	// The name group's file never existed, so it is stale; the content
+	// group is untouched.
+	if got := loaded.StaleCount(); got != 1 {
+		t.Fatalf("StaleCount = %d, want 1", got)
+	}
+	for _, id := range loaded.GroupIDs()[digest] {
+		info, ok := loaded.FileInfo(id)
+		if !ok || info.Stale || info.Size != int64(len("duplicate")) {
+			t.Fatalf("unexpected info for %s: %+v", loaded.Path(id), info)
+		}
+	}
+}
+
+func TestLoadResultsMarksChangedFilesStale(t *testing.T) {
+	dir := t.TempDir()
+	dm, _, paths := writeResultsFixture(t, dir, "a.dat", "b.dat", "c.dat")
+
+	resultsPath := filepath.Join(dir, "results.json")
+	if err := dm.SaveResults(resultsPath, ScanInfo{HashAlgorithm: dfs.HashSHA256}); err != nil {
+		t.Fatalf("SaveResults: %v", err)
+	}
+
+	// Same size, new mtime.
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(paths[1], later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := os.WriteFile(paths[2], []byte("changed content"), 0o644); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+
+	loaded, _, err := LoadResults(resultsPath)
+	if err != nil {
+		t.Fatalf("LoadResults: %v", err)
+	}
+	if got := loaded.StaleCount(); got != 2 {
+		t.Fatalf("StaleCount = %d, want 2", got)
+	}
+
+	removed, err := loaded.RemoveDuplicates(1)
+	if err != nil {
+		t.Fatalf("RemoveDuplicates: %v", err)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("expected stale files to be left alone, removed %v", removed)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to survive: %v", path, err)
+		}
+	}
+}
+
+func TestRemoveDuplicatesSkipsGroupWithStaleSurvivor(t *testing.T) {
+	dir := t.TempDir()
+	dm, _, paths := writeResultsFixture(t, dir, "a.dat", "b.dat")
+
+	resultsPath := filepath.Join(dir, "results.json")
+	if err := dm.SaveResults(resultsPath, ScanInfo{HashAlgorithm: dfs.HashSHA256}); err != nil {
+		t.Fatalf("SaveResults: %v", err)
+	}
+	if err := os.WriteFile(paths[0], []byte("other"), 0o644); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+
+	loaded, _, err := LoadResults(resultsPath)
+	if err != nil {
+		t.Fatalf("LoadResults: %v", err)
+	}
+	if _, err := loaded.RemoveDuplicates(1); err == nil {
+		t.Fatalf("expected an error for a group whose kept file changed")
+	}
+	if _, err := os.Stat(paths[1]); err != nil {
+		t.Fatalf("expected %s to survive: %v", paths[1], err)
+	}
+}
+
+func TestLoadResultsRejectsUnknownVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+	if err := os.WriteFile(path, []byte(`{"version": 99}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, _, err := LoadResults(path); err == nil {
+		t.Fatalf("expected error for unsupported version")
+	}
+}
@@ -0,0 +1,59 @@
+package dmap
+
+import (
+	"path/filepath"
+
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
+)
+
+// SetRoots records the roots the scan started from so groups can report which
+// of them they touch. Call it before the Dmap is shared between goroutines.
+func (d *Dmap) SetRoots(roots []string) {
+	d.roots = make([]string, 0, len(roots))
+	for _, root := range roots {
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		d.roots = append(d.roots, root)
+	}
+}
+
+// Roots returns the roots recorded with SetRoots.
+func (d *Dmap) Roots() []string {
+	if d == nil {
+		return nil
+	}
+	return d.roots
+}
+
+// GroupRoots returns the scan roots the members of hash's group were found
+// under, in the order the roots were given. A file below nested roots counts
+// towards the innermost one. It returns nil when fewer than two roots were
+// scanned, since every group then touches the same root.
+func (d *Dmap) GroupRoots(hash Digest) []string {
+	if d == nil || len(d.roots) < 2 {
+		return nil
+	}
+	ids, ok := d.ids(hash)
+	if !ok {
+		return nil
+	}
+	touched := make([]bool, len(d.roots))
+	for _, id := range ids {
+		if i := d.rootIndex(d.paths.Path(id)); i >= 0 {
+			touched[i] = true
+		}
+	}
+	var roots []string
+	for i, root := range d.roots {
+		if touched[i] {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// rootIndex returns the index of the innermost root holding path, or -1.
+func (d *Dmap) rootIndex(path string) int {
+	return dpath.InnermostRoot(d.roots, path)
+}
@@ -0,0 +1,188 @@
+// dpath provides a compact, interned store for the file paths seen during a scan.
+//
+// A scan of tens of millions of files would otherwise keep one heap string per
+// path, repeating the full directory prefix for every file in a directory. The
+// Store keeps each directory once and packs base names into large byte chunks,
+// so a file costs a 12 byte record plus its name. Callers hold a 4 byte ID and
+// resolve it back to a string only when a path is shown or opened.
+package dpath
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ID identifies a path interned in a Store. IDs are dense and start at zero.
+type ID uint32
+
+const (
+	// chunkSize is the size of each name arena chunk. Chunks are never
+	// reallocated, so growth never copies names already stored.
+	chunkSize = 1 << 20
+
+	// noDir marks paths that contain no separator.
+	noDir = 0
+)
+
+// entry locates one interned path. dir is the directory index plus one, or
+// noDir. The name is stored at chunks[chunk][off:] behind a uvarint length.
+type entry struct {
+	dir   uint32
+	chunk uint32
+	off   uint32
+}
+
+// Store interns paths. It is safe for concurrent use.
+type Store struct {
+	mu     sync.RWMutex
+	dirs   []string
+	dirIDs map[string]uint32
+	chunks [][]byte
+	files  []entry
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{dirIDs: make(map[string]uint32)}
+}
+
+// Add interns path and returns its ID. Every call returns a new ID, even for a
+// path added before; the walker already reports each file once.
+func (s *Store) Add(path string) ID {
+	dir, name, hasDir := split(path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := entry{dir: noDir}
+	if hasDir {
+		idx, ok := s.dirIDs[dir]
+		if !ok {
+			// Clone so the directory does not pin the caller's full path.
+			s.dirs = append(s.dirs, strings.Clone(dir))
+			idx = uint32(len(s.dirs)) // #nosec G115 -- bounded by the ID space
+			s.dirIDs[s.dirs[idx-1]] = idx
+		}
+		e.dir = idx
+	}
+	e.chunk, e.off = s.appendName(name)
+	s.files = append(s.files, e)
+	return ID(len(s.files) - 1) // #nosec G115 -- bounded by the ID space
+}
+
+// appendName copies name into the arena and returns its location.
+func (s *Store) appendName(name string) (chunk, off uint32) {
+	need := binary.MaxVarintLen64 + len(name)
+	last := len(s.chunks) - 1
+	if last < 0 || cap(s.chunks[last])-len(s.chunks[last]) < need {
+		s.chunks = append(s.chunks, make([]byte, 0, max(chunkSize, need)))
+		last++
+	}
+	buf := s.chunks[last]
+	off = uint32(len(buf)) // #nosec G115 -- chunk length fits in uint32
+	buf = binary.AppendUvarint(buf, uint64(len(name)))
+	s.chunks[last] = append(buf, name...)
+	return uint32(last), off // #nosec G115 -- chunk count fits in uint32
+}
+
+// Path returns the full path for id, or "" when id is unknown.
+func (s *Store) Path(id ID) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.lookup(id)
+	if !ok {
+		return ""
+	}
+	name := s.name(e)
+	if e.dir == noDir {
+		return string(name)
+	}
+	dir := s.dirs[e.dir-1]
+	var b strings.Builder
+	b.Grow(len(dir) + 1 + len(name))
+	b.WriteString(dir)
+	b.WriteByte(os.PathSeparator)
+	b.Write(name)
+	return b.String()
+}
+
+// Dir returns the directory part of id's path, without a trailing separator.
+func (s *Store) Dir(id ID) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.lookup(id)
+	if !ok || e.dir == noDir {
+		return ""
+	}
+	return s.dirs[e.dir-1]
+}
+
+// Base returns the final element of id's path.
+func (s *Store) Base(id ID) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.lookup(id)
+	if !ok {
+		return ""
+	}
+	return string(s.name(e))
+}
+
+// Len returns the number of paths interned.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.files)
+}
+
+// DirCount returns the number of distinct directories interned.
+func (s *Store) DirCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.dirs)
+}
+
+func (s *Store) lookup(id ID) (entry, bool) {
+	if int(id) >= len(s.files) {
+		return entry{}, false
+	}
+	return s.files[id], true
+}
+
+func (s *Store) name(e entry) []byte {
+	buf := s.chunks[e.chunk][e.off:]
+	n, w := binary.Uvarint(buf)
+	return buf[w : w+int(n)] // #nosec G115 -- length was written by appendName
+}
+
+// split breaks path at its last separator. The pieces rejoin to the exact
+// input, so paths like "a//b" or "/x" round-trip unchanged.
+func split(path string) (dir, name string, hasDir bool) {
+	i := strings.LastIndexByte(path, os.PathSeparator)
+	if i < 0 {
+		return "", path, false
+	}
+	return path[:i], path[i+1:], true
+}
+
+// InnermostRoot returns the index of the innermost of roots holding path, or
+// -1 if none does. A path below nested roots belongs to the deepest one, so
+// attribution doesn't depend on which walk reached it first. Roots and path
+// should be clean and absolute.
+func InnermostRoot(roots []string, path string) int {
+	best := -1
+	for i, root := range roots {
+		if path != root && !strings.HasPrefix(path, strings.TrimSuffix(root, string(os.PathSeparator))+string(os.PathSeparator)) {
+			continue
+		}
+		if best < 0 || len(root) > len(roots[best]) {
+			best = i
+		}
+	}
+	return best
+}
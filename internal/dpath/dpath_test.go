@@ -0,0 +1,105 @@
+package dpath
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStoreRoundTrip(t *testing.T) {
+	s := NewStore()
+	paths := []string{
+		"/tmp/a/one.txt",
+		"/tmp/a/two.txt",
+		"/tmp/b/one.txt",
+		"/root.txt",
+		"relative.txt",
+		"dir/",
+		"a//b",
+		"",
+		filepath.Join("/tmp", strings.Repeat("x", chunkSize+10)),
+	}
+
+	ids := make([]ID, len(paths))
+	for i, p := range paths {
+		ids[i] = s.Add(p)
+	}
+	for i, p := range paths {
+		if got := s.Path(ids[i]); got != p {
+			t.Fatalf("Path(%d) = %q, want %q", ids[i], got, p)
+		}
+	}
+
+	if got := s.Dir(ids[0]); got != "/tmp/a" {
+		t.Fatalf("Dir = %q, want /tmp/a", got)
+	}
+	if got := s.Base(ids[2]); got != "one.txt" {
+		t.Fatalf("Base = %q, want one.txt", got)
+	}
+	if got := s.Dir(ids[4]); got != "" {
+		t.Fatalf("expected no directory for a bare name, got %q", got)
+	}
+	if s.Len() != len(paths) {
+		t.Fatalf("Len = %d, want %d", s.Len(), len(paths))
+	}
+	// /tmp/a, /tmp/b, "" (for /root.txt), dir, a/ and /tmp.
+	if s.DirCount() != 6 {
+		t.Fatalf("DirCount = %d, want 6", s.DirCount())
+	}
+	if got := s.Path(ID(len(paths))); got != "" {
+		t.Fatalf("expected empty path for unknown ID, got %q", got)
+	}
+}
+
+func TestStoreConcurrentAdd(t *testing.T) {
+	s := NewStore()
+	const workers, perWorker = 8, 500
+
+	ids := make([][]ID, workers)
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				ids[w] = append(ids[w], s.Add(fmt.Sprintf("/data/%d/file-%d", i%7, w*perWorker+i)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.Len() != workers*perWorker {
+		t.Fatalf("Len = %d, want %d", s.Len(), workers*perWorker)
+	}
+	if s.DirCount() != 7 {
+		t.Fatalf("DirCount = %d, want 7", s.DirCount())
+	}
+	for w := range workers {
+		for i, id := range ids[w] {
+			want := fmt.Sprintf("/data/%d/file-%d", i%7, w*perWorker+i)
+			if got := s.Path(id); got != want {
+				t.Fatalf("Path(%d) = %q, want %q", id, got, want)
+			}
+		}
+	}
+}
+
+func TestInnermostRoot(t *testing.T) {
+	roots := []string{"/data", "/data/nested", "/"}
+	for path, want := range map[string]int{
+		"/data/a.txt":        0,
+		"/data/nested/b.txt": 1,
+		"/data/nested":       1,
+		"/data/nestedness/c": 0,
+		"/elsewhere/d.txt":   2,
+	} {
+		if got := InnermostRoot(roots, path); got != want {
+			t.Errorf("InnermostRoot(%q) = %d, want %d", path, got, want)
+		}
+	}
+	if got := InnermostRoot([]string{"/data"}, "/other"); got != -1 {
+		t.Errorf("InnermostRoot outside every root = %d, want -1", got)
+	}
+}
@@ -1,11 +1,13 @@
 package dupview
 
 import (
+	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dmap"
 	"github.com/jdefrancesco/dskDitto/internal/dsklog"
 	"github.com/jdefrancesco/dskDitto/internal/manifest"
 )
@@ -14,74 +16,398 @@ type ApplyOptions struct {
 	BackupPath    string
 	HashAlgorithm dfs.HashAlgorithm
 	SkipConfirm   bool
+	// Disposal decides where deleted files go; nil deletes them outright.
+	Disposal *dfs.Disposal
+	// LinkStyle decides how link actions write symlink targets.
+	LinkStyle dfs.LinkStyle
+	// VerifyHash re-hashes every marked file and the copy it defers to with
+	// HashAlgorithm right before acting, on top of the size and mtime check.
+	VerifyHash bool
+	// DryRun makes ApplyMarked only describe what it would do; see
+	// BuildPreview.
+	DryRun bool
+	// Guard holds the safety limits ApplyMarked enforces. Its protected
+	// directories apply even when it is left zero.
+	Guard dmap.Guard
+	// Scan describes the scan behind the groups. It goes in the header of
+	// the manifest at BackupPath if ApplyMarked creates it.
+	Scan dmap.ScanInfo
 }
 
+// plannedMutation is one group's share of an action: its marked files and
+// the unmarked file they defer to, which is nil for a delete that isn't
+// journaled.
 type plannedMutation struct {
-	action     Action
-	targetPath string
-	affected   []*FileEntry
+	group    *Group
+	target   *FileEntry
+	affected []*FileEntry
 }
 
+// ApplyMarked performs action on the marked entries of groups. Marked files
+// that changed since the scan, or whose kept copy did, are refused first (see
+// refuseChanged), then files opts.Guard protects or finds too recently
+// modified (see refuseGuarded). If what remains exceeds the guard's limits,
+// nothing is done and an error wrapping dmap.ErrLimitExceeded is returned.
+// With opts.BackupPath set, a restore manifest covering the remaining files is
+// written before anything is touched. With opts.DryRun set, nothing is
+// checked against the scan or touched and the summary of BuildPreview is
+// returned instead.
 func ApplyMarked(groups []*Group, action Action, opts ApplyOptions) (string, error) {
-	if opts.BackupPath == "" {
-		switch action {
-		case ActionLink:
-			return LinkMarked(groups), nil
-		case ActionReflink:
-			return ReflinkMarked(groups), nil
-		default:
-			return DeleteMarked(groups), nil
+	if opts.DryRun {
+		preview := BuildPreview(groups, action, opts)
+		if err := opts.Guard.CheckBatch(preview.Files, preview.Reclaim); err != nil {
+			return "", err
+		}
+		return "Dry run: " + preview.Summary() + " Nothing was changed.", nil
+	}
+	var rehash dfs.HashAlgorithm
+	if opts.VerifyHash {
+		if opts.HashAlgorithm == "" {
+			return "", fmt.Errorf("re-hashing before acting requires a hash algorithm")
 		}
+		rehash = opts.HashAlgorithm
 	}
-	if opts.HashAlgorithm == "" {
-		return "", fmt.Errorf("backup manifest requires a hash algorithm")
+	refused := refuseChanged(groups, rehash)
+	guarded := refuseGuarded(groups, opts.Guard)
+	preview := BuildPreview(groups, action, opts)
+	if err := opts.Guard.CheckBatch(preview.Files, preview.Reclaim); err != nil {
+		return "", err
+	}
+	summary, err := applyMarked(groups, action, opts)
+	if err != nil {
+		return "", err
+	}
+	return withGuarded(withRefused(summary, refused), guarded), nil
+}
+
+// applyMarked is ApplyMarked once the marked entries have been checked, and
+// the one path every action takes. Marked directories are changed first, each
+// as a unit, then the marked files of each group against its first unmarked
+// file. With opts.BackupPath set, the files are journaled before any is
+// touched; directory groups can't be journaled and are refused up front.
+func applyMarked(groups []*Group, action Action, opts ApplyOptions) (string, error) {
+	backup := opts.BackupPath != ""
+	if backup {
+		if opts.HashAlgorithm == "" {
+			return "", fmt.Errorf("backup manifest requires a hash algorithm")
+		}
+		for _, group := range groups {
+			if group != nil && group.MatchInfo.Type.IsDirectory() && len(markedActionEntries(group)) > 0 {
+				return "", fmt.Errorf("group %q holds directories, which a restore manifest cannot cover", group.Title)
+			}
+		}
 	}
 
-	plan, entries, err := buildMutationPlan(groups, action, opts.HashAlgorithm)
+	treesDone, treeFailures, treesLost := applyTreeGroups(groups, action, opts)
+	plan, unplanned, err := buildMutationPlan(groups, action, backup)
 	if err != nil {
 		return "", err
 	}
-	if err := manifest.AppendUnique(opts.BackupPath, entries); err != nil {
-		return "", fmt.Errorf("write restore manifest %s: %w", opts.BackupPath, err)
+	if backup {
+		entries, err := journalEntries(plan, action, opts.HashAlgorithm)
+		if err != nil {
+			return "", err
+		}
+		if err := manifest.AppendUnique(opts.BackupPath, manifest.NewHeader(opts.Scan), entries); err != nil {
+			return "", fmt.Errorf("write restore manifest %s: %w", opts.BackupPath, err)
+		}
 	}
+	return executeMutationPlan(plan, action, opts, treesDone, treeFailures+unplanned, treesLost), nil
+}
 
-	return executeMutationPlan(plan), nil
+// refuseChanged re-checks the marked files of every file group, and the
+// unmarked copy each would defer to, against the size and mtime recorded at
+// scan time; with algo set, content groups are re-hashed too. Marked
+// directories are checked file by file against their tree records the same
+// way (see dmap.CheckTrees). Marked entries that changed, or whose kept copy
+// changed, are unmarked and flagged FileStatusError with the reason. Entries
+// already changed by an earlier action are not checked. It returns the
+// number of entries refused.
+func refuseChanged(groups []*Group, algo dfs.HashAlgorithm) int {
+	refused := 0
+	for _, group := range groups {
+		if group == nil {
+			continue
+		}
+		marked := markedActionEntries(group)
+		if len(marked) == 0 {
+			continue
+		}
+		if group.MatchInfo.Type.IsDirectory() {
+			refused += refuseChangedTrees(marked, survivingTarget(group), algo)
+			continue
+		}
+		rehash := algo
+		switch group.MatchInfo.Type {
+		case "", dmap.MatchContent, dmap.MatchZeroFilled:
+		default:
+			rehash = ""
+		}
+
+		var targetErr error
+		if target := survivingTarget(group); target != nil {
+			if err := checkEntry(target, group.Hash, rehash); err != nil {
+				targetErr = fmt.Errorf("kept copy: %w", err)
+			}
+		}
+		for _, entry := range marked {
+			err := targetErr
+			if err == nil {
+				err = checkEntry(entry, group.Hash, rehash)
+			}
+			if err == nil {
+				continue
+			}
+			entry.Marked = false
+			entry.Status = FileStatusError
+			entry.Message = err.Error()
+			if dsklog.Dlogger != nil {
+				dsklog.Dlogger.Errorf("Refusing to act on %s: %v", entry.Path, err)
+			}
+			refused++
+		}
+	}
+	return refused
 }
 
-func buildMutationPlan(groups []*Group, action Action, algo dfs.HashAlgorithm) ([]plannedMutation, []manifest.Entry, error) {
-	plan := make([]plannedMutation, 0, len(groups))
-	entries := make([]manifest.Entry, 0)
-	var groupID uint64 = 1
+// refuseChangedTrees unmarks the marked directory entries whose files, or
+// those of the kept directory target, no longer match their tree records,
+// and flags them FileStatusError with the reason. Entries without a target
+// are left for applyTreeGroups to fail. It returns the number refused.
+func refuseChangedTrees(marked []*FileEntry, target *FileEntry, algo dfs.HashAlgorithm) int {
+	if target == nil {
+		return 0
+	}
+	refused := 0
+	for _, entry := range marked {
+		if entry.Status != FileStatusPending {
+			continue
+		}
+		err := dmap.CheckTrees(entry.Path, entry.Tree, target.Path, target.Tree, algo)
+		if err == nil {
+			continue
+		}
+		entry.Marked = false
+		entry.Status = FileStatusError
+		entry.Message = err.Error()
+		if dsklog.Dlogger != nil {
+			dsklog.Dlogger.Errorf("Refusing to act on directory %s: %v", entry.Path, err)
+		}
+		refused++
+	}
+	return refused
+}
 
+// refuseGuarded unmarks the marked entries of every group that guard
+// protects or finds too recently modified, or whose kept copy it finds too
+// recently modified, and flags them FileStatusError with the reason. A
+// directory counts as too recently modified if any file recorded below it
+// is. It returns the number of entries refused.
+func refuseGuarded(groups []*Group, guard dmap.Guard) int {
+	refused := 0
 	for _, group := range groups {
+		if group == nil {
+			continue
+		}
+		marked := markedActionEntries(group)
+		if len(marked) == 0 {
+			continue
+		}
+		var targetErr error
+		if target := survivingTarget(group); target != nil {
+			targetErr = checkSettled(target, guard)
+		}
+		for _, entry := range marked {
+			err := guardEntry(entry, targetErr, guard)
+			if err == nil {
+				continue
+			}
+			entry.Marked = false
+			entry.Status = FileStatusError
+			entry.Message = err.Error()
+			if dsklog.Dlogger != nil {
+				dsklog.Dlogger.Errorf("Refusing to act on %s: %v", entry.Path, err)
+			}
+			refused++
+		}
+	}
+	return refused
+}
+
+// guardEntry returns why guard refuses entry, if it does: targetErr, the
+// result of checking the copy entry defers to, or the check of entry itself.
+func guardEntry(entry *FileEntry, targetErr error, guard dmap.Guard) error {
+	if entry.Status != FileStatusPending {
+		return nil
+	}
+	if guard.Protected(entry.Path) {
+		return fmt.Errorf("%w: %s", dmap.ErrProtected, entry.Path)
+	}
+	if targetErr != nil {
+		return fmt.Errorf("kept copy: %w", targetErr)
+	}
+	return checkSettled(entry, guard)
+}
+
+// checkSettled runs guard.CheckSettled on entry or, for a directory entry, on
+// it and every file the scan recorded below it.
+func checkSettled(entry *FileEntry, guard dmap.Guard) error {
+	if entry.Tree != nil {
+		return guard.CheckTreeSettled(entry.Path, entry.Tree)
+	}
+	return guard.CheckSettled(entry.Path)
+}
+
+// checkEntry returns an error wrapping dfs.ErrChanged if entry no longer
+// matches its scanned size and mtime or, with algo set, hash.
+func checkEntry(entry *FileEntry, hash dmap.Digest, algo dfs.HashAlgorithm) error {
+	if entry.Status != FileStatusPending {
+		return nil
+	}
+	if err := dfs.CheckUnchanged(entry.Path, entry.Info.FileMeta); err != nil {
+		return err
+	}
+	if algo == "" {
+		return nil
+	}
+	return dfs.CheckHash(entry.Path, hash, algo)
+}
+
+// withRefused appends the number of files refused by refuseChanged to an
+// action summary.
+func withRefused(summary string, refused int) string {
+	if refused == 0 {
+		return summary
+	}
+	note := fmt.Sprintf("Refused %d file(s) that changed since the scan.", refused)
+	if summary == "" {
+		return note
+	}
+	return summary + " " + note
+}
+
+// withGuarded appends the number of files refuseGuarded refused to summary.
+func withGuarded(summary string, refused int) string {
+	if refused == 0 {
+		return summary
+	}
+	note := fmt.Sprintf("Refused %d protected or recently modified file(s).", refused)
+	if summary == "" {
+		return note
+	}
+	return summary + " " + note
+}
+
+// noteLostMetadata appends the attributes a conversion of entry could not
+// preserve, as reported by err, to its message and logs them. It reports
+// whether anything was lost.
+func noteLostMetadata(entry *FileEntry, err error) bool {
+	if err == nil {
+		return false
+	}
+	entry.Message += "; " + err.Error()
+	if dsklog.Dlogger != nil {
+		dsklog.Dlogger.Warn(err)
+	}
+	return true
+}
+
+// withLostMetadata appends the number of converted files that lost metadata
+// to an action summary.
+func withLostMetadata(summary string, lost int) string {
+	if lost == 0 {
+		return summary
+	}
+	return summary + fmt.Sprintf(" Could not preserve all metadata of %d file(s).", lost)
+}
+
+// buildMutationPlan pairs the marked files of every file group with the
+// group's first unmarked file. A journaled action needs one in every group
+// and fails without changing anything if a group has none. Otherwise only
+// conversions need one; the marked files of a group without it are unmarked
+// and flagged FileStatusError, and counted in the second result.
+func buildMutationPlan(groups []*Group, action Action, journaled bool) ([]plannedMutation, int, error) {
+	plan := make([]plannedMutation, 0, len(groups))
+	failures := 0
+	for _, group := range groups {
+		if group == nil || group.MatchInfo.Type.IsDirectory() {
+			continue
+		}
+		for _, entry := range group.Files {
+			if entry != nil && entry.Marked && entry.Status == FileStatusDeleted {
+				entry.Marked = false
+			}
+		}
 		marked := markedActionEntries(group)
 		if len(marked) == 0 {
 			continue
 		}
 
 		target := survivingTarget(group)
-		if target == nil {
-			return nil, nil, fmt.Errorf("group %q has no surviving canonical file for backup", group.Title)
+		if target == nil && journaled {
+			return nil, 0, fmt.Errorf("group %q has no surviving canonical file for backup", group.Title)
 		}
+		if target == nil && action != ActionDelete {
+			for _, entry := range marked {
+				entry.Status = FileStatusError
+				entry.Message = noTargetMessage(action)
+				entry.Marked = false
+				failures++
+			}
+			continue
+		}
+		plan = append(plan, plannedMutation{group: group, target: target, affected: marked})
+	}
+	return plan, failures, nil
+}
 
-		hash := fmt.Sprintf("%x", group.Hash)
-		plan = append(plan, plannedMutation{
-			action:     action,
-			targetPath: target.Path,
-			affected:   marked,
-		})
+// noTargetMessage explains why action skipped the marked files of a group
+// with no unmarked file left.
+func noTargetMessage(action Action) string {
+	switch action {
+	case ActionLink:
+		return "no unmarked file to link to"
+	case ActionReflink:
+		return "no unmarked file to reflink from"
+	case ActionHardlink:
+		return "no unmarked file to hard link to"
+	case ActionDedupe:
+		return "no unmarked file to dedupe against"
+	}
+	return ""
+}
 
-		for _, entry := range marked {
-			manifestEntry, err := manifest.NewEntry(groupID, algo, hash, target.Path, entry.Path)
+// journalEntries returns the restore manifest entries recording plan, one
+// group number per step.
+func journalEntries(plan []plannedMutation, action Action, algo dfs.HashAlgorithm) ([]manifest.Entry, error) {
+	entries := make([]manifest.Entry, 0)
+	for i, step := range plan {
+		hash := fmt.Sprintf("%x", step.group.Hash)
+		for _, entry := range step.affected {
+			manifestEntry, err := manifest.NewEntryWithMeta(uint64(i+1), algo, hash, step.target.Path, step.target.Info.FileMeta, entry.Path, entry.Info.FileMeta)
 			if err != nil {
-				return nil, nil, err
+				return nil, err
 			}
+			manifestEntry.Action = JournalAction(action)
 			entries = append(entries, manifestEntry)
 		}
-		groupID++
 	}
+	return entries, nil
+}
 
-	return plan, entries, nil
+// JournalAction returns the manifest action that records action.
+func JournalAction(action Action) manifest.Action {
+	switch action {
+	case ActionLink:
+		return manifest.ActionSymlink
+	case ActionReflink:
+		return manifest.ActionReflink
+	case ActionHardlink:
+		return manifest.ActionHardlink
+	case ActionDedupe:
+		return manifest.ActionDedupe
+	}
+	return manifest.ActionDelete
 }
 
 func markedActionEntries(group *Group) []*FileEntry {
@@ -113,134 +439,264 @@ func survivingTarget(group *Group) *FileEntry {
 	return nil
 }
 
-func executeMutationPlan(plan []plannedMutation) string {
-	if len(plan) == 0 {
-		return ""
-	}
-
-	switch plan[0].action {
+// executeMutationPlan carries out plan and summarizes the action, counting
+// on from the directories applyTreeGroups changed, failed and changed without
+// all metadata.
+func executeMutationPlan(plan []plannedMutation, action Action, opts ApplyOptions, done, failures, lost int) string {
+	switch action {
 	case ActionLink:
-		return executeLinkPlan(plan)
+		symlink := func(path, target string) error {
+			return dfs.SymlinkReplace(path, target, opts.LinkStyle)
+		}
+		linked, failed, missing := executeReplacePlan(plan, "symlink", "linked", FileStatusLinked, symlink)
+		return withLostMetadata(conversionSummary("symlinks", done+linked, failures+failed), lost+missing)
 	case ActionReflink:
-		return executeReflinkPlan(plan)
+		reflinked, failed, missing := executeReplacePlan(plan, "reflink", "reflinked", FileStatusReflinked, dfs.ReflinkReplace)
+		return withLostMetadata(conversionSummary("reflinks", done+reflinked, failures+failed), lost+missing)
+	case ActionHardlink:
+		hardlinked, failed, missing := executeReplacePlan(plan, "hard link", "hard linked", FileStatusHardlinked, dfs.HardlinkReplace)
+		return withLostMetadata(conversionSummary("hard links", done+hardlinked, failures+failed), lost+missing)
+	case ActionDedupe:
+		deduped, failed, _ := executeReplacePlan(plan, "dedupe", "deduped", FileStatusDeduped, dfs.Dedupe)
+		return conversionSummary("shared extents", done+deduped, failures+failed)
 	default:
-		return executeDeletePlan(plan)
+		deleted, failed := executeDeletePlan(plan, opts.Disposal)
+		return deleteSummary(opts.Disposal, done+deleted, failures+failed)
 	}
 }
 
-func executeDeletePlan(plan []plannedMutation) string {
-	var deleted, failures int
+func executeDeletePlan(plan []plannedMutation, disposal *dfs.Disposal) (deleted, failures int) {
 	for _, step := range plan {
 		for _, entry := range step.affected {
-			if err := os.Remove(entry.Path); err != nil {
-				entry.Status = FileStatusError
-				entry.Message = err.Error()
-				if dsklog.Dlogger != nil {
-					dsklog.Dlogger.Errorf("Failed to delete file %s: %v", entry.Path, err)
-				}
-				failures++
-			} else {
-				entry.Status = FileStatusDeleted
-				entry.Message = fmt.Sprintf("deleted (%s)", filepath.Base(entry.Path))
-				if dsklog.Dlogger != nil {
-					dsklog.Dlogger.Infof("Successfully deleted file: %s", entry.Path)
-				}
+			if disposeEntry(entry, disposal) {
 				deleted++
+			} else {
+				failures++
 			}
-			entry.Marked = false
 		}
 	}
+	return deleted, failures
+}
 
+// disposeEntry removes entry's file with disposal and records the outcome,
+// reporting whether it succeeded.
+func disposeEntry(entry *FileEntry, disposal *dfs.Disposal) bool {
+	entry.Marked = false
+	if err := disposal.Remove(entry.Path); err != nil {
+		entry.Status = FileStatusError
+		entry.Message = err.Error()
+		if dsklog.Dlogger != nil {
+			dsklog.Dlogger.Errorf("Failed to delete file %s: %v", entry.Path, err)
+		}
+		return false
+	}
+	entry.Status = FileStatusDeleted
+	entry.Message = fmt.Sprintf("%s (%s)", disposal.Verb(), filepath.Base(entry.Path))
+	if dsklog.Dlogger != nil {
+		dsklog.Dlogger.Infof("Successfully %s file: %s", disposal.Verb(), entry.Path)
+	}
+	return true
+}
+
+// deleteSummary reports the outcome of a delete action.
+func deleteSummary(disposal *dfs.Disposal, deleted, failures int) string {
+	verb := disposal.Verb()
+	done := strings.ToUpper(verb[:1]) + verb[1:]
 	switch {
 	case deleted == 0 && failures == 0:
-		return "No files were deleted."
+		return fmt.Sprintf("No files were %s.", verb)
 	case failures == 0:
-		return fmt.Sprintf("Deleted %d file(s).", deleted)
+		return fmt.Sprintf("%s %d file(s).", done, deleted)
 	case deleted == 0:
 		return fmt.Sprintf("Failed to delete %d file(s).", failures)
 	default:
-		return fmt.Sprintf("Deleted %d file(s); %d error(s) occurred.", deleted, failures)
+		return fmt.Sprintf("%s %d file(s); %d error(s) occurred.", done, deleted, failures)
 	}
 }
 
-func executeReflinkPlan(plan []plannedMutation) string {
-	var reflinked, failures int
+// executeReplacePlan replaces the affected files of every step with replace,
+// pointing them at the step's target, and records the outcome on each entry
+// with status. kind names the replacement in logs and verb describes a
+// replaced file in its message. Replacements that lost some metadata count as
+// done and as lost.
+func executeReplacePlan(plan []plannedMutation, kind, verb string, status FileStatus, replace func(path, target string) error) (done, failures, lost int) {
 	for _, step := range plan {
 		for _, entry := range step.affected {
-			if err := dfs.ReflinkReplace(entry.Path, step.targetPath); err != nil {
+			entry.Marked = false
+			err := replace(entry.Path, step.target.Path)
+			if err != nil && !errors.Is(err, dfs.ErrMetadataNotPreserved) {
 				entry.Status = FileStatusError
 				entry.Message = err.Error()
 				if dsklog.Dlogger != nil {
-					dsklog.Dlogger.Errorf("Failed to reflink %s -> %s: %v", entry.Path, step.targetPath, err)
+					dsklog.Dlogger.Errorf("Failed to %s %s -> %s: %v", kind, entry.Path, step.target.Path, err)
 				}
 				failures++
-				entry.Marked = false
 				continue
 			}
-			entry.Status = FileStatusReflinked
-			entry.Message = fmt.Sprintf("reflinked -> %s", filepath.Base(step.targetPath))
+			entry.Status = status
+			entry.Message = fmt.Sprintf("%s -> %s", verb, filepath.Base(step.target.Path))
+			if noteLostMetadata(entry, err) {
+				lost++
+			}
 			if dsklog.Dlogger != nil {
-				dsklog.Dlogger.Infof("Converted duplicate to reflink: %s -> %s", entry.Path, step.targetPath)
+				dsklog.Dlogger.Infof("Converted duplicate to %s: %s -> %s", kind, entry.Path, step.target.Path)
 			}
-			reflinked++
-			entry.Marked = false
+			done++
 		}
 	}
-
-	switch {
-	case reflinked == 0 && failures == 0:
-		return "No files were converted."
-	case failures == 0:
-		return fmt.Sprintf("Converted %d file(s) to reflinks.", reflinked)
-	case reflinked == 0:
-		return fmt.Sprintf("Failed to convert %d file(s) to reflinks.", failures)
-	default:
-		return fmt.Sprintf("Converted %d file(s); %d error(s) occurred.", reflinked, failures)
-	}
+	return done, failures, lost
 }
 
-func executeLinkPlan(plan []plannedMutation) string {
-	var linked, failures int
-	for _, step := range plan {
-		for _, entry := range step.affected {
-			if err := os.Remove(entry.Path); err != nil {
+// applyTreeGroups runs action on the marked members of directory groups, each
+// as a unit against the group's first unmarked directory. Entries of other
+// groups that lived below a changed directory take its status and are
+// unmarked, so file-level actions leave them alone. It returns the number of
+// directories changed, the number that failed and the number changed without
+// all of their files' metadata.
+func applyTreeGroups(groups []*Group, action Action, opts ApplyOptions) (done, failures, lost int) {
+	changed := make(map[string]*FileEntry)
+	for _, group := range groups {
+		if group == nil || !group.MatchInfo.Type.IsDirectory() {
+			continue
+		}
+		marked := markedActionEntries(group)
+		if len(marked) == 0 {
+			continue
+		}
+		target := survivingTarget(group)
+		for _, entry := range marked {
+			entry.Marked = false
+			if target == nil {
 				entry.Status = FileStatusError
-				entry.Message = err.Error()
-				if dsklog.Dlogger != nil {
-					dsklog.Dlogger.Errorf("Failed to remove file for relink %s: %v", entry.Path, err)
-				}
+				entry.Message = "no unmarked directory holding a copy"
 				failures++
-				entry.Marked = false
 				continue
 			}
-			if err := os.Symlink(step.targetPath, entry.Path); err != nil {
+			err := applyTree(action, entry, target.Path, opts)
+			if err != nil && !errors.Is(err, dfs.ErrMetadataNotPreserved) {
 				entry.Status = FileStatusError
 				entry.Message = err.Error()
 				if dsklog.Dlogger != nil {
-					dsklog.Dlogger.Errorf("Failed to create symlink %s -> %s: %v", entry.Path, step.targetPath, err)
+					dsklog.Dlogger.Errorf("Failed to act on directory %s: %v", entry.Path, err)
 				}
 				failures++
-				entry.Marked = false
 				continue
 			}
-			entry.Status = FileStatusLinked
-			entry.Message = fmt.Sprintf("linked -> %s", filepath.Base(step.targetPath))
 			if dsklog.Dlogger != nil {
-				dsklog.Dlogger.Infof("Converted duplicate to symlink: %s -> %s", entry.Path, step.targetPath)
+				dsklog.Dlogger.Infof("Duplicate directory %s (copy kept at %s)", entry.Message, target.Path)
 			}
-			linked++
-			entry.Marked = false
+			if noteLostMetadata(entry, err) {
+				lost++
+			}
+			changed[entry.Path] = entry
+			done++
+		}
+	}
+	if len(changed) > 0 {
+		settleBelow(groups, changed)
+	}
+	return done, failures, lost
+}
+
+// applyTree performs action on the directory entry, keeping keep, and
+// records the outcome on entry. Deleted directories go where opts.Disposal
+// sends them and links are written in opts.LinkStyle. A conversion that only
+// lost metadata is recorded as done and its dfs.ErrMetadataNotPreserved
+// returned.
+func applyTree(action Action, entry *FileEntry, keep string, opts ApplyOptions) error {
+	name := filepath.Base(entry.Path)
+	var err error
+	switch action {
+	case ActionLink:
+		if err = dmap.LinkTree(entry.Path, keep, opts.LinkStyle); err != nil && !errors.Is(err, dfs.ErrMetadataNotPreserved) {
+			return err
 		}
+		entry.Status = FileStatusLinked
+		entry.Message = fmt.Sprintf("linked -> %s", filepath.Base(keep))
+	case ActionReflink:
+		if err = dmap.ReflinkTree(entry.Path, keep); err != nil && !errors.Is(err, dfs.ErrMetadataNotPreserved) {
+			return err
+		}
+		entry.Status = FileStatusReflinked
+		entry.Message = fmt.Sprintf("reflinked -> %s", filepath.Base(keep))
+	case ActionHardlink:
+		if err = dmap.HardlinkTree(entry.Path, keep); err != nil && !errors.Is(err, dfs.ErrMetadataNotPreserved) {
+			return err
+		}
+		entry.Status = FileStatusHardlinked
+		entry.Message = fmt.Sprintf("hard linked -> %s", filepath.Base(keep))
+	case ActionDedupe:
+		if err := dmap.DedupeTree(entry.Path, keep); err != nil {
+			return err
+		}
+		entry.Status = FileStatusDeduped
+		entry.Message = fmt.Sprintf("deduped -> %s", filepath.Base(keep))
+	default:
+		if err := dmap.RemoveTree(entry.Path, keep, opts.Disposal); err != nil {
+			return err
+		}
+		entry.Status = FileStatusDeleted
+		entry.Message = fmt.Sprintf("%s (%s)", opts.Disposal.Verb(), name)
 	}
+	return err
+}
+
+// settleBelow copies the status of each changed directory onto the entries
+// of file groups that live below it.
+func settleBelow(groups []*Group, changed map[string]*FileEntry) {
+	for _, group := range groups {
+		if group == nil || group.MatchInfo.Type.IsDirectory() {
+			continue
+		}
+		for _, entry := range group.Files {
+			if dir, tree := enclosingEntry(entry.Path, changed); tree != nil {
+				entry.Status = tree.Status
+				entry.Message = fmt.Sprintf("%s (via %s)", fileStatusVerb(tree.Status), filepath.Base(dir))
+				entry.Marked = false
+			}
+		}
+	}
+}
+
+// enclosingEntry returns the nearest directory above path that is a key of
+// dirs, and its entry, or nil if there is none.
+func enclosingEntry(path string, dirs map[string]*FileEntry) (string, *FileEntry) {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if entry, ok := dirs[dir]; ok {
+			return dir, entry
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return "", nil
+		}
+	}
+}
+
+func fileStatusVerb(status FileStatus) string {
+	switch status {
+	case FileStatusLinked:
+		return "linked"
+	case FileStatusReflinked:
+		return "reflinked"
+	case FileStatusHardlinked:
+		return "hard linked"
+	case FileStatusDeduped:
+		return "deduped"
+	default:
+		return "deleted"
+	}
+}
 
+// conversionSummary reports the outcome of converting files to kind, such as
+// "symlinks".
+func conversionSummary(kind string, converted, failures int) string {
 	switch {
-	case linked == 0 && failures == 0:
+	case converted == 0 && failures == 0:
 		return "No files were converted."
 	case failures == 0:
-		return fmt.Sprintf("Converted %d file(s) to symlinks.", linked)
-	case linked == 0:
-		return fmt.Sprintf("Failed to convert %d file(s) to symlinks.", failures)
+		return fmt.Sprintf("Converted %d file(s) to %s.", converted, kind)
+	case converted == 0:
+		return fmt.Sprintf("Failed to convert %d file(s) to %s.", failures, kind)
 	default:
-		return fmt.Sprintf("Converted %d file(s); %d error(s) occurred.", linked, failures)
+		return fmt.Sprintf("Converted %d file(s); %d error(s) occurred.", converted, failures)
 	}
 }
@@ -7,11 +7,14 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jdefrancesco/dskDitto/internal/dfs"
 	"github.com/jdefrancesco/dskDitto/internal/dmap"
 	"github.com/jdefrancesco/dskDitto/internal/dsklog"
 	"github.com/jdefrancesco/dskDitto/internal/manifest"
+	"github.com/jdefrancesco/dskDitto/internal/plan"
+	"github.com/jdefrancesco/dskDitto/pkg/utils"
 )
 
 type testFileSpec struct {
@@ -68,6 +71,32 @@ func newTestGroup(t *testing.T, dir string, content string, specs []testFileSpec
 	return group, paths
 }
 
+// mustTreeFiles records every file below dir the way a scan with
+// --dir-trees would, without digests.
+func mustTreeFiles(t *testing.T, dir string) []dmap.TreeFile {
+	t.Helper()
+	var files []dmap.TreeFile
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		meta, err := dfs.LstatMeta(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, dmap.TreeFile{Rel: rel, Meta: meta})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("record %s: %v", dir, err)
+	}
+	return files
+}
+
 func absPath(t *testing.T, path string) string {
 	t.Helper()
 	abs, err := filepath.Abs(path)
@@ -121,6 +150,9 @@ func TestApplyMarkedDeleteBackupEntriesOnlyChangedPaths(t *testing.T) {
 	if entries[0].RestorePath != absPath(t, paths[1]) {
 		t.Fatalf("unexpected restore path: got %s want %s", entries[0].RestorePath, absPath(t, paths[1]))
 	}
+	if entries[0].Action != manifest.ActionDelete {
+		t.Fatalf("unexpected journal action: got %q want %q", entries[0].Action, manifest.ActionDelete)
+	}
 	if _, err := os.Stat(paths[2]); err != nil {
 		t.Fatalf("untouched file should remain: %v", err)
 	}
@@ -160,6 +192,9 @@ func TestApplyMarkedLinkBackupUsesCurrentUnmarkedTarget(t *testing.T) {
 		if entry.Canonical != wantCanonical {
 			t.Fatalf("unexpected canonical path: got %s want %s", entry.Canonical, wantCanonical)
 		}
+		if entry.Action != manifest.ActionSymlink {
+			t.Fatalf("unexpected journal action: got %q want %q", entry.Action, manifest.ActionSymlink)
+		}
 	}
 	gotRestorePaths := restorePaths(entries)
 	wantRestorePaths := []string{absPath(t, paths[0]), absPath(t, paths[2])}
@@ -243,6 +278,131 @@ func TestApplyMarkedReflinkBackupUsesCurrentUnmarkedTarget(t *testing.T) {
 	}
 }
 
+func TestApplyMarkedDedupeKeepsFilesInPlace(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.bin", marked: false},
+		{name: "b.bin", marked: true},
+	})
+	before, err := dfs.LstatMeta(paths[1])
+	if err != nil {
+		t.Fatalf("lstat: %v", err)
+	}
+	manifestPath := filepath.Join(dir, "restore.jsonl")
+
+	result, err := ApplyMarked([]*Group{group}, ActionDedupe, ApplyOptions{
+		BackupPath:    manifestPath,
+		HashAlgorithm: dfs.HashSHA256,
+	})
+	if err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	entry := group.Files[1]
+	switch entry.Status {
+	case FileStatusDeduped:
+		if result != "Converted 1 file(s) to shared extents." {
+			t.Fatalf("unexpected result: %q", result)
+		}
+	case FileStatusError:
+		if !strings.Contains(entry.Message, dfs.ErrDedupeUnsupported.Error()) {
+			t.Fatalf("unexpected dedupe failure: %s", entry.Message)
+		}
+	default:
+		t.Fatalf("unexpected status %v", entry.Status)
+	}
+
+	// Either way the duplicate is the same file it was.
+	after, err := dfs.LstatMeta(paths[1])
+	if err != nil || after.Ino != before.Ino || after.ModTime != before.ModTime {
+		t.Fatalf("duplicate was replaced: before %+v after %+v (%v)", before, after, err)
+	}
+	entries, err := manifest.Read(manifestPath)
+	if err != nil || len(entries) != 1 || entries[0].Action != manifest.ActionDedupe {
+		t.Fatalf("expected one dedupe journal entry, got %+v (%v)", entries, err)
+	}
+}
+
+func TestApplyMarkedHardlinkReportsLostMetadata(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.bin", marked: false},
+		{name: "b.bin", marked: true},
+	})
+	if err := os.Chmod(paths[1], 0o600); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+
+	result, err := ApplyMarked([]*Group{group}, ActionHardlink, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if result != "Converted 1 file(s) to hard links. Could not preserve all metadata of 1 file(s)." {
+		t.Fatalf("unexpected result: %q", result)
+	}
+	entry := group.Files[1]
+	if entry.Status != FileStatusHardlinked || !strings.Contains(entry.Message, "mode -rw------- is now") {
+		t.Fatalf("expected a converted entry noting the lost mode, got %v %q", entry.Status, entry.Message)
+	}
+}
+
+func TestApplyMarkedHardlinkBackupUsesCurrentUnmarkedTarget(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.bin", marked: true},
+		{name: "b.bin", marked: false},
+		{name: "c.bin", marked: true},
+	})
+	manifestPath := filepath.Join(dir, "restore.jsonl")
+
+	result, err := ApplyMarked([]*Group{group}, ActionHardlink, ApplyOptions{
+		BackupPath:    manifestPath,
+		HashAlgorithm: dfs.HashSHA256,
+	})
+	if err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if result != "Converted 2 file(s) to hard links." {
+		t.Fatalf("unexpected result: %q", result)
+	}
+
+	entries, err := manifest.Read(manifestPath)
+	if err != nil {
+		t.Fatalf("Read manifest: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected manifest entry count: got %d want 2", len(entries))
+	}
+	wantCanonical := absPath(t, paths[1])
+	for _, entry := range entries {
+		if entry.Canonical != wantCanonical {
+			t.Fatalf("unexpected canonical path: got %s want %s", entry.Canonical, wantCanonical)
+		}
+	}
+
+	keptInfo, err := os.Stat(paths[1])
+	if err != nil {
+		t.Fatalf("stat %s: %v", paths[1], err)
+	}
+	for i, path := range []string{paths[0], paths[2]} {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("lstat %s: %v", path, err)
+		}
+		if !os.SameFile(info, keptInfo) {
+			t.Fatalf("%s should be a hard link to %s", path, paths[1])
+		}
+		if status := group.Files[i*2].Status; status != FileStatusHardlinked {
+			t.Fatalf("unexpected status for %s: %v", path, status)
+		}
+	}
+}
+
 func TestApplyMarkedDeleteBackupUsesSurvivingUnmarkedTarget(t *testing.T) {
 	initDupviewTestLogger()
 
@@ -280,6 +440,34 @@ func TestApplyMarkedDeleteBackupUsesSurvivingUnmarkedTarget(t *testing.T) {
 	}
 }
 
+func TestApplyMarkedDeleteMovesToTrash(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.bin", marked: false},
+		{name: "b.bin", marked: true},
+	})
+
+	result, err := ApplyMarked([]*Group{group}, ActionDelete, ApplyOptions{Disposal: dfs.TrashDisposal()})
+	if err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if result != "Trashed 1 file(s)." {
+		t.Fatalf("unexpected result: %q", result)
+	}
+	if _, err := os.Lstat(paths[1]); !os.IsNotExist(err) {
+		t.Fatalf("%s should be gone, got %v", paths[1], err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data", "Trash", "files", "b.bin")); err != nil {
+		t.Fatalf("trashed file missing: %v", err)
+	}
+	if group.Files[1].Status != FileStatusDeleted || group.Files[1].Message != "trashed (b.bin)" {
+		t.Fatalf("unexpected entry state: %v %q", group.Files[1].Status, group.Files[1].Message)
+	}
+}
+
 func TestApplyMarkedDeleteBackupAbortsWhenAllFilesMarked(t *testing.T) {
 	initDupviewTestLogger()
 
@@ -337,3 +525,542 @@ func TestApplyMarkedBackupWriteFailureAbortsBeforeMutation(t *testing.T) {
 		t.Fatalf("marked file should remain after backup write failure: %v", statErr)
 	}
 }
+
+func TestApplyMarkedDeletesDirectoryGroupAsUnit(t *testing.T) {
+	initDupviewTestLogger()
+	root := t.TempDir()
+	keep, dup := filepath.Join(root, "project"), filepath.Join(root, "project copy")
+	for _, dir := range []string{keep, dup} {
+		mustWriteDupFile(t, filepath.Join(dir, "main.go"), "package main")
+	}
+	outside := filepath.Join(root, "main.go")
+	mustWriteDupFile(t, outside, "package main")
+
+	tree := &Group{
+		MatchInfo: dmap.MatchInfo{Type: dmap.MatchDirTree},
+		Files: []*FileEntry{
+			{Path: keep, Tree: mustTreeFiles(t, keep)},
+			{Path: dup, Marked: true, Tree: mustTreeFiles(t, dup)},
+		},
+	}
+	files := &Group{
+		MatchInfo: dmap.MatchInfo{Type: dmap.MatchContent},
+		Files: []*FileEntry{
+			{Path: outside},
+			{Path: filepath.Join(dup, "main.go"), Marked: true},
+		},
+	}
+
+	result, err := ApplyMarked([]*Group{files, tree}, ActionDelete, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if result != "Deleted 1 file(s)." {
+		t.Fatalf("unexpected result %q", result)
+	}
+	if _, err := os.Stat(dup); !os.IsNotExist(err) {
+		t.Fatalf("duplicate directory should be gone, stat err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(keep, "main.go")); err != nil {
+		t.Fatalf("kept directory damaged: %v", err)
+	}
+	below := files.Files[1]
+	if below.Status != FileStatusDeleted || below.Marked || !strings.Contains(below.Message, "via project copy") {
+		t.Fatalf("entry below the removed directory = %+v", below)
+	}
+}
+
+func TestApplyMarkedBackupRejectsDirectoryGroups(t *testing.T) {
+	initDupviewTestLogger()
+	root := t.TempDir()
+	keep, dup := filepath.Join(root, "a"), filepath.Join(root, "b")
+	for _, dir := range []string{keep, dup} {
+		mustWriteDupFile(t, filepath.Join(dir, "f.txt"), "same")
+	}
+	group := &Group{
+		Title:     "tree",
+		MatchInfo: dmap.MatchInfo{Type: dmap.MatchDirTree},
+		Files: []*FileEntry{
+			{Path: keep, Tree: mustTreeFiles(t, keep)},
+			{Path: dup, Marked: true, Tree: mustTreeFiles(t, dup)},
+		},
+	}
+	_, err := ApplyMarked([]*Group{group}, ActionDelete, ApplyOptions{
+		BackupPath:    filepath.Join(root, "backup.jsonl"),
+		HashAlgorithm: dfs.HashSHA256,
+	})
+	if err == nil {
+		t.Fatal("expected directory groups to be rejected with a backup manifest")
+	}
+}
+
+func TestApplyPlanSkipsStaleSteps(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.bin", marked: false},
+		{name: "b.bin", marked: true},
+		{name: "c.bin", marked: true},
+	})
+	p, err := BuildPlan([]*Group{group}, ActionDelete, dfs.HashSHA256, dfs.LinkAbsolute)
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if len(p.Steps) != 2 {
+		t.Fatalf("expected 2 steps, got %d", len(p.Steps))
+	}
+	for _, step := range p.Steps {
+		if step.Target != paths[0] || step.Action != plan.Delete {
+			t.Fatalf("unexpected step: %+v", step)
+		}
+	}
+
+	// c.bin changes after the plan was made and must survive.
+	mustWriteDupFile(t, paths[2], "edited-after-plan")
+
+	manifestPath := filepath.Join(dir, "restore.jsonl")
+	result, err := ApplyPlan(p, ApplyOptions{BackupPath: manifestPath})
+	if err != nil {
+		t.Fatalf("ApplyPlan: %v", err)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].Step.Path != paths[2] || !errors.Is(result.Skipped[0].Err, plan.ErrStale) {
+		t.Fatalf("expected c.bin skipped as stale, got %+v", result.Skipped)
+	}
+	if len(result.Failed) != 0 || len(result.Summaries) != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if _, err := os.Stat(paths[1]); !os.IsNotExist(err) {
+		t.Fatalf("b.bin should be deleted, stat err=%v", err)
+	}
+	for _, path := range []string{paths[0], paths[2]} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%s should remain: %v", path, err)
+		}
+	}
+	entries, err := manifest.Read(manifestPath)
+	if err != nil {
+		t.Fatalf("Read manifest: %v", err)
+	}
+	if len(entries) != 1 || entries[0].RestorePath != absPath(t, paths[1]) {
+		t.Fatalf("unexpected manifest entries: %+v", entries)
+	}
+}
+
+func TestApplyPlanSkipsStepsWhoseTargetIsChanged(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.bin", marked: false},
+		{name: "b.bin", marked: true},
+	})
+	p, err := BuildPlan([]*Group{group}, ActionDelete, dfs.HashSHA256, dfs.LinkAbsolute)
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	// A hand edit that would also delete the kept copy.
+	extra := p.Steps[0]
+	extra.Path, extra.Target = paths[0], paths[1]
+	info, err := os.Stat(paths[0])
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	extra.MTime = info.ModTime()
+	p.Steps = append(p.Steps, extra)
+
+	result, err := ApplyPlan(p, ApplyOptions{BackupPath: filepath.Join(dir, "restore.jsonl")})
+	if err != nil {
+		t.Fatalf("ApplyPlan: %v", err)
+	}
+	if len(result.Skipped) != 2 {
+		t.Fatalf("expected both steps skipped, got %+v", result.Skipped)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%s should remain: %v", path, err)
+		}
+	}
+}
+
+func TestBuildPlanRejectsFuzzyGroups(t *testing.T) {
+	dir := t.TempDir()
+	group, _ := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.bin", marked: false},
+		{name: "b.bin", marked: true},
+	})
+	group.MatchInfo.Type = dmap.MatchFuzzy
+	if _, err := BuildPlan([]*Group{group}, ActionDelete, dfs.HashSHA256, dfs.LinkAbsolute); err == nil {
+		t.Fatal("expected BuildPlan to reject a fuzzy group")
+	}
+}
+
+func TestApplyMarkedRefusesFilesChangedSinceScan(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.bin", marked: false},
+		{name: "b.bin", marked: true},
+		{name: "c.bin", marked: true},
+	})
+	for _, entry := range group.Files {
+		meta, err := dfs.LstatMeta(entry.Path)
+		if err != nil {
+			t.Fatalf("LstatMeta: %v", err)
+		}
+		entry.Info.FileMeta = meta
+	}
+	// c.bin is rewritten with content of the same size, keeping its mtime.
+	mtime := time.Unix(0, group.Files[2].Info.ModTime)
+	mustWriteDupFile(t, paths[2], "SAME-CONTENT")
+	if err := os.Chtimes(paths[2], mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	result, err := ApplyMarked([]*Group{group}, ActionDelete, ApplyOptions{HashAlgorithm: dfs.HashSHA256, VerifyHash: true})
+	if err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if result != "Deleted 1 file(s). Refused 1 file(s) that changed since the scan." {
+		t.Fatalf("unexpected result: %q", result)
+	}
+	if entry := group.Files[2]; entry.Status != FileStatusError || !strings.Contains(entry.Message, "changed since scan") {
+		t.Fatalf("c.bin should be refused, got status %v %q", entry.Status, entry.Message)
+	}
+	if _, err := os.Stat(paths[2]); err != nil {
+		t.Fatalf("c.bin should remain: %v", err)
+	}
+}
+
+func TestApplyMarkedRefusesWhenKeptCopyChanged(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.bin", marked: false},
+		{name: "b.bin", marked: true},
+	})
+	for _, entry := range group.Files {
+		meta, err := dfs.LstatMeta(entry.Path)
+		if err != nil {
+			t.Fatalf("LstatMeta: %v", err)
+		}
+		entry.Info.FileMeta = meta
+	}
+	mustWriteDupFile(t, paths[0], "kept copy was edited")
+
+	result, err := ApplyMarked([]*Group{group}, ActionLink, ApplyOptions{LinkStyle: dfs.LinkAbsolute})
+	if err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if result != "No files were converted. Refused 1 file(s) that changed since the scan." {
+		t.Fatalf("unexpected result: %q", result)
+	}
+	if entry := group.Files[1]; entry.Status != FileStatusError || !strings.HasPrefix(entry.Message, "kept copy:") {
+		t.Fatalf("b.bin should be refused because of its kept copy, got %v %q", entry.Status, entry.Message)
+	}
+	if info, err := os.Lstat(paths[1]); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("b.bin should be left a regular file: %v", err)
+	}
+}
+
+func TestBuildPreviewReportsKeptTargetAndReclaim(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "keep.txt", marked: false},
+		{name: "dup.txt", marked: true},
+		{name: "shared.txt", marked: true},
+	})
+	group.Files[1].Info.DiskSize = 4096
+	group.Files[2].Info.DiskSize = 4096
+	group.Files[2].Info.AlreadyDeduplicated = true
+	orphaned, _ := newTestGroup(t, filepath.Join(dir, "orphaned"), "other-content", []testFileSpec{
+		{name: "x.txt", marked: true},
+		{name: "y.txt", marked: true},
+	})
+
+	preview := BuildPreview([]*Group{group, orphaned}, ActionDelete, ApplyOptions{Disposal: dfs.TrashDisposal()})
+	if preview.Files != 2 || preview.Reclaim != 4096 {
+		t.Fatalf("expected 2 files reclaiming 4096 bytes, got %d files and %d bytes", preview.Files, preview.Reclaim)
+	}
+	if len(preview.Groups) != 2 || preview.Groups[0].Keep != paths[0] || preview.Groups[1].Keep != "" {
+		t.Fatalf("unexpected groups: %+v", preview.Groups)
+	}
+	lines := preview.Lines()
+	if want := "keep " + paths[0] + " (reclaims " + utils.DisplaySize(4096) + ")"; lines[0] != want {
+		t.Fatalf("expected %q, got %q", want, lines[0])
+	}
+	if want := "  trash " + paths[1] + " (" + utils.DisplaySize(4096) + ")"; lines[1] != want {
+		t.Fatalf("expected %q, got %q", want, lines[1])
+	}
+	if groupLines := preview.GroupLines(); len(groupLines) != len(lines)-1 || groupLines[len(groupLines)-1] != lines[len(lines)-2] {
+		t.Fatalf("GroupLines should be Lines without the summary, got %q", groupLines)
+	}
+	summary := lines[len(lines)-1]
+	if !strings.HasPrefix(summary, "Would trash 2 file(s) in 1 group(s)") || !strings.Contains(summary, "once the Trash is emptied") {
+		t.Fatalf("unexpected summary: %q", summary)
+	}
+}
+
+func TestApplyMarkedDryRunChangesNothing(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.txt", marked: false},
+		{name: "b.txt", marked: true},
+	})
+	manifestPath := filepath.Join(dir, "restore.jsonl")
+
+	result, err := ApplyMarked([]*Group{group}, ActionDelete, ApplyOptions{
+		BackupPath:    manifestPath,
+		HashAlgorithm: dfs.HashSHA256,
+		DryRun:        true,
+	})
+	if err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if !strings.HasPrefix(result, "Dry run: Would delete 1 file(s) in 1 group(s)") {
+		t.Fatalf("unexpected result: %q", result)
+	}
+	if _, err := os.Stat(paths[1]); err != nil {
+		t.Fatalf("dry run removed %s: %v", paths[1], err)
+	}
+	if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Fatalf("dry run wrote a manifest: %v", err)
+	}
+	if entry := group.Files[1]; entry.Status != FileStatusPending || !entry.Marked {
+		t.Fatalf("dry run changed the entry: status %v, marked %v", entry.Status, entry.Marked)
+	}
+}
+
+func TestApplyMarkedEnforcesGuard(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.txt", marked: false},
+		{name: "b.txt", marked: true},
+		{name: "protected/c.txt", marked: true},
+		{name: "d.txt", marked: true},
+	})
+	old := time.Now().Add(-time.Hour)
+	for _, path := range paths[:3] {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	for _, entry := range group.Files {
+		meta, err := dfs.LstatMeta(entry.Path)
+		if err != nil {
+			t.Fatalf("lstat: %v", err)
+		}
+		entry.Info.FileMeta = meta
+	}
+	guard := dmap.Guard{Protect: []string{filepath.Join(dir, "protected")}, MinAge: time.Minute}
+
+	// Over the limit, nothing is deleted and no manifest is written, but the
+	// guarded files are already refused.
+	manifestPath := filepath.Join(dir, "restore.jsonl")
+	limited := guard
+	limited.MaxReclaim = 1
+	group.Files[1].Info.DiskSize = 4096
+	if _, err := ApplyMarked([]*Group{group}, ActionDelete, ApplyOptions{
+		BackupPath:    manifestPath,
+		HashAlgorithm: dfs.HashSHA256,
+		Guard:         limited,
+	}); !errors.Is(err, dmap.ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded, got %v", err)
+	}
+	if _, err := os.Stat(paths[1]); err != nil {
+		t.Fatalf("batch over the limit removed %s: %v", paths[1], err)
+	}
+	if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Fatalf("batch over the limit wrote a manifest: %v", err)
+	}
+
+	for i, want := range map[int]error{2: dmap.ErrProtected, 3: dmap.ErrTooRecent} {
+		entry := group.Files[i]
+		if _, err := os.Stat(entry.Path); err != nil {
+			t.Fatalf("%s should remain: %v", entry.Path, err)
+		}
+		if entry.Status != FileStatusError || !strings.Contains(entry.Message, want.Error()) {
+			t.Fatalf("%s: expected refusal %q, got status %v message %q", entry.Path, want, entry.Status, entry.Message)
+		}
+	}
+
+	result, err := ApplyMarked([]*Group{group}, ActionDelete, ApplyOptions{Guard: guard})
+	if err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if result != "Deleted 1 file(s)." {
+		t.Fatalf("unexpected result: %q", result)
+	}
+	if _, err := os.Stat(paths[1]); !os.IsNotExist(err) {
+		t.Fatalf("expected %s deleted, got %v", paths[1], err)
+	}
+}
+
+func TestApplyMarkedGuardsConversions(t *testing.T) {
+	initDupviewTestLogger()
+
+	dir := t.TempDir()
+	group, paths := newTestGroup(t, dir, "same-content", []testFileSpec{
+		{name: "a.txt", marked: false},
+		{name: "protected/b.txt", marked: true},
+	})
+	guard := dmap.Guard{Protect: []string{filepath.Join(dir, "protected")}}
+
+	for _, action := range []Action{ActionLink, ActionHardlink, ActionReflink, ActionDedupe} {
+		group.Files[1].Marked = true
+		group.Files[1].Status = FileStatusPending
+		if _, err := ApplyMarked([]*Group{group}, action, ApplyOptions{Guard: guard}); err != nil {
+			t.Fatalf("ApplyMarked(%v): %v", action, err)
+		}
+		entry := group.Files[1]
+		if entry.Status != FileStatusError || !strings.Contains(entry.Message, dmap.ErrProtected.Error()) {
+			t.Fatalf("%v: expected the protected file refused, got status %v message %q", action, entry.Status, entry.Message)
+		}
+		info, err := os.Lstat(paths[1])
+		if err != nil || !info.Mode().IsRegular() {
+			t.Fatalf("%v: protected file should be left a regular file: %v", action, err)
+		}
+		if kept, err := os.Stat(paths[0]); err != nil || os.SameFile(info, kept) {
+			t.Fatalf("%v: protected file was linked to the kept copy: %v", action, err)
+		}
+	}
+}
+
+func TestApplyMarkedRefusesDirectoryWithRecentFiles(t *testing.T) {
+	initDupviewTestLogger()
+	root := t.TempDir()
+	keep, dup := filepath.Join(root, "project"), filepath.Join(root, "project copy")
+	for _, dir := range []string{keep, dup} {
+		mustWriteDupFile(t, filepath.Join(dir, "src", "main.go"), "package main")
+	}
+	// The directories themselves look settled; the files below them don't.
+	old := time.Now().Add(-time.Hour)
+	for _, dir := range []string{keep, dup} {
+		if err := os.Chtimes(dir, old, old); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	group := &Group{
+		MatchInfo: dmap.MatchInfo{Type: dmap.MatchDirTree},
+		Files: []*FileEntry{
+			{Path: keep, Tree: mustTreeFiles(t, keep)},
+			{Path: dup, Marked: true, Tree: mustTreeFiles(t, dup)},
+		},
+	}
+
+	if _, err := ApplyMarked([]*Group{group}, ActionDelete, ApplyOptions{Guard: dmap.Guard{MinAge: time.Minute}}); err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dup, "src", "main.go")); err != nil {
+		t.Fatalf("directory with recent files was removed: %v", err)
+	}
+	entry := group.Files[1]
+	if entry.Status != FileStatusError || !strings.Contains(entry.Message, dmap.ErrTooRecent.Error()) {
+		t.Fatalf("expected a too-recent refusal, got status %v message %q", entry.Status, entry.Message)
+	}
+}
+
+func TestApplyMarkedRefusesDirectoryChangedSinceScan(t *testing.T) {
+	initDupviewTestLogger()
+	root := t.TempDir()
+	keep, dup := filepath.Join(root, "project"), filepath.Join(root, "project copy")
+	for _, dir := range []string{keep, dup} {
+		mustWriteDupFile(t, filepath.Join(dir, "src", "main.go"), "package main")
+	}
+	group := &Group{
+		MatchInfo: dmap.MatchInfo{Type: dmap.MatchDirTree},
+		Files: []*FileEntry{
+			{Path: keep, Tree: mustTreeFiles(t, keep)},
+			{Path: dup, Marked: true, Tree: mustTreeFiles(t, dup)},
+		},
+	}
+	// A same-size edit to the kept copy leaves nothing to defer to.
+	edited := filepath.Join(keep, "src", "main.go")
+	mustWriteDupFile(t, edited, "package mine")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(edited, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	result, err := ApplyMarked([]*Group{group}, ActionDelete, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dup, "src", "main.go")); err != nil {
+		t.Fatalf("directory whose kept copy changed was removed: %v", err)
+	}
+	entry := group.Files[1]
+	if entry.Marked || entry.Status != FileStatusError || !strings.Contains(entry.Message, dfs.ErrChanged.Error()) {
+		t.Fatalf("expected a changed refusal, got marked %v status %v message %q", entry.Marked, entry.Status, entry.Message)
+	}
+	if !strings.Contains(result, "Refused 1") {
+		t.Fatalf("summary should mention the refusal: %q", result)
+	}
+}
+
+func TestApplyMarkedRefusesDirectoryWithoutTreeRecord(t *testing.T) {
+	initDupviewTestLogger()
+	root := t.TempDir()
+	keep, dup := filepath.Join(root, "a"), filepath.Join(root, "b")
+	for _, dir := range []string{keep, dup} {
+		mustWriteDupFile(t, filepath.Join(dir, "f.txt"), "same")
+	}
+	group := &Group{
+		MatchInfo: dmap.MatchInfo{Type: dmap.MatchDirTree},
+		Files:     []*FileEntry{{Path: keep}, {Path: dup, Marked: true}},
+	}
+
+	if _, err := ApplyMarked([]*Group{group}, ActionDelete, ApplyOptions{}); err != nil {
+		t.Fatalf("ApplyMarked: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dup, "f.txt")); err != nil {
+		t.Fatalf("directory without a tree record was removed: %v", err)
+	}
+	if group.Files[1].Status != FileStatusError {
+		t.Fatalf("expected the directory refused, got %+v", group.Files[1])
+	}
+}
+
+func TestBuildPreviewSkipsFilesBelowMarkedDirectories(t *testing.T) {
+	initDupviewTestLogger()
+	root := t.TempDir()
+	keep, dup := filepath.Join(root, "project"), filepath.Join(root, "project copy")
+	for _, dir := range []string{keep, dup} {
+		mustWriteDupFile(t, filepath.Join(dir, "main.go"), "package main")
+	}
+	outside := filepath.Join(root, "main.go")
+	mustWriteDupFile(t, outside, "package main")
+
+	tree := &Group{
+		Title:     "tree",
+		MatchInfo: dmap.MatchInfo{Type: dmap.MatchDirTree},
+		Files: []*FileEntry{
+			{Path: keep},
+			{Path: dup, Marked: true, Info: dmap.FileInfo{FileMeta: dfs.FileMeta{DiskSize: 8192}}},
+		},
+	}
+	files := &Group{
+		Title:     "files",
+		MatchInfo: dmap.MatchInfo{Type: dmap.MatchContent},
+		Files: []*FileEntry{
+			{Path: outside},
+			{Path: filepath.Join(dup, "main.go"), Marked: true, Info: dmap.FileInfo{FileMeta: dfs.FileMeta{DiskSize: 4096}}},
+		},
+	}
+
+	preview := BuildPreview([]*Group{files, tree}, ActionDelete, ApplyOptions{})
+	if preview.Files != 1 || preview.Reclaim != 8192 {
+		t.Fatalf("expected only the directory counted, got %d file(s) reclaiming %d", preview.Files, preview.Reclaim)
+	}
+	if len(preview.Groups) != 1 || preview.Groups[0].Title != "tree" {
+		t.Fatalf("expected only the tree group listed, got %+v", preview.Groups)
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
-	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 	"unicode"
 
@@ -22,6 +22,8 @@ const (
 	FileStatusDeleted
 	FileStatusLinked
 	FileStatusReflinked
+	FileStatusHardlinked
+	FileStatusDeduped
 	FileStatusError
 )
 
@@ -31,6 +33,8 @@ const (
 	ActionDelete Action = iota
 	ActionLink
 	ActionReflink
+	ActionHardlink
+	ActionDedupe
 )
 
 type SortMode int
@@ -47,6 +51,10 @@ type FileEntry struct {
 	Marked  bool
 	Status  FileStatus
 	Message string
+	// Info holds sparse/zero-filled details from the hashing pass, if known.
+	Info dmap.FileInfo
+	// Tree lists the files the scan recorded below a directory entry.
+	Tree []dmap.TreeFile
 }
 
 type Group struct {
@@ -55,7 +63,15 @@ type Group struct {
 	Title     string
 	Files     []*FileEntry
 	Expanded  bool
-	TotalSz   uint64
+	// TotalSz is the apparent size of all members; DiskSz is what they
+	// allocate on disk.
+	TotalSz uint64
+	DiskSz  uint64
+	// ReclaimableSz is the on-disk space freed by keeping a single copy;
+	// files that already share blocks with another member don't count.
+	ReclaimableSz uint64
+	// Roots lists the scan roots the group touches when several were scanned.
+	Roots []string
 }
 
 type Model struct {
@@ -76,26 +92,37 @@ func New(dMap *dmap.Dmap) *Model {
 	}
 
 	m.MinDuplicates = dMap.MinDuplicates()
-	for hash, files := range dMap.GetMap() {
+	for hash, files := range dMap.GroupIDs() {
 		if uint(len(files)) < m.MinDuplicates {
 			continue
 		}
 
-		totalSize := EstimateGroupTotalSize(files)
 		matchInfo := dMap.MatchInfo(hash)
 		group := &Group{
 			Hash:      hash,
 			MatchInfo: matchInfo,
-			Title:     FormatGroupTitle(hash, matchInfo, len(files), totalSize),
 			Expanded:  true,
-			TotalSz:   totalSize,
+			Roots:     dMap.GroupRoots(hash),
 		}
 
-		for _, file := range files {
-			group.Files = append(group.Files, &FileEntry{Path: file})
+		for _, id := range files {
+			info, ok := dMap.FileInfo(id)
+			if !ok {
+				meta, _ := dMap.FileMeta(id)
+				info = dmap.FileInfo{FileMeta: meta}
+			}
+			entry := &FileEntry{Path: dMap.Path(id), Info: info}
+			if matchInfo.Type.IsDirectory() {
+				entry.Tree = dMap.TreeFiles(id)
+			}
+			group.Files = append(group.Files, entry)
 		}
+		group.TotalSz, group.DiskSz = EstimateEntrySizes(group.Files)
+		group.ReclaimableSz = EstimateGroupReclaimableSize(group.Files)
+		group.Title = FormatGroupTitle(hash, matchInfo, len(files), group.TotalSz, group.DiskSz) + FormatGroupRoots(group.Roots)
 
-		AutoMarkGroup(group)
+		AutoMarkGroup(group, dMap.KeepPolicy())
+		UnmarkProtected(group, dMap.Guard())
 		m.Groups = append(m.Groups, group)
 	}
 
@@ -161,7 +188,7 @@ func SortGroups(groups []*Group, mode SortMode) {
 func MarkAll(groups []*Group) {
 	for _, group := range groups {
 		for _, entry := range group.Files {
-			if entry.Status == FileStatusDeleted {
+			if entry.Status == FileStatusDeleted || entry.Info.Stale {
 				continue
 			}
 			entry.Marked = true
@@ -201,232 +228,128 @@ func CountMarked(groups []*Group) int {
 	return count
 }
 
-func DeleteMarked(groups []*Group) string {
-	if len(groups) == 0 {
-		return ""
-	}
-
-	var deleted, failures int
-	for _, entry := range MarkedEntries(groups) {
-		err := os.Remove(entry.Path)
-		if err != nil {
-			entry.Status = FileStatusError
-			entry.Message = err.Error()
-			if dsklog.Dlogger != nil {
-				dsklog.Dlogger.Errorf("Failed to delete file %s: %v", entry.Path, err)
-			}
-			failures++
-		} else {
-			entry.Status = FileStatusDeleted
-			entry.Message = fmt.Sprintf("deleted (%s)", filepath.Base(entry.Path))
-			if dsklog.Dlogger != nil {
-				dsklog.Dlogger.Infof("Successfully deleted file: %s", entry.Path)
-			}
-			deleted++
-		}
-		entry.Marked = false
+func EstimateGroupTotalSize(files []string) uint64 {
+	if len(files) == 0 {
+		return 0
 	}
-
-	switch {
-	case deleted == 0 && failures == 0:
-		return "No files were deleted."
-	case failures == 0:
-		return fmt.Sprintf("Deleted %d file(s).", deleted)
-	case deleted == 0:
-		return fmt.Sprintf("Failed to delete %d file(s).", failures)
-	default:
-		return fmt.Sprintf("Deleted %d file(s); %d error(s) occurred.", deleted, failures)
+	var total uint64
+	for _, file := range files {
+		total += dfs.GetFileSize(file)
 	}
+	return total
 }
 
-func LinkMarked(groups []*Group) string {
-	if len(groups) == 0 {
-		return ""
-	}
-
-	var linked, failures int
-	for _, group := range groups {
-		var target *FileEntry
-		for _, entry := range group.Files {
-			if entry.Status == FileStatusDeleted {
-				continue
-			}
-			if !entry.Marked {
-				target = entry
-				break
-			}
-		}
-		if target == nil {
-			for _, entry := range group.Files {
-				if !entry.Marked {
-					continue
-				}
-				entry.Status = FileStatusError
-				entry.Message = "no unmarked file to link to"
-				entry.Marked = false
-				failures++
-			}
-			continue
-		}
-
-		for _, entry := range group.Files {
-			if !entry.Marked {
-				continue
-			}
-			if entry.Status == FileStatusDeleted {
-				entry.Marked = false
-				continue
-			}
-
-			if err := os.Remove(entry.Path); err != nil {
-				entry.Status = FileStatusError
-				entry.Message = err.Error()
-				if dsklog.Dlogger != nil {
-					dsklog.Dlogger.Errorf("Failed to remove file for relink %s: %v", entry.Path, err)
-				}
-				failures++
-				entry.Marked = false
-				continue
-			}
-			if err := os.Symlink(target.Path, entry.Path); err != nil {
-				entry.Status = FileStatusError
-				entry.Message = err.Error()
-				if dsklog.Dlogger != nil {
-					dsklog.Dlogger.Errorf("Failed to create symlink %s -> %s: %v", entry.Path, target.Path, err)
-				}
-				failures++
-				entry.Marked = false
-				continue
-			}
-			entry.Status = FileStatusLinked
-			entry.Message = fmt.Sprintf("linked -> %s", filepath.Base(target.Path))
-			if dsklog.Dlogger != nil {
-				dsklog.Dlogger.Infof("Converted duplicate to symlink: %s -> %s", entry.Path, target.Path)
-			}
-			linked++
-			entry.Marked = false
-		}
-	}
-
-	switch {
-	case linked == 0 && failures == 0:
-		return "No files were converted."
-	case failures == 0:
-		return fmt.Sprintf("Converted %d file(s) to symlinks.", linked)
-	case linked == 0:
-		return fmt.Sprintf("Failed to convert %d file(s) to symlinks.", failures)
-	default:
-		return fmt.Sprintf("Converted %d file(s); %d error(s) occurred.", linked, failures)
+// EstimateEntrySizes sums the apparent and on-disk sizes of entries.
+func EstimateEntrySizes(entries []*FileEntry) (apparent, disk uint64) {
+	for _, entry := range entries {
+		apparent += uint64(max(entry.Info.Size, 0))
+		disk += uint64(max(entry.Info.DiskSize, 0))
 	}
+	return apparent, disk
 }
 
-func ReflinkMarked(groups []*Group) string {
-	if len(groups) == 0 {
-		return ""
-	}
-
-	var reflinked, failures int
-	for _, group := range groups {
-		var target *FileEntry
-		for _, entry := range group.Files {
-			if entry.Status == FileStatusDeleted {
-				continue
-			}
-			if !entry.Marked {
-				target = entry
-				break
-			}
-		}
-		if target == nil {
-			for _, entry := range group.Files {
-				if !entry.Marked {
-					continue
-				}
-				entry.Status = FileStatusError
-				entry.Message = "no unmarked file to reflink from"
-				entry.Marked = false
-				failures++
-			}
+// EstimateGroupReclaimableSize sums the on-disk sizes of every copy after the
+// first, skipping entries already marked as deduplicated.
+func EstimateGroupReclaimableSize(entries []*FileEntry) uint64 {
+	var total uint64
+	kept := false
+	for _, entry := range entries {
+		if entry.Info.AlreadyDeduplicated {
 			continue
 		}
-
-		for _, entry := range group.Files {
-			if !entry.Marked {
-				continue
-			}
-			if entry.Status == FileStatusDeleted {
-				entry.Marked = false
-				continue
-			}
-
-			if err := dfs.ReflinkReplace(entry.Path, target.Path); err != nil {
-				entry.Status = FileStatusError
-				entry.Message = err.Error()
-				if dsklog.Dlogger != nil {
-					dsklog.Dlogger.Errorf("Failed to reflink %s -> %s: %v", entry.Path, target.Path, err)
-				}
-				failures++
-				entry.Marked = false
-				continue
-			}
-			entry.Status = FileStatusReflinked
-			entry.Message = fmt.Sprintf("reflinked -> %s", filepath.Base(target.Path))
-			if dsklog.Dlogger != nil {
-				dsklog.Dlogger.Infof("Converted duplicate to reflink: %s -> %s", entry.Path, target.Path)
-			}
-			reflinked++
-			entry.Marked = false
+		if !kept {
+			kept = true
+			continue
 		}
+		total += uint64(max(entry.Info.DiskSize, 0))
 	}
-
-	switch {
-	case reflinked == 0 && failures == 0:
-		return "No files were converted."
-	case failures == 0:
-		return fmt.Sprintf("Converted %d file(s) to reflinks.", reflinked)
-	case reflinked == 0:
-		return fmt.Sprintf("Failed to convert %d file(s) to reflinks.", failures)
-	default:
-		return fmt.Sprintf("Converted %d file(s); %d error(s) occurred.", reflinked, failures)
-	}
+	return total
 }
 
-func EstimateGroupTotalSize(files []string) uint64 {
-	if len(files) == 0 {
-		return 0
-	}
+// TotalReclaimable sums ReclaimableSz across groups.
+func TotalReclaimable(groups []*Group) uint64 {
 	var total uint64
-	for _, file := range files {
-		total += dfs.GetFileSize(file)
+	for _, group := range groups {
+		total += group.ReclaimableSz
 	}
 	return total
 }
 
-func FormatGroupTitle(hash dmap.Digest, info dmap.MatchInfo, count int, totalSize uint64) string {
+func FormatGroupTitle(hash dmap.Digest, info dmap.MatchInfo, count int, totalSize, diskSize uint64) string {
 	if count == 0 {
 		return "Empty group"
 	}
 
-	const tmpl = "%s - %d files - (approx. size %s)"
+	const tmpl = "%s - %d files - (approx. size %s, %s on disk)"
+	apparent, disk := utils.DisplaySize(totalSize), utils.DisplaySize(diskSize)
+	if info.Type.IsDirectory() {
+		const dirTmpl = "%s - %d directories - (approx. size %s, %s on disk)"
+		if info.Type == dmap.MatchDirSuperset {
+			return fmt.Sprintf(dirTmpl, "Superset: "+info.Key, count, apparent, disk)
+		}
+		return fmt.Sprintf(dirTmpl, fmt.Sprintf("Directory tree: %x", hash[:16]), count, apparent, disk)
+	}
 	if info.Type == dmap.MatchName {
-		return fmt.Sprintf(tmpl, "Name: "+info.Key, count, utils.DisplaySize(totalSize))
+		return fmt.Sprintf(tmpl, "Name: "+info.Key, count, apparent, disk)
 	}
 	if info.Type == dmap.MatchFuzzy {
-		return fmt.Sprintf(tmpl, "Similar: "+info.Key, count, utils.DisplaySize(totalSize))
+		return fmt.Sprintf(tmpl, "Similar: "+info.Key, count, apparent, disk)
 	}
 	hashHex := fmt.Sprintf("%x", hash[:16])
-	return fmt.Sprintf(tmpl, hashHex, count, utils.DisplaySize(totalSize))
+	if info.Type == dmap.MatchZeroFilled {
+		return fmt.Sprintf(tmpl, "Zero-filled: "+hashHex, count, apparent, disk)
+	}
+	return fmt.Sprintf(tmpl, hashHex, count, apparent, disk)
+}
+
+// FormatGroupRoots describes the scan roots a group touches for appending to
+// its title, e.g. " - roots: /data, /backup". It returns an empty string when
+// roots is empty.
+func FormatGroupRoots(roots []string) string {
+	if len(roots) == 0 {
+		return ""
+	}
+	return " - roots: " + strings.Join(roots, ", ")
 }
 
-func AutoMarkGroup(group *Group) {
+// AutoMarkGroup orders the group's files by policy and marks every file but
+// the first for deletion, matching what the batch actions would keep. Stale
+// files and files the policy protects are never marked; a protected file
+// counts as the kept copy but a stale one doesn't.
+func AutoMarkGroup(group *Group, policy dmap.KeepPolicy) {
+	MarkExtras(group, policy, 1)
+}
+
+// MarkExtras is AutoMarkGroup for a keep count: it leaves the first keep
+// files by policy unmarked and marks the rest, replacing any earlier marks.
+func MarkExtras(group *Group, policy dmap.KeepPolicy, keep uint) {
 	if group == nil {
 		return
 	}
 	if group.MatchInfo.Type == dmap.MatchFuzzy {
 		return
 	}
+	members := make([]dmap.KeepMember, len(group.Files))
 	for i, entry := range group.Files {
-		if i == 0 {
+		members[i] = dmap.KeepMember{Path: entry.Path, Meta: entry.Info.FileMeta}
+	}
+	ordered := make([]*FileEntry, len(group.Files))
+	for i, j := range policy.Order(members) {
+		ordered[i] = group.Files[j]
+	}
+	group.Files = ordered
+	var kept uint
+	for _, entry := range group.Files {
+		entry.Marked = false
+		if entry.Info.Stale {
+			continue
+		}
+		if policy.Protected(entry.Path) {
+			kept++
+			continue
+		}
+		if kept < keep {
+			kept++
 			continue
 		}
 		entry.Marked = true
@@ -436,6 +359,20 @@ func AutoMarkGroup(group *Group) {
 	}
 }
 
+// UnmarkProtected unmarks the files of group that guard protects. They stay
+// where MarkExtras ordered them and, unlike files the keep policy protects, do
+// not count as kept copies, matching what the batch actions skip.
+func UnmarkProtected(group *Group, guard dmap.Guard) {
+	if group == nil {
+		return
+	}
+	for _, entry := range group.Files {
+		if entry.Marked && guard.Protected(entry.Path) {
+			entry.Marked = false
+		}
+	}
+}
+
 func IsSymlink(path string) bool {
 	fi, err := os.Lstat(path)
 	return err == nil && fi.Mode()&os.ModeSymlink != 0
@@ -4,16 +4,84 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
 	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/dsklog"
 )
 
 func TestFormatGroupTitleFuzzy(t *testing.T) {
-	title := FormatGroupTitle(dmap.Digest{}, dmap.MatchInfo{Type: dmap.MatchFuzzy, Key: "near-content >=85%"}, 3, 4096)
+	title := FormatGroupTitle(dmap.Digest{}, dmap.MatchInfo{Type: dmap.MatchFuzzy, Key: "near-content >=85%"}, 3, 4096, 4096)
 	if !strings.Contains(title, "Similar: near-content >=85%") {
 		t.Fatalf("expected fuzzy title prefix, got %q", title)
 	}
 }
 
+func TestFormatGroupTitleZeroFilled(t *testing.T) {
+	var digest dmap.Digest
+	digest[0] = 0xab
+	title := FormatGroupTitle(digest, dmap.MatchInfo{Type: dmap.MatchZeroFilled, Key: "ab"}, 2, 2048, 0)
+	if !strings.HasPrefix(title, "Zero-filled: ab") {
+		t.Fatalf("expected zero-filled title prefix, got %q", title)
+	}
+}
+
+func TestFormatGroupTitleDirectoryGroups(t *testing.T) {
+	var digest dmap.Digest
+	digest[0] = 0xcd
+	title := FormatGroupTitle(digest, dmap.MatchInfo{Type: dmap.MatchDirTree}, 2, 4096, 4096)
+	if !strings.HasPrefix(title, "Directory tree: cd") || !strings.Contains(title, "2 directories") {
+		t.Fatalf("unexpected directory tree title %q", title)
+	}
+	title = FormatGroupTitle(digest, dmap.MatchInfo{Type: dmap.MatchDirSuperset, Key: "/data/full"}, 2, 4096, 4096)
+	if !strings.HasPrefix(title, "Superset: /data/full") {
+		t.Fatalf("unexpected superset title %q", title)
+	}
+}
+
+func TestNewCarriesFileInfo(t *testing.T) {
+	dsklog.InitializeDlogger("/dev/null")
+	dm, err := dmap.NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	var digest dmap.Digest
+	digest[0] = 0x1
+	info := dmap.FileInfo{FileMeta: dfs.FileMeta{Size: 1 << 20, DiskSize: 0}, Sparse: true, ZeroFilled: true}
+	dm.AddFile(digest, "/tmp/a", info)
+	dm.AddFile(digest, "/tmp/b", info)
+
+	model := New(dm)
+	if len(model.Groups) != 1 {
+		t.Fatalf("expected 1 group, got %d", len(model.Groups))
+	}
+	for _, entry := range model.Groups[0].Files {
+		if entry.Info != info {
+			t.Fatalf("entry %s info = %+v, want %+v", entry.Path, entry.Info, info)
+		}
+	}
+}
+
+func TestNewTitlesShowGroupRoots(t *testing.T) {
+	dsklog.InitializeDlogger("/dev/null")
+	dm, err := dmap.NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap failed: %v", err)
+	}
+	dm.SetRoots([]string{"/data", "/backup"})
+	var digest dmap.Digest
+	digest[0] = 0x2
+	dm.AddPath(digest, "/data/a")
+	dm.AddPath(digest, "/backup/a")
+
+	model := New(dm)
+	if len(model.Groups) != 1 {
+		t.Fatalf("expected 1 group, got %d", len(model.Groups))
+	}
+	if got := model.Groups[0].Title; !strings.HasSuffix(got, " - roots: /data, /backup") {
+		t.Fatalf("title %q does not list the group's roots", got)
+	}
+}
+
 func TestAutoMarkGroupSkipsFuzzy(t *testing.T) {
 	group := &Group{
 		MatchInfo: dmap.MatchInfo{Type: dmap.MatchFuzzy, Key: "near-content"},
@@ -23,8 +91,82 @@ func TestAutoMarkGroupSkipsFuzzy(t *testing.T) {
 		},
 	}
 
-	AutoMarkGroup(group)
+	AutoMarkGroup(group, dmap.KeepPolicy{})
 	if group.Files[0].Marked || group.Files[1].Marked {
 		t.Fatalf("expected fuzzy group entries to remain unmarked")
 	}
 }
+
+func TestAutoMarkGroupSkipsStaleFiles(t *testing.T) {
+	group := &Group{
+		MatchInfo: dmap.MatchInfo{Type: dmap.MatchContent},
+		Files: []*FileEntry{
+			{Path: "/tmp/a", Info: dmap.FileInfo{Stale: true}},
+			{Path: "/tmp/b"},
+			{Path: "/tmp/c"},
+			{Path: "/tmp/d", Info: dmap.FileInfo{Stale: true}},
+		},
+	}
+
+	AutoMarkGroup(group, dmap.KeepPolicy{})
+	want := []bool{false, false, true, false}
+	for i, entry := range group.Files {
+		if entry.Marked != want[i] {
+			t.Fatalf("%s marked = %v, want %v", entry.Path, entry.Marked, want[i])
+		}
+	}
+}
+
+func TestAutoMarkGroupFollowsKeepPolicy(t *testing.T) {
+	newest := dmap.FileInfo{FileMeta: dfs.FileMeta{ModTime: 3}}
+	group := &Group{
+		MatchInfo: dmap.MatchInfo{Type: dmap.MatchContent},
+		Files: []*FileEntry{
+			{Path: "/tmp/old", Info: dmap.FileInfo{FileMeta: dfs.FileMeta{ModTime: 1}}},
+			{Path: "/tmp/new", Info: newest},
+			{Path: "/tmp/keep/older", Info: dmap.FileInfo{FileMeta: dfs.FileMeta{ModTime: 2}}},
+		},
+	}
+
+	AutoMarkGroup(group, dmap.KeepPolicy{Rules: []dmap.KeepRule{dmap.KeepNewest}})
+	if group.Files[0].Path != "/tmp/new" || group.Files[0].Marked {
+		t.Fatalf("newest file should come first and stay unmarked, got %s (marked %v)", group.Files[0].Path, group.Files[0].Marked)
+	}
+	if !group.Files[1].Marked || !group.Files[2].Marked {
+		t.Fatalf("older copies should be marked")
+	}
+
+	for _, entry := range group.Files {
+		entry.Marked = false
+	}
+	AutoMarkGroup(group, dmap.KeepPolicy{Rules: []dmap.KeepRule{dmap.KeepNewest}, KeepIn: []string{"/tmp/keep"}})
+	want := map[string]bool{"/tmp/keep/older": false, "/tmp/new": true, "/tmp/old": true}
+	for _, entry := range group.Files {
+		if entry.Marked != want[entry.Path] {
+			t.Fatalf("%s marked = %v, want %v", entry.Path, entry.Marked, want[entry.Path])
+		}
+	}
+}
+
+func TestEstimateGroupReclaimableSizeUsesDiskBlocks(t *testing.T) {
+	entries := []*FileEntry{
+		{Path: "a", Info: dmap.FileInfo{FileMeta: dfs.FileMeta{Size: 1 << 20, DiskSize: 8192}}},
+		{Path: "b", Info: dmap.FileInfo{FileMeta: dfs.FileMeta{Size: 1 << 20, DiskSize: 4096}}},
+		{Path: "c", Info: dmap.FileInfo{FileMeta: dfs.FileMeta{Size: 1 << 20, DiskSize: 1 << 20}}},
+	}
+	apparent, disk := EstimateEntrySizes(entries)
+	if apparent != 3<<20 || disk != 8192+4096+1<<20 {
+		t.Fatalf("unexpected sizes apparent=%d disk=%d", apparent, disk)
+	}
+	if got := EstimateGroupReclaimableSize(entries); got != 4096+1<<20 {
+		t.Fatalf("expected reclaimable from disk blocks, got %d", got)
+	}
+	entries[2].Info.AlreadyDeduplicated = true
+	if got := EstimateGroupReclaimableSize(entries); got != 4096 {
+		t.Fatalf("expected 4096 reclaimable with one deduplicated copy, got %d", got)
+	}
+	groups := []*Group{{ReclaimableSz: 5}, {ReclaimableSz: 7}}
+	if got := TotalReclaimable(groups); got != 12 {
+		t.Fatalf("expected total of 12, got %d", got)
+	}
+}
@@ -0,0 +1,208 @@
+package dupview
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/plan"
+)
+
+// planActions maps actions to their names in a plan, in the order ApplyPlan
+// applies them.
+var planActions = []struct {
+	action Action
+	name   plan.Action
+}{
+	{ActionLink, plan.Link},
+	{ActionReflink, plan.Reflink},
+	{ActionHardlink, plan.Hardlink},
+	{ActionDedupe, plan.Dedupe},
+	{ActionDelete, plan.Delete},
+}
+
+func planActionName(action Action) plan.Action {
+	for _, a := range planActions {
+		if a.action == action {
+			return a.name
+		}
+	}
+	return plan.Delete
+}
+
+// BuildPlan describes what ApplyMarked would do to the marked files of
+// groups. Each marked file becomes a step against the group's first unmarked
+// file, recording its size, mtime and the group's content hash. Only content
+// groups can be planned, since a plan is verified by hash.
+func BuildPlan(groups []*Group, action Action, algo dfs.HashAlgorithm, style dfs.LinkStyle) (plan.Plan, error) {
+	p := plan.Plan{
+		Version:   plan.Version,
+		CreatedAt: time.Now(),
+		HashAlgo:  algo,
+		LinkStyle: style,
+	}
+	for _, group := range groups {
+		marked := markedActionEntries(group)
+		if len(marked) == 0 {
+			continue
+		}
+		switch group.MatchInfo.Type {
+		case "", dmap.MatchContent, dmap.MatchZeroFilled:
+		default:
+			return plan.Plan{}, fmt.Errorf("group %q is a %s match, which a plan cannot verify", group.Title, group.MatchInfo.Type)
+		}
+		target := survivingTarget(group)
+		if target == nil {
+			return plan.Plan{}, fmt.Errorf("group %q has no file left to keep", group.Title)
+		}
+		for _, entry := range marked {
+			meta := entry.Info.FileMeta
+			if !meta.Known() {
+				var err error
+				if meta, err = dfs.LstatMeta(entry.Path); err != nil {
+					return plan.Plan{}, err
+				}
+			}
+			p.Steps = append(p.Steps, plan.Step{
+				Action: planActionName(action),
+				Path:   entry.Path,
+				Target: target.Path,
+				Size:   meta.Size,
+				MTime:  time.Unix(0, meta.ModTime),
+				Hash:   fmt.Sprintf("%x", group.Hash),
+			})
+		}
+	}
+	return p, nil
+}
+
+// SkippedStep is a plan step ApplyPlan left alone, and why.
+type SkippedStep struct {
+	Step plan.Step
+	Err  error
+}
+
+// PlanResult reports what ApplyPlan did.
+type PlanResult struct {
+	// Summaries holds one ApplyMarked summary per action applied.
+	Summaries []string
+	// Previews holds one BuildPreview per action instead, on a dry run.
+	Previews []Preview
+	Skipped  []SkippedStep
+	// Failed lists the entries whose action was attempted and failed.
+	Failed []*FileEntry
+}
+
+// ApplyPlan re-verifies every step of p against the filesystem, skips the
+// ones that went stale and applies the rest with ApplyMarked, one action at a
+// time. Steps whose target is itself changed by the plan are skipped too, so
+// an edited plan can't remove every copy. opts.BackupPath must be set: the
+// restore manifest is written before anything is touched. With opts.DryRun
+// set, the steps are still verified but only previewed. A plan that exceeds
+// the limits of opts.Guard as a whole is refused before anything is touched.
+func ApplyPlan(p plan.Plan, opts ApplyOptions) (PlanResult, error) {
+	var result PlanResult
+	if opts.BackupPath == "" {
+		return result, errors.New("applying a plan requires a restore manifest path")
+	}
+	opts.HashAlgorithm = p.HashAlgo
+	if p.LinkStyle != "" {
+		opts.LinkStyle = p.LinkStyle
+	}
+
+	changed := make(map[string]bool, len(p.Steps))
+	for _, step := range p.Steps {
+		changed[step.Path] = true
+	}
+
+	type groupKey struct {
+		action plan.Action
+		target string
+		hash   string
+	}
+	groups := make(map[groupKey]*Group)
+	var order []groupKey
+	for _, step := range p.Steps {
+		if changed[step.Target] {
+			result.Skipped = append(result.Skipped, SkippedStep{Step: step, Err: fmt.Errorf("target %s is itself changed by the plan", step.Target)})
+			continue
+		}
+		if err := step.Verify(p.HashAlgo); err != nil {
+			result.Skipped = append(result.Skipped, SkippedStep{Step: step, Err: err})
+			continue
+		}
+		key := groupKey{step.Action, step.Target, step.Hash}
+		group, ok := groups[key]
+		if !ok {
+			hash, err := dmap.DigestFromHex(step.Hash)
+			if err != nil {
+				result.Skipped = append(result.Skipped, SkippedStep{Step: step, Err: err})
+				continue
+			}
+			group = &Group{Hash: hash, Title: step.Target, Files: []*FileEntry{planEntry(step.Target, false)}}
+			groups[key] = group
+			order = append(order, key)
+		}
+		group.Files = append(group.Files, planEntry(step.Path, true))
+	}
+
+	type batch struct {
+		action Action
+		groups []*Group
+	}
+	var batches []batch
+	var files int
+	var reclaim uint64
+	for _, a := range planActions {
+		var groupsOf []*Group
+		for _, key := range order {
+			if key.action == a.name {
+				groupsOf = append(groupsOf, groups[key])
+			}
+		}
+		if len(groupsOf) == 0 {
+			continue
+		}
+		preview := BuildPreview(groupsOf, a.action, opts)
+		files += preview.Files
+		reclaim += preview.Reclaim
+		if opts.DryRun {
+			result.Previews = append(result.Previews, preview)
+			continue
+		}
+		batches = append(batches, batch{a.action, groupsOf})
+	}
+	// The limits cover the whole plan, not each action in it.
+	if err := opts.Guard.CheckBatch(files, reclaim); err != nil {
+		return result, err
+	}
+
+	for _, b := range batches {
+		summary, err := ApplyMarked(b.groups, b.action, opts)
+		if err != nil {
+			return result, err
+		}
+		result.Summaries = append(result.Summaries, summary)
+		for _, group := range b.groups {
+			for _, entry := range group.Files {
+				if entry.Status == FileStatusError {
+					result.Failed = append(result.Failed, entry)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// planEntry returns an entry for path carrying its current metadata, so the
+// restore manifest records the file as verified.
+func planEntry(path string, marked bool) *FileEntry {
+	entry := &FileEntry{Path: path, Marked: marked}
+	if info, err := os.Lstat(path); err == nil {
+		entry.Info = dmap.FileInfo{FileMeta: dfs.MetaFromFileInfo(info)}
+	}
+	return entry
+}
@@ -0,0 +1,216 @@
+package dupview
+
+import (
+	"fmt"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/pkg/utils"
+)
+
+// PreviewItem is one marked file an action would change.
+type PreviewItem struct {
+	Path string
+	// Reclaim is the disk space changing the file frees: its on-disk size,
+	// or zero if it already shares its blocks.
+	Reclaim uint64
+	// Refused is why the guard would refuse the file, if it would; refused
+	// items don't count towards the totals.
+	Refused string
+}
+
+// PreviewGroup is what an action would do to one group.
+type PreviewGroup struct {
+	Title string
+	// Keep is the copy the group's items would defer to. It is empty when
+	// every member is marked; ApplyMarked refuses such groups.
+	Keep    string
+	Items   []PreviewItem
+	Reclaim uint64
+}
+
+// Preview describes what ApplyMarked would do to the marked entries of some
+// groups, without touching anything.
+type Preview struct {
+	// Verb names the action in the present tense, such as "delete" or
+	// "hard link".
+	Verb   string
+	Groups []PreviewGroup
+	// Files and Reclaim total the items of groups that have a copy to keep,
+	// leaving out refused ones.
+	Files   int
+	Reclaim uint64
+	Refused int
+	// Destination is where deletes are moved, if anywhere; their space is
+	// only freed once it is emptied.
+	Destination string
+}
+
+// BuildPreview describes what ApplyMarked would do with action and opts to the
+// marked entries of groups, each against its group's first unmarked file.
+// Deletes are described as moves when opts.Disposal sends them somewhere, and
+// files opts.Guard would refuse are listed as such. Marked files below a
+// marked directory that would be changed are left out, since the directory
+// already accounts for them.
+func BuildPreview(groups []*Group, action Action, opts ApplyOptions) Preview {
+	p := Preview{Verb: previewVerb(action, opts.Disposal)}
+	if action == ActionDelete {
+		p.Destination = opts.Disposal.Destination()
+	}
+	covered := coveringDirs(groups, opts.Guard)
+	for _, group := range groups {
+		marked := markedActionEntries(group)
+		if len(marked) > 0 && len(covered) > 0 && !group.MatchInfo.Type.IsDirectory() {
+			marked = uncovered(marked, covered)
+		}
+		if len(marked) == 0 {
+			continue
+		}
+		pg := PreviewGroup{Title: group.Title}
+		target := survivingTarget(group)
+		if target != nil {
+			pg.Keep = target.Path
+		}
+		var targetErr error
+		if target != nil {
+			targetErr = checkSettled(target, opts.Guard)
+		}
+		for _, entry := range marked {
+			item := PreviewItem{Path: entry.Path}
+			if err := guardEntry(entry, targetErr, opts.Guard); err != nil {
+				item.Refused = err.Error()
+				p.Refused++
+				pg.Items = append(pg.Items, item)
+				continue
+			}
+			if !entry.Info.AlreadyDeduplicated && !sameInode(entry, target) {
+				item.Reclaim = uint64(max(entry.Info.DiskSize, 0))
+			}
+			pg.Items = append(pg.Items, item)
+			pg.Reclaim += item.Reclaim
+			if pg.Keep != "" {
+				p.Files++
+			}
+		}
+		if pg.Keep != "" {
+			p.Reclaim += pg.Reclaim
+		}
+		p.Groups = append(p.Groups, pg)
+	}
+	return p
+}
+
+// coveringDirs returns the marked directories of groups that an action
+// would change as a unit: those with a copy to keep that guard doesn't
+// refuse.
+func coveringDirs(groups []*Group, guard dmap.Guard) map[string]*FileEntry {
+	dirs := make(map[string]*FileEntry)
+	for _, group := range groups {
+		if group == nil || !group.MatchInfo.Type.IsDirectory() {
+			continue
+		}
+		target := survivingTarget(group)
+		if target == nil {
+			continue
+		}
+		targetErr := checkSettled(target, guard)
+		for _, entry := range markedActionEntries(group) {
+			if guardEntry(entry, targetErr, guard) == nil {
+				dirs[entry.Path] = entry
+			}
+		}
+	}
+	return dirs
+}
+
+// uncovered returns the entries that lie below none of dirs.
+func uncovered(entries []*FileEntry, dirs map[string]*FileEntry) []*FileEntry {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if _, dir := enclosingEntry(entry.Path, dirs); dir == nil {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// sameInode reports whether entry is already a hard link to target, so
+// changing it frees nothing.
+func sameInode(entry, target *FileEntry) bool {
+	if target == nil || entry.Info.Ino == 0 {
+		return false
+	}
+	return entry.Info.Dev == target.Info.Dev && entry.Info.Ino == target.Info.Ino
+}
+
+func previewVerb(action Action, disposal *dfs.Disposal) string {
+	switch action {
+	case ActionLink:
+		return "symlink"
+	case ActionReflink:
+		return "reflink"
+	case ActionHardlink:
+		return "hard link"
+	case ActionDedupe:
+		return "dedupe"
+	}
+	switch disposal.Verb() {
+	case "trashed":
+		return "trash"
+	case "quarantined":
+		return "quarantine"
+	}
+	return "delete"
+}
+
+// Summary totals the preview in one sentence.
+func (p Preview) Summary() string {
+	if p.Files == 0 {
+		if p.Refused > 0 {
+			return fmt.Sprintf("Nothing would change; would refuse %d protected or recently modified file(s).", p.Refused)
+		}
+		return "Nothing would change."
+	}
+	groups := 0
+	for _, pg := range p.Groups {
+		if pg.Keep != "" {
+			groups++
+		}
+	}
+	summary := fmt.Sprintf("Would %s %d file(s) in %d group(s), reclaiming %s", p.Verb, p.Files, groups, utils.DisplaySize(p.Reclaim))
+	if p.Destination != "" {
+		summary += fmt.Sprintf(" once %s is emptied", p.Destination)
+	}
+	summary += "."
+	if p.Refused > 0 {
+		summary += fmt.Sprintf(" Would refuse %d protected or recently modified file(s).", p.Refused)
+	}
+	return summary
+}
+
+// Lines lists every group of the preview as GroupLines does, then the
+// Summary.
+func (p Preview) Lines() []string {
+	return append(p.GroupLines(), p.Summary())
+}
+
+// GroupLines lists every group of the preview: the kept copy and the space
+// the group frees, then each file the action would change.
+func (p Preview) GroupLines() []string {
+	var lines []string
+	for _, pg := range p.Groups {
+		if pg.Keep == "" {
+			lines = append(lines, fmt.Sprintf("%s: no unmarked copy to keep; would be refused", pg.Title))
+		} else {
+			lines = append(lines, fmt.Sprintf("keep %s (reclaims %s)", pg.Keep, utils.DisplaySize(pg.Reclaim)))
+		}
+		for _, item := range pg.Items {
+			if item.Refused != "" {
+				lines = append(lines, fmt.Sprintf("  refuse %s", item.Refused))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("  %s %s (%s)", p.Verb, item.Path, utils.DisplaySize(item.Reclaim)))
+		}
+	}
+	return lines
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/jdefrancesco/dskDitto/internal/config"
 	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
 	"github.com/jdefrancesco/dskDitto/internal/dsklog"
 	"github.com/jdefrancesco/dskDitto/pkg/utils"
 
@@ -47,6 +48,7 @@ type DWalk struct {
 	// Channel used to communicate with main monitor goroutine.
 	dFiles          chan<- *dfs.Dfile
 	candidateFiles  chan<- FileCandidate
+	paths           *dpath.Store
 	sem             *semaphore.Weighted
 	skipHidden      bool
 	skipEmpty       bool
@@ -68,13 +70,20 @@ type DWalk struct {
 
 // FileCandidate is a regular file that survived the cheap walker filters.
 // The content hash is intentionally deferred so callers can skip files that
-// cannot be duplicates by size.
+// cannot be duplicates by size. The path is interned in the walker's
+// dpath.Store and referenced by ID to keep large scans compact.
 type FileCandidate struct {
-	Path string
-	Size int64
+	// FileMeta is the walker's lstat of the file, carried through so later
+	// stages don't need to stat it again.
+	dfs.FileMeta
+	ID dpath.ID
+	// Root is the index in Roots() of the innermost root holding the file.
+	Root int
 }
 
+// filesystemRoot describes the root a walk started from.
 type filesystemRoot struct {
+	index  int
 	device uint64
 	known  bool
 }
@@ -85,9 +94,15 @@ func NewDWalker(rootDirs []string, dFiles chan<- *dfs.Dfile, cfg config.Config)
 }
 
 // NewCandidateWalker returns a walker that emits file path and size without
-// hashing file contents.
-func NewCandidateWalker(rootDirs []string, candidates chan<- FileCandidate, cfg config.Config) *DWalk {
-	return newDWalker(rootDirs, nil, candidates, cfg)
+// hashing file contents. Paths are interned in paths, which callers use to
+// resolve each candidate's ID.
+func NewCandidateWalker(rootDirs []string, candidates chan<- FileCandidate, paths *dpath.Store, cfg config.Config) *DWalk {
+	walker := newDWalker(rootDirs, nil, candidates, cfg)
+	if paths == nil {
+		paths = dpath.NewStore()
+	}
+	walker.paths = paths
+	return walker
 }
 
 func newDWalker(rootDirs []string, dFiles chan<- *dfs.Dfile, candidates chan<- FileCandidate, cfg config.Config) *DWalk {
@@ -143,12 +158,13 @@ func newDWalker(rootDirs []string, dFiles chan<- *dfs.Dfile, candidates chan<- F
 // Run method kicks off filesystem crawl for file dupes.
 func (d *DWalk) Run(ctx context.Context) {
 
-	for _, root := range d.rootDirs {
+	for i, root := range d.rootDirs {
 		if d.shouldSkipPath(root) {
 			dsklog.Dlogger.Infof("Skipping directory %s due to restricted filesystem", root)
 			continue
 		}
 		rootFS := d.rootFilesystem(root)
+		rootFS.index = i
 		d.wg.Add(1)
 		go walkDir(ctx, root, 0, d, rootFS)
 	}
@@ -192,6 +208,17 @@ func (d *DWalk) isDifferentFilesystem(rootFS filesystemRoot, meta fileMeta) bool
 	return meta.device != rootFS.device
 }
 
+// Roots returns the cleaned, absolute roots the walker scans. Candidates refer
+// to them by index.
+func (d *DWalk) Roots() []string {
+	return d.rootDirs
+}
+
+// Paths returns the store candidate IDs refer to, or nil for a hashing walker.
+func (d *DWalk) Paths() *dpath.Store {
+	return d.paths
+}
+
 // cancelled polls, checking for cancellation.
 func cancelled(ctx context.Context) bool {
 
@@ -268,7 +295,7 @@ func walkDir(ctx context.Context, dir string, depth int, d *DWalk, rootFS filesy
 			continue
 		}
 
-		if d.skipSymLinks && meta.mode&os.ModeSymlink != 0 {
+		if d.skipSymLinks && meta.Mode&os.ModeSymlink != 0 {
 			dsklog.Dlogger.Debugf("Skipping symlink (resolved): %s", absFileName)
 			continue
 		}
@@ -278,13 +305,13 @@ func walkDir(ctx context.Context, dir string, depth int, d *DWalk, rootFS filesy
 		}
 
 		// Skip non-regular files (sockets, pipes, device files, etc.)
-		if !meta.mode.IsRegular() {
-			dsklog.Dlogger.Debugf("Skipping non-regular file: %s (mode: %s)", entry.Name(), meta.mode)
+		if !meta.Mode.IsRegular() {
+			dsklog.Dlogger.Debugf("Skipping non-regular file: %s (mode: %s)", entry.Name(), meta.Mode)
 			continue
 		}
 
 		// Check file size properties the user set.
-		fileSize := max(meta.size, 0)
+		fileSize := max(meta.Size, 0)
 		if d.skipEmpty && fileSize == 0 {
 			dsklog.Dlogger.Debugf("Skipping empty file: %s", name)
 			continue
@@ -316,15 +343,22 @@ func walkDir(ctx context.Context, dir string, depth int, d *DWalk, rootFS filesy
 			d.seenMu.Unlock()
 		}
 
-		d.emitFile(ctx, absFileName, meta.size)
+		// Nested roots reach the same file from several walks; it belongs to
+		// the innermost root whichever walk got there first.
+		root := rootFS.index
+		if i := dpath.InnermostRoot(d.rootDirs, absFileName); i >= 0 {
+			root = i
+		}
+		d.emitFile(ctx, absFileName, meta, root)
 	}
 }
 
-func (d *DWalk) emitFile(ctx context.Context, path string, size int64) {
+func (d *DWalk) emitFile(ctx context.Context, path string, meta fileMeta, root int) {
+	size := meta.Size
 	if d.candidateFiles != nil {
 		select {
 		case <-ctx.Done():
-		case d.candidateFiles <- FileCandidate{Path: path, Size: size}:
+		case d.candidateFiles <- FileCandidate{FileMeta: meta.FileMeta, ID: d.paths.Add(path), Root: root}:
 		}
 		return
 	}
@@ -3,6 +3,7 @@
 package dwalk
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
@@ -66,3 +67,43 @@ func TestExcludedHardlinkDoesNotClaimIdentityUnix(t *testing.T) {
 	paths := collectRelativePaths(t, root, cfg)
 	expectPathsEqual(t, paths, []string{"z-keep.txt"})
 }
+
+// TestCandidateCarriesAllocatedSizeUnix verifies that candidates report the
+// allocated size from the walker's stat alongside the apparent size.
+func TestCandidateCarriesAllocatedSizeUnix(t *testing.T) {
+	dsklog.InitializeDlogger("/dev/null")
+
+	root := t.TempDir()
+	dense := filepath.Join(root, "dense.bin")
+	if err := os.WriteFile(dense, make([]byte, 64*1024), 0o644); err != nil {
+		t.Fatalf("failed to create dense file: %v", err)
+	}
+	sparse := filepath.Join(root, "sparse.bin")
+	truncateFile(t, sparse, 8<<20)
+
+	cfg := config.Config{
+		HashAlgorithm: dfs.HashSHA256,
+		MaxDepth:      -1,
+	}
+	candidates := make(chan FileCandidate, 4)
+	walker := NewCandidateWalker([]string{root}, candidates, nil, cfg)
+	walker.Run(context.Background())
+
+	got := make(map[string]FileCandidate)
+	for candidate := range candidates {
+		got[walker.Paths().Base(candidate.ID)] = candidate
+	}
+	for _, name := range []string{"dense.bin", "sparse.bin"} {
+		path := filepath.Join(root, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("stat %s: %v", path, err)
+		}
+		if want := dfs.AllocatedSize(info); got[name].DiskSize != want {
+			t.Fatalf("%s DiskSize = %d, want %d", name, got[name].DiskSize, want)
+		}
+	}
+	if got["sparse.bin"].DiskSize >= got["sparse.bin"].Size {
+		t.Skipf("filesystem allocated %d bytes for sparse file", got["sparse.bin"].DiskSize)
+	}
+}
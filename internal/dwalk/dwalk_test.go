@@ -12,6 +12,7 @@ import (
 
 	"github.com/jdefrancesco/dskDitto/internal/config"
 	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
 	"github.com/jdefrancesco/dskDitto/internal/dsklog"
 )
 
@@ -369,7 +370,8 @@ func collectCandidateRelativePaths(t *testing.T, root string, cfg config.Config)
 	t.Helper()
 
 	candidates := make(chan FileCandidate, 16)
-	walker := NewCandidateWalker([]string{root}, candidates, cfg)
+	paths := dpath.NewStore()
+	walker := NewCandidateWalker([]string{root}, candidates, paths, cfg)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -377,7 +379,7 @@ func collectCandidateRelativePaths(t *testing.T, root string, cfg config.Config)
 
 	var names []string
 	for candidate := range candidates {
-		rel, err := filepath.Rel(root, candidate.Path)
+		rel, err := filepath.Rel(root, paths.Path(candidate.ID))
 		if err != nil {
 			t.Fatalf("failed to compute relative path: %v", err)
 		}
@@ -413,3 +415,98 @@ func expectPathsEqual(t *testing.T, got []string, want []string) {
 		}
 	}
 }
+
+func TestCandidateCarriesFileMeta(t *testing.T) {
+	dsklog.InitializeDlogger("/dev/null")
+
+	root := t.TempDir()
+	path := filepath.Join(root, "meta.dat")
+	if err := os.WriteFile(path, []byte("metadata"), 0o640); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+	mtime := time.Unix(1700000000, 123456789)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("chtimes %s: %v", path, err)
+	}
+
+	candidates := make(chan FileCandidate, 1)
+	paths := dpath.NewStore()
+	walker := NewCandidateWalker([]string{root}, candidates, paths, config.Config{HashAlgorithm: dfs.HashSHA256})
+	walker.Run(context.Background())
+
+	var got []FileCandidate
+	for candidate := range candidates {
+		got = append(got, candidate)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(got))
+	}
+	want, err := dfs.LstatMeta(path)
+	if err != nil {
+		t.Fatalf("LstatMeta: %v", err)
+	}
+	if got[0].FileMeta != want {
+		t.Fatalf("candidate meta = %+v, want %+v", got[0].FileMeta, want)
+	}
+	if got[0].ModTime != mtime.UnixNano() || got[0].Mode.Perm() != 0o640 {
+		t.Fatalf("unexpected mtime/mode: %d %s", got[0].ModTime, got[0].Mode)
+	}
+}
+
+func TestCandidateCarriesRootIndex(t *testing.T) {
+	dsklog.InitializeDlogger("/dev/null")
+
+	rootA, rootB := t.TempDir(), t.TempDir()
+	for _, root := range []string{rootA, rootB} {
+		if err := os.MkdirAll(filepath.Join(root, "sub"), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "sub", "f.dat"), []byte(root), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	candidates := make(chan FileCandidate, 2)
+	paths := dpath.NewStore()
+	walker := NewCandidateWalker([]string{rootA, rootB}, candidates, paths, config.Config{HashAlgorithm: dfs.HashSHA256, MaxDepth: -1})
+	walker.Run(context.Background())
+
+	roots := walker.Roots()
+	seen := 0
+	for candidate := range candidates {
+		path := paths.Path(candidate.ID)
+		if want := filepath.Join(roots[candidate.Root], "sub", "f.dat"); path != want {
+			t.Fatalf("candidate %s tagged with root %d (%s)", path, candidate.Root, roots[candidate.Root])
+		}
+		seen++
+	}
+	if seen != 2 {
+		t.Fatalf("expected 2 candidates, got %d", seen)
+	}
+}
+
+func TestCandidateUnderNestedRootsCarriesInnermostRoot(t *testing.T) {
+	dsklog.InitializeDlogger("/dev/null")
+
+	outer := t.TempDir()
+	inner := filepath.Join(outer, "nested")
+	if err := os.MkdirAll(inner, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(inner, "f.dat"), []byte("data"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// Whichever walk reaches the file first, it belongs to the inner root.
+	for run := 0; run < 5; run++ {
+		candidates := make(chan FileCandidate, 2)
+		paths := dpath.NewStore()
+		walker := NewCandidateWalker([]string{outer, inner}, candidates, paths, config.Config{HashAlgorithm: dfs.HashSHA256, MaxDepth: -1})
+		walker.Run(context.Background())
+		for candidate := range candidates {
+			if candidate.Root != 1 {
+				t.Fatalf("run %d: %s tagged with root %d, want 1", run, paths.Path(candidate.ID), candidate.Root)
+			}
+		}
+	}
+}
@@ -2,15 +2,18 @@
 
 package dwalk
 
-import "os"
+import (
+	"os"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+)
 
 // fileIdentity is a no-op placeholder on non-Unix platforms where we don't
 // currently attempt inode-based hardlink deduplication.
 type fileIdentity struct{}
 
 type fileMeta struct {
-	size        int64
-	mode        os.FileMode
+	dfs.FileMeta
 	device      uint64
 	hasDevice   bool
 	identity    fileIdentity
@@ -22,8 +25,5 @@ func statFile(path string) (fileMeta, error) {
 	if err != nil {
 		return fileMeta{}, err
 	}
-	return fileMeta{
-		size: info.Size(),
-		mode: info.Mode(),
-	}, nil
+	return fileMeta{FileMeta: dfs.MetaFromFileInfo(info)}, nil
 }
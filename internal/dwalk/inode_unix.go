@@ -5,6 +5,9 @@ package dwalk
 import (
 	"os"
 	"syscall"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"golang.org/x/sys/unix"
 )
 
 // fileIdentity uniquely identifies a file by device and inode on Unix systems.
@@ -13,9 +16,11 @@ type fileIdentity struct {
 	ino uint64
 }
 
+// statBlockSize is the unit st_blocks is reported in.
+const statBlockSize = 512
+
 type fileMeta struct {
-	size        int64
-	mode        os.FileMode
+	dfs.FileMeta
 	device      uint64
 	hasDevice   bool
 	identity    fileIdentity
@@ -23,13 +28,22 @@ type fileMeta struct {
 }
 
 func statFile(path string) (fileMeta, error) {
-	var stat syscall.Stat_t
-	if err := syscall.Lstat(path, &stat); err != nil {
+	var stat unix.Stat_t
+	if err := unix.Lstat(path, &stat); err != nil {
 		return fileMeta{}, err
 	}
 	return fileMeta{
-		size:      stat.Size,
-		mode:      modeFromStat(uint32(stat.Mode)),
+		FileMeta: dfs.FileMeta{
+			Size:     stat.Size,
+			DiskSize: int64(stat.Blocks) * statBlockSize,
+			Mode:     modeFromStat(uint32(stat.Mode)),
+			Uid:      stat.Uid,
+			Gid:      stat.Gid,
+			ModTime:  stat.Mtim.Nano(),
+			Dev:      uint64(stat.Dev),   // #nosec G115 -- platform-defined but safely representable in uint64
+			Ino:      uint64(stat.Ino),   // #nosec G115 -- platform-defined but safely representable in uint64
+			Nlink:    uint64(stat.Nlink), // #nosec G115 -- platform-defined but safely representable in uint64
+		},
 		device:    uint64(stat.Dev), // #nosec G115 -- platform-defined but safely representable in uint64
 		hasDevice: true,
 		identity: fileIdentity{
@@ -42,6 +56,15 @@ func statFile(path string) (fileMeta, error) {
 
 func modeFromStat(mode uint32) os.FileMode {
 	fileMode := os.FileMode(mode & 0o777)
+	if mode&syscall.S_ISUID != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		fileMode |= os.ModeSticky
+	}
 	switch mode & syscall.S_IFMT {
 	case syscall.S_IFDIR:
 		fileMode |= os.ModeDir
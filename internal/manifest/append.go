@@ -0,0 +1,335 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// entryKey is what an entry records about its restore path. An entry whose
+// key matches the newest one already kept for its path adds nothing.
+type entryKey struct {
+	action    Action
+	canonical string
+	hash      string
+	size      int64
+	mtimeUnix int64
+	mtimeNsec int64
+}
+
+func keyOf(entry Entry) entryKey {
+	return entryKey{
+		action:    entry.Action,
+		canonical: entry.Canonical,
+		hash:      entry.Hash,
+		size:      entry.Size,
+		mtimeUnix: entry.ModTimeUnix,
+		mtimeNsec: entry.ModTimeNsec,
+	}
+}
+
+// pathIndex maps each restore path of a manifest to the key and number of its
+// newest entry. It is current while the file keeps the size and mtime
+// recorded here.
+type pathIndex struct {
+	size    int64
+	modTime time.Time
+	// count is the number of entries in the file.
+	count  int
+	latest map[string]entryKey
+	newest map[string]int
+}
+
+func newPathIndex() *pathIndex {
+	return &pathIndex{latest: make(map[string]entryKey), newest: make(map[string]int)}
+}
+
+// add records entry as the next entry of the file.
+func (idx *pathIndex) add(entry Entry) {
+	idx.latest[entry.RestorePath] = keyOf(entry)
+	idx.newest[entry.RestorePath] = idx.count
+	idx.count++
+}
+
+var (
+	// indexMu guards indexes and, with the lock file lockJournal takes,
+	// serializes changes to a manifest.
+	indexMu sync.Mutex
+	// indexes caches the index of every manifest appended to, by absolute
+	// path, so each append streams the file at most once per outside change.
+	indexes = make(map[string]*pathIndex)
+)
+
+// lockJournal serializes changes to the manifest at absPath: indexMu within
+// this process, and an advisory lock across processes. The lock is taken on a
+// sidecar file beside the manifest, since Compact renames a new file over the
+// manifest itself. The returned func releases both.
+func lockJournal(absPath string) (func(), error) {
+	indexMu.Lock()
+	unlock, err := lockFile(absPath + ".lock")
+	if err != nil {
+		indexMu.Unlock()
+		return nil, fmt.Errorf("lock manifest %s: %w", absPath, err)
+	}
+	return func() {
+		unlock()
+		indexMu.Unlock()
+	}, nil
+}
+
+// loadIndex returns the index of the manifest at absPath, whose current stat
+// is info, streaming the file to rebuild it if the cached one is out of date.
+// The journal lock must be held.
+func loadIndex(absPath string, info os.FileInfo) (*pathIndex, error) {
+	if idx, ok := indexes[absPath]; ok && idx.size == info.Size() && idx.modTime.Equal(info.ModTime()) {
+		return idx, nil
+	}
+	delete(indexes, absPath)
+	idx := newPathIndex()
+	err := Each(absPath, func(_ int, entry Entry) error {
+		idx.add(entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	idx.size, idx.modTime = info.Size(), info.ModTime()
+	indexes[absPath] = idx
+	return idx, nil
+}
+
+// forgetIndex drops the cached index of the manifest at absPath after the
+// file was rewritten.
+func forgetIndex(absPath string) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	delete(indexes, absPath)
+}
+
+// numberedEntry is an entry with its number, as Each numbers them.
+type numberedEntry struct {
+	index int
+	entry Entry
+}
+
+// newestEntries returns the newest entry for each restore path of the
+// manifest at path in file order, reading the file once under the journal
+// lock. Only one entry per path is held in memory; older ones are superseded.
+func newestEntries(path string) ([]numberedEntry, error) {
+	absPath, err := filepath.Abs(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("resolve manifest path %s: %w", path, err)
+	}
+	// Don't leave a lock file beside a manifest that isn't there.
+	if _, err := os.Stat(absPath); err != nil {
+		return nil, fmt.Errorf("stat manifest %s: %w", absPath, err)
+	}
+	unlock, err := lockJournal(absPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	newest := make(map[string]numberedEntry)
+	err = Each(absPath, func(i int, entry Entry) error {
+		newest[entry.RestorePath] = numberedEntry{index: i, entry: entry}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]numberedEntry, 0, len(newest))
+	for _, entry := range newest {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].index < entries[j].index })
+	return entries, nil
+}
+
+// superseded reports whether entry number i is followed by a newer entry for
+// its restore path, according to newest.
+func superseded(newest map[string]int, i int, entry Entry) bool {
+	n, ok := newest[entry.RestorePath]
+	return ok && n != i
+}
+
+// AppendUnique adds entries to the manifest at path, skipping those that
+// repeat the newest entry already recorded for their restore path. An entry
+// recording something new about a path is appended after the older ones,
+// which it supersedes; Compact drops those. Complete lines are never
+// rewritten; a last line cut short by an interrupted write is dropped. The
+// new ones go out in a single append and are synced before AppendUnique
+// returns. A missing manifest is created with header.
+func AppendUnique(path string, header Header, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if path == "" {
+		return errors.New("manifest path is empty")
+	}
+	absPath, err := filepath.Abs(filepath.Clean(path))
+	if err != nil {
+		return fmt.Errorf("resolve manifest path %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(absPath)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("create manifest directory %s: %w", dir, err)
+	}
+	unlock, err := lockJournal(absPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := openAppend(absPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return createIndexed(absPath, header, entries)
+	}
+	if err != nil {
+		return fmt.Errorf("open manifest %s: %w", absPath, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat manifest %s: %w", absPath, err)
+	}
+	idx, err := loadIndex(absPath, info)
+	if err != nil {
+		return err
+	}
+
+	added := make(map[string]entryKey)
+	var appended []Entry
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	for _, entry := range entries {
+		if entry.RestorePath == "" {
+			continue
+		}
+		key := keyOf(entry)
+		latest, ok := added[entry.RestorePath]
+		if !ok {
+			latest, ok = idx.latest[entry.RestorePath]
+		}
+		if ok && latest == key {
+			continue
+		}
+		if entry.Version == 0 {
+			entry.Version = ManifestVersion
+		}
+		if err := enc.Encode(entry); err != nil {
+			return fmt.Errorf("encode manifest entry: %w", err)
+		}
+		added[entry.RestorePath] = key
+		appended = append(appended, entry)
+	}
+	if len(appended) == 0 {
+		return nil
+	}
+
+	delete(indexes, absPath)
+	newline, err := repairTail(file, info.Size())
+	if err != nil {
+		return fmt.Errorf("repair manifest %s: %w", absPath, err)
+	}
+	if newline {
+		if _, err := file.Write([]byte{'\n'}); err != nil {
+			return fmt.Errorf("append manifest %s: %w", absPath, err)
+		}
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("append manifest %s: %w", absPath, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("sync manifest %s: %w", absPath, err)
+	}
+	// The entries are safely written; without a stat the index is simply
+	// rebuilt next time.
+	info, err = file.Stat()
+	if err != nil {
+		return nil
+	}
+	for _, entry := range appended {
+		idx.add(entry)
+	}
+	idx.size, idx.modTime = info.Size(), info.ModTime()
+	indexes[absPath] = idx
+	return nil
+}
+
+// createIndexed writes a new manifest at absPath holding header and the
+// distinct entries, and caches its index. The journal lock must be held.
+func createIndexed(absPath string, header Header, entries []Entry) error {
+	writer, err := NewWriter(absPath, header)
+	if err != nil {
+		return err
+	}
+	idx := newPathIndex()
+	for _, entry := range entries {
+		if entry.RestorePath == "" {
+			continue
+		}
+		if latest, ok := idx.latest[entry.RestorePath]; ok && latest == keyOf(entry) {
+			continue
+		}
+		if err := writer.WriteEntry(entry); err != nil {
+			_ = writer.Abort()
+			return err
+		}
+		idx.add(entry)
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return nil // rebuilt on the next append
+	}
+	idx.size, idx.modTime = info.Size(), info.ModTime()
+	indexes[absPath] = idx
+	return nil
+}
+
+// repairTail readies the manifest file of size bytes for an append. A last
+// line without a newline is either a complete entry, reported by returning
+// true so a newline goes out first, or what an interrupted append left
+// behind, which readers skip and which is truncated here so it can't end up
+// mid-file.
+func repairTail(file *os.File, size int64) (bool, error) {
+	start := size
+	chunk := make([]byte, 64*1024)
+	for start > 0 {
+		n := min(int64(len(chunk)), start)
+		if _, err := file.ReadAt(chunk[:n], start-n); err != nil {
+			return false, err
+		}
+		if i := bytes.LastIndexByte(chunk[:n], '\n'); i >= 0 {
+			start = start - n + int64(i) + 1
+			break
+		}
+		start -= n
+	}
+	if start == size {
+		return false, nil
+	}
+	tail := make([]byte, size-start)
+	if _, err := file.ReadAt(tail, start); err != nil {
+		return false, err
+	}
+	if json.Valid(tail) {
+		return true, nil
+	}
+	if len(bytes.TrimSpace(tail)) == 0 {
+		return false, nil
+	}
+	return false, file.Truncate(start)
+}
@@ -0,0 +1,135 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dmap"
+)
+
+// CompactResult counts what Compact kept and dropped.
+type CompactResult struct {
+	Kept int
+	// Superseded counts entries followed by a newer one for the same
+	// restore path.
+	Superseded int
+	// Restored counts entries whose restore path already holds its recorded
+	// content and metadata, leaving nothing to restore or undo.
+	Restored int
+}
+
+// Compact rewrites the manifest at path keeping only the newest entry for
+// each restore path, less those already restored (see entryRestored). The
+// newest entries come from the index AppendUnique keeps, and the file is
+// streamed once more to rewrite it, never held in memory. Appends, from this
+// process or another, wait on the journal lock until the rewrite is in place. The rewrite keeps the file's
+// header, or gives a format 1 file one. With dryRun set the file is left
+// alone and only the counts are returned.
+func Compact(path string, dryRun bool) (CompactResult, error) {
+	absPath, err := filepath.Abs(filepath.Clean(path))
+	if err != nil {
+		return CompactResult{}, fmt.Errorf("resolve manifest path %s: %w", path, err)
+	}
+	// Don't leave a lock file beside a manifest that isn't there.
+	if _, err := os.Stat(absPath); err != nil {
+		return CompactResult{}, fmt.Errorf("stat manifest %s: %w", absPath, err)
+	}
+	unlock, err := lockJournal(absPath)
+	if err != nil {
+		return CompactResult{}, err
+	}
+	defer unlock()
+
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return CompactResult{}, fmt.Errorf("stat manifest %s: %w", absPath, err)
+	}
+	idx, err := loadIndex(absPath, info)
+	if err != nil {
+		return CompactResult{}, err
+	}
+
+	r, err := OpenReader(absPath)
+	if err != nil {
+		return CompactResult{}, err
+	}
+	defer r.Close()
+
+	var writer *Writer
+	if !dryRun {
+		header, ok := r.Header()
+		if !ok {
+			header = NewHeader(dmap.ScanInfo{})
+		}
+		header.Format = FormatVersion
+		if writer, err = NewWriter(absPath, header); err != nil {
+			return CompactResult{}, err
+		}
+	}
+
+	var result CompactResult
+	for i := 0; ; i++ {
+		entry, err := r.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			_ = writer.Abort()
+			return CompactResult{}, err
+		}
+		switch {
+		case superseded(idx.newest, i, entry):
+			result.Superseded++
+		case entryRestored(entry):
+			result.Restored++
+		default:
+			result.Kept++
+			if writer != nil {
+				if err := writer.WriteEntry(entry); err != nil {
+					_ = writer.Abort()
+					return CompactResult{}, err
+				}
+			}
+		}
+	}
+	if writer == nil {
+		return result, nil
+	}
+	// Close the old file before the new one is renamed over it.
+	_ = r.Close()
+	if err := writer.Close(); err != nil {
+		return CompactResult{}, err
+	}
+	delete(indexes, absPath)
+	return result, nil
+}
+
+// entryRestored reports whether the restore path of entry is an independent
+// regular file holding the recorded content, mode and mtime, so neither
+// RestoreManifest nor Undo has anything left to do for it. That is the case
+// after a restore or undo, and for dedupe and reflink entries whose file
+// kept its metadata. Entries that can't be checked count as not restored.
+func entryRestored(entry Entry) bool {
+	resolved, err := resolveEntry(0, entry)
+	if err != nil {
+		return false
+	}
+	info, err := os.Lstat(resolved.restore)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if resolved.restore != resolved.canonical && os.SameFile(info, resolved.canonicalInfo) {
+		return false
+	}
+	if entry.Mode != 0 && info.Mode()&modeMask != fileMode(entry.Mode) {
+		return false
+	}
+	if entry.ModTimeUnix != 0 && !info.ModTime().Equal(time.Unix(entry.ModTimeUnix, entry.ModTimeNsec)) {
+		return false
+	}
+	return VerifyFileHash(resolved.restore, entry.Hash, entry.Size, resolved.algo) == nil
+}
@@ -7,9 +7,15 @@ import (
 	"os"
 )
 
-func openCreateTruncate(absPath string, perm fs.FileMode) (*os.File, error) {
+// lockFile creates absPath if needed. Without flock there is no lock across
+// processes; within one, indexMu serializes access.
+func lockFile(absPath string) (func(), error) {
 	// #nosec G304 -- non-unix fallback retains scoped caller behavior from normalized absolute paths.
-	return os.OpenFile(absPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	file, err := os.OpenFile(absPath, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return func() { _ = file.Close() }, nil
 }
 
 func openCreateExclusive(absPath string, perm fs.FileMode) (*os.File, error) {
@@ -17,6 +23,11 @@ func openCreateExclusive(absPath string, perm fs.FileMode) (*os.File, error) {
 	return os.OpenFile(absPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
 }
 
+func openAppend(absPath string) (*os.File, error) {
+	// #nosec G304 -- non-unix fallback retains scoped caller behavior from normalized absolute paths.
+	return os.OpenFile(absPath, os.O_RDWR|os.O_APPEND, 0)
+}
+
 func syncDir(path string) error {
 	// #nosec G304 -- non-unix fallback syncing parent directory metadata after atomic rename.
 	dir, err := os.Open(path)
@@ -3,6 +3,7 @@
 package manifest
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"math"
@@ -12,14 +13,38 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func openCreateTruncate(absPath string, perm fs.FileMode) (*os.File, error) {
-	return openInParent(absPath, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC|unix.O_CLOEXEC, perm)
+// lockFile takes an exclusive advisory lock on absPath, creating the file if
+// needed, and returns the func that releases it.
+func lockFile(absPath string) (func(), error) {
+	file, err := openInParent(absPath, unix.O_RDWR|unix.O_CREAT|unix.O_CLOEXEC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(file.Fd())
+	for {
+		err = unix.Flock(fd, unix.LOCK_EX)
+		if !errors.Is(err, unix.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("lock file %s: %w", absPath, err)
+	}
+	return func() {
+		_ = unix.Flock(fd, unix.LOCK_UN)
+		_ = file.Close()
+	}, nil
 }
 
 func openCreateExclusive(absPath string, perm fs.FileMode) (*os.File, error) {
 	return openInParent(absPath, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_CLOEXEC, perm)
 }
 
+func openAppend(absPath string) (*os.File, error) {
+	return openInParent(absPath, unix.O_RDWR|unix.O_APPEND|unix.O_CLOEXEC, 0)
+}
+
 func syncDir(path string) error {
 	dirfd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
 	if err != nil {
@@ -0,0 +1,60 @@
+//go:build unix
+
+package manifest
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dmap"
+)
+
+// TestJournalWaitsForLockHeldElsewhere holds the journal's lock file through
+// its own descriptor, as another dskDitto process would, and checks that
+// AppendUnique and Compact wait for it.
+func TestJournalWaitsForLockHeldElsewhere(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "journal.jsonl")
+	entry := func(name string) Entry {
+		return Entry{HashAlgo: string(dfs.HashSHA256), Hash: "abc", Canonical: filepath.Join(dir, "missing"),
+			RestorePath: filepath.Join(dir, name), Action: ActionDelete}
+	}
+	if err := AppendUnique(journal, NewHeader(dmap.ScanInfo{}), []Entry{entry("a")}); err != nil {
+		t.Fatalf("AppendUnique create: %v", err)
+	}
+
+	unlock, err := lockFile(journal + ".lock")
+	if err != nil {
+		t.Fatalf("lockFile: %v", err)
+	}
+	done := make(chan error, 2)
+	go func() {
+		done <- AppendUnique(journal, Header{}, []Entry{entry("b")})
+	}()
+	go func() {
+		_, err := Compact(journal, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		unlock()
+		t.Fatalf("journal changed while another process held its lock (err %v)", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	for range 2 {
+		if err := <-done; err != nil {
+			t.Fatalf("journal change after unlock: %v", err)
+		}
+	}
+
+	entries, err := Read(journal)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("journal holds %d entries, want 2", len(entries))
+	}
+}
@@ -2,22 +2,86 @@
 // by accident. They can simply restore them by providing the generated file
 // that holds restore information.
 //
-// The restore file is dumped as JSONL for simplicity. The primary logic for
-// creating the file or reading for restoration are in: writer.go, reader.go
+// The restore file is dumped as JSONL for simplicity: a Header line, then
+// one Entry per line. The primary logic for creating the file or reading for
+// restoration are in: writer.go, reader.go. Entries from later actions are
+// appended in place (append.go) and --manifest-compact drops the ones no
+// longer needed (compact.go).
 package manifest
 
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
+	"time"
 
+	"github.com/jdefrancesco/dskDitto/internal/buildinfo"
 	"github.com/jdefrancesco/dskDitto/internal/dfs"
 	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
 )
 
-const ManifestVersion = 1
+// ManifestVersion is the entry version written by NewEntry. Version 2
+// entries form an action journal: they record the action taken and the
+// restore path's owner, link count and extended attributes, so --undo can
+// reverse each action. Version 1 entries are still read and restored.
+const ManifestVersion = 2
+
+// manifestV1 entries carry no action and are restored by copying the
+// canonical file back.
+const manifestV1 = 1
+
+// FormatVersion is the manifest file format written by Write and
+// AppendUnique. Format 2 files open with a Header line; format 1 files are
+// bare entry lines and are still read.
+const FormatVersion = 2
+
+// Header is the first line of a format 2 manifest. It records which dskDitto
+// wrote the file and, when known, the scan its entries came from.
+type Header struct {
+	Format    int            `json:"format"`
+	Tool      string         `json:"tool,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	Scan      *dmap.ScanInfo `json:"scan,omitempty"`
+}
+
+// NewHeader returns the header of a manifest written now for scan. A scan
+// with neither roots nor a scan time is left out.
+func NewHeader(scan dmap.ScanInfo) Header {
+	header := Header{
+		Format:    FormatVersion,
+		Tool:      "dskDitto " + buildinfo.Version,
+		CreatedAt: time.Now().UTC(),
+	}
+	if len(scan.Roots) > 0 || !scan.ScannedAt.IsZero() {
+		header.Scan = &scan
+	}
+	return header
+}
+
+// Action is what a duplicate action did to an entry's restore path.
+type Action string
+
+const (
+	// ActionDelete removed the restore path (including moves to the Trash
+	// or a quarantine directory).
+	ActionDelete Action = "delete"
+	// ActionSymlink replaced the restore path with a symlink to the
+	// canonical file.
+	ActionSymlink Action = "symlink"
+	// ActionReflink replaced the restore path with a copy-on-write clone of
+	// the canonical file.
+	ActionReflink Action = "reflink"
+	// ActionHardlink replaced the restore path with a hard link to the
+	// canonical file.
+	ActionHardlink Action = "hardlink"
+	// ActionDedupe shared the restore path's extents with the canonical
+	// file in place. The path kept its inode, content and metadata.
+	ActionDedupe Action = "dedupe"
+)
 
 // Try to keep as much metadata for file as we can
 // for robustness. Not all attributes exist for every
@@ -30,13 +94,55 @@ type Entry struct {
 	Size        int64  `json:"size"`
 	Canonical   string `json:"canonical"`
 	RestorePath string `json:"restore_path"`
+	// Mode holds the permission, set-id and sticky bits as st_mode does.
 	Mode        uint32 `json:"mode,omitempty"`
 	ModTimeUnix int64  `json:"mtime_unix,omitempty"`
 	ModTimeNsec int64  `json:"mtime_nsec,omitempty"`
 	Dev         uint64 `json:"dev,omitempty"`
 	Ino         uint64 `json:"ino,omitempty"`
+	// Version 2 fields. Action is empty when the action wasn't known when
+	// the entry was written.
+	Action Action            `json:"action,omitempty"`
+	Uid    uint32            `json:"uid,omitempty"`
+	Gid    uint32            `json:"gid,omitempty"`
+	Nlink  uint64            `json:"nlink,omitempty"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
 }
 
+// modeBits returns the permission, set-id and sticky bits of mode as
+// Entry.Mode records them.
+func modeBits(mode fs.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+	return bits
+}
+
+// fileMode converts a recorded Entry.Mode back to an fs.FileMode.
+func fileMode(bits uint32) fs.FileMode {
+	mode := fs.FileMode(bits & 0o777)
+	if bits&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if bits&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if bits&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// modeMask selects the bits of an fs.FileMode that Entry.Mode records.
+const modeMask = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
 // RestoreOptions config info
 type RestoreOptions struct {
 	DryRun       bool
@@ -47,12 +153,26 @@ type RestoreOptions struct {
 }
 
 type group struct {
-	hash   string
-	digest dmap.Digest
-	paths  []string
+	hash  string
+	files []groupFile
+}
+
+// groupFile is a group member with the metadata the scan captured for it.
+type groupFile struct {
+	path string
+	meta dfs.FileMeta
 }
 
+// NewEntry builds the restore entry for restorePath, a duplicate of
+// canonicalPath, stat'ing both files.
 func NewEntry(groupID uint64, algo dfs.HashAlgorithm, hash, canonicalPath, restorePath string) (Entry, error) {
+	return NewEntryWithMeta(groupID, algo, hash, canonicalPath, dfs.FileMeta{}, restorePath, dfs.FileMeta{})
+}
+
+// NewEntryWithMeta is NewEntry for files whose metadata was captured during
+// the scan, so they needn't be stat'd again. A zero meta is filled in from a
+// fresh stat.
+func NewEntryWithMeta(groupID uint64, algo dfs.HashAlgorithm, hash, canonicalPath string, canonicalMeta dfs.FileMeta, restorePath string, restoreMeta dfs.FileMeta) (Entry, error) {
 	if hash == "" {
 		return Entry{}, errors.New("manifest hash is empty")
 	}
@@ -72,40 +192,56 @@ func NewEntry(groupID uint64, algo dfs.HashAlgorithm, hash, canonicalPath, resto
 		return Entry{}, fmt.Errorf("resolve restore path %s: %w", restorePath, err)
 	}
 
-	canonicalInfo, err := os.Stat(canonicalAbs)
-	if err != nil {
-		return Entry{}, fmt.Errorf("stat canonical %s: %w", canonicalAbs, err)
+	if !canonicalMeta.Known() {
+		canonicalInfo, err := os.Stat(canonicalAbs)
+		if err != nil {
+			return Entry{}, fmt.Errorf("stat canonical %s: %w", canonicalAbs, err)
+		}
+		canonicalMeta = dfs.MetaFromFileInfo(canonicalInfo)
 	}
-	if !canonicalInfo.Mode().IsRegular() {
+	if !canonicalMeta.Mode.IsRegular() {
 		return Entry{}, fmt.Errorf("canonical path is not a regular file: %s", canonicalAbs)
 	}
 
-	restoreInfo, err := os.Lstat(restoreAbs)
-	if err != nil {
-		return Entry{}, fmt.Errorf("stat restore path %s: %w", restoreAbs, err)
+	if !restoreMeta.Known() {
+		restoreMeta, err = dfs.LstatMeta(restoreAbs)
+		if err != nil {
+			return Entry{}, fmt.Errorf("stat restore path %s: %w", restoreAbs, err)
+		}
 	}
-	if !restoreInfo.Mode().IsRegular() && restoreInfo.Mode()&os.ModeSymlink == 0 {
+	if !restoreMeta.Mode.IsRegular() && restoreMeta.Mode&os.ModeSymlink == 0 {
 		return Entry{}, fmt.Errorf("restore path is not a file or symlink: %s", restoreAbs)
 	}
 
-	dev, ino := fileIdentity(restoreInfo)
-	mt := restoreInfo.ModTime()
+	// Attributes are best effort: a file whose attributes can't be listed
+	// is still recorded.
+	xattrs, _ := dfs.Xattrs(restoreAbs)
+
+	mt := restoreMeta.ModTimeValue()
 	return Entry{
 		Version:     ManifestVersion,
 		GroupID:     groupID,
 		HashAlgo:    string(algo),
 		Hash:        hash,
-		Size:        canonicalInfo.Size(),
+		Size:        canonicalMeta.Size,
 		Canonical:   canonicalAbs,
 		RestorePath: restoreAbs,
-		Mode:        uint32(restoreInfo.Mode().Perm()),
+		Mode:        modeBits(restoreMeta.Mode),
 		ModTimeUnix: mt.Unix(),
 		ModTimeNsec: int64(mt.Nanosecond()),
-		Dev:         dev,
-		Ino:         ino,
+		Dev:         restoreMeta.Dev,
+		Ino:         restoreMeta.Ino,
+		Uid:         restoreMeta.Uid,
+		Gid:         restoreMeta.Gid,
+		Nlink:       restoreMeta.Nlink,
+		Xattrs:      xattrs,
 	}, nil
 }
 
+// EntriesFromDmap builds restore entries for every group in dm, keeping the
+// lexically first path of each group as its canonical copy. Metadata the
+// scan captured is reused; files without it are stat'd. Directory groups
+// are skipped, since an entry restores a single file.
 func EntriesFromDmap(dm *dmap.Dmap, algo dfs.HashAlgorithm) ([]Entry, error) {
 	if dm == nil {
 		return nil, nil
@@ -117,21 +253,25 @@ func EntriesFromDmap(dm *dmap.Dmap, algo dfs.HashAlgorithm) ([]Entry, error) {
 	}
 
 	groups := make([]group, 0, dm.MapSize())
-	for digest, files := range dm.GetMap() {
-		if uint(len(files)) < minDups {
+	for digest, ids := range dm.GroupIDs() {
+		if uint(len(ids)) < minDups || dm.MatchInfo(digest).Type.IsDirectory() {
 			continue
 		}
-		absPaths, err := normalizeAndSortPaths(files)
+		files := make([]groupFile, 0, len(ids))
+		for _, id := range ids {
+			info, _ := dm.FileInfo(id)
+			files = append(files, groupFile{path: dm.Path(id), meta: info.FileMeta})
+		}
+		files, err := normalizeAndSortFiles(files)
 		if err != nil {
 			return nil, err
 		}
-		if len(absPaths) < 2 {
+		if len(files) < 2 {
 			continue
 		}
 		groups = append(groups, group{
-			hash:   fmt.Sprintf("%x", digest),
-			digest: digest,
-			paths:  absPaths,
+			hash:  fmt.Sprintf("%x", digest),
+			files: files,
 		})
 	}
 
@@ -142,9 +282,9 @@ func EntriesFromDmap(dm *dmap.Dmap, algo dfs.HashAlgorithm) ([]Entry, error) {
 	entries := make([]Entry, 0)
 	for i, g := range groups {
 		groupID := uint64(i + 1)
-		canonical := g.paths[0]
-		for _, dupPath := range g.paths[1:] {
-			entry, err := NewEntry(groupID, algo, g.hash, canonical, dupPath)
+		canonical := g.files[0]
+		for _, dup := range g.files[1:] {
+			entry, err := NewEntryWithMeta(groupID, algo, g.hash, canonical.path, canonical.meta, dup.path, dup.meta)
 			if err != nil {
 				return nil, err
 			}
@@ -155,8 +295,32 @@ func EntriesFromDmap(dm *dmap.Dmap, algo dfs.HashAlgorithm) ([]Entry, error) {
 	return entries, nil
 }
 
+// BatchEntry returns the journal entry for a batch action about to act on id,
+// one of dm's files, deferring to keep (see dmap.Dmap.SetJournal): keep is the
+// canonical, hash the group's digest, and action is recorded. groupID numbers
+// the group in the journal. It must be built before the action, while id's
+// extended attributes can still be read.
+func BatchEntry(dm *dmap.Dmap, algo dfs.HashAlgorithm, groupID uint64, hash dmap.Digest, keep, id dpath.ID, action Action) (Entry, error) {
+	keepInfo, _ := dm.FileInfo(keep)
+	info, _ := dm.FileInfo(id)
+	entry, err := NewEntryWithMeta(groupID, algo, fmt.Sprintf("%x", hash), dm.Path(keep), keepInfo.FileMeta, dm.Path(id), info.FileMeta)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry.Action = action
+	return entry, nil
+}
+
+// Write writes entries to a new manifest at path under a header without scan
+// metadata, replacing any file already there.
 func Write(path string, entries []Entry) error {
-	writer, err := NewWriter(path)
+	return WriteWithHeader(path, NewHeader(dmap.ScanInfo{}), entries)
+}
+
+// WriteWithHeader is Write with the given header. The file is written to a
+// temporary name, synced and renamed into place.
+func WriteWithHeader(path string, header Header, entries []Entry) error {
+	writer, err := NewWriter(path, header)
 	if err != nil {
 		return err
 	}
@@ -166,45 +330,11 @@ func Write(path string, entries []Entry) error {
 			return err
 		}
 	}
-	return writer.Close()
-}
-
-func AppendUnique(path string, entries []Entry) error {
-	if len(entries) == 0 {
-		return nil
-	}
-
-	existing, err := Read(path)
-	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return err
-		}
-		existing = nil
-	}
-
-	return Write(path, MergeEntriesByRestorePath(existing, entries))
-}
-
-func MergeEntriesByRestorePath(existing, incoming []Entry) []Entry {
-	merged := make([]Entry, 0, len(existing)+len(incoming))
-	seen := make(map[string]struct{}, len(existing)+len(incoming))
-
-	appendUnique := func(entries []Entry) {
-		for _, entry := range entries {
-			if entry.RestorePath == "" {
-				continue
-			}
-			if _, ok := seen[entry.RestorePath]; ok {
-				continue
-			}
-			seen[entry.RestorePath] = struct{}{}
-			merged = append(merged, entry)
-		}
+	if err := writer.Close(); err != nil {
+		return err
 	}
-
-	appendUnique(existing)
-	appendUnique(incoming)
-	return merged
+	forgetIndex(writer.path)
+	return nil
 }
 
 func CanonicalizeDmapGroups(dm *dmap.Dmap) error {
@@ -216,11 +346,36 @@ func CanonicalizeDmapGroups(dm *dmap.Dmap) error {
 		if err != nil {
 			return err
 		}
-		dm.GetMap()[digest] = normalized
+		dm.SetPaths(digest, normalized)
 	}
 	return nil
 }
 
+// normalizeAndSortFiles is normalizeAndSortPaths for files carrying metadata.
+func normalizeAndSortFiles(files []groupFile) ([]groupFile, error) {
+	seen := make(map[string]struct{}, len(files))
+	normalized := make([]groupFile, 0, len(files))
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(file.path)
+		if err != nil {
+			return nil, fmt.Errorf("resolve path %s: %w", file.path, err)
+		}
+		if _, ok := seen[abs]; ok {
+			continue
+		}
+		seen[abs] = struct{}{}
+		file.path = abs
+		normalized = append(normalized, file)
+	}
+	sort.Slice(normalized, func(i, j int) bool {
+		return normalized[i].path < normalized[j].path
+	})
+	return normalized, nil
+}
+
 func normalizeAndSortPaths(paths []string) ([]string, error) {
 	seen := make(map[string]struct{}, len(paths))
 	normalized := make([]string, 0, len(paths))
@@ -5,14 +5,19 @@ package manifest
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/jdefrancesco/dskDitto/internal/dfs"
 	"github.com/jdefrancesco/dskDitto/internal/dmap"
+	"github.com/jdefrancesco/dskDitto/internal/dpath"
 	"github.com/jdefrancesco/dskDitto/internal/dsklog"
 )
 
@@ -31,6 +36,15 @@ func mustWriteFile(t *testing.T, path string, content string, mode os.FileMode)
 	}
 }
 
+func mustReadFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return string(data)
+}
+
 func mustSymlink(t *testing.T, target, link string) {
 	t.Helper()
 	if err := os.Symlink(target, link); err != nil {
@@ -103,6 +117,81 @@ func TestManifestWriteReadRoundTrip(t *testing.T) {
 	}
 }
 
+func TestBatchJournalRecordsOnlyFilesActedOn(t *testing.T) {
+	initTestLogger()
+
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		path := filepath.Join(dir, name, "f.txt")
+		mustWriteFile(t, path, "dup", 0o644)
+		paths = append(paths, path)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	for _, path := range paths[:4] {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+
+	// An existing journal must be appended to, not replaced.
+	journal := filepath.Join(dir, "journal.jsonl")
+	earlier := Entry{HashAlgo: string(dfs.HashSHA256), Hash: "abc", Canonical: filepath.Join(dir, "x"),
+		RestorePath: filepath.Join(dir, "y"), Action: ActionDelete}
+	if err := AppendUnique(journal, NewHeader(dmap.ScanInfo{}), []Entry{earlier}); err != nil {
+		t.Fatalf("AppendUnique: %v", err)
+	}
+
+	dm, err := dmap.NewDmap(2)
+	if err != nil {
+		t.Fatalf("NewDmap: %v", err)
+	}
+	var digest dmap.Digest
+	digest[0] = 0x1
+	for _, path := range paths {
+		dm.AddPath(digest, path)
+	}
+	// The preferred copy is kept; the protected one and the one modified
+	// too recently are left alone, so neither may be journaled.
+	dm.SetKeepPolicy(dmap.KeepPolicy{Prefer: []string{filepath.Join(dir, "c")}})
+	dm.SetGuard(dmap.Guard{Protect: []string{filepath.Join(dir, "d")}, MinAge: time.Hour})
+	dm.SetJournal(func(hash dmap.Digest, keep, id dpath.ID) (func() error, error) {
+		entry, err := BatchEntry(dm, dfs.HashSHA256, 1, hash, keep, id, ActionDelete)
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return AppendUnique(journal, Header{}, []Entry{entry}) }, nil
+	})
+
+	removed, err := dm.RemoveDuplicates(1)
+	if err == nil || !errors.Is(err, dmap.ErrTooRecent) {
+		t.Fatalf("expected the recent copy refused, got %v", err)
+	}
+
+	entries, err := Read(journal)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(entries) == 0 || entries[0].RestorePath != earlier.RestorePath {
+		t.Fatalf("earlier journal entry lost: %+v", entries)
+	}
+	var journaled []string
+	for _, entry := range entries[1:] {
+		if entry.Canonical != paths[2] {
+			t.Fatalf("canonical = %s, want the preferred copy %s", entry.Canonical, paths[2])
+		}
+		if entry.Action != ActionDelete {
+			t.Fatalf("action = %q, want %q", entry.Action, ActionDelete)
+		}
+		journaled = append(journaled, entry.RestorePath)
+	}
+	sort.Strings(journaled)
+	sort.Strings(removed)
+	if len(removed) != 2 || strings.Join(journaled, "\n") != strings.Join(removed, "\n") {
+		t.Fatalf("journal covers %v, but %v were removed", journaled, removed)
+	}
+}
+
 func TestCanonicalSelectionDeterministic(t *testing.T) {
 	initTestLogger()
 
@@ -356,6 +445,56 @@ func TestRestoreSymlinkEquivalentBytesBecomesRegularFile(t *testing.T) {
 	}
 }
 
+func TestRestoreHardLinkBecomesIndependentFile(t *testing.T) {
+	initTestLogger()
+
+	dir := t.TempDir()
+	canonical := filepath.Join(dir, "keep.bin")
+	restorePath := filepath.Join(dir, "dup.bin")
+	mustWriteFile(t, canonical, "same-content", 0o644)
+	mustWriteFile(t, restorePath, "same-content", 0o644)
+
+	entry, err := NewEntry(1, dfs.HashSHA256, fileHash(t, canonical, dfs.HashSHA256), canonical, restorePath)
+	if err != nil {
+		t.Fatalf("NewEntry: %v", err)
+	}
+
+	if err := os.Remove(restorePath); err != nil {
+		t.Fatalf("remove restore path before linking: %v", err)
+	}
+	if err := os.Link(canonical, restorePath); err != nil {
+		t.Fatalf("link restore path: %v", err)
+	}
+
+	manifestPath := filepath.Join(dir, "restore.jsonl")
+	if err := Write(manifestPath, []Entry{entry}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := RestoreManifest(manifestPath, RestoreOptions{VerifyHash: true}); err != nil {
+		t.Fatalf("RestoreManifest: %v", err)
+	}
+
+	canonicalInfo, err := os.Stat(canonical)
+	if err != nil {
+		t.Fatalf("stat canonical: %v", err)
+	}
+	restoreInfo, err := os.Stat(restorePath)
+	if err != nil {
+		t.Fatalf("stat restored path: %v", err)
+	}
+	if os.SameFile(canonicalInfo, restoreInfo) {
+		t.Fatalf("restore path should no longer be a hard link to the canonical file")
+	}
+	data, err := os.ReadFile(restorePath)
+	if err != nil {
+		t.Fatalf("read restore path: %v", err)
+	}
+	if string(data) != "same-content" {
+		t.Fatalf("unexpected restored content: %q", data)
+	}
+}
+
 func TestRestoreSymlinkEquivalentBytesWithOverwriteDisabled(t *testing.T) {
 	initTestLogger()
 
@@ -567,3 +706,519 @@ func TestManifestRemoveRestoreRoundTrip(t *testing.T) {
 		t.Fatalf("restored hash mismatch: got %s want %s", restoredHash, canonicalHash)
 	}
 }
+
+func TestNewEntryWithMetaUsesRecordedMetadata(t *testing.T) {
+	initTestLogger()
+	root := t.TempDir()
+	canonical := filepath.Join(root, "a.txt")
+	restore := filepath.Join(root, "b.txt")
+
+	// Neither file exists, so every field must come from the recorded meta.
+	canonicalMeta := dfs.FileMeta{Size: 5, Mode: 0o644, ModTime: 1, Nlink: 1}
+	restoreMeta := dfs.FileMeta{Size: 5, Mode: 0o600, ModTime: time.Unix(1700000000, 42).UnixNano(), Dev: 7, Ino: 9, Nlink: 1}
+	entry, err := NewEntryWithMeta(1, dfs.HashSHA256, "abc", canonical, canonicalMeta, restore, restoreMeta)
+	if err != nil {
+		t.Fatalf("NewEntryWithMeta: %v", err)
+	}
+	if entry.Size != 5 || entry.Mode != 0o600 || entry.Dev != 7 || entry.Ino != 9 {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	if entry.ModTimeUnix != 1700000000 || entry.ModTimeNsec != 42 {
+		t.Fatalf("unexpected mtime: %d.%d", entry.ModTimeUnix, entry.ModTimeNsec)
+	}
+
+	if _, err := NewEntryWithMeta(1, dfs.HashSHA256, "abc", canonical, dfs.FileMeta{}, restore, restoreMeta); err == nil {
+		t.Fatalf("expected stat error for missing canonical without recorded meta")
+	}
+}
+
+func TestUndoSymlinkRestoresFileAndMetadata(t *testing.T) {
+	initTestLogger()
+
+	dir := t.TempDir()
+	canonical := filepath.Join(dir, "keep.bin")
+	dup := filepath.Join(dir, "dup.bin")
+	mustWriteFile(t, canonical, "same-data", 0o644)
+	mustWriteFile(t, dup, "same-data", 0o600)
+	mtime := time.Date(2020, 2, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(dup, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	entry, err := NewEntry(1, dfs.HashSHA256, fileHash(t, canonical, dfs.HashSHA256), canonical, dup)
+	if err != nil {
+		t.Fatalf("NewEntry: %v", err)
+	}
+	if entry.Version != ManifestVersion {
+		t.Fatalf("expected version %d, got %d", ManifestVersion, entry.Version)
+	}
+	entry.Action = ActionSymlink
+	journal := filepath.Join(dir, "journal.jsonl")
+	if err := Write(journal, []Entry{entry}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := os.Remove(dup); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	mustSymlink(t, canonical, dup)
+
+	var out strings.Builder
+	if err := Undo(journal, RestoreOptions{DryRun: true}, &out); err != nil {
+		t.Fatalf("Undo dry run: %v", err)
+	}
+	if info, err := os.Lstat(dup); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("dry run must leave the symlink: %v", err)
+	}
+	if err := Undo(journal, RestoreOptions{}, &out); err != nil {
+		t.Fatalf("Undo: %v", err)
+	}
+	if !strings.Contains(out.String(), "would undo symlink of "+dup) || !strings.Contains(out.String(), "undid symlink of "+dup) {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+
+	info, err := os.Lstat(dup)
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected a regular file back at %s: %v", dup, err)
+	}
+	if info.Mode().Perm() != 0o600 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("metadata not restored: mode %v mtime %v", info.Mode().Perm(), info.ModTime())
+	}
+	if data, _ := os.ReadFile(dup); string(data) != "same-data" {
+		t.Fatalf("unexpected content %q", data)
+	}
+}
+
+func TestUndoRestoresSetIDBits(t *testing.T) {
+	initTestLogger()
+
+	dir := t.TempDir()
+	canonical := filepath.Join(dir, "keep.bin")
+	dup := filepath.Join(dir, "dup.bin")
+	mustWriteFile(t, canonical, "same-data", 0o644)
+	mustWriteFile(t, dup, "same-data", 0o644)
+	if err := os.Chmod(dup, 0o755|os.ModeSetuid); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+
+	entry, err := NewEntry(1, dfs.HashSHA256, fileHash(t, canonical, dfs.HashSHA256), canonical, dup)
+	if err != nil {
+		t.Fatalf("NewEntry: %v", err)
+	}
+	if entry.Mode != 0o4755 {
+		t.Fatalf("expected mode 04755 recorded, got %o", entry.Mode)
+	}
+	entry.Action = ActionDelete
+	journal := filepath.Join(dir, "journal.jsonl")
+	if err := Write(journal, []Entry{entry}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := os.Remove(dup); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	if err := Undo(journal, RestoreOptions{}, io.Discard); err != nil {
+		t.Fatalf("Undo: %v", err)
+	}
+	info, err := os.Lstat(dup)
+	if err != nil {
+		t.Fatalf("lstat: %v", err)
+	}
+	if got := info.Mode() & modeMask; got != 0o755|os.ModeSetuid {
+		t.Fatalf("expected mode %v back, got %v", 0o755|os.ModeSetuid, got)
+	}
+}
+
+func TestUndoRefusesRetargetedSymlink(t *testing.T) {
+	initTestLogger()
+
+	dir := t.TempDir()
+	canonical := filepath.Join(dir, "keep.bin")
+	dup := filepath.Join(dir, "dup.bin")
+	other := filepath.Join(dir, "other.bin")
+	mustWriteFile(t, canonical, "same-data", 0o644)
+	mustWriteFile(t, dup, "same-data", 0o644)
+	mustWriteFile(t, other, "different", 0o644)
+
+	entry, err := NewEntry(1, dfs.HashSHA256, fileHash(t, canonical, dfs.HashSHA256), canonical, dup)
+	if err != nil {
+		t.Fatalf("NewEntry: %v", err)
+	}
+	entry.Action = ActionSymlink
+	journal := filepath.Join(dir, "journal.jsonl")
+	if err := Write(journal, []Entry{entry}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := os.Remove(dup); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	mustSymlink(t, other, dup)
+
+	if err := Undo(journal, RestoreOptions{}, io.Discard); err == nil || !strings.Contains(err.Error(), "no longer leads to") {
+		t.Fatalf("expected retargeted symlink to be refused, got %v", err)
+	}
+	if target, _ := os.Readlink(dup); target != other {
+		t.Fatalf("symlink must be left alone, points at %q", target)
+	}
+}
+
+func TestUndoRunsNewestFirstAndAcceptsV1Entries(t *testing.T) {
+	initTestLogger()
+
+	dir := t.TempDir()
+	canonical := filepath.Join(dir, "keep.bin")
+	first := filepath.Join(dir, "first.bin")
+	second := filepath.Join(dir, "second.bin")
+	mustWriteFile(t, canonical, "same-data", 0o644)
+	hash := fileHash(t, canonical, dfs.HashSHA256)
+
+	// first is a v1 entry with no action; second a v2 hard link.
+	v1 := Entry{Version: 1, GroupID: 1, HashAlgo: string(dfs.HashSHA256), Hash: hash, Size: int64(len("same-data")),
+		Canonical: canonical, RestorePath: first, Mode: 0o644}
+	mustWriteFile(t, second, "same-data", 0o644)
+	v2, err := NewEntry(1, dfs.HashSHA256, hash, canonical, second)
+	if err != nil {
+		t.Fatalf("NewEntry: %v", err)
+	}
+	v2.Action = ActionHardlink
+	if err := os.Remove(second); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := os.Link(canonical, second); err != nil {
+		t.Skipf("hard links unsupported: %v", err)
+	}
+	journal := filepath.Join(dir, "journal.jsonl")
+	if err := Write(journal, []Entry{v1, v2}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var out strings.Builder
+	if err := Undo(journal, RestoreOptions{}, &out); err != nil {
+		t.Fatalf("Undo: %v", err)
+	}
+	want := "undid hardlink of " + second + "\nrestored " + first + "\n"
+	if out.String() != want {
+		t.Fatalf("output = %q, want %q", out.String(), want)
+	}
+	canonicalInfo, _ := os.Stat(canonical)
+	secondInfo, err := os.Stat(second)
+	if err != nil || os.SameFile(canonicalInfo, secondInfo) {
+		t.Fatalf("hard link should be an independent file again: %v", err)
+	}
+}
+
+func TestReaderReadsHeaderAndHeaderlessFiles(t *testing.T) {
+	dir := t.TempDir()
+	entry := Entry{Version: ManifestVersion, HashAlgo: string(dfs.HashSHA256), Hash: "abc", Canonical: "/a", RestorePath: "/b"}
+
+	withHeader := filepath.Join(dir, "v2.jsonl")
+	scan := dmap.ScanInfo{Roots: []string{"/data"}, HashAlgorithm: dfs.HashSHA256, ScannedAt: time.Unix(1700000000, 0).UTC()}
+	if err := WriteWithHeader(withHeader, NewHeader(scan), []Entry{entry}); err != nil {
+		t.Fatalf("WriteWithHeader: %v", err)
+	}
+	r, err := OpenReader(withHeader)
+	if err != nil {
+		t.Fatalf("OpenReader: %v", err)
+	}
+	header, ok := r.Header()
+	if !ok || header.Format != FormatVersion || header.Scan == nil || header.Scan.Roots[0] != "/data" || !header.Scan.ScannedAt.Equal(scan.ScannedAt) {
+		t.Fatalf("unexpected header %+v (present %v)", header, ok)
+	}
+	if got, err := r.Next(); err != nil || got.RestorePath != "/b" {
+		t.Fatalf("Next = %+v, %v", got, err)
+	}
+	if _, err := r.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF after the last entry, got %v", err)
+	}
+	_ = r.Close()
+
+	// Format 1 files are bare entry lines.
+	headerless := filepath.Join(dir, "v1.jsonl")
+	mustWriteFile(t, headerless, `{"version":1,"hash_algo":"sha256","hash":"abc","canonical":"/a","restore_path":"/b"}`+"\n\n", 0o600)
+	r, err = OpenReader(headerless)
+	if err != nil {
+		t.Fatalf("OpenReader headerless: %v", err)
+	}
+	if _, ok := r.Header(); ok {
+		t.Fatal("headerless manifest reported a header")
+	}
+	_ = r.Close()
+	entries, err := Read(headerless)
+	if err != nil || len(entries) != 1 || entries[0].Version != 1 {
+		t.Fatalf("Read headerless = %+v, %v", entries, err)
+	}
+
+	future := filepath.Join(dir, "v3.jsonl")
+	mustWriteFile(t, future, `{"format":3}`+"\n", 0o600)
+	if _, err := OpenReader(future); err == nil {
+		t.Fatal("expected an error for an unsupported format")
+	}
+}
+
+func TestAppendUniqueAppendsInPlace(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "journal.jsonl")
+	first := Entry{HashAlgo: string(dfs.HashSHA256), Hash: "abc", Canonical: "/a", RestorePath: "/b", Action: ActionSymlink}
+	if err := AppendUnique(journal, NewHeader(dmap.ScanInfo{}), []Entry{first, first}); err != nil {
+		t.Fatalf("AppendUnique create: %v", err)
+	}
+	before, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatalf("read journal: %v", err)
+	}
+
+	// Repeating the newest entry for a path adds nothing.
+	if err := AppendUnique(journal, Header{}, []Entry{first}); err != nil {
+		t.Fatalf("AppendUnique repeat: %v", err)
+	}
+	if after, _ := os.ReadFile(journal); string(after) != string(before) {
+		t.Fatalf("repeated entry changed the journal:\n%s", after)
+	}
+
+	// A new action on the same path is appended after the old lines, and
+	// lines written by someone else since are indexed before appending.
+	second := first
+	second.Action = ActionDelete
+	other := Entry{Version: ManifestVersion, HashAlgo: string(dfs.HashSHA256), Hash: "abc", Canonical: "/a", RestorePath: "/c", Action: ActionDelete}
+	file, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	if _, err := file.WriteString(`{"version":2,"hash_algo":"sha256","hash":"abc","canonical":"/a","restore_path":"/c","action":"delete"}`); err != nil {
+		t.Fatalf("write journal: %v", err)
+	}
+	_ = file.Close()
+	if err := AppendUnique(journal, Header{}, []Entry{other, second}); err != nil {
+		t.Fatalf("AppendUnique: %v", err)
+	}
+	after, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatalf("read journal: %v", err)
+	}
+	if !strings.HasPrefix(string(after), string(before)) {
+		t.Fatalf("existing lines were rewritten:\n%s", after)
+	}
+	entries, err := Read(journal)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(entries) != 3 || entries[0].Action != ActionSymlink || entries[1].RestorePath != "/c" || entries[2].Action != ActionDelete {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestCompactDropsSupersededAndRestoredEntries(t *testing.T) {
+	initTestLogger()
+
+	dir := t.TempDir()
+	canonical := filepath.Join(dir, "keep.bin")
+	restored := filepath.Join(dir, "restored.bin")
+	deleted := filepath.Join(dir, "deleted.bin")
+	for _, path := range []string{canonical, restored, deleted} {
+		mustWriteFile(t, path, "same-data", 0o644)
+	}
+	hash := fileHash(t, canonical, dfs.HashSHA256)
+	var entries []Entry
+	for _, path := range []string{restored, deleted} {
+		entry, err := NewEntry(1, dfs.HashSHA256, hash, canonical, path)
+		if err != nil {
+			t.Fatalf("NewEntry: %v", err)
+		}
+		entry.Action = ActionDelete
+		entries = append(entries, entry)
+	}
+	// deleted was first symlinked, then the symlink deleted.
+	older := entries[1]
+	older.Action = ActionSymlink
+	entries = append([]Entry{older}, entries...)
+	if err := os.Remove(deleted); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	journal := filepath.Join(dir, "journal.jsonl")
+	if err := Write(journal, entries); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	before, _ := os.ReadFile(journal)
+	result, err := Compact(journal, true)
+	if err != nil {
+		t.Fatalf("Compact dry run: %v", err)
+	}
+	if after, _ := os.ReadFile(journal); string(after) != string(before) {
+		t.Fatal("dry run changed the journal")
+	}
+	want := CompactResult{Kept: 1, Superseded: 1, Restored: 1}
+	if result != want {
+		t.Fatalf("dry run result = %+v, want %+v", result, want)
+	}
+
+	if result, err = Compact(journal, false); err != nil || result != want {
+		t.Fatalf("Compact = %+v, %v; want %+v", result, err, want)
+	}
+	r, err := OpenReader(journal)
+	if err != nil {
+		t.Fatalf("OpenReader: %v", err)
+	}
+	defer r.Close()
+	if _, ok := r.Header(); !ok {
+		t.Fatal("compacted journal lost its header")
+	}
+	kept, err := r.Next()
+	if err != nil || kept.RestorePath != deleted || kept.Action != ActionDelete {
+		t.Fatalf("kept entry = %+v, %v", kept, err)
+	}
+	if _, err := r.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected one entry, got %v", err)
+	}
+}
+
+func TestAppendUniqueDropsTruncatedLine(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "journal.jsonl")
+	first := Entry{HashAlgo: string(dfs.HashSHA256), Hash: "abc", Canonical: "/a", RestorePath: "/b", Action: ActionSymlink}
+	if err := AppendUnique(journal, NewHeader(dmap.ScanInfo{}), []Entry{first}); err != nil {
+		t.Fatalf("AppendUnique create: %v", err)
+	}
+	// An append interrupted mid-line leaves a partial entry behind.
+	file, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	if _, err := file.WriteString(`{"version":2,"hash_algo":"sha`); err != nil {
+		t.Fatalf("write journal: %v", err)
+	}
+	_ = file.Close()
+
+	entries, err := Read(journal)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Read with a truncated last line = %+v, %v", entries, err)
+	}
+
+	second := first
+	second.RestorePath = "/c"
+	if err := AppendUnique(journal, Header{}, []Entry{second}); err != nil {
+		t.Fatalf("AppendUnique: %v", err)
+	}
+	entries, err = Read(journal)
+	if err != nil {
+		t.Fatalf("Read after append: %v", err)
+	}
+	if len(entries) != 2 || entries[1].RestorePath != "/c" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestRestoreSkipsSupersededEntries(t *testing.T) {
+	initTestLogger()
+
+	dir := t.TempDir()
+	older := filepath.Join(dir, "older.bin")
+	newer := filepath.Join(dir, "newer.bin")
+	restorePath := filepath.Join(dir, "copy.bin")
+	mustWriteFile(t, older, "old-data", 0o644)
+	mustWriteFile(t, newer, "new-data", 0o644)
+
+	var entries []Entry
+	for _, canonical := range []string{older, newer} {
+		mustWriteFile(t, restorePath, mustReadFile(t, canonical), 0o644)
+		entry, err := NewEntry(1, dfs.HashSHA256, fileHash(t, canonical, dfs.HashSHA256), canonical, restorePath)
+		if err != nil {
+			t.Fatalf("NewEntry: %v", err)
+		}
+		entry.Action = ActionDelete
+		entries = append(entries, entry)
+	}
+	if err := os.Remove(restorePath); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	journal := filepath.Join(dir, "journal.jsonl")
+	if err := Write(journal, entries); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// Replaying the older entry first would leave the newer one facing
+	// different content without overwrite.
+	if err := RestoreManifest(journal, RestoreOptions{VerifyHash: true}); err != nil {
+		t.Fatalf("RestoreManifest: %v", err)
+	}
+	if got := mustReadFile(t, restorePath); got != "new-data" {
+		t.Fatalf("restored content = %q, want the newest entry's", got)
+	}
+}
+
+func TestCompactDoesNotLoseConcurrentAppends(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "journal.jsonl")
+	entry := func(i int) Entry {
+		return Entry{HashAlgo: string(dfs.HashSHA256), Hash: "abc", Canonical: filepath.Join(dir, "missing"),
+			RestorePath: filepath.Join(dir, fmt.Sprintf("copy-%d", i)), Action: ActionDelete}
+	}
+	if err := AppendUnique(journal, NewHeader(dmap.ScanInfo{}), []Entry{entry(0)}); err != nil {
+		t.Fatalf("AppendUnique create: %v", err)
+	}
+
+	const appends = 50
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= appends; i++ {
+			if err := AppendUnique(journal, Header{}, []Entry{entry(i)}); err != nil {
+				t.Errorf("AppendUnique: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < appends; i++ {
+			if _, err := Compact(journal, false); err != nil {
+				t.Errorf("Compact: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	entries, err := Read(journal)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(entries) != appends+1 {
+		t.Fatalf("journal holds %d entries, want %d", len(entries), appends+1)
+	}
+}
+
+func TestWritersOfSameManifestDoNotShareTempFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.jsonl")
+	entry := Entry{HashAlgo: string(dfs.HashSHA256), Hash: "abc", Canonical: "/a", RestorePath: "/b"}
+
+	first, err := NewWriter(path, NewHeader(dmap.ScanInfo{}))
+	if err != nil {
+		t.Fatalf("NewWriter first: %v", err)
+	}
+	second, err := NewWriter(path, NewHeader(dmap.ScanInfo{}))
+	if err != nil {
+		t.Fatalf("NewWriter second: %v", err)
+	}
+	if err := first.WriteEntry(entry); err != nil {
+		t.Fatalf("WriteEntry: %v", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close first: %v", err)
+	}
+	if err := second.Close(); err != nil {
+		t.Fatalf("Close second: %v", err)
+	}
+
+	entries, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the last writer's empty manifest, got %d entries", len(entries))
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".*.tmp"))
+	if len(leftovers) != 0 {
+		t.Fatalf("temp files left behind: %v", leftovers)
+	}
+}
@@ -2,38 +2,174 @@ package manifest
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 )
 
-func Read(path string) ([]Entry, error) {
+// Reader streams the entries of a manifest one line at a time, so a large
+// journal never has to fit in memory. Format 1 files, which have no header,
+// are read too. A final line without a newline that doesn't decode was cut
+// short by an interrupted append and is skipped.
+type Reader struct {
+	path      string
+	file      *os.File
+	scanner   *bufio.Scanner
+	line      int
+	header    Header
+	hasHeader bool
+	// unterminated is set once the scanner returns a final line that had no
+	// newline.
+	unterminated bool
+	// pending is the first entry of a headerless file, read while looking
+	// for a header.
+	pending *Entry
+}
+
+// OpenReader opens the manifest at path and reads its header, if it has one.
+func OpenReader(path string) (*Reader, error) {
 	file, err := os.Open(path) // #nosec G304 -- caller controls manifest path intentionally
 	if err != nil {
 		return nil, fmt.Errorf("open manifest %s: %w", path, err)
 	}
-	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
 	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	r := &Reader{path: path, file: file, scanner: scanner}
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil && atEOF && bytes.IndexByte(data, '\n') < 0 {
+			r.unterminated = true
+		}
+		return advance, token, err
+	})
 
-	entries := make([]Entry, 0)
-	line := 0
-	for scanner.Scan() {
-		line++
-		raw := strings.TrimSpace(scanner.Text())
-		if raw == "" {
-			continue
+	raw, err := r.nextLine()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return r, nil
 		}
-		var entry Entry
-		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
-			return nil, fmt.Errorf("decode manifest line %d: %w", line, err)
+		_ = file.Close()
+		return nil, err
+	}
+	var probe struct {
+		Format *int `json:"format"`
+	}
+	if err := json.Unmarshal([]byte(raw), &probe); err != nil {
+		if r.unterminated {
+			return r, nil
 		}
-		entries = append(entries, entry)
+		_ = file.Close()
+		return nil, fmt.Errorf("decode manifest line %d: %w", r.line, err)
+	}
+	if probe.Format == nil {
+		entry, err := r.decode(raw)
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		r.pending = &entry
+		return r, nil
+	}
+	if *probe.Format > FormatVersion {
+		_ = file.Close()
+		return nil, fmt.Errorf("manifest %s has unsupported format %d", path, *probe.Format)
+	}
+	if err := json.Unmarshal([]byte(raw), &r.header); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("decode manifest header: %w", err)
+	}
+	r.hasHeader = true
+	return r, nil
+}
+
+// Header returns the manifest's header, and false for a format 1 file.
+func (r *Reader) Header() (Header, bool) {
+	return r.header, r.hasHeader
+}
+
+// Next returns the next entry, or io.EOF after the last one.
+func (r *Reader) Next() (Entry, error) {
+	if r.pending != nil {
+		entry := *r.pending
+		r.pending = nil
+		return entry, nil
+	}
+	raw, err := r.nextLine()
+	if err != nil {
+		return Entry{}, err
+	}
+	entry, err := r.decode(raw)
+	if err != nil && r.unterminated {
+		return Entry{}, io.EOF
+	}
+	return entry, err
+}
+
+// Close closes the manifest file.
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// nextLine returns the next non-blank line, or io.EOF.
+func (r *Reader) nextLine() (string, error) {
+	for r.scanner.Scan() {
+		r.line++
+		if raw := strings.TrimSpace(r.scanner.Text()); raw != "" {
+			return raw, nil
+		}
+	}
+	if err := r.scanner.Err(); err != nil {
+		return "", fmt.Errorf("read manifest %s: %w", r.path, err)
+	}
+	return "", io.EOF
+}
+
+func (r *Reader) decode(raw string) (Entry, error) {
+	var entry Entry
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		return Entry{}, fmt.Errorf("decode manifest line %d: %w", r.line, err)
+	}
+	return entry, nil
+}
+
+// Each streams the entries of the manifest at path to fn, numbering them from
+// zero, and stops at the first error fn returns.
+func Each(path string, fn func(index int, entry Entry) error) error {
+	r, err := OpenReader(path)
+	if err != nil {
+		return err
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("read manifest %s: %w", path, err)
+	defer r.Close()
+
+	for i := 0; ; i++ {
+		entry, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(i, entry); err != nil {
+			return err
+		}
+	}
+}
+
+// Read returns every entry of the manifest at path. Prefer Each for files
+// that may be large.
+func Read(path string) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	err := Each(path, func(_ int, entry Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return entries, nil
 }
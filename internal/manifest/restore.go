@@ -18,15 +18,17 @@ var (
 	ErrSizeMismatch = errors.New("size mismatch")
 )
 
+// RestoreManifest restores the newest entry for every restore path of the
+// manifest at path, in file order. Entries a later one supersedes are
+// skipped.
 func RestoreManifest(path string, opts RestoreOptions) error {
-	entries, err := Read(path)
+	entries, err := newestEntries(path)
 	if err != nil {
 		return err
 	}
-
 	var allErrs []error
-	for i, entry := range entries {
-		if err := restoreEntry(i, entry, opts); err != nil {
+	for _, e := range entries {
+		if err := restoreEntry(e.index, e.entry, opts); err != nil {
 			allErrs = append(allErrs, err)
 		}
 	}
@@ -36,38 +38,59 @@ func RestoreManifest(path string, opts RestoreOptions) error {
 	return nil
 }
 
-func restoreEntry(index int, entry Entry, opts RestoreOptions) error {
-	if entry.Version != 0 && entry.Version != ManifestVersion {
-		return fmt.Errorf("entry %d has unsupported version %d", index+1, entry.Version)
+// resolvedEntry is an entry whose paths were made absolute and whose
+// canonical file was found to be a regular file.
+type resolvedEntry struct {
+	canonical     string
+	restore       string
+	canonicalInfo os.FileInfo
+	algo          dfs.HashAlgorithm
+}
+
+// resolveEntry validates entry and stats its canonical file. index numbers
+// the entry in errors.
+func resolveEntry(index int, entry Entry) (resolvedEntry, error) {
+	if entry.Version != 0 && entry.Version != manifestV1 && entry.Version != ManifestVersion {
+		return resolvedEntry{}, fmt.Errorf("entry %d has unsupported version %d", index+1, entry.Version)
 	}
 	if entry.Canonical == "" {
-		return fmt.Errorf("entry %d has empty canonical path", index+1)
+		return resolvedEntry{}, fmt.Errorf("entry %d has empty canonical path", index+1)
 	}
 	if entry.RestorePath == "" {
-		return fmt.Errorf("entry %d has empty restore path", index+1)
+		return resolvedEntry{}, fmt.Errorf("entry %d has empty restore path", index+1)
 	}
 
 	algo, err := dfs.ParseHashAlgorithm(entry.HashAlgo)
 	if err != nil {
-		return fmt.Errorf("entry %d has invalid hash algorithm %q: %w", index+1, entry.HashAlgo, err)
+		return resolvedEntry{}, fmt.Errorf("entry %d has invalid hash algorithm %q: %w", index+1, entry.HashAlgo, err)
 	}
 
 	canonicalPath, err := filepath.Abs(filepath.Clean(entry.Canonical))
 	if err != nil {
-		return fmt.Errorf("entry %d canonical path resolution failed: %w", index+1, err)
+		return resolvedEntry{}, fmt.Errorf("entry %d canonical path resolution failed: %w", index+1, err)
 	}
 	restorePath, err := filepath.Abs(filepath.Clean(entry.RestorePath))
 	if err != nil {
-		return fmt.Errorf("entry %d restore path resolution failed: %w", index+1, err)
+		return resolvedEntry{}, fmt.Errorf("entry %d restore path resolution failed: %w", index+1, err)
 	}
 
 	canonicalInfo, err := os.Stat(canonicalPath)
 	if err != nil {
-		return fmt.Errorf("entry %d canonical stat failed %s: %w", index+1, canonicalPath, err)
+		return resolvedEntry{}, fmt.Errorf("entry %d canonical stat failed %s: %w", index+1, canonicalPath, err)
 	}
 	if !canonicalInfo.Mode().IsRegular() {
-		return fmt.Errorf("entry %d canonical path is not a regular file: %s", index+1, canonicalPath)
+		return resolvedEntry{}, fmt.Errorf("entry %d canonical path is not a regular file: %s", index+1, canonicalPath)
 	}
+	return resolvedEntry{canonical: canonicalPath, restore: restorePath, canonicalInfo: canonicalInfo, algo: algo}, nil
+}
+
+func restoreEntry(index int, entry Entry, opts RestoreOptions) error {
+	resolved, err := resolveEntry(index, entry)
+	if err != nil {
+		return err
+	}
+	canonicalPath, restorePath := resolved.canonical, resolved.restore
+	canonicalInfo, algo := resolved.canonicalInfo, resolved.algo
 
 	if opts.VerifyHash {
 		if err := VerifyFileHash(canonicalPath, entry.Hash, entry.Size, algo); err != nil {
@@ -84,6 +107,15 @@ func restoreEntry(index int, entry Entry, opts RestoreOptions) error {
 			if err := os.Remove(restorePath); err != nil {
 				return fmt.Errorf("entry %d remove existing restore symlink %s: %w", index+1, restorePath, err)
 			}
+		} else if restorePath != canonicalPath && os.SameFile(canonicalInfo, restoreInfo) {
+			// A hard link to the canonical file: replace it with an
+			// independent copy so the two paths no longer share data.
+			if opts.DryRun {
+				return nil
+			}
+			if err := os.Remove(restorePath); err != nil {
+				return fmt.Errorf("entry %d remove existing restore hard link %s: %w", index+1, restorePath, err)
+			}
 		} else if !restoreInfo.Mode().IsRegular() {
 			return fmt.Errorf("entry %d restore path exists but is not a regular file: %s", index+1, restorePath)
 		} else {
@@ -114,7 +146,7 @@ func restoreEntry(index int, entry Entry, opts RestoreOptions) error {
 
 	mode := canonicalInfo.Mode().Perm()
 	if opts.RestoreMode && entry.Mode != 0 {
-		mode = fs.FileMode(entry.Mode & 0o777)
+		mode = fileMode(entry.Mode)
 	}
 
 	if err := CopyFile(canonicalPath, restorePath, mode); err != nil {
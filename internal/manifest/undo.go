@@ -0,0 +1,198 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+)
+
+// Undo reverses the actions recorded in the journal at path, newest entry
+// first, and writes one line per entry to out. Only the newest entry for each
+// restore path is undone; older ones were superseded by it. The journal is
+// read once, under the lock AppendUnique and Compact take, holding only those
+// newest entries. Every entry is verified before anything is touched: the
+// canonical file must still hash to the recorded digest, and the restore path
+// must still be what the action left behind (a symlink leading to the
+// canonical file, a hard link sharing its inode, or a reflink holding its
+// content). A restore path that already holds the
+// recorded content is left alone; a deduped path always does, since dedupe
+// changes neither content nor metadata. Restored files get back their recorded
+// mode, owner, mtime and extended attributes. Version 1 entries carry no
+// action and are restored as RestoreManifest would, with hash verification.
+func Undo(path string, opts RestoreOptions, out io.Writer) error {
+	entries, err := newestEntries(path)
+	if err != nil {
+		return err
+	}
+
+	var allErrs []error
+	for i := len(entries) - 1; i >= 0; i-- {
+		result, err := undoEntry(entries[i].index, entries[i].entry, opts)
+		if err != nil {
+			allErrs = append(allErrs, err)
+			continue
+		}
+		fmt.Fprintln(out, result)
+	}
+	if len(allErrs) > 0 {
+		return errors.Join(allErrs...)
+	}
+	return nil
+}
+
+// undoEntry reverses a single journal entry and describes what it did.
+func undoEntry(index int, entry Entry, opts RestoreOptions) (string, error) {
+	if entry.Action == "" {
+		opts.VerifyHash = true
+		if err := restoreEntry(index, entry, opts); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("restored %s", entry.RestorePath), nil
+	}
+
+	resolved, err := resolveEntry(index, entry)
+	if err != nil {
+		return "", err
+	}
+	if err := VerifyFileHash(resolved.canonical, entry.Hash, entry.Size, resolved.algo); err != nil {
+		return "", fmt.Errorf("entry %d canonical verify failed: %w", index+1, err)
+	}
+
+	restorePath := resolved.restore
+	info, statErr := os.Lstat(restorePath)
+	exists := statErr == nil
+	if statErr != nil && !errors.Is(statErr, os.ErrNotExist) {
+		return "", fmt.Errorf("entry %d restore path stat failed %s: %w", index+1, restorePath, statErr)
+	}
+
+	// replace is set when the restore path holds what the action left
+	// behind and must give way to a copy.
+	replace := false
+	switch entry.Action {
+	case ActionDelete, ActionReflink, ActionDedupe:
+	case ActionSymlink:
+		if exists && info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(restorePath)
+			if err != nil || !os.SameFile(target, resolved.canonicalInfo) {
+				return "", fmt.Errorf("entry %d restore path %s is a symlink that no longer leads to %s", index+1, restorePath, resolved.canonical)
+			}
+			replace = true
+		}
+	case ActionHardlink:
+		if exists && restorePath != resolved.canonical && os.SameFile(info, resolved.canonicalInfo) {
+			replace = true
+		}
+	default:
+		return "", fmt.Errorf("entry %d has unknown action %q", index+1, entry.Action)
+	}
+
+	if exists && !replace {
+		if !info.Mode().IsRegular() {
+			return "", fmt.Errorf("entry %d restore path exists but is not a regular file: %s", index+1, restorePath)
+		}
+		verifyErr := VerifyFileHash(restorePath, entry.Hash, entry.Size, resolved.algo)
+		switch {
+		case verifyErr == nil && entry.Action == ActionReflink:
+			// The clone is already an independent file; only the metadata
+			// the action replaced needs restoring.
+			if opts.DryRun {
+				return fmt.Sprintf("would restore metadata of %s (reflink)", restorePath), nil
+			}
+			if err := applyEntryMeta(restorePath, entry); err != nil {
+				return "", fmt.Errorf("entry %d restored %s but not all of its metadata: %w", index+1, restorePath, err)
+			}
+			return fmt.Sprintf("restored metadata of %s (reflink)", restorePath), nil
+		case verifyErr == nil:
+			return fmt.Sprintf("skipped %s: already restored", restorePath), nil
+		case !errors.Is(verifyErr, ErrHashMismatch) && !errors.Is(verifyErr, ErrSizeMismatch):
+			return "", fmt.Errorf("entry %d restore-path verify failed: %w", index+1, verifyErr)
+		case !opts.Overwrite:
+			return "", fmt.Errorf("entry %d restore path %s changed since the %s and overwrite is disabled", index+1, restorePath, entry.Action)
+		}
+	}
+
+	if opts.DryRun {
+		return fmt.Sprintf("would undo %s of %s", entry.Action, restorePath), nil
+	}
+	if err := copyOver(resolved.canonical, restorePath, entry); err != nil {
+		return "", fmt.Errorf("entry %d undo %s failed: %w", index+1, entry.Action, err)
+	}
+	return fmt.Sprintf("undid %s of %s", entry.Action, restorePath), nil
+}
+
+// copyOver copies canonical to a temporary name beside restorePath, gives it
+// entry's metadata and renames it into place, so restorePath is replaced in
+// one step. Metadata that couldn't be restored is reported after the rename.
+func copyOver(canonical, restorePath string, entry Entry) error {
+	dir := filepath.Dir(restorePath)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("create directory %s: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, ".dskditto-undo-*")
+	if err != nil {
+		return fmt.Errorf("create temp file in %s: %w", dir, err)
+	}
+	tmpPath := tmp.Name()
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("close temp file %s: %w", tmpPath, err)
+	}
+	// CopyFile creates its destination exclusively; the temp file only
+	// reserved a unique name.
+	if err := os.Remove(tmpPath); err != nil {
+		return fmt.Errorf("prepare temp file %s: %w", tmpPath, err)
+	}
+
+	mode := fs.FileMode(0o600)
+	if entry.Mode != 0 {
+		mode = fileMode(entry.Mode)
+	}
+	if err := CopyFile(canonical, tmpPath, mode); err != nil {
+		return err
+	}
+	metaErr := applyEntryMeta(tmpPath, entry)
+	if err := os.Rename(tmpPath, restorePath); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("rename %s -> %s: %w", tmpPath, restorePath, err)
+	}
+	if metaErr != nil {
+		return fmt.Errorf("restored %s but not all of its metadata: %w", restorePath, metaErr)
+	}
+	return nil
+}
+
+// applyEntryMeta gives path the owner, mode, extended attributes and mtime
+// recorded in entry. It tries each and returns the failures joined.
+func applyEntryMeta(path string, entry Entry) error {
+	var errs []error
+	if entry.Version >= ManifestVersion && runtime.GOOS != "windows" {
+		if err := os.Lchown(path, int(entry.Uid), int(entry.Gid)); err != nil {
+			errs = append(errs, fmt.Errorf("owner: %w", err))
+		}
+	}
+	// chmod after chown, which may clear set-id bits.
+	if entry.Mode != 0 {
+		if err := os.Chmod(path, fileMode(entry.Mode)); err != nil {
+			errs = append(errs, fmt.Errorf("mode: %w", err))
+		}
+	}
+	if len(entry.Xattrs) > 0 {
+		if err := dfs.SetXattrs(path, entry.Xattrs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if entry.ModTimeUnix != 0 {
+		mt := time.Unix(entry.ModTimeUnix, entry.ModTimeNsec)
+		if err := os.Chtimes(path, mt, mt); err != nil {
+			errs = append(errs, fmt.Errorf("mtime: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 )
 
+// Writer writes a new manifest: a header line, then one line per entry. The
+// file replaces path only when Close succeeds.
 type Writer struct {
 	path    string
 	tmpPath string
@@ -16,7 +18,9 @@ type Writer struct {
 	closed  bool
 }
 
-func NewWriter(path string) (*Writer, error) {
+// NewWriter starts a manifest at path with header. A zero header Format is
+// set to FormatVersion.
+func NewWriter(path string, header Header) (*Writer, error) {
 	if path == "" {
 		return nil, errors.New("manifest path is empty")
 	}
@@ -30,15 +34,26 @@ func NewWriter(path string) (*Writer, error) {
 		return nil, fmt.Errorf("create manifest directory %s: %w", dir, err)
 	}
 
-	tmpPath := absPath + ".tmp"
-	file, err := openCreateTruncate(tmpPath, 0o600)
+	// A unique name keeps writers of the same manifest, in this process or
+	// another, from truncating each other's rewrite.
+	file, err := os.CreateTemp(dir, "."+filepath.Base(absPath)+".*.tmp")
 	if err != nil {
-		return nil, fmt.Errorf("open temp manifest %s: %w", tmpPath, err)
+		return nil, fmt.Errorf("create temp manifest in %s: %w", dir, err)
 	}
+	tmpPath := file.Name()
 
 	enc := json.NewEncoder(file)
 	enc.SetEscapeHTML(false)
 
+	if header.Format == 0 {
+		header.Format = FormatVersion
+	}
+	if err := enc.Encode(header); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmpPath)
+		return nil, fmt.Errorf("encode manifest header: %w", err)
+	}
+
 	return &Writer{
 		path:    absPath,
 		tmpPath: tmpPath,
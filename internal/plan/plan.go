@@ -0,0 +1,165 @@
+// Package plan reads and writes action plans: reviewable JSON files listing
+// every delete, link, reflink, hard link or dedupe a duplicate action intends
+// to make, so the change can be generated in one run, checked or edited by
+// hand, and applied in another.
+package plan
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/manifest"
+)
+
+// Version is the plan format version written by Write.
+const Version = 1
+
+// Action names what a step does to its path.
+type Action string
+
+const (
+	Delete   Action = "delete"
+	Link     Action = "link"
+	Reflink  Action = "reflink"
+	Hardlink Action = "hardlink"
+	Dedupe   Action = "dedupe"
+)
+
+// ErrStale indicates a file no longer matches what the plan recorded.
+var ErrStale = errors.New("file changed since the plan was made")
+
+// Step is one intended change: Path is deleted or replaced by a link to
+// Target, the copy that is kept. Size, MTime and Hash describe Path when the
+// plan was made; Target must still hash the same.
+type Step struct {
+	Action Action    `json:"action"`
+	Path   string    `json:"path"`
+	Target string    `json:"target"`
+	Size   int64     `json:"size"`
+	MTime  time.Time `json:"mtime"`
+	Hash   string    `json:"hash"`
+}
+
+// Plan is the document written by Write. Removing a step from Steps drops
+// that change; changing its Action switches what is done.
+type Plan struct {
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"created_at"`
+	HashAlgo  dfs.HashAlgorithm `json:"hash_algo"`
+	LinkStyle dfs.LinkStyle     `json:"link_style,omitempty"`
+	Steps     []Step            `json:"steps"`
+}
+
+// Write saves p to path as indented JSON so it can be reviewed and edited.
+func Write(path string, p Plan) error {
+	if path == "" {
+		return errors.New("plan path is empty")
+	}
+	if p.Version == 0 {
+		p.Version = Version
+	}
+	if p.Steps == nil {
+		p.Steps = []Step{}
+	}
+	file, err := os.OpenFile(filepath.Clean(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600) // #nosec G304 -- caller controls plan path intentionally
+	if err != nil {
+		return fmt.Errorf("create plan %s: %w", path, err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(p); err != nil {
+		return fmt.Errorf("encode plan %s: %w", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write plan %s: %w", path, err)
+	}
+	return file.Sync()
+}
+
+// Read loads a plan written by Write and checks that every step is complete.
+func Read(path string) (Plan, error) {
+	file, err := os.Open(filepath.Clean(path)) // #nosec G304 -- caller controls plan path intentionally
+	if err != nil {
+		return Plan{}, fmt.Errorf("open plan %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var p Plan
+	dec := json.NewDecoder(bufio.NewReader(file))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return Plan{}, fmt.Errorf("decode plan %s: %w", path, err)
+	}
+	if p.Version != Version {
+		return Plan{}, fmt.Errorf("unsupported plan version %d in %s", p.Version, path)
+	}
+	if _, err := dfs.ParseHashAlgorithm(string(p.HashAlgo)); err != nil {
+		return Plan{}, fmt.Errorf("plan %s: %w", path, err)
+	}
+	if _, err := dfs.ParseLinkStyle(string(p.LinkStyle)); err != nil {
+		return Plan{}, fmt.Errorf("plan %s: %w", path, err)
+	}
+	for i, step := range p.Steps {
+		if err := step.validate(); err != nil {
+			return Plan{}, fmt.Errorf("plan %s step %d: %w", path, i+1, err)
+		}
+	}
+	return p, nil
+}
+
+func (s Step) validate() error {
+	switch s.Action {
+	case Delete, Link, Reflink, Hardlink, Dedupe:
+	default:
+		return fmt.Errorf("unknown action %q (want delete, link, reflink, hardlink or dedupe)", s.Action)
+	}
+	if s.Path == "" || s.Target == "" {
+		return errors.New("path and target are required")
+	}
+	if filepath.Clean(s.Path) == filepath.Clean(s.Target) {
+		return fmt.Errorf("%s is its own target", s.Path)
+	}
+	if s.Hash == "" {
+		return errors.New("hash is required")
+	}
+	return nil
+}
+
+// Verify re-checks the step against the filesystem: Path must still be a
+// regular file with the recorded size, mtime and hash, and Target a regular
+// file with the same content. Mismatches wrap ErrStale.
+func (s Step) Verify(algo dfs.HashAlgorithm) error {
+	info, err := os.Lstat(s.Path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrStale, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is no longer a regular file", ErrStale, s.Path)
+	}
+	if info.Size() != s.Size || !info.ModTime().Equal(s.MTime) {
+		return fmt.Errorf("%w: %s size or mtime differs", ErrStale, s.Path)
+	}
+	targetInfo, err := os.Lstat(s.Target)
+	if err != nil {
+		return fmt.Errorf("%w: target %v", ErrStale, err)
+	}
+	if !targetInfo.Mode().IsRegular() {
+		return fmt.Errorf("%w: target %s is no longer a regular file", ErrStale, s.Target)
+	}
+	for _, path := range []string{s.Path, s.Target} {
+		if err := manifest.VerifyFileHash(path, s.Hash, s.Size, algo); err != nil {
+			return fmt.Errorf("%w: %v", ErrStale, err)
+		}
+	}
+	return nil
+}
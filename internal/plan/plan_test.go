@@ -0,0 +1,115 @@
+package plan
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/internal/dsklog"
+)
+
+func initTestLogger() {
+	dsklog.InitializeDlogger("/dev/null")
+}
+
+func writeStepFiles(t *testing.T, dir, content string) Step {
+	t.Helper()
+	initTestLogger()
+	path := filepath.Join(dir, "dup.txt")
+	target := filepath.Join(dir, "keep.txt")
+	for _, p := range []string{path, target} {
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", p, err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	df, err := dfs.NewDfile(path, info.Size(), dfs.HashSHA256)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	return Step{
+		Action: Delete,
+		Path:   path,
+		Target: target,
+		Size:   info.Size(),
+		MTime:  info.ModTime(),
+		Hash:   df.HashString(),
+	}
+}
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	step := writeStepFiles(t, dir, "same")
+	path := filepath.Join(dir, "plan.json")
+	want := Plan{
+		CreatedAt: time.Now(),
+		HashAlgo:  dfs.HashSHA256,
+		LinkStyle: dfs.LinkRelative,
+		Steps:     []Step{step},
+	}
+	if err := Write(path, want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got.Version != Version || got.HashAlgo != want.HashAlgo || got.LinkStyle != want.LinkStyle {
+		t.Fatalf("header mismatch: %+v", got)
+	}
+	if len(got.Steps) != 1 || got.Steps[0].Path != step.Path || !got.Steps[0].MTime.Equal(step.MTime) {
+		t.Fatalf("steps mismatch: %+v", got.Steps)
+	}
+}
+
+func TestReadRejectsInvalidSteps(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"action":  `{"version":1,"hash_algo":"sha256","steps":[{"action":"shred","path":"/a","target":"/b","hash":"00"}]}`,
+		"self":    `{"version":1,"hash_algo":"sha256","steps":[{"action":"delete","path":"/a","target":"/a","hash":"00"}]}`,
+		"version": `{"version":9,"hash_algo":"sha256","steps":[]}`,
+		"unknown": `{"version":1,"hash_algo":"sha256","steps":[],"extra":true}`,
+	}
+	for name, body := range cases {
+		path := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := Read(path); err == nil {
+			t.Fatalf("%s: expected Read to fail", name)
+		}
+	}
+}
+
+func TestStepVerifyDetectsChanges(t *testing.T) {
+	dir := t.TempDir()
+	step := writeStepFiles(t, dir, "same")
+	if err := step.Verify(dfs.HashSHA256); err != nil {
+		t.Fatalf("fresh step should verify: %v", err)
+	}
+
+	// Same size and restored mtime, different content.
+	if err := os.WriteFile(step.Path, []byte("diff"), 0o644); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	if err := os.Chtimes(step.Path, step.MTime, step.MTime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := step.Verify(dfs.HashSHA256); !errors.Is(err, ErrStale) {
+		t.Fatalf("expected ErrStale for changed content, got %v", err)
+	}
+
+	step = writeStepFiles(t, dir, "same")
+	if err := os.Remove(step.Target); err != nil {
+		t.Fatalf("remove target: %v", err)
+	}
+	if err := step.Verify(dfs.HashSHA256); !errors.Is(err, ErrStale) {
+		t.Fatalf("expected ErrStale for missing target, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package plan
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+	"github.com/jdefrancesco/dskDitto/pkg/utils"
+)
+
+// scriptTempSuffix names the link a step creates beside its path before
+// renaming it over the duplicate.
+const scriptTempSuffix = ".dskditto-tmp"
+
+// scriptPrelude defines check, which every step calls first: it aborts the
+// script unless both files are still regular files with identical content.
+const scriptPrelude = `set -eu
+
+check() {
+	if [ ! -f "$1" ] || [ -L "$1" ] || [ ! -f "$2" ] || [ -L "$2" ] || ! cmp -s -- "$1" "$2"; then
+		printf 'dskDitto: %s no longer matches %s; aborting\n' "$2" "$1" >&2
+		exit 1
+	fi
+}
+`
+
+// WriteScript saves p to path as a POSIX shell script that performs its
+// steps with rm, ln and mv. Each step first compares its path with its target
+// using cmp and aborts the script if they differ. roots are listed in the
+// header. Reflink and dedupe steps have no portable command and are
+// rejected.
+func WriteScript(path string, p Plan, roots []string) error {
+	if path == "" {
+		return errors.New("script path is empty")
+	}
+	var body strings.Builder
+	var reclaim uint64
+	targets := make(map[string]bool)
+	for i, step := range p.Steps {
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		cmds, err := stepCommands(step, p.LinkStyle)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		fmt.Fprintf(&body, "\n# %s %s\n", step.Action, strconv.Quote(step.Path))
+		fmt.Fprintf(&body, "check %s %s\n", shellQuote(step.Target), shellQuote(step.Path))
+		for _, cmd := range cmds {
+			body.WriteString(cmd)
+			body.WriteByte('\n')
+		}
+		targets[step.Target] = true
+		if step.Size > 0 {
+			reclaim += uint64(step.Size)
+		}
+	}
+
+	file, err := os.OpenFile(filepath.Clean(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600) // #nosec G304 -- caller controls script path intentionally
+	if err != nil {
+		return fmt.Errorf("create script %s: %w", path, err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, "#!/bin/sh")
+	fmt.Fprintf(w, "# Generated by dskDitto on %s.\n", time.Now().Format(time.DateTime))
+	for _, root := range roots {
+		fmt.Fprintf(w, "# Scanned: %s\n", strconv.Quote(root))
+	}
+	fmt.Fprintf(w, "# %d step(s) across %d duplicate group(s), reclaiming up to %s (%d bytes).\n",
+		len(p.Steps), len(targets), utils.DisplaySize(reclaim), reclaim)
+	fmt.Fprintln(w, "# Review every step before running this script with: sh <file>")
+	fmt.Fprintln(w)
+	w.WriteString(scriptPrelude)
+	w.WriteString(body.String())
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write script %s: %w", path, err)
+	}
+	return file.Sync()
+}
+
+// stepCommands returns the shell commands that carry out step. Links are
+// created under a temporary name and renamed over the duplicate, so it is
+// never missing.
+func stepCommands(step Step, style dfs.LinkStyle) ([]string, error) {
+	path := shellQuote(step.Path)
+	tmp := shellQuote(step.Path + scriptTempSuffix)
+	switch step.Action {
+	case Delete:
+		return []string{"rm -f -- " + path}, nil
+	case Link:
+		text, err := dfs.SymlinkText(step.Path, step.Target, style)
+		if err != nil {
+			return nil, fmt.Errorf("symlink %s -> %s: %w", step.Path, step.Target, err)
+		}
+		return []string{
+			"ln -s -- " + shellQuote(text) + " " + tmp,
+			"mv -f -- " + tmp + " " + path,
+		}, nil
+	case Hardlink:
+		return []string{
+			"ln -- " + shellQuote(step.Target) + " " + tmp,
+			"mv -f -- " + tmp + " " + path,
+		}, nil
+	}
+	return nil, fmt.Errorf("%s steps have no portable shell command", step.Action)
+}
+
+// shellQuote quotes s for a POSIX shell. Everything inside single quotes is
+// literal, newlines included, so only single quotes need escaping.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,100 @@
+package plan
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jdefrancesco/dskDitto/internal/dfs"
+)
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"plain":     "'plain'",
+		"it's":      `'it'\''s'`,
+		"two\nline": "'two\nline'",
+		"$HOME `x`": "'$HOME `x`'",
+	}
+	for in, want := range cases {
+		if got := shellQuote(in); got != want {
+			t.Fatalf("shellQuote(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestWriteScriptRunsWithAwkwardNames(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	dir := t.TempDir()
+	step := writeStepFiles(t, dir, "same")
+	odd := filepath.Join(dir, "it's a\nnew $file")
+	if err := os.Rename(step.Path, odd); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	step.Path = odd
+	linked := step
+	linked.Path = filepath.Join(dir, "-linked")
+	if err := os.WriteFile(linked.Path, []byte("same"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	linked.Action = Link
+
+	script := filepath.Join(dir, "dedupe.sh")
+	p := Plan{HashAlgo: dfs.HashSHA256, LinkStyle: dfs.LinkRelative, Steps: []Step{step, linked}}
+	if err := WriteScript(script, p, []string{dir}); err != nil {
+		t.Fatalf("WriteScript: %v", err)
+	}
+	data, err := os.ReadFile(script)
+	if err != nil {
+		t.Fatalf("read script: %v", err)
+	}
+	if !strings.Contains(string(data), "2 step(s) across 1 duplicate group(s), reclaiming up to 8 B") {
+		t.Fatalf("header missing summary:\n%s", data)
+	}
+
+	if out, err := exec.Command(sh, script).CombinedOutput(); err != nil {
+		t.Fatalf("script failed: %v\n%s", err, out)
+	}
+	if _, err := os.Lstat(odd); !os.IsNotExist(err) {
+		t.Fatalf("duplicate with odd name should be removed, err=%v", err)
+	}
+	text, err := os.Readlink(linked.Path)
+	if err != nil || text != "keep.txt" {
+		t.Fatalf("expected relative link to keep.txt, got %q (%v)", text, err)
+	}
+}
+
+func TestWriteScriptAbortsOnMismatch(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	dir := t.TempDir()
+	step := writeStepFiles(t, dir, "same")
+	script := filepath.Join(dir, "dedupe.sh")
+	if err := WriteScript(script, Plan{Steps: []Step{step}}, nil); err != nil {
+		t.Fatalf("WriteScript: %v", err)
+	}
+	if err := os.WriteFile(step.Path, []byte("edit"), 0o644); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	if err := exec.Command(sh, script).Run(); err == nil {
+		t.Fatal("expected the script to abort")
+	}
+	if _, err := os.Stat(step.Path); err != nil {
+		t.Fatalf("changed duplicate must survive: %v", err)
+	}
+}
+
+func TestWriteScriptRejectsReflink(t *testing.T) {
+	dir := t.TempDir()
+	step := writeStepFiles(t, dir, "same")
+	step.Action = Reflink
+	if err := WriteScript(filepath.Join(dir, "s.sh"), Plan{Steps: []Step{step}}, nil); err == nil {
+		t.Fatal("expected reflink steps to be rejected")
+	}
+}
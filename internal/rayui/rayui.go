@@ -223,6 +223,8 @@ func (a *app) updateKeyboard() {
 		a.goToStart()
 	case rl.IsKeyPressed(rl.KeyEnd):
 		a.goToEnd()
+	case rl.IsKeyPressed(rl.KeyH) && shiftDown():
+		a.startConfirmation(dupview.ActionHardlink)
 	case rl.IsKeyPressed(rl.KeyLeft) || rl.IsKeyPressed(rl.KeyH):
 		a.collapseCurrentGroup()
 	case rl.IsKeyPressed(rl.KeyRight):
@@ -235,6 +237,8 @@ func (a *app) updateKeyboard() {
 		}
 	case rl.IsKeyPressed(rl.KeyR) && shiftDown():
 		a.startConfirmation(dupview.ActionReflink)
+	case rl.IsKeyPressed(rl.KeyD) && shiftDown():
+		a.startConfirmation(dupview.ActionDedupe)
 	case rl.IsKeyPressed(rl.KeyEnter):
 		a.toggleCurrentGroup()
 	case rl.IsKeyPressed(rl.KeySpace) || rl.IsKeyPressed(rl.KeyM):
@@ -421,9 +425,15 @@ func (a *app) drawRow(ref nodeRef, rect rl.Rectangle, selected bool) {
 		drawCheckbox(box, entry.Marked)
 
 		path := entry.Path
+		if a.results.Groups[ref.group].MatchInfo.Type.IsDirectory() {
+			path += string(filepath.Separator)
+		}
 		if dupview.IsSymlink(entry.Path) {
 			path += " [symlink]"
 		}
+		if note := entry.Info.Annotation(); note != "" {
+			path += " " + note
+		}
 		status := fileStatusLabel(entry)
 		statusWidth := measureText(status, a.layout.smallSize)
 		pathMax := rect.Width - 82 - statusWidth
@@ -526,6 +536,10 @@ func (a *app) drawSidebarDetails(panel rl.Rectangle, group *dupview.Group) {
 	drawText(fmt.Sprintf("%d files", len(group.Files)), panel.X+18, y, 18, colorText)
 	y += 28
 	drawText(utils.DisplaySize(group.TotalSz), panel.X+18, y, 18, colorText)
+	y += 28
+	drawText(utils.DisplaySize(group.DiskSz)+" on disk", panel.X+18, y, 18, colorMuted)
+	y += 28
+	drawText(utils.DisplaySize(group.ReclaimableSz)+" reclaimable", panel.X+18, y, 18, colorMuted)
 	y += 34
 
 	hash := groupKeyValue(group)
@@ -573,7 +587,19 @@ func (a *app) drawConfirmModal() {
 	height := float32(rl.GetScreenHeight())
 	rl.DrawRectangleRec(rl.NewRectangle(0, 0, width, height), rl.NewColor(15, 23, 42, 135))
 
-	panel := rl.NewRectangle(width/2-235, height/2-126, 470, 252)
+	// The preview lists what each group would lose, as many lines as fit
+	// beside the fixed rows of the panel.
+	const previewLineHeight = 18
+	preview := dupview.BuildPreview(a.results.Groups, a.action, a.applyOptions)
+	lines := preview.GroupLines()
+	rows := max(int((height-80-278)/previewLineHeight), 1)
+	if len(lines) > rows {
+		more := len(lines) - rows + 1
+		lines = append(lines[:rows-1:rows-1], fmt.Sprintf("… and %d more line(s)", more))
+	}
+	panelWidth := min(max(width-80, 470), 720)
+	panelHeight := 278 + float32(len(lines))*previewLineHeight
+	panel := rl.NewRectangle(width/2-panelWidth/2, height/2-panelHeight/2, panelWidth, panelHeight)
 	rl.DrawRectangleRounded(panel, 0.04, 8, colorSurface)
 	rl.DrawRectangleRoundedLinesEx(panel, 0.04, 8, 1, colorBorder)
 
@@ -586,14 +612,34 @@ func (a *app) drawConfirmModal() {
 	case dupview.ActionReflink:
 		title = "Confirm Reflink Conversion"
 		verb = "convert to reflinks (copy-on-write clones)"
+	case dupview.ActionHardlink:
+		title = "Confirm Hard Link Conversion"
+		verb = "convert to hard links"
+	case dupview.ActionDedupe:
+		title = "Confirm Dedupe"
+		verb = "share data in place (kernel-verified dedupe) for"
+	}
+	prompt := fmt.Sprintf("You are about to %s %d file(s).", verb, dupview.CountMarked(a.results.Groups))
+	if dest := a.applyOptions.Disposal.Destination(); dest != "" && a.action == dupview.ActionDelete {
+		prompt = fmt.Sprintf("You are about to move %d file(s) to %s.", dupview.CountMarked(a.results.Groups), dest)
+	}
+	if a.applyOptions.DryRun {
+		title += " (dry run)"
 	}
 
 	x := panel.X + 24
 	y := panel.Y + 22
+	textWidth := panel.Width - 48
 	drawText(title, x, y, 22, colorText)
 	y += 42
-	drawText(fmt.Sprintf("You are about to %s %d file(s).", verb, dupview.CountMarked(a.results.Groups)), x, y, 16, colorMuted)
-	y += 36
+	drawText(truncateText(prompt, 16, textWidth), x, y, 16, colorMuted)
+	y += 28
+	for _, line := range lines {
+		drawText(truncateText(line, 14, textWidth), x, y, 14, colorText)
+		y += previewLineHeight
+	}
+	drawText(truncateText(preview.Summary(), 15, textWidth), x, y, 15, colorMuted)
+	y += 34
 	drawText("Confirmation code", x, y, 15, colorMuted)
 	y += 24
 	drawText(a.confirmCode, x, y, 24, colorMarked)
@@ -699,6 +745,8 @@ func (a *app) buildToolbarButtons(width, margin, gap float32) ([]button, float32
 		{id: "delete", label: "Delete", enabled: marked > 0, danger: true},
 		{id: "link", label: "Link", enabled: marked > 0, primary: true},
 		{id: "reflink", label: "Reflink", enabled: marked > 0, primary: true},
+		{id: "hardlink", label: "Hard link", enabled: marked > 0, primary: true},
+		{id: "dedupe", label: "Dedupe", enabled: marked > 0, primary: true},
 	}
 
 	buttons := make([]button, 0, len(viewSpecs)+len(actionSpecs))
@@ -774,6 +822,10 @@ func (a *app) handleButton(id string) {
 		a.startConfirmation(dupview.ActionLink)
 	case "reflink":
 		a.startConfirmation(dupview.ActionReflink)
+	case "hardlink":
+		a.startConfirmation(dupview.ActionHardlink)
+	case "dedupe":
+		a.startConfirmation(dupview.ActionDedupe)
 	case "sort":
 		a.results.CycleSortMode()
 		a.rebuildVisibleNodes()
@@ -920,7 +972,7 @@ func (a *app) toggleCurrentFileMark() {
 		return
 	}
 	entry := a.results.Groups[node.group].Files[node.file]
-	if entry.Status == dupview.FileStatusDeleted {
+	if entry.Status == dupview.FileStatusDeleted || entry.Info.Stale {
 		return
 	}
 	entry.Marked = !entry.Marked
@@ -1375,7 +1427,7 @@ func formatCompactGroupTitle(group *dupview.Group) string {
 	if group == nil {
 		return ""
 	}
-	return fmt.Sprintf("%s - %d files - approx. %s", groupKeyText(group), len(group.Files), utils.DisplaySize(group.TotalSz))
+	return fmt.Sprintf("%s - %d files - approx. %s", groupKeyText(group), len(group.Files), utils.DisplaySize(group.TotalSz)) + dupview.FormatGroupRoots(group.Roots)
 }
 
 func hashPrefix(group *dupview.Group) string {
@@ -1396,6 +1448,15 @@ func groupKeyLabel(group *dupview.Group) string {
 	if group != nil && group.MatchInfo.Type == dmap.MatchFuzzy {
 		return "Similarity"
 	}
+	if group != nil && group.MatchInfo.Type == dmap.MatchZeroFilled {
+		return "Zero-filled"
+	}
+	if group != nil && group.MatchInfo.Type == dmap.MatchDirTree {
+		return "Directory tree"
+	}
+	if group != nil && group.MatchInfo.Type == dmap.MatchDirSuperset {
+		return "Superset"
+	}
 	return "Hash prefix"
 }
 
@@ -1409,6 +1470,9 @@ func groupKeyValue(group *dupview.Group) string {
 	if group.MatchInfo.Type == dmap.MatchFuzzy {
 		return group.MatchInfo.Key
 	}
+	if group.MatchInfo.Type == dmap.MatchDirSuperset {
+		return group.MatchInfo.Key
+	}
 	return hashPrefix(group)
 }
 
@@ -1422,6 +1486,15 @@ func groupKeyText(group *dupview.Group) string {
 	if group.MatchInfo.Type == dmap.MatchFuzzy {
 		return "Similar: " + group.MatchInfo.Key
 	}
+	if group.MatchInfo.Type == dmap.MatchZeroFilled {
+		return "Zero-filled: " + hashPrefix(group)
+	}
+	if group.MatchInfo.Type == dmap.MatchDirTree {
+		return "Directory tree: " + hashPrefix(group)
+	}
+	if group.MatchInfo.Type == dmap.MatchDirSuperset {
+		return "Superset: " + group.MatchInfo.Key
+	}
 	return hashPrefix(group)
 }
 
@@ -1429,11 +1502,11 @@ func groupKeyText(group *dupview.Group) string {
 func footerHelp(width float32) string {
 	switch {
 	case width < 850:
-		return "arrows navigate | home/end jump | space marks | d delete | shift+L link | shift+R reflink | q exits"
+		return "arrows navigate | home/end jump | space marks | d delete | shift+L link | shift+R reflink | shift+H hard link | shift+D dedupe | q exits"
 	case width < 1180:
 		return "jk arrows navigate | home/end jump | enter folds | space marks | a mark all | u clear | d delete | q exits"
 	default:
-		return "jk arrows navigate | home/end jump | enter folds | space/m mark | a mark all | u clear | d delete | shift+L link | shift+R reflink | q exits"
+		return "jk arrows navigate | home/end jump | enter folds | space/m mark | a mark all | u clear | d delete | shift+L link | shift+R reflink | shift+H hard link | shift+D dedupe | q exits"
 	}
 }
 
@@ -1453,6 +1526,10 @@ func fileStatusLabel(entry *dupview.FileEntry) string {
 		return "LINKED"
 	case dupview.FileStatusReflinked:
 		return "REFLINK"
+	case dupview.FileStatusHardlinked:
+		return "HARDLINK"
+	case dupview.FileStatusDeduped:
+		return "DEDUPED"
 	case dupview.FileStatusError:
 		if entry.Message != "" {
 			return "ERROR: " + entry.Message
@@ -1465,7 +1542,7 @@ func fileStatusLabel(entry *dupview.FileEntry) string {
 
 func fileStatusColor(entry *dupview.FileEntry) rl.Color {
 	switch entry.Status {
-	case dupview.FileStatusDeleted, dupview.FileStatusLinked, dupview.FileStatusReflinked:
+	case dupview.FileStatusDeleted, dupview.FileStatusLinked, dupview.FileStatusReflinked, dupview.FileStatusHardlinked, dupview.FileStatusDeduped:
 		return colorSuccess
 	case dupview.FileStatusError:
 		return colorDanger
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -170,19 +171,23 @@ const (
 type fileStatus = dupview.FileStatus
 
 const (
-	fileStatusPending   = dupview.FileStatusPending
-	fileStatusDeleted   = dupview.FileStatusDeleted
-	fileStatusLinked    = dupview.FileStatusLinked
-	fileStatusReflinked = dupview.FileStatusReflinked
-	fileStatusError     = dupview.FileStatusError
+	fileStatusPending    = dupview.FileStatusPending
+	fileStatusDeleted    = dupview.FileStatusDeleted
+	fileStatusLinked     = dupview.FileStatusLinked
+	fileStatusReflinked  = dupview.FileStatusReflinked
+	fileStatusHardlinked = dupview.FileStatusHardlinked
+	fileStatusDeduped    = dupview.FileStatusDeduped
+	fileStatusError      = dupview.FileStatusError
 )
 
 type confirmAction = dupview.Action
 
 const (
-	confirmDelete  = dupview.ActionDelete
-	confirmLink    = dupview.ActionLink
-	confirmReflink = dupview.ActionReflink
+	confirmDelete   = dupview.ActionDelete
+	confirmLink     = dupview.ActionLink
+	confirmReflink  = dupview.ActionReflink
+	confirmHardlink = dupview.ActionHardlink
+	confirmDedupe   = dupview.ActionDedupe
 )
 
 type fileEntry = dupview.FileEntry
@@ -355,6 +360,12 @@ func (m *model) handleTreeKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case "R":
 		m.startConfirmationPrompt(confirmReflink)
 
+	case "H":
+		m.startConfirmationPrompt(confirmHardlink)
+
+	case "D":
+		m.startConfirmationPrompt(confirmDedupe)
+
 	case "1":
 		m.setSortMode(sortByTotalSize)
 
@@ -501,8 +512,10 @@ func (m *model) renderTreeView() string {
 	countStr := fmt.Sprintf("%d", m.countMarked())
 	markedLabel := "marked files: "
 	countStyled := markedStyle.Render(countStr)
+	reclaimStr := utils.DisplaySize(dupview.TotalReclaimable(m.groups))
 	sections = append(sections,
-		footerStyle.Render(markedLabel)+countStyled,
+		footerStyle.Render(markedLabel)+countStyled+
+			footerStyle.Render(" • reclaimable: ")+markedStyle.Render(reclaimStr),
 	)
 	if m.deleteResult != "" {
 		sections = append(sections, resultStyle.Render(m.deleteResult))
@@ -527,25 +540,71 @@ func (m *model) renderConfirmView() string {
 	case confirmReflink:
 		title = "Confirm Reflink Conversion"
 		verb = "convert to reflinks (copy-on-write clones)"
-	}
-	content := []string{
+	case confirmHardlink:
+		title = "Confirm Hard Link Conversion"
+		verb = "convert to hard links"
+	case confirmDedupe:
+		title = "Confirm Dedupe"
+		verb = "share data in place (kernel-verified dedupe) for"
+	}
+	prompt := fmt.Sprintf("You are about to %s %d file(s).", verb, m.countMarked())
+	if dest := m.applyOptions.Disposal.Destination(); dest != "" && m.action == confirmDelete {
+		prompt = fmt.Sprintf("You are about to move %d file(s) to %s.", m.countMarked(), dest)
+	}
+	if m.applyOptions.DryRun {
+		title += " (dry run)"
+	}
+	preview := dupview.BuildPreview(m.groups, m.action, m.applyOptions)
+	head := []string{
 		titleStyle.Render(title),
-		statusInfoStyle.Render(fmt.Sprintf("You are about to %s %d file(s).", verb, m.countMarked())),
+		statusInfoStyle.Render(prompt),
+		"",
+	}
+	tail := []string{
+		statusInfoStyle.Render(preview.Summary()),
 		"",
 		fmt.Sprintf("Confirmation code: %s", confirmCodeStyle.Render(m.confirmCode)),
 		fmt.Sprintf("Your input: %s", confirmInputStyle.Render(m.confirmInput)),
 	}
-
 	if m.confirmError != "" {
-		content = append(content, "", errorTextStyle.Render(m.confirmError))
+		tail = append(tail, "", errorTextStyle.Render(m.confirmError))
 	}
+	tail = append(tail, "", footerStyle.Render("Enter confirms • Esc cancels"))
 
-	content = append(content, "", footerStyle.Render("Enter confirms • Esc cancels"))
-	panel := confirmPanelStyle.Width(min(width, 80)).Render(strings.Join(content, "\n"))
+	render := func(lines []string) string {
+		content := append(append(append([]string{}, head...), lines...), tail...)
+		return confirmPanelStyle.Width(min(width, 80)).Render(strings.Join(content, "\n"))
+	}
+	h := m.height
+	if h <= 0 {
+		h = 24
+	}
+	// The preview gets the rows the rest of the panel, as rendered, leaves
+	// free, less the blank line after it.
+	rows := max(h-lipgloss.Height(render(nil))-1, 2)
+	panel := render(previewLines(preview, min(width, 80)-6, rows))
 	renderWidth := max(width, lipgloss.Width(panel))
 	return lipgloss.Place(renderWidth, lipgloss.Height(panel), lipgloss.Center, lipgloss.Center, panel)
 }
 
+// previewLines returns the per-group lines of preview, cut to maxWidth and to
+// at most rows lines, followed by a blank line.
+func previewLines(preview dupview.Preview, maxWidth, rows int) []string {
+	lines := preview.GroupLines()
+	if len(lines) > rows {
+		more := len(lines) - rows + 1
+		lines = append(lines[:rows-1:rows-1], fmt.Sprintf("… and %d more line(s)", more))
+	}
+	out := make([]string, 0, len(lines)+1)
+	for _, line := range lines {
+		if runewidth.StringWidth(line) > maxWidth {
+			line = runewidth.Truncate(line, maxWidth, "…")
+		}
+		out = append(out, line)
+	}
+	return append(out, "")
+}
+
 // moveCursor moves the indicator on the left of the listed items.
 func (m *model) moveCursor(delta int) {
 	if len(m.visible) == 0 {
@@ -656,7 +715,7 @@ func (m *model) toggleCurrentFileMark() {
 	}
 
 	entry := m.groups[node.group].Files[node.file]
-	if entry.Status == fileStatusDeleted {
+	if entry.Status == fileStatusDeleted || entry.Info.Stale {
 		return
 	}
 
@@ -700,6 +759,10 @@ func (m *model) processConfirmedAction() {
 		m.processLinking()
 	case confirmReflink:
 		m.processReflink()
+	case confirmHardlink:
+		m.processHardlink()
+	case confirmDedupe:
+		m.processDedupe()
 	default:
 		m.processDeletion()
 	}
@@ -743,6 +806,30 @@ func (m *model) processReflink() {
 	m.deleteResult = result
 }
 
+func (m *model) processHardlink() {
+	m.mode = modeTree
+	m.confirmInput = ""
+	m.confirmError = ""
+	result, err := dupview.ApplyMarked(m.groups, dupview.ActionHardlink, m.applyOptions)
+	if err != nil {
+		m.deleteResult = err.Error()
+		return
+	}
+	m.deleteResult = result
+}
+
+func (m *model) processDedupe() {
+	m.mode = modeTree
+	m.confirmInput = ""
+	m.confirmError = ""
+	result, err := dupview.ApplyMarked(m.groups, dupview.ActionDedupe, m.applyOptions)
+	if err != nil {
+		m.deleteResult = err.Error()
+		return
+	}
+	m.deleteResult = result
+}
+
 // markedEntries return a slice of files selected (marked) for removal.
 func (m *model) markedEntries() []*fileEntry {
 	return dupview.MarkedEntries(m.groups)
@@ -829,11 +916,17 @@ func (m *model) renderNodeLine(ref nodeRef, selected bool) string {
 		used := lipgloss.Width(markStr) + lipgloss.Width(statusStr)
 		pathMax := max(avail-used, 1)
 		path := entry.Path
+		if m.groups[ref.group].MatchInfo.Type.IsDirectory() {
+			path += string(filepath.Separator)
+		}
 		// If this path is currently a symlink on disk, annotate it so the user
 		// can distinguish converted duplicates.
 		if dupview.IsSymlink(entry.Path) {
 			path += " [symlink]"
 		}
+		if note := entry.Info.Annotation(); note != "" {
+			path += " " + note
+		}
 		if runewidth.StringWidth(path) > pathMax {
 			path = runewidth.Truncate(path, pathMax, "…")
 		}
@@ -879,6 +972,18 @@ func formatFileStatus(entry *fileEntry, maxWidth int) string {
 			text = runewidth.Truncate(text, maxWidth, "…")
 		}
 		return " " + statusDeletedStyle.Render(text)
+	case fileStatusHardlinked:
+		text := "HARDLINK"
+		if runewidth.StringWidth(text) > maxWidth {
+			text = runewidth.Truncate(text, maxWidth, "…")
+		}
+		return " " + statusDeletedStyle.Render(text)
+	case fileStatusDeduped:
+		text := "DEDUPED"
+		if runewidth.StringWidth(text) > maxWidth {
+			text = runewidth.Truncate(text, maxWidth, "…")
+		}
+		return " " + statusDeletedStyle.Render(text)
 	case fileStatusError:
 		text := "ERROR"
 		if entry.Message != "" {
@@ -924,7 +1029,7 @@ func (m *model) listAreaHeight() int {
 }
 
 func (m *model) instructionsText() string {
-	return "enter exp/fold • arrows nav • m toggle • a mark all • u clear • d delete marked • L link marked • R reflink marked • q exit"
+	return "enter exp/fold • arrows nav • m toggle • a mark all • u clear • d delete marked • L link marked • R reflink marked • H hard link marked • D dedupe marked • q exit"
 }
 
 func (m *model) sortHotkeysText() string {
@@ -1095,23 +1200,27 @@ func (m *model) selectedGroupInfoLine() string {
 	}
 	prefix := fmt.Sprintf("Selected group: %d files • Total size: ", count)
 	size := utils.DisplaySize(group.TotalSz)
+	disk := utils.DisplaySize(group.DiskSz)
+	reclaimable := utils.DisplaySize(group.ReclaimableSz)
 	// Make the size pop using an existing bold highlight style.
-	return footerStyle.Render(prefix) + confirmCodeStyle.Render(size)
+	return footerStyle.Render(prefix) + confirmCodeStyle.Render(size) +
+		footerStyle.Render(" • On disk: ") + confirmCodeStyle.Render(disk) +
+		footerStyle.Render(" • Reclaimable: ") + confirmCodeStyle.Render(reclaimable)
 }
 
 func estimateGroupTotalSize(files []string) uint64 {
 	return dupview.EstimateGroupTotalSize(files)
 }
 
-// formatGroupTitle constructs a descriptive label for a digest-based group, summarizing its hash, file count, and approximate total size.
-func formatGroupTitle(hash dmap.Digest, count int, totalSize uint64) string {
-	return dupview.FormatGroupTitle(hash, dmap.MatchInfo{Type: dmap.MatchContent, Key: fmt.Sprintf("%x", hash)}, count, totalSize)
+// formatGroupTitle constructs a descriptive label for a digest-based group, summarizing its hash, file count, and approximate apparent and on-disk sizes.
+func formatGroupTitle(hash dmap.Digest, count int, totalSize, diskSize uint64) string {
+	return dupview.FormatGroupTitle(hash, dmap.MatchInfo{Type: dmap.MatchContent, Key: fmt.Sprintf("%x", hash)}, count, totalSize, diskSize)
 }
 
 // autoMarkGroup marks all but one in the duplicate group. For UX, assumes users will want
 // to probably keep at least one of the files.
 func autoMarkGroup(group *duplicateGroup) {
-	dupview.AutoMarkGroup(group)
+	dupview.AutoMarkGroup(group, dmap.KeepPolicy{})
 }
 
 func isAlphaNumeric(r rune) bool {
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
 	"github.com/jdefrancesco/dskDitto/internal/dmap"
 	"github.com/jdefrancesco/dskDitto/internal/dupview"
 )
@@ -99,6 +100,32 @@ func TestHandleTreeKeysReflinkStartsConfirmation(t *testing.T) {
 	}
 }
 
+func TestRenderConfirmViewFitsTerminal(t *testing.T) {
+	group := &dupview.Group{Title: "many", Files: []*dupview.FileEntry{{Path: "/tmp/keep"}}}
+	for i := range 40 {
+		group.Files = append(group.Files, &dupview.FileEntry{Path: filepath.Join("/tmp", "dup", string(rune('a'+i%26))+strings.Repeat("x", i)), Marked: true})
+	}
+	m := &model{
+		mode:         modeConfirm,
+		width:        40,
+		height:       24,
+		groups:       []*dupview.Group{group},
+		confirmCode:  "ABCDE",
+		confirmError: "code does not match",
+	}
+
+	view := m.renderConfirmView()
+	if got := lipgloss.Height(view); got > m.height {
+		t.Fatalf("confirm view is %d rows, taller than the %d-row terminal", got, m.height)
+	}
+	if !strings.Contains(view, "more line(s)") {
+		t.Fatalf("expected the preview to be cut short:\n%s", view)
+	}
+	if !strings.Contains(view, "code does not match") {
+		t.Fatalf("expected the confirm error to stay visible:\n%s", view)
+	}
+}
+
 func TestFormatFileStatusReflinked(t *testing.T) {
 	entry := &fileEntry{Path: "/tmp/dup.bin", Status: fileStatusReflinked, Message: "reflinked -> /tmp/target.bin"}
 